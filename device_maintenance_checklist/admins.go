@@ -0,0 +1,415 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// Changes of the admin set an admin can propose
+const (
+	adminAdd       = "add"
+	adminRemove    = "remove"
+	adminThreshold = "threshold"
+)
+
+// Admin is a member of the admin set, identified by the SHA-256 hash of its certificate
+type Admin struct {
+	Id          string `json:"id"`
+	Certificate []byte `json:"certificate"`
+}
+
+// AdminProposal is a change of the admin set waiting for the approval of enough admins
+type AdminProposal struct {
+	Id          string   `json:"id"`
+	Action      string   `json:"action"`
+	Certificate []byte   `json:"certificate,omitempty"`
+	Threshold   int64    `json:"threshold,omitempty"`
+	Approvals   []string `json:"approvals"`
+}
+
+func adminId(certificate []byte) string {
+	hash := sha256.Sum256(certificate)
+	return hex.EncodeToString(hash[:])
+}
+
+func (t *DeviceMaintenanceChaincode) insertAdmin(stub shim.ChaincodeStubInterface, certificate []byte) (bool, error) {
+	return stub.InsertRow(adminsTable, shim.Row{
+		Columns: []*shim.Column{
+			&shim.Column{Value: &shim.Column_String_{String_: adminId(certificate)}},
+			&shim.Column{Value: &shim.Column_Bytes{Bytes: certificate}},
+		},
+	})
+}
+
+func (t *DeviceMaintenanceChaincode) getAdmins(stub shim.ChaincodeStubInterface) ([]Admin, error) {
+	var columns []shim.Column
+	rowChannel, err := stub.GetRows(adminsTable, columns)
+	if err != nil {
+		logger.Errorf("Error in getting rows:%s", err.Error())
+		return nil, errors.New("Error in fetching rows")
+	}
+	admins := make([]Admin, 0)
+	for row := range rowChannel {
+		admins = append(admins, Admin{Id: row.Columns[0].GetString_(), Certificate: row.Columns[1].GetBytes()})
+	}
+	return admins, nil
+}
+
+// Returns the number of admins that have to approve a change of the admin set
+func (t *DeviceMaintenanceChaincode) getAdminThreshold(stub shim.ChaincodeStubInterface) (int64, error) {
+	thresholdStr, err := stub.GetState("admin_threshold")
+	if err != nil {
+		logger.Error("Failed to retrieve admin threshold")
+		return 0, errors.New("Failed to retrieve admin threshold")
+	}
+	if len(thresholdStr) == 0 {
+		return 1, nil
+	}
+	threshold, err := strconv.ParseInt(string(thresholdStr), 10, 64)
+	if err != nil {
+		logger.Errorf("Invalid value %s for admin threshold", thresholdStr)
+		return 0, errors.New("Invalid value for admin threshold")
+	}
+	return threshold, nil
+}
+
+// Returns the id of the admin calling. Before the admin set is migrated the single
+// admin certificate in state is the only admin.
+func (t *DeviceMaintenanceChaincode) callerAdmin(stub shim.ChaincodeStubInterface) (string, error) {
+	admins, err := t.getAdmins(stub)
+	if err != nil || len(admins) == 0 {
+		adminCertificate, err := stub.GetState("admin")
+		if err != nil {
+			return "", fmt.Errorf("Failed getting admin certificate:%s", err.Error())
+		}
+		admins = []Admin{{Id: adminId(adminCertificate), Certificate: adminCertificate}}
+	}
+
+	for _, admin := range admins {
+		if len(admin.Certificate) == 0 {
+			continue
+		}
+		ok, err := t.isCaller(stub, admin.Certificate)
+		if err != nil {
+			logger.Error("Failed checking admin identity")
+			return "", fmt.Errorf("Failed checking admin identity:%s", err.Error())
+		}
+		if ok {
+			return admin.Id, nil
+		}
+	}
+	logger.Error("Caller is not administrator")
+	return "", errors.New("The caller is not an administrator")
+}
+
+// Check that the caller is an administrator
+func (t *DeviceMaintenanceChaincode) checkAdmin(stub shim.ChaincodeStubInterface) error {
+	_, err := t.callerAdmin(stub)
+	return err
+}
+
+func (t *DeviceMaintenanceChaincode) proposalRow(proposal AdminProposal) (shim.Row, error) {
+	approvals, err := json.Marshal(proposal.Approvals)
+	if err != nil {
+		return shim.Row{}, err
+	}
+	return shim.Row{
+		Columns: []*shim.Column{
+			&shim.Column{Value: &shim.Column_String_{String_: proposal.Id}},
+			&shim.Column{Value: &shim.Column_String_{String_: proposal.Action}},
+			&shim.Column{Value: &shim.Column_Bytes{Bytes: proposal.Certificate}},
+			&shim.Column{Value: &shim.Column_Int64{Int64: proposal.Threshold}},
+			&shim.Column{Value: &shim.Column_String_{String_: string(approvals)}},
+		},
+	}, nil
+}
+
+func (t *DeviceMaintenanceChaincode) extractProposal(row shim.Row) (AdminProposal, error) {
+	proposal := AdminProposal{
+		Id:          row.Columns[0].GetString_(),
+		Action:      row.Columns[1].GetString_(),
+		Certificate: row.Columns[2].GetBytes(),
+		Threshold:   row.Columns[3].GetInt64(),
+	}
+	err := json.Unmarshal([]byte(row.Columns[4].GetString_()), &proposal.Approvals)
+	if err != nil {
+		return proposal, fmt.Errorf("Invalid approvals of proposal %s: %s", proposal.Id, err)
+	}
+	return proposal, nil
+}
+
+// Checks that the change still leaves a valid admin set
+func (t *DeviceMaintenanceChaincode) validateProposal(stub shim.ChaincodeStubInterface, proposal AdminProposal) error {
+	admins, err := t.getAdmins(stub)
+	if err != nil {
+		return err
+	}
+	threshold, err := t.getAdminThreshold(stub)
+	if err != nil {
+		return err
+	}
+	isAdmin := false
+	for _, admin := range admins {
+		if admin.Id == adminId(proposal.Certificate) {
+			isAdmin = true
+		}
+	}
+
+	switch proposal.Action {
+	case adminAdd:
+		if isAdmin {
+			return errors.New("The certificate is already an administrator")
+		}
+	case adminRemove:
+		if !isAdmin {
+			return errors.New("The certificate is not an administrator")
+		}
+		if int64(len(admins)-1) < threshold {
+			return fmt.Errorf("Removing an administrator would leave fewer than the %d needed to approve changes", threshold)
+		}
+	case adminThreshold:
+		if proposal.Threshold < 1 || proposal.Threshold > int64(len(admins)) {
+			return fmt.Errorf("Threshold must be between 1 and the %d administrators", len(admins))
+		}
+	default:
+		return fmt.Errorf("Invalid action %s, expected %s, %s or %s", proposal.Action, adminAdd, adminRemove, adminThreshold)
+	}
+	return nil
+}
+
+// Applies the proposal if enough of the current admins approved it, otherwise saves it
+// with its approvals
+func (t *DeviceMaintenanceChaincode) decideProposal(stub shim.ChaincodeStubInterface, proposal AdminProposal) (bool, error) {
+	admins, err := t.getAdmins(stub)
+	if err != nil {
+		return false, err
+	}
+	threshold, err := t.getAdminThreshold(stub)
+	if err != nil {
+		return false, err
+	}
+	current := make(map[string]bool)
+	for _, admin := range admins {
+		current[admin.Id] = true
+	}
+	approvals := int64(0)
+	for _, id := range proposal.Approvals {
+		if current[id] {
+			approvals++
+		}
+	}
+
+	if approvals < threshold {
+		row, err := t.proposalRow(proposal)
+		if err != nil {
+			return false, err
+		}
+		ok, err := stub.InsertRow(adminProposalsTable, row)
+		if err == nil && !ok {
+			ok, err = stub.ReplaceRow(adminProposalsTable, row)
+		}
+		if !ok || err != nil {
+			return false, fmt.Errorf("Error in saving proposal %s: %s", proposal.Id, err)
+		}
+		return false, nil
+	}
+
+	err = t.validateProposal(stub, proposal)
+	if err != nil {
+		return false, err
+	}
+	switch proposal.Action {
+	case adminAdd:
+		ok, err := t.insertAdmin(stub, proposal.Certificate)
+		if !ok || err != nil {
+			return false, fmt.Errorf("Error in adding administrator: %s", err)
+		}
+	case adminRemove:
+		var columns []shim.Column
+		col := shim.Column{Value: &shim.Column_String_{String_: adminId(proposal.Certificate)}}
+		columns = append(columns, col)
+		err = stub.DeleteRow(adminsTable, columns)
+		if err != nil {
+			return false, fmt.Errorf("Error in removing administrator: %s", err)
+		}
+	case adminThreshold:
+		err = stub.PutState("admin_threshold", []byte(strconv.FormatInt(proposal.Threshold, 10)))
+		if err != nil {
+			return false, fmt.Errorf("Error in saving admin threshold: %s", err)
+		}
+	}
+
+	var columns []shim.Column
+	col := shim.Column{Value: &shim.Column_String_{String_: proposal.Id}}
+	columns = append(columns, col)
+	err = stub.DeleteRow(adminProposalsTable, columns)
+	if err != nil {
+		return false, fmt.Errorf("Error in deleting proposal %s: %s", proposal.Id, err)
+	}
+	return true, nil
+}
+
+// Proposes to add or remove an administrator certificate, given base64 encoded, or to
+// change the number of administrators that have to approve changes. The proposal counts
+// as approved by the proposing administrator. Returns the id of the proposal.
+func (t *DeviceMaintenanceChaincode) proposeAdminChange(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	logger.Info("In proposeAdminChange function")
+	if len(args) != 2 {
+		logger.Error("Incorrect number of arguments")
+		return nil, errors.New("Incorrect number of arguments. Specify the action and the certificate or threshold.")
+	}
+
+	proposal := AdminProposal{Id: stub.GetTxID(), Action: args[0]}
+	var err error
+	if proposal.Action == adminThreshold {
+		proposal.Threshold, err = strconv.ParseInt(args[1], 10, 64)
+		if err != nil {
+			logger.Errorf("Error in converting to int:%s", err.Error())
+			return nil, fmt.Errorf("Invalid value of threshold:%s", args[1])
+		}
+	} else {
+		proposal.Certificate, err = base64.StdEncoding.DecodeString(args[1])
+		if err != nil || len(proposal.Certificate) == 0 {
+			logger.Error("Failed decoding certificate")
+			return nil, errors.New("Failed decoding certificate")
+		}
+	}
+
+	caller, err := t.callerAdmin(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	err = t.validateProposal(stub, proposal)
+	if err != nil {
+		logger.Errorf("Invalid proposal: [%s]", err)
+		return nil, fmt.Errorf("Invalid proposal [%s]", err)
+	}
+
+	proposal.Approvals = []string{caller}
+	applied, err := t.decideProposal(stub, proposal)
+	if err != nil {
+		logger.Errorf("Error in proposing admin change:%s", err)
+		return nil, fmt.Errorf("Error in proposing admin change [%s]", err)
+	}
+	logger.Infof("Admin change %s proposed, applied: %t", proposal.Id, applied)
+
+	return []byte(proposal.Id), nil
+}
+
+// Approves a proposed change of the admin set, applying it once enough administrators
+// approved it
+func (t *DeviceMaintenanceChaincode) approveAdminChange(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	logger.Info("In approveAdminChange function")
+	if len(args) != 1 {
+		logger.Error("Incorrect number of arguments")
+		return nil, errors.New("Incorrect number of arguments. Specify proposal id.")
+	}
+
+	caller, err := t.callerAdmin(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	var columns []shim.Column
+	col := shim.Column{Value: &shim.Column_String_{String_: args[0]}}
+	columns = append(columns, col)
+	row, err := stub.GetRow(adminProposalsTable, columns)
+	if err != nil {
+		logger.Errorf("Error in getting proposal:%s", err.Error())
+		return nil, errors.New("Error in fetching proposal")
+	}
+	if len(row.Columns) == 0 {
+		logger.Errorf("Proposal %s not found", args[0])
+		return nil, fmt.Errorf("Proposal %s not found", args[0])
+	}
+	proposal, err := t.extractProposal(row)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, id := range proposal.Approvals {
+		if id == caller {
+			logger.Errorf("Proposal %s already approved by the caller", proposal.Id)
+			return nil, fmt.Errorf("Proposal %s already approved by the caller", proposal.Id)
+		}
+	}
+	proposal.Approvals = append(proposal.Approvals, caller)
+
+	applied, err := t.decideProposal(stub, proposal)
+	if err != nil {
+		logger.Errorf("Error in approving admin change:%s", err)
+		return nil, fmt.Errorf("Error in approving admin change [%s]", err)
+	}
+	logger.Infof("Admin change %s approved, applied: %t", proposal.Id, applied)
+
+	return nil, nil
+}
+
+// Return the administrators and the number of them that have to approve changes
+func (t *DeviceMaintenanceChaincode) admins(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	logger.Info("In admins function")
+	if len(args) > 0 {
+		logger.Error("Incorrect number of arguments")
+		return nil, errors.New("Incorrect number of arguments. No arguments required")
+	}
+
+	admins, err := t.getAdmins(stub)
+	if err != nil {
+		return nil, err
+	}
+	threshold, err := t.getAdminThreshold(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	payload, err := json.Marshal(struct {
+		Threshold int64   `json:"threshold"`
+		Admins    []Admin `json:"admins"`
+	}{threshold, admins})
+	if err != nil {
+		logger.Errorf("Failed marshalling payload: [%s]", err)
+		return nil, fmt.Errorf("Failed marshalling payload [%s]", err)
+	}
+
+	return payload, nil
+}
+
+// Return the changes of the admin set waiting for approval
+func (t *DeviceMaintenanceChaincode) adminProposals(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	logger.Info("In adminProposals function")
+	if len(args) > 0 {
+		logger.Error("Incorrect number of arguments")
+		return nil, errors.New("Incorrect number of arguments. No arguments required")
+	}
+
+	var columns []shim.Column
+	rowChannel, err := stub.GetRows(adminProposalsTable, columns)
+	if err != nil {
+		logger.Errorf("Error in getting rows:%s", err.Error())
+		return nil, errors.New("Error in fetching rows")
+	}
+	proposals := make([]AdminProposal, 0)
+	for row := range rowChannel {
+		proposal, err := t.extractProposal(row)
+		if err != nil {
+			return nil, err
+		}
+		proposals = append(proposals, proposal)
+	}
+
+	payload, err := json.Marshal(proposals)
+	if err != nil {
+		logger.Errorf("Failed marshalling payload: [%s]", err)
+		return nil, fmt.Errorf("Failed marshalling payload [%s]", err)
+	}
+
+	return payload, nil
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"testing"
+
+	"github.com/predix/chaincode_example/energy_trading/memstub"
+)
+
+func expectAdmins(t *testing.T, cc *DeviceMaintenanceChaincode, stub *memstub.Stub, want ...[]byte) {
+	t.Helper()
+	admins, err := cc.getAdmins(stub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(admins) != len(want) {
+		t.Fatalf("%d admins, want %d", len(admins), len(want))
+	}
+	for _, certificate := range want {
+		found := false
+		for _, admin := range admins {
+			found = found || bytes.Equal(admin.Certificate, certificate)
+		}
+		if !found {
+			t.Errorf("%s is not an admin", certificate)
+		}
+	}
+}
+
+// Deploying again leaves the admin set to the approval of the admins
+func TestInitKeepsAdmins(t *testing.T) {
+	cc, stub := newTestChaincode(t)
+	stranger := []byte("stranger")
+
+	for _, deployer := range [][]byte{testAdmin, stranger} {
+		stub.Caller = deployer
+		_, err := cc.Init(stub, "init", nil)
+		if err != nil {
+			t.Fatalf("Deploy by %s failed: %s", deployer, err)
+		}
+		expectAdmins(t, cc, stub, testAdmin)
+	}
+
+	_, err := invoke(cc, stub, stranger, "createTemplate", "t", `[{"name":"c","role":"r"}]`)
+	if err == nil {
+		t.Error("Deployer that is not an admin created a template")
+	}
+}
+
+func TestAdminChangesNeedApprovals(t *testing.T) {
+	cc, stub := newTestChaincode(t)
+	second := []byte("second")
+	third := []byte("third")
+
+	// A single admin decides alone
+	invokeAs(t, cc, stub, testAdmin, "proposeAdminChange", adminAdd, base64.StdEncoding.EncodeToString(second))
+	invokeAs(t, cc, stub, testAdmin, "proposeAdminChange", adminThreshold, "2")
+	expectAdmins(t, cc, stub, testAdmin, second)
+
+	id := string(invokeAs(t, cc, stub, second, "proposeAdminChange", adminAdd, base64.StdEncoding.EncodeToString(third)))
+	expectAdmins(t, cc, stub, testAdmin, second)
+	_, err := invoke(cc, stub, second, "approveAdminChange", id)
+	if err == nil {
+		t.Error("Proposer approved its own proposal twice")
+	}
+	_, err = invoke(cc, stub, third, "approveAdminChange", id)
+	if err == nil {
+		t.Error("Certificate that is not an admin approved a proposal")
+	}
+	invokeAs(t, cc, stub, testAdmin, "approveAdminChange", id)
+	expectAdmins(t, cc, stub, testAdmin, second, third)
+
+	// With all three needed, none can be removed
+	id = string(invokeAs(t, cc, stub, second, "proposeAdminChange", adminThreshold, "3"))
+	invokeAs(t, cc, stub, third, "approveAdminChange", id)
+	_, err = invoke(cc, stub, testAdmin, "proposeAdminChange", adminRemove, base64.StdEncoding.EncodeToString(third))
+	if err == nil {
+		t.Error("Removal below the threshold proposed")
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// ArchivedDevice is a decommissioned device with its owners, the delegations of checks
+// in its service cycles and its maintenance schedule as of the decommission. Archived
+// devices and their service records are kept for retention and never change.
+type ArchivedDevice struct {
+	Device           Device               `json:"device"`
+	Owners           []OwnershipRecord    `json:"owners"`
+	Delegations      []CheckDelegation    `json:"delegations"`
+	Schedule         *MaintenanceSchedule `json:"schedule,omitempty"`
+	DecommissionedAt string               `json:"decommissioned_at"`
+	Reason           string               `json:"reason,omitempty"`
+}
+
+func (t *DeviceMaintenanceChaincode) archiveDevice(stub shim.ChaincodeStubInterface, archived ArchivedDevice) error {
+	device, err := json.Marshal(archived)
+	if err != nil {
+		return err
+	}
+	ok, err := stub.InsertRow(archivedDevicesTable, shim.Row{
+		Columns: []*shim.Column{
+			&shim.Column{Value: &shim.Column_String_{String_: archived.Device.Id}},
+			&shim.Column{Value: &shim.Column_String_{String_: string(device)}},
+		},
+	})
+	if !ok || err != nil {
+		return fmt.Errorf("Error in archiving device %s: %s", archived.Device.Id, err)
+	}
+	return nil
+}
+
+func (t *DeviceMaintenanceChaincode) archiveServiceRecord(stub shim.ChaincodeStubInterface, record DeviceServiceRecord) error {
+	payload, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	ok, err := stub.InsertRow(archivedServiceTable, shim.Row{
+		Columns: []*shim.Column{
+			&shim.Column{Value: &shim.Column_String_{String_: record.DeviceId}},
+			&shim.Column{Value: &shim.Column_String_{String_: record.ServiceId}},
+			&shim.Column{Value: &shim.Column_String_{String_: string(payload)}},
+		},
+	})
+	if !ok || err != nil {
+		return fmt.Errorf("Error in archiving service record %s of device %s: %s", record.ServiceId, record.DeviceId, err)
+	}
+	return nil
+}
+
+func (t *DeviceMaintenanceChaincode) extractArchivedDevice(row shim.Row) (ArchivedDevice, error) {
+	var archived ArchivedDevice
+	err := json.Unmarshal([]byte(row.Columns[1].GetString_()), &archived)
+	if err != nil {
+		return archived, fmt.Errorf("Invalid archived device %s: %s", row.Columns[0].GetString_(), err)
+	}
+	return archived, nil
+}
+
+// Returns an archived device, nil if no device with the id was decommissioned
+func (t *DeviceMaintenanceChaincode) getArchivedDevice(stub shim.ChaincodeStubInterface, deviceId string) (*ArchivedDevice, error) {
+	var columns []shim.Column
+	col := shim.Column{Value: &shim.Column_String_{String_: deviceId}}
+	columns = append(columns, col)
+
+	row, err := stub.GetRow(archivedDevicesTable, columns)
+	if err != nil {
+		logger.Errorf("Error in getting archived device:%s", err.Error())
+		return nil, errors.New("Error in fetching archived device")
+	}
+	if len(row.Columns) == 0 {
+		return nil, nil
+	}
+	archived, err := t.extractArchivedDevice(row)
+	if err != nil {
+		return nil, err
+	}
+	return &archived, nil
+}
+
+// Return a decommissioned device
+func (t *DeviceMaintenanceChaincode) archivedDevice(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	logger.Info("In archivedDevice function")
+	if len(args) != 1 {
+		logger.Error("Incorrect number of arguments")
+		return nil, errors.New("Incorrect number of arguments. Specify device id.")
+	}
+	archived, err := t.getArchivedDevice(stub, args[0])
+	if err != nil {
+		logger.Errorf("Failed fetching archived device: [%s]", err)
+		return nil, fmt.Errorf("Failed fetching archived device [%s]", err)
+	}
+	if archived == nil {
+		logger.Errorf("Device %s is not archived", args[0])
+		return nil, fmt.Errorf("Device %s is not archived", args[0])
+	}
+
+	payload, err := json.Marshal(archived)
+	if err != nil {
+		logger.Errorf("Failed marshalling payload: [%s]", err)
+		return nil, fmt.Errorf("Failed marshalling payload [%s]", err)
+	}
+
+	return payload, nil
+}
+
+// Return all decommissioned devices
+func (t *DeviceMaintenanceChaincode) archivedDevices(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	logger.Info("In archivedDevices function")
+	if len(args) > 0 {
+		logger.Error("Incorrect number of arguments")
+		return nil, errors.New("Incorrect number of arguments. No arguments required")
+	}
+
+	var columns []shim.Column
+	rowChannel, err := stub.GetRows(archivedDevicesTable, columns)
+	if err != nil {
+		logger.Errorf("Error in getting rows:%s", err.Error())
+		return nil, errors.New("Error in fetching rows")
+	}
+	devices := make([]ArchivedDevice, 0)
+	for row := range rowChannel {
+		archived, err := t.extractArchivedDevice(row)
+		if err != nil {
+			return nil, err
+		}
+		devices = append(devices, archived)
+	}
+
+	payload, err := json.Marshal(devices)
+	if err != nil {
+		logger.Errorf("Failed marshalling payload: [%s]", err)
+		return nil, fmt.Errorf("Failed marshalling payload [%s]", err)
+	}
+
+	return payload, nil
+}
+
+// Return the archived service records of a decommissioned device
+func (t *DeviceMaintenanceChaincode) archivedServiceRecords(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	logger.Info("In archivedServiceRecords function")
+	if len(args) != 1 {
+		logger.Error("Incorrect number of arguments")
+		return nil, errors.New("Incorrect number of arguments. Specify device id.")
+	}
+
+	var columns []shim.Column
+	col := shim.Column{Value: &shim.Column_String_{String_: args[0]}}
+	columns = append(columns, col)
+
+	rowChannel, err := stub.GetRows(archivedServiceTable, columns)
+	if err != nil {
+		logger.Errorf("Error in getting rows:%s", err.Error())
+		return nil, errors.New("Error in fetching rows")
+	}
+	records := DeviceServiceRecords{}
+	for row := range rowChannel {
+		var record DeviceServiceRecord
+		err = json.Unmarshal([]byte(row.Columns[2].GetString_()), &record)
+		if err != nil {
+			logger.Errorf("Invalid archived service record %s: [%s]", row.Columns[1].GetString_(), err)
+			return nil, fmt.Errorf("Invalid archived service record %s [%s]", row.Columns[1].GetString_(), err)
+		}
+		records = append(records, record)
+	}
+
+	payload, err := json.Marshal(records)
+	if err != nil {
+		logger.Errorf("Failed marshalling payload: [%s]", err)
+		return nil, fmt.Errorf("Failed marshalling payload [%s]", err)
+	}
+
+	return payload, nil
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"testing"
+)
+
+// Decommissioning a device in the middle of a service cycle and a transfer archives all
+// of it and leaves nothing of the device behind
+func TestDecommissionArchivesDevice(t *testing.T) {
+	cc, stub := newTestChaincode(t)
+	enrollScheduled(t, cc, stub)
+	delegate := []byte("delegate")
+	invokeAs(t, cc, stub, testOwner, "setMaintenanceInterval", "d1", "30", "0")
+	invokeAs(t, cc, stub, testOwner, "startServiceCycle", "d1", "s1")
+	invokeAs(t, cc, stub, testOwner, "delegateCheck", "d1", "s1", "check1", base64.StdEncoding.EncodeToString(delegate))
+	invokeAs(t, cc, stub, testOwner, "proposeTransfer", "d1", base64.StdEncoding.EncodeToString([]byte("buyer")))
+
+	_, err := invoke(cc, stub, testOwner, "decommission", "d1")
+	if err == nil {
+		t.Fatal("Owner decommissioned the device")
+	}
+	invokeAs(t, cc, stub, testAdmin, "decommission", "d1", "scrapped")
+
+	var records DeviceServiceRecords
+	err = json.Unmarshal(queryAs(t, cc, stub, "archivedServiceRecords", "d1"), &records)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 || records[0].ServiceId != "s1" || records[0].State != cycleAborted || records[0].AbortReason != "Device decommissioned" {
+		t.Fatalf("Archived service records %+v", records)
+	}
+
+	var archived ArchivedDevice
+	err = json.Unmarshal(queryAs(t, cc, stub, "archivedDevice", "d1"), &archived)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if archived.Device.Id != "d1" || archived.Reason != "scrapped" || len(archived.Owners) != 1 || !bytes.Equal(archived.Owners[0].Owner, testOwner) {
+		t.Errorf("Archived device %+v", archived)
+	}
+	if len(archived.Delegations) != 1 || archived.Delegations[0].Check != "check1" || !bytes.Equal(archived.Delegations[0].Delegate, delegate) {
+		t.Errorf("Archived delegations %+v", archived.Delegations)
+	}
+	if archived.Schedule == nil || archived.Schedule.IntervalDays != 30 {
+		t.Errorf("Archived schedule %+v", archived.Schedule)
+	}
+
+	var devices []Device
+	err = json.Unmarshal(queryAs(t, cc, stub, "devices"), &devices)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(devices) != 0 {
+		t.Errorf("Devices %+v left after decommission", devices)
+	}
+	for _, query := range []string{"pendingTransfer", "maintenanceSchedule"} {
+		_, err = cc.Query(stub, query, []string{"d1"})
+		if err == nil {
+			t.Errorf("%s of the decommissioned device succeeded", query)
+		}
+	}
+	var delegations []CheckDelegation
+	err = json.Unmarshal(queryAs(t, cc, stub, "checkDelegations", "d1", "s1"), &delegations)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(delegations) != 0 {
+		t.Errorf("Delegations %+v left after decommission", delegations)
+	}
+
+	_, err = invoke(cc, stub, testAdmin, "enroll", "d1", base64.StdEncoding.EncodeToString([]byte("key")), base64.StdEncoding.EncodeToString(testOwner), "scheduled")
+	if err == nil {
+		t.Error("Decommissioned device enrolled again")
+	}
+}
@@ -46,13 +46,33 @@ type Device struct {
 	Id string `json:"id"`
 }
 
+type CheckDefinition struct {
+	Name          string   `json:"name"`
+	Owner         []byte   `json:"owner,omitempty"`
+	Role          string   `json:"role,omitempty"`
+	Prerequisites []string `json:"prerequisites,omitempty"`
+}
+
+type CheckResult struct {
+	Check     string `json:"check"`
+	Completed bool   `json:"completed"`
+}
+
 type DeviceServiceRecord struct {
-	DeviceId  string `json:"device_id"`
-	ServiceId string `json:"service_id"`
-	Check1    bool   `json:"check1"`
-	Check2    bool   `json:"check2"`
-	Check3    bool   `json:"check3"`
-	Signoff   bool   `json:"signoff"`
+	DeviceId  string        `json:"device_id"`
+	ServiceId string        `json:"service_id"`
+	Checks    []CheckResult `json:"checks"`
+	Signoff   bool          `json:"signoff"`
+}
+
+// Returns whether a check of the service record is complete
+func (r DeviceServiceRecord) completed(check string) bool {
+	for _, result := range r.Checks {
+		if result.Check == check {
+			return result.Completed
+		}
+	}
+	return false
 }
 
 func deploy() (err error) {
@@ -84,9 +104,11 @@ func enroll() (err error) {
 
 	// 1. Alice is the administrator of the chaincode;
 	// 2. Alice enrolls a new device and assigns ownership to Bob.
-	// 3. Alice also assigns ownership of check1, check2 and check3 to
-	//    carol, dave and finn respectively
+	// 3. The checklist template of the device assigns ownership of check1,
+	//    check2 and check3 to carol, dave and finn respectively, check3
+	//    can only be performed once check2 has passed
 	deviceId = "Device6"
+	templateName := "Template6"
 
 	bobCert, err = bob.GetEnrollmentCertificateHandler()
 	if err != nil {
@@ -109,7 +131,18 @@ func enroll() (err error) {
 		return
 	}
 
-	resp, err := enrollInternal(alice, aliceCert, deviceId, bobCert, carolCert, daveCert, finnCert)
+	resp, err := createTemplateInternal(alice, aliceCert, templateName, carolCert, daveCert, finnCert)
+	if err != nil {
+		logger.Errorf("Failed creating a checklist template [%s]", err)
+		return
+	}
+	logger.Debugf("Resp [%s]", resp.String())
+
+	logger.Debug("Template creation transaction submitted")
+	logger.Debug("Wait 10 seconds...")
+	time.Sleep(10 * time.Second)
+
+	resp, err = enrollInternal(alice, aliceCert, deviceId, bobCert, templateName)
 	if err != nil {
 		logger.Errorf("Failed enrolling a new device [%s]", err)
 		return
@@ -216,25 +249,10 @@ func markCheckComplete(check string, ownerCert, nonOwnerCert crypto.CertificateH
 		logger.Errorf("Failed querying device service record [%s]", err)
 		return
 	}
-	switch check {
-	case "check1":
-		if deviceServiceRecord.Check1 {
-			logger.Errorf("Check: %s marked complete by non-owner", check)
-			err = fmt.Errorf("Check: %s marked complete by non-owner", check)
-			return
-		}
-	case "check2":
-		if deviceServiceRecord.Check2 {
-			logger.Errorf("Check: %s marked complete by non-owner", check)
-			err = fmt.Errorf("Check: %s marked complete by non-owner", check)
-			return
-		}
-	case "check3":
-		if deviceServiceRecord.Check3 {
-			logger.Errorf("Check: %s marked complete by non-owner", check)
-			err = fmt.Errorf("Check: %s marked complete by non-owner", check)
-			return
-		}
+	if deviceServiceRecord.completed(check) {
+		logger.Errorf("Check: %s marked complete by non-owner", check)
+		err = fmt.Errorf("Check: %s marked complete by non-owner", check)
+		return
 	}
 	logger.Debugf("Now trying with owner")
 
@@ -255,25 +273,10 @@ func markCheckComplete(check string, ownerCert, nonOwnerCert crypto.CertificateH
 		logger.Errorf("Failed querying device service record [%s]", err)
 		return
 	}
-	switch check {
-	case "check1":
-		if !deviceServiceRecord.Check1 {
-			logger.Errorf("Check: %s marked complete by non-owner", check)
-			err = fmt.Errorf("Check: %s marked complete by non-owner", check)
-			return
-		}
-	case "check2":
-		if !deviceServiceRecord.Check2 {
-			logger.Errorf("Check: %s marked complete by non-owner", check)
-			err = fmt.Errorf("Check: %s marked complete by non-owner", check)
-			return
-		}
-	case "check3":
-		if !deviceServiceRecord.Check3 {
-			logger.Errorf("Check: %s marked complete by non-owner", check)
-			err = fmt.Errorf("Check: %s marked complete by non-owner", check)
-			return
-		}
+	if !deviceServiceRecord.completed(check) {
+		logger.Errorf("Check: %s marked complete by non-owner", check)
+		err = fmt.Errorf("Check: %s marked complete by non-owner", check)
+		return
 	}
 	logger.Infof("Mark check:%s complete test successful-------", check)
 	return
@@ -159,7 +159,72 @@ func deployInternal(deployer crypto.Client, adminCert crypto.CertificateHandler)
 	return
 }
 
-func enrollInternal(invoker crypto.Client, invokerCert crypto.CertificateHandler, deviceId string, ownerCert, check1Cert, check2Cert, check3Cert crypto.CertificateHandler) (resp *pb.Response, err error) {
+func createTemplateInternal(invoker crypto.Client, invokerCert crypto.CertificateHandler, templateName string, check1Cert, check2Cert, check3Cert crypto.CertificateHandler) (resp *pb.Response, err error) {
+	// Get a transaction handler to be used to submit the execute transaction
+	// and bind the chaincode access control logic using the binding
+	submittingCertHandler, err := invoker.GetTCertificateHandlerNext()
+	if err != nil {
+		return nil, err
+	}
+	txHandler, err := submittingCertHandler.GetTransactionHandler()
+	if err != nil {
+		return nil, err
+	}
+	// txHandler, err := invokerCert.GetTransactionHandler()
+	// if err != nil {
+	// 	return nil, err
+	// }
+	binding, err := txHandler.GetBinding()
+	if err != nil {
+		return nil, err
+	}
+
+	// Certificates are encoded as base64 by the JSON encoder
+	checks, err := json.Marshal([]CheckDefinition{
+		{Name: "check1", Owner: check1Cert.GetCertificate()},
+		{Name: "check2", Owner: check2Cert.GetCertificate()},
+		{Name: "check3", Owner: check3Cert.GetCertificate(), Prerequisites: []string{"check2"}},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	chaincodeInput := &pb.ChaincodeInput{
+		Function: "createTemplate",
+		Args:     []string{templateName, string(checks)},
+	}
+	chaincodeInputRaw, err := proto.Marshal(chaincodeInput)
+	if err != nil {
+		return nil, err
+	}
+
+	// Access control. Administrator signs chaincodeInputRaw || binding to confirm his identity
+	sigma, err := invokerCert.Sign(append(chaincodeInputRaw, binding...))
+	if err != nil {
+		return nil, err
+	}
+
+	// Prepare spec and submit
+	spec := &pb.ChaincodeSpec{
+		Type:                 1,
+		ChaincodeID:          &pb.ChaincodeID{Name: chaincodeName},
+		CtorMsg:              chaincodeInput,
+		Metadata:             sigma, // Proof of identity
+		ConfidentialityLevel: confidentialityLevel,
+	}
+
+	chaincodeInvocationSpec := &pb.ChaincodeInvocationSpec{ChaincodeSpec: spec}
+
+	// Now create the Transactions message and send to Peer.
+	transaction, err := txHandler.NewChaincodeExecute(chaincodeInvocationSpec, util.GenerateUUID())
+	if err != nil {
+		return nil, fmt.Errorf("Error invoking chaincode: %s ", err)
+	}
+
+	return processTransaction(transaction)
+}
+
+func enrollInternal(invoker crypto.Client, invokerCert crypto.CertificateHandler, deviceId string, ownerCert crypto.CertificateHandler, templateName string) (resp *pb.Response, err error) {
 	// Get a transaction handler to be used to submit the execute transaction
 	// and bind the chaincode access control logic using the binding
 	submittingCertHandler, err := invoker.GetTCertificateHandlerNext()
@@ -181,13 +246,10 @@ func enrollInternal(invoker crypto.Client, invokerCert crypto.CertificateHandler
 
 	pubKey := base64.StdEncoding.EncodeToString([]byte("publickey"))
 	owner := base64.StdEncoding.EncodeToString(ownerCert.GetCertificate())
-	check1 := base64.StdEncoding.EncodeToString(check1Cert.GetCertificate())
-	check2 := base64.StdEncoding.EncodeToString(check2Cert.GetCertificate())
-	check3 := base64.StdEncoding.EncodeToString(check3Cert.GetCertificate())
 
 	chaincodeInput := &pb.ChaincodeInput{
 		Function: "enroll",
-		Args:     []string{deviceId, pubKey, owner, check1, check2, check3},
+		Args:     []string{deviceId, pubKey, owner, templateName},
 	}
 	chaincodeInputRaw, err := proto.Marshal(chaincodeInput)
 	if err != nil {
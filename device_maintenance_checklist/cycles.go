@@ -0,0 +1,198 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// States of a service cycle. Signed off and aborted cycles are closed, a device has at
+// most one cycle in any of the other states.
+const (
+	cycleOpen            = "open"
+	cycleInProgress      = "in_progress"
+	cycleAwaitingSignoff = "awaiting_signoff"
+	cycleSignedOff       = "signed_off"
+	cycleAborted         = "aborted"
+)
+
+// Returns whether the service cycle is still open
+func (r *DeviceServiceRecord) active() bool {
+	return r.State != cycleSignedOff && r.State != cycleAborted
+}
+
+// Returns the state of an active cycle from its check results: open until a result is
+// recorded, awaiting signoff once every check is complete and none failed
+func (r *DeviceServiceRecord) progress() string {
+	completed := 0
+	failed := false
+	for _, result := range r.Checks {
+		if result.Completed {
+			completed++
+		}
+		if result.Outcome == outcomeFail {
+			failed = true
+		}
+	}
+	if completed == 0 {
+		return cycleOpen
+	}
+	if completed == len(r.Checks) && !failed {
+		return cycleAwaitingSignoff
+	}
+	return cycleInProgress
+}
+
+// Returns the id of the open service cycle of a device, empty if there is none
+func (t *DeviceMaintenanceChaincode) getOpenCycle(stub shim.ChaincodeStubInterface, deviceId string) (string, error) {
+	var columns []shim.Column
+	col := shim.Column{Value: &shim.Column_String_{String_: deviceId}}
+	columns = append(columns, col)
+
+	row, err := stub.GetRow(openCyclesTable, columns)
+	if err != nil {
+		logger.Errorf("Error in getting open service cycle:%s", err.Error())
+		return "", errors.New("Error in fetching open service cycle")
+	}
+	if len(row.Columns) == 0 {
+		return "", nil
+	}
+	return row.Columns[1].GetString_(), nil
+}
+
+// Records the service cycle as the open one of its device, failing if there is one already
+func (t *DeviceMaintenanceChaincode) openCycle(stub shim.ChaincodeStubInterface, deviceId, serviceId string) error {
+	ok, err := stub.InsertRow(openCyclesTable, shim.Row{
+		Columns: []*shim.Column{
+			&shim.Column{Value: &shim.Column_String_{String_: deviceId}},
+			&shim.Column{Value: &shim.Column_String_{String_: serviceId}},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	if !ok {
+		openServiceId, err := t.getOpenCycle(stub, deviceId)
+		if err != nil {
+			return err
+		}
+		return fmt.Errorf("Service cycle %s of device %s is still open", openServiceId, deviceId)
+	}
+	return nil
+}
+
+func (t *DeviceMaintenanceChaincode) closeCycle(stub shim.ChaincodeStubInterface, deviceId string) error {
+	var columns []shim.Column
+	col := shim.Column{Value: &shim.Column_String_{String_: deviceId}}
+	columns = append(columns, col)
+	return stub.DeleteRow(openCyclesTable, columns)
+}
+
+// Aborts an open service cycle, recording the reason. Only owner can do it.
+func (t *DeviceMaintenanceChaincode) abortServiceCycle(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	logger.Info("In abortServiceCycle function")
+	if len(args) != 3 {
+		logger.Error("Incorrect number of arguments")
+		return nil, errors.New("Incorrect number of arguments. Specify device id, service id and the reason.")
+	}
+
+	deviceId := args[0]
+	serviceId := args[1]
+	reason := args[2]
+	if reason == "" {
+		logger.Error("Reason cannot be empty")
+		return nil, errors.New("Specify the reason for aborting the service cycle")
+	}
+
+	device, err := t.getDevice(stub, deviceId)
+	if err != nil {
+		logger.Errorf("Failed fetching device: [%s]", err)
+		return nil, fmt.Errorf("Failed fetching device [%s]", err)
+	}
+
+	deviceServiceRecord, err := t.getDeviceServiceRecord(stub, deviceId, serviceId)
+	if err != nil {
+		logger.Errorf("Failed fetching device service record: [%s]", err)
+		return nil, fmt.Errorf("Failed fetching device service record [%s]", err)
+	}
+
+	if deviceServiceRecord.ServiceId == "" {
+		logger.Errorf("No service record with id [%s] found for device %s", serviceId, deviceId)
+		return nil, fmt.Errorf("No service record with id [%s] found for device %s", serviceId, deviceId)
+	}
+
+	ok, err := t.isCaller(stub, device.Owner)
+	if err != nil {
+		logger.Error("Failed checking owner identity")
+		return nil, errors.New("Failed checking owner identity")
+	}
+	if !ok {
+		logger.Error("Caller is not the owner, cannot abort the service cycle")
+		return nil, errors.New("The caller is not the owner of device")
+	}
+
+	if !deviceServiceRecord.active() {
+		logger.Errorf("Service cycle %s of device %s is %s", serviceId, deviceId, deviceServiceRecord.State)
+		return nil, fmt.Errorf("Service cycle %s of device %s is %s", serviceId, deviceId, deviceServiceRecord.State)
+	}
+
+	deviceServiceRecord.State = cycleAborted
+	deviceServiceRecord.AbortReason = reason
+	ok, err = stub.ReplaceRow(deviceServiceTable, t.serviceRow(deviceServiceRecord))
+	if !ok || err != nil {
+		logger.Errorf("Error in aborting the service cycle:%s", err)
+		return nil, errors.New("Error in aborting the service cycle")
+	}
+	err = t.closeCycle(stub, deviceId)
+	if err != nil {
+		logger.Errorf("Error in closing the service cycle:%s", err)
+		return nil, errors.New("Error in aborting the service cycle")
+	}
+	logger.Infof("Service cycle %s of device %s aborted: %s", serviceId, deviceId, reason)
+
+	return nil, nil
+}
+
+// Return the open service cycles, of all devices or of the one given
+func (t *DeviceMaintenanceChaincode) openServiceCycles(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	logger.Info("In openServiceCycles function")
+	if len(args) > 1 {
+		logger.Error("Incorrect number of arguments")
+		return nil, errors.New("Incorrect number of arguments. Specify device id or nothing for all devices.")
+	}
+
+	var columns []shim.Column
+	if len(args) == 1 {
+		col := shim.Column{Value: &shim.Column_String_{String_: args[0]}}
+		columns = append(columns, col)
+	}
+
+	rowChannel, err := stub.GetRows(openCyclesTable, columns)
+	if err != nil {
+		logger.Errorf("Error in getting rows:%s", err.Error())
+		return nil, errors.New("Error in fetching rows")
+	}
+	rows := make([]shim.Row, 0)
+	for row := range rowChannel {
+		rows = append(rows, row)
+	}
+	deviceServiceRecords := DeviceServiceRecords{}
+	for _, row := range rows {
+		deviceServiceRecord, err := t.getDeviceServiceRecord(stub, row.Columns[0].GetString_(), row.Columns[1].GetString_())
+		if err != nil {
+			logger.Errorf("Failed fetching device service record: [%s]", err)
+			return nil, fmt.Errorf("Failed fetching device service record [%s]", err)
+		}
+		deviceServiceRecords = append(deviceServiceRecords, deviceServiceRecord)
+	}
+
+	payload, err := json.Marshal(deviceServiceRecords)
+	if err != nil {
+		logger.Errorf("Failed marshalling payload: [%s]", err)
+		return nil, fmt.Errorf("Failed marshalling payload [%s]", err)
+	}
+
+	return payload, nil
+}
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// CheckDelegation hands a check of one service cycle to another certificate, until it
+// expires if an expiry was given
+type CheckDelegation struct {
+	DeviceId    string `json:"device_id"`
+	ServiceId   string `json:"service_id"`
+	Check       string `json:"check"`
+	Delegate    []byte `json:"delegate"`
+	DelegatedAt string `json:"delegated_at"`
+	ExpiresAt   string `json:"expires_at,omitempty"`
+	Expired     bool   `json:"expired"`
+}
+
+func (t *DeviceMaintenanceChaincode) extractDelegation(row shim.Row) (CheckDelegation, int64) {
+	expiresAt := row.Columns[5].GetInt64()
+	return CheckDelegation{
+		DeviceId:    row.Columns[0].GetString_(),
+		ServiceId:   row.Columns[1].GetString_(),
+		Check:       row.Columns[2].GetString_(),
+		Delegate:    row.Columns[3].GetBytes(),
+		DelegatedAt: formatTime(row.Columns[4].GetInt64()),
+		ExpiresAt:   formatTime(expiresAt),
+	}, expiresAt
+}
+
+// Returns the delegation of a check in a service cycle and when it expires, 0 if never.
+// The delegation is nil if the check is not delegated.
+func (t *DeviceMaintenanceChaincode) getDelegation(stub shim.ChaincodeStubInterface, deviceId, serviceId, check string) (*CheckDelegation, int64, error) {
+	var columns []shim.Column
+	col1 := shim.Column{Value: &shim.Column_String_{String_: deviceId}}
+	col2 := shim.Column{Value: &shim.Column_String_{String_: serviceId}}
+	col3 := shim.Column{Value: &shim.Column_String_{String_: check}}
+	columns = append(columns, col1, col2, col3)
+
+	row, err := stub.GetRow(delegationsTable, columns)
+	if err != nil {
+		logger.Errorf("Error in getting delegation:%s", err.Error())
+		return nil, 0, errors.New("Error in fetching delegation")
+	}
+	if len(row.Columns) == 0 {
+		return nil, 0, nil
+	}
+	delegation, expiresAt := t.extractDelegation(row)
+	return &delegation, expiresAt, nil
+}
+
+// Returns the certificate the caller performs a check of a service cycle as: the owner
+// certificate of the check, its own certificate if it has the role of the check, or the
+// certificate the check is delegated to. Nil if the caller cannot perform the check.
+func (t *DeviceMaintenanceChaincode) checkPerformer(stub shim.ChaincodeStubInterface, deviceId, serviceId string, check *CheckDefinition) ([]byte, error) {
+	ok, err := t.isCheckPerformer(stub, check)
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		if len(check.Owner) > 0 {
+			return check.Owner, nil
+		}
+		return stub.GetCallerCertificate()
+	}
+
+	delegation, expiresAt, err := t.getDelegation(stub, deviceId, serviceId, check.Name)
+	if err != nil || delegation == nil {
+		return nil, err
+	}
+	if expiresAt != 0 {
+		now, err := txTime(stub)
+		if err != nil {
+			return nil, err
+		}
+		if now.Unix() >= expiresAt {
+			logger.Errorf("Delegation of check %s expired at %s", check.Name, delegation.ExpiresAt)
+			return nil, nil
+		}
+	}
+	ok, err = t.isCaller(stub, delegation.Delegate)
+	if err != nil || !ok {
+		return nil, err
+	}
+	return delegation.Delegate, nil
+}
+
+// Checks that the check is part of an open service cycle and that the caller performs it
+// itself rather than by delegation
+func (t *DeviceMaintenanceChaincode) delegableCheck(stub shim.ChaincodeStubInterface, deviceId, serviceId, check string) error {
+	device, err := t.getDevice(stub, deviceId)
+	if err != nil {
+		logger.Errorf("Failed fetching device: [%s]", err)
+		return fmt.Errorf("Failed fetching device [%s]", err)
+	}
+	if device.Id == "" {
+		logger.Errorf("Device %s not found", deviceId)
+		return fmt.Errorf("Device %s not found", deviceId)
+	}
+
+	deviceServiceRecord, err := t.getDeviceServiceRecord(stub, deviceId, serviceId)
+	if err != nil {
+		logger.Errorf("Failed fetching device service record: [%s]", err)
+		return fmt.Errorf("Failed fetching device service record [%s]", err)
+	}
+	if deviceServiceRecord.ServiceId == "" {
+		logger.Errorf("No service record with id [%s] found for device %s", serviceId, deviceId)
+		return fmt.Errorf("No service record with id [%s] found for device %s", serviceId, deviceId)
+	}
+	if !deviceServiceRecord.active() {
+		logger.Errorf("Service cycle %s of device %s is %s", serviceId, deviceId, deviceServiceRecord.State)
+		return fmt.Errorf("Service cycle %s of device %s is %s", serviceId, deviceId, deviceServiceRecord.State)
+	}
+
+	template, err := t.getTemplate(stub, device.Template)
+	if err != nil || template == nil {
+		logger.Errorf("Failed fetching template %s: [%s]", device.Template, err)
+		return fmt.Errorf("Failed fetching template %s [%s]", device.Template, err)
+	}
+	checkDefinition := template.check(check)
+	if checkDefinition == nil || deviceServiceRecord.position(check) < 0 {
+		logger.Errorf("Invalid check specified %s", check)
+		return fmt.Errorf("Invalid check specified %s", check)
+	}
+
+	ok, err := t.isCheckPerformer(stub, checkDefinition)
+	if err != nil {
+		logger.Error("Failed checking owner identity")
+		return errors.New("Failed checking owner identity")
+	}
+	if !ok {
+		logger.Error("Caller is not the owner for this check")
+		return errors.New("Caller is not the owner for this check")
+	}
+	return nil
+}
+
+// Delegates a check of an open service cycle to another certificate, optionally for a
+// number of hours. A new delegation replaces the one before. Only check owner can do it.
+func (t *DeviceMaintenanceChaincode) delegateCheck(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	logger.Info("In delegateCheck function")
+	if len(args) != 4 && len(args) != 5 {
+		logger.Error("Incorrect number of arguments")
+		return nil, errors.New("Incorrect number of arguments. Specify device id, service id, the check, the delegate and optionally the hours the delegation is valid.")
+	}
+
+	deviceId := args[0]
+	serviceId := args[1]
+	check := args[2]
+	delegate, err := base64.StdEncoding.DecodeString(args[3])
+	if err != nil || len(delegate) == 0 {
+		logger.Error("Failed decoding delegate certificate")
+		return nil, errors.New("Failed decoding delegate")
+	}
+	var validity time.Duration
+	if len(args) == 5 {
+		hours, err := strconv.ParseInt(args[4], 10, 64)
+		if err != nil || hours <= 0 {
+			logger.Errorf("Invalid value of validity:%s", args[4])
+			return nil, fmt.Errorf("Invalid value of validity:%s", args[4])
+		}
+		validity = time.Duration(hours) * time.Hour
+	}
+
+	err = t.delegableCheck(stub, deviceId, serviceId, check)
+	if err != nil {
+		return nil, err
+	}
+
+	now, err := txTime(stub)
+	if err != nil {
+		return nil, err
+	}
+	var expiresAt int64
+	if validity > 0 {
+		expiresAt = now.Add(validity).Unix()
+	}
+
+	row := shim.Row{
+		Columns: []*shim.Column{
+			&shim.Column{Value: &shim.Column_String_{String_: deviceId}},
+			&shim.Column{Value: &shim.Column_String_{String_: serviceId}},
+			&shim.Column{Value: &shim.Column_String_{String_: check}},
+			&shim.Column{Value: &shim.Column_Bytes{Bytes: delegate}},
+			&shim.Column{Value: &shim.Column_Int64{Int64: now.Unix()}},
+			&shim.Column{Value: &shim.Column_Int64{Int64: expiresAt}},
+		},
+	}
+	ok, err := stub.InsertRow(delegationsTable, row)
+	if err == nil && !ok {
+		ok, err = stub.ReplaceRow(delegationsTable, row)
+	}
+	if !ok || err != nil {
+		logger.Errorf("Error in delegating the check:%s", err)
+		return nil, errors.New("Error in delegating the check")
+	}
+	logger.Infof("Check %s of service cycle %s of device %s delegated", check, serviceId, deviceId)
+
+	return nil, nil
+}
+
+// Withdraws the delegation of a check of an open service cycle. Only check owner can do it.
+func (t *DeviceMaintenanceChaincode) revokeDelegation(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	logger.Info("In revokeDelegation function")
+	if len(args) != 3 {
+		logger.Error("Incorrect number of arguments")
+		return nil, errors.New("Incorrect number of arguments. Specify device id, service id and the check.")
+	}
+
+	deviceId := args[0]
+	serviceId := args[1]
+	check := args[2]
+	err := t.delegableCheck(stub, deviceId, serviceId, check)
+	if err != nil {
+		return nil, err
+	}
+
+	delegation, _, err := t.getDelegation(stub, deviceId, serviceId, check)
+	if err != nil {
+		return nil, err
+	}
+	if delegation == nil {
+		logger.Errorf("Check %s is not delegated", check)
+		return nil, fmt.Errorf("Check %s of service cycle %s of device %s is not delegated", check, serviceId, deviceId)
+	}
+
+	var columns []shim.Column
+	col1 := shim.Column{Value: &shim.Column_String_{String_: deviceId}}
+	col2 := shim.Column{Value: &shim.Column_String_{String_: serviceId}}
+	col3 := shim.Column{Value: &shim.Column_String_{String_: check}}
+	columns = append(columns, col1, col2, col3)
+	err = stub.DeleteRow(delegationsTable, columns)
+	if err != nil {
+		logger.Errorf("Error in revoking the delegation:%s", err)
+		return nil, errors.New("Error in revoking the delegation")
+	}
+	logger.Infof("Delegation of check %s of service cycle %s of device %s revoked", check, serviceId, deviceId)
+
+	return nil, nil
+}
+
+// Returns the delegations of checks in all service cycles of a device
+func (t *DeviceMaintenanceChaincode) getDeviceDelegations(stub shim.ChaincodeStubInterface, deviceId string) ([]CheckDelegation, error) {
+	var columns []shim.Column
+	col := shim.Column{Value: &shim.Column_String_{String_: deviceId}}
+	columns = append(columns, col)
+
+	rowChannel, err := stub.GetRows(delegationsTable, columns)
+	if err != nil {
+		logger.Errorf("Error in getting rows:%s", err.Error())
+		return nil, errors.New("Error in fetching rows")
+	}
+	now, err := txTime(stub)
+	if err != nil {
+		return nil, err
+	}
+	delegations := make([]CheckDelegation, 0)
+	for row := range rowChannel {
+		delegation, expiresAt := t.extractDelegation(row)
+		delegation.Expired = expiresAt != 0 && now.Unix() >= expiresAt
+		delegations = append(delegations, delegation)
+	}
+	return delegations, nil
+}
+
+// Return the delegated checks of a service cycle
+func (t *DeviceMaintenanceChaincode) checkDelegations(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	logger.Info("In checkDelegations function")
+	if len(args) != 2 {
+		logger.Error("Incorrect number of arguments")
+		return nil, errors.New("Incorrect number of arguments. Specify device id and service id.")
+	}
+
+	var columns []shim.Column
+	col1 := shim.Column{Value: &shim.Column_String_{String_: args[0]}}
+	col2 := shim.Column{Value: &shim.Column_String_{String_: args[1]}}
+	columns = append(columns, col1, col2)
+
+	rowChannel, err := stub.GetRows(delegationsTable, columns)
+	if err != nil {
+		logger.Errorf("Error in getting rows:%s", err.Error())
+		return nil, errors.New("Error in fetching rows")
+	}
+	now, err := txTime(stub)
+	if err != nil {
+		return nil, err
+	}
+	delegations := make([]CheckDelegation, 0)
+	for row := range rowChannel {
+		delegation, expiresAt := t.extractDelegation(row)
+		delegation.Expired = expiresAt != 0 && now.Unix() >= expiresAt
+		delegations = append(delegations, delegation)
+	}
+
+	payload, err := json.Marshal(delegations)
+	if err != nil {
+		logger.Errorf("Failed marshalling payload: [%s]", err)
+		return nil, fmt.Errorf("Failed marshalling payload [%s]", err)
+	}
+
+	return payload, nil
+}
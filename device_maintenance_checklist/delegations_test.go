@@ -0,0 +1,31 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"testing"
+)
+
+// A delegate without the role attribute in its certificate performs a role check
+func TestDelegateWithoutRolePerformsCheck(t *testing.T) {
+	cc, stub := newTestChaincode(t)
+	inspector := []byte("inspector")
+	delegate := []byte("delegate")
+
+	checks, _ := json.Marshal([]CheckDefinition{{Name: "inspect", Role: "inspector"}})
+	invokeAs(t, cc, stub, testAdmin, "createTemplate", "inspected", string(checks))
+	invokeAs(t, cc, stub, testAdmin, "enroll", "d1", base64.StdEncoding.EncodeToString([]byte("key")), base64.StdEncoding.EncodeToString(testOwner), "inspected")
+	invokeAs(t, cc, stub, testOwner, "startServiceCycle", "d1", "s1")
+
+	_, err := invoke(cc, stub, delegate, "markCheckComplete", "d1", "s1", "inspect")
+	if err == nil {
+		t.Fatal("Caller without role or delegation performed the check")
+	}
+
+	stub.Attributes[roleAttribute] = []byte("inspector")
+	invokeAs(t, cc, stub, inspector, "delegateCheck", "d1", "s1", "inspect", base64.StdEncoding.EncodeToString(delegate))
+
+	delete(stub.Attributes, roleAttribute)
+	invokeAs(t, cc, stub, delegate, "markCheckComplete", "d1", "s1", "inspect")
+	invokeAs(t, cc, stub, testOwner, "signoff", "d1", "s1")
+}
@@ -5,6 +5,8 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"strconv"
+	"time"
 
 	"github.com/hyperledger/fabric/core/chaincode/shim"
 	"github.com/hyperledger/fabric/core/crypto/primitives"
@@ -15,6 +17,18 @@ var logger = shim.NewLogger("device_maintenance")
 const (
 	deviceChecksOwnerMapTable = "DeviceChecksOwnerMap"
 	deviceServiceTable        = "DeviceService"
+	templatesTable            = "ChecklistTemplates"
+	checkResultsTable         = "CheckResults"
+	openCyclesTable           = "OpenServiceCycles"
+	pendingTransfersTable     = "PendingTransfers"
+	ownershipHistoryTable     = "OwnershipHistory"
+	adminsTable               = "Admins"
+	adminProposalsTable       = "AdminProposals"
+	archivedDevicesTable      = "ArchivedDevices"
+	archivedServiceTable      = "ArchivedDeviceService"
+	selfTestsTable            = "SelfTests"
+	delegationsTable          = "CheckDelegations"
+	schedulesTable            = "MaintenanceSchedules"
 )
 
 type Devices []Device
@@ -23,20 +37,28 @@ type Device struct {
 	Id        string `json:"id"`
 	PublicKey []byte
 	Owner     []byte
-	Check1    []byte
-	Check2    []byte
-	Check3    []byte
+	Template  string `json:"template"`
 }
 
 type DeviceServiceRecords []DeviceServiceRecord
 
+// CheckResult is the state of one check of the device's template in a service cycle.
+// PerformedBy is the certificate of whoever last marked the check complete.
+type CheckResult struct {
+	Check       string `json:"check"`
+	Completed   bool   `json:"completed"`
+	PerformedBy []byte `json:"performed_by,omitempty"`
+	ResultDetails
+}
+
 type DeviceServiceRecord struct {
-	DeviceId  string `json:"device_id"`
-	ServiceId string `json:"service_id"`
-	Check1    bool   `json:"check1"`
-	Check2    bool   `json:"check2"`
-	Check3    bool   `json:"check3"`
-	Signoff   bool   `json:"signoff"`
+	DeviceId    string        `json:"device_id"`
+	ServiceId   string        `json:"service_id"`
+	State       string        `json:"state"`
+	AbortReason string        `json:"abort_reason,omitempty"`
+	Checks      []CheckResult `json:"checks"`
+	SelfTest    *SelfTest     `json:"self_test,omitempty"`
+	Signoff     bool          `json:"signoff"`
 }
 
 // DeviceMaintenance chaincode that provides a way to record maintenance checklist
@@ -52,19 +74,68 @@ func (t *DeviceMaintenanceChaincode) Init(stub shim.ChaincodeStubInterface, func
 		return nil, errors.New("Incorrect number of arguments. No arguments required.")
 	}
 
+	fresh, err := t.isFreshDeploy(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	err = t.createTables(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	// A deploy over an earlier one keeps its admins, changes of the admin set go through
+	// the approval of the admins
+	if !fresh {
+		logger.Info("Successfully deployed chain code, admins kept")
+		return nil, nil
+	}
+
+	// Set the admin
+	// The metadata will contain the certificate of the administrator
+	adminCert, err := stub.GetCallerMetadata()
+	if err != nil {
+		logger.Debug("Failed getting metadata")
+		return nil, errors.New("Failed getting metadata.")
+	}
+	if len(adminCert) == 0 {
+		logger.Debug("Invalid admin certificate. Empty.")
+		return nil, errors.New("Invalid admin certificate. Empty.")
+	}
+
+	logger.Debug("The administrator is [%x]", adminCert)
+
+	ok, err := t.insertAdmin(stub, adminCert)
+	if !ok || err != nil {
+		logger.Errorf("Error in adding administrator:%s", err)
+		return nil, errors.New("Failed adding administrator.")
+	}
+	err = stub.PutState("schema_version", []byte(strconv.FormatInt(currentSchemaVersion, 10)))
+	if err != nil {
+		logger.Errorf("Error saving schema version %s", err.Error())
+		return nil, errors.New("Schema version cannot be saved")
+	}
+
+	logger.Info("Successfully deployed chain code")
+
+	return adminCert, nil
+}
+
+// Create the tables that do not exist yet
+func (t *DeviceMaintenanceChaincode) createTables(stub shim.ChaincodeStubInterface) error {
+	var err error
+
 	_, err = stub.GetTable(deviceChecksOwnerMapTable)
 	if err == shim.ErrTableNotFound {
 		err = stub.CreateTable(deviceChecksOwnerMapTable, []*shim.ColumnDefinition{
 			&shim.ColumnDefinition{Name: "DeviceId", Type: shim.ColumnDefinition_STRING, Key: true},
 			&shim.ColumnDefinition{Name: "PublicKey", Type: shim.ColumnDefinition_BYTES, Key: false},
 			&shim.ColumnDefinition{Name: "Owner", Type: shim.ColumnDefinition_BYTES, Key: false},
-			&shim.ColumnDefinition{Name: "Check1", Type: shim.ColumnDefinition_BYTES, Key: false},
-			&shim.ColumnDefinition{Name: "Check2", Type: shim.ColumnDefinition_BYTES, Key: false},
-			&shim.ColumnDefinition{Name: "Check3", Type: shim.ColumnDefinition_BYTES, Key: false},
+			&shim.ColumnDefinition{Name: "Template", Type: shim.ColumnDefinition_STRING, Key: false},
 		})
 		if err != nil {
 			logger.Errorf("Error creating table:%s - %s", deviceChecksOwnerMapTable, err.Error())
-			return nil, errors.New("Failed creating DeviceChecksOwnerMap table.")
+			return errors.New("Failed creating DeviceChecksOwnerMap table.")
 		}
 	} else {
 		logger.Info("Table already exists")
@@ -75,42 +146,220 @@ func (t *DeviceMaintenanceChaincode) Init(stub shim.ChaincodeStubInterface, func
 		err = stub.CreateTable(deviceServiceTable, []*shim.ColumnDefinition{
 			&shim.ColumnDefinition{Name: "DeviceId", Type: shim.ColumnDefinition_STRING, Key: true},
 			&shim.ColumnDefinition{Name: "ServiceId", Type: shim.ColumnDefinition_STRING, Key: true},
-			&shim.ColumnDefinition{Name: "Check1", Type: shim.ColumnDefinition_BOOL, Key: false},
-			&shim.ColumnDefinition{Name: "Check2", Type: shim.ColumnDefinition_BOOL, Key: false},
-			&shim.ColumnDefinition{Name: "Check3", Type: shim.ColumnDefinition_BOOL, Key: false},
-			&shim.ColumnDefinition{Name: "SignOff", Type: shim.ColumnDefinition_BOOL, Key: false},
+			&shim.ColumnDefinition{Name: "State", Type: shim.ColumnDefinition_STRING, Key: false},
+			&shim.ColumnDefinition{Name: "AbortReason", Type: shim.ColumnDefinition_STRING, Key: false},
 		})
 		if err != nil {
 			logger.Errorf("Error creating table:%s - %s", deviceServiceTable, err.Error())
-			return nil, errors.New("Failed creating DeviceService table.")
+			return errors.New("Failed creating DeviceService table.")
 		}
 	} else {
 		logger.Info("Table already exists")
 	}
 
-	// Set the admin
-	// The metadata will contain the certificate of the administrator
-	adminCert, err := stub.GetCallerMetadata()
-	if err != nil {
-		logger.Debug("Failed getting metadata")
-		return nil, errors.New("Failed getting metadata.")
+	_, err = stub.GetTable(templatesTable)
+	if err == shim.ErrTableNotFound {
+		err = stub.CreateTable(templatesTable, []*shim.ColumnDefinition{
+			&shim.ColumnDefinition{Name: "Name", Type: shim.ColumnDefinition_STRING, Key: true},
+			&shim.ColumnDefinition{Name: "Checks", Type: shim.ColumnDefinition_STRING, Key: false},
+			&shim.ColumnDefinition{Name: "RequireSelfTest", Type: shim.ColumnDefinition_BOOL, Key: false},
+		})
+		if err != nil {
+			logger.Errorf("Error creating table:%s - %s", templatesTable, err.Error())
+			return errors.New("Failed creating ChecklistTemplates table.")
+		}
+	} else {
+		logger.Info("Table already exists")
 	}
-	if len(adminCert) == 0 {
-		logger.Debug("Invalid admin certificate. Empty.")
-		return nil, errors.New("Invalid admin certificate. Empty.")
+
+	_, err = stub.GetTable(checkResultsTable)
+	if err == shim.ErrTableNotFound {
+		err = stub.CreateTable(checkResultsTable, []*shim.ColumnDefinition{
+			&shim.ColumnDefinition{Name: "DeviceId", Type: shim.ColumnDefinition_STRING, Key: true},
+			&shim.ColumnDefinition{Name: "ServiceId", Type: shim.ColumnDefinition_STRING, Key: true},
+			&shim.ColumnDefinition{Name: "Check", Type: shim.ColumnDefinition_STRING, Key: true},
+			&shim.ColumnDefinition{Name: "Position", Type: shim.ColumnDefinition_INT64, Key: false},
+			&shim.ColumnDefinition{Name: "Completed", Type: shim.ColumnDefinition_BOOL, Key: false},
+			&shim.ColumnDefinition{Name: "Result", Type: shim.ColumnDefinition_STRING, Key: false},
+			&shim.ColumnDefinition{Name: "PerformedBy", Type: shim.ColumnDefinition_BYTES, Key: false},
+		})
+		if err != nil {
+			logger.Errorf("Error creating table:%s - %s", checkResultsTable, err.Error())
+			return errors.New("Failed creating CheckResults table.")
+		}
+	} else {
+		logger.Info("Table already exists")
 	}
 
-	logger.Debug("The administrator is [%x]", adminCert)
+	_, err = stub.GetTable(openCyclesTable)
+	if err == shim.ErrTableNotFound {
+		err = stub.CreateTable(openCyclesTable, []*shim.ColumnDefinition{
+			&shim.ColumnDefinition{Name: "DeviceId", Type: shim.ColumnDefinition_STRING, Key: true},
+			&shim.ColumnDefinition{Name: "ServiceId", Type: shim.ColumnDefinition_STRING, Key: false},
+		})
+		if err != nil {
+			logger.Errorf("Error creating table:%s - %s", openCyclesTable, err.Error())
+			return errors.New("Failed creating OpenServiceCycles table.")
+		}
+	} else {
+		logger.Info("Table already exists")
+	}
+
+	_, err = stub.GetTable(pendingTransfersTable)
+	if err == shim.ErrTableNotFound {
+		err = stub.CreateTable(pendingTransfersTable, []*shim.ColumnDefinition{
+			&shim.ColumnDefinition{Name: "DeviceId", Type: shim.ColumnDefinition_STRING, Key: true},
+			&shim.ColumnDefinition{Name: "NewOwner", Type: shim.ColumnDefinition_BYTES, Key: false},
+			&shim.ColumnDefinition{Name: "ProposedAt", Type: shim.ColumnDefinition_INT64, Key: false},
+			&shim.ColumnDefinition{Name: "ExpiresAt", Type: shim.ColumnDefinition_INT64, Key: false},
+		})
+		if err != nil {
+			logger.Errorf("Error creating table:%s - %s", pendingTransfersTable, err.Error())
+			return errors.New("Failed creating PendingTransfers table.")
+		}
+	} else {
+		logger.Info("Table already exists")
+	}
 
-	stub.PutState("admin", adminCert)
+	_, err = stub.GetTable(ownershipHistoryTable)
+	if err == shim.ErrTableNotFound {
+		err = stub.CreateTable(ownershipHistoryTable, []*shim.ColumnDefinition{
+			&shim.ColumnDefinition{Name: "DeviceId", Type: shim.ColumnDefinition_STRING, Key: true},
+			&shim.ColumnDefinition{Name: "Sequence", Type: shim.ColumnDefinition_INT64, Key: true},
+			&shim.ColumnDefinition{Name: "Owner", Type: shim.ColumnDefinition_BYTES, Key: false},
+			&shim.ColumnDefinition{Name: "Since", Type: shim.ColumnDefinition_INT64, Key: false},
+		})
+		if err != nil {
+			logger.Errorf("Error creating table:%s - %s", ownershipHistoryTable, err.Error())
+			return errors.New("Failed creating OwnershipHistory table.")
+		}
+	} else {
+		logger.Info("Table already exists")
+	}
 
-	logger.Info("Successfully deployed chain code")
+	_, err = stub.GetTable(adminsTable)
+	if err == shim.ErrTableNotFound {
+		err = stub.CreateTable(adminsTable, []*shim.ColumnDefinition{
+			&shim.ColumnDefinition{Name: "Id", Type: shim.ColumnDefinition_STRING, Key: true},
+			&shim.ColumnDefinition{Name: "Certificate", Type: shim.ColumnDefinition_BYTES, Key: false},
+		})
+		if err != nil {
+			logger.Errorf("Error creating table:%s - %s", adminsTable, err.Error())
+			return errors.New("Failed creating Admins table.")
+		}
+	} else {
+		logger.Info("Table already exists")
+	}
 
-	return adminCert, nil
+	_, err = stub.GetTable(adminProposalsTable)
+	if err == shim.ErrTableNotFound {
+		err = stub.CreateTable(adminProposalsTable, []*shim.ColumnDefinition{
+			&shim.ColumnDefinition{Name: "Id", Type: shim.ColumnDefinition_STRING, Key: true},
+			&shim.ColumnDefinition{Name: "Action", Type: shim.ColumnDefinition_STRING, Key: false},
+			&shim.ColumnDefinition{Name: "Certificate", Type: shim.ColumnDefinition_BYTES, Key: false},
+			&shim.ColumnDefinition{Name: "Threshold", Type: shim.ColumnDefinition_INT64, Key: false},
+			&shim.ColumnDefinition{Name: "Approvals", Type: shim.ColumnDefinition_STRING, Key: false},
+		})
+		if err != nil {
+			logger.Errorf("Error creating table:%s - %s", adminProposalsTable, err.Error())
+			return errors.New("Failed creating AdminProposals table.")
+		}
+	} else {
+		logger.Info("Table already exists")
+	}
+
+	_, err = stub.GetTable(archivedDevicesTable)
+	if err == shim.ErrTableNotFound {
+		err = stub.CreateTable(archivedDevicesTable, []*shim.ColumnDefinition{
+			&shim.ColumnDefinition{Name: "DeviceId", Type: shim.ColumnDefinition_STRING, Key: true},
+			&shim.ColumnDefinition{Name: "Device", Type: shim.ColumnDefinition_STRING, Key: false},
+		})
+		if err != nil {
+			logger.Errorf("Error creating table:%s - %s", archivedDevicesTable, err.Error())
+			return errors.New("Failed creating ArchivedDevices table.")
+		}
+	} else {
+		logger.Info("Table already exists")
+	}
+
+	_, err = stub.GetTable(archivedServiceTable)
+	if err == shim.ErrTableNotFound {
+		err = stub.CreateTable(archivedServiceTable, []*shim.ColumnDefinition{
+			&shim.ColumnDefinition{Name: "DeviceId", Type: shim.ColumnDefinition_STRING, Key: true},
+			&shim.ColumnDefinition{Name: "ServiceId", Type: shim.ColumnDefinition_STRING, Key: true},
+			&shim.ColumnDefinition{Name: "Record", Type: shim.ColumnDefinition_STRING, Key: false},
+		})
+		if err != nil {
+			logger.Errorf("Error creating table:%s - %s", archivedServiceTable, err.Error())
+			return errors.New("Failed creating ArchivedDeviceService table.")
+		}
+	} else {
+		logger.Info("Table already exists")
+	}
+
+	_, err = stub.GetTable(selfTestsTable)
+	if err == shim.ErrTableNotFound {
+		err = stub.CreateTable(selfTestsTable, []*shim.ColumnDefinition{
+			&shim.ColumnDefinition{Name: "DeviceId", Type: shim.ColumnDefinition_STRING, Key: true},
+			&shim.ColumnDefinition{Name: "ServiceId", Type: shim.ColumnDefinition_STRING, Key: true},
+			&shim.ColumnDefinition{Name: "Report", Type: shim.ColumnDefinition_STRING, Key: false},
+			&shim.ColumnDefinition{Name: "Signature", Type: shim.ColumnDefinition_BYTES, Key: false},
+			&shim.ColumnDefinition{Name: "Passed", Type: shim.ColumnDefinition_BOOL, Key: false},
+			&shim.ColumnDefinition{Name: "SubmittedAt", Type: shim.ColumnDefinition_INT64, Key: false},
+		})
+		if err != nil {
+			logger.Errorf("Error creating table:%s - %s", selfTestsTable, err.Error())
+			return errors.New("Failed creating SelfTests table.")
+		}
+	} else {
+		logger.Info("Table already exists")
+	}
+
+	_, err = stub.GetTable(delegationsTable)
+	if err == shim.ErrTableNotFound {
+		err = stub.CreateTable(delegationsTable, []*shim.ColumnDefinition{
+			&shim.ColumnDefinition{Name: "DeviceId", Type: shim.ColumnDefinition_STRING, Key: true},
+			&shim.ColumnDefinition{Name: "ServiceId", Type: shim.ColumnDefinition_STRING, Key: true},
+			&shim.ColumnDefinition{Name: "Check", Type: shim.ColumnDefinition_STRING, Key: true},
+			&shim.ColumnDefinition{Name: "Delegate", Type: shim.ColumnDefinition_BYTES, Key: false},
+			&shim.ColumnDefinition{Name: "DelegatedAt", Type: shim.ColumnDefinition_INT64, Key: false},
+			&shim.ColumnDefinition{Name: "ExpiresAt", Type: shim.ColumnDefinition_INT64, Key: false},
+		})
+		if err != nil {
+			logger.Errorf("Error creating table:%s - %s", delegationsTable, err.Error())
+			return errors.New("Failed creating CheckDelegations table.")
+		}
+	} else {
+		logger.Info("Table already exists")
+	}
+
+	_, err = stub.GetTable(schedulesTable)
+	if err == shim.ErrTableNotFound {
+		err = stub.CreateTable(schedulesTable, []*shim.ColumnDefinition{
+			&shim.ColumnDefinition{Name: "DeviceId", Type: shim.ColumnDefinition_STRING, Key: true},
+			&shim.ColumnDefinition{Name: "IntervalDays", Type: shim.ColumnDefinition_INT64, Key: false},
+			&shim.ColumnDefinition{Name: "IntervalHours", Type: shim.ColumnDefinition_INT64, Key: false},
+			&shim.ColumnDefinition{Name: "OperatingHours", Type: shim.ColumnDefinition_INT64, Key: false},
+			&shim.ColumnDefinition{Name: "LastServiceAt", Type: shim.ColumnDefinition_INT64, Key: false},
+			&shim.ColumnDefinition{Name: "LastServiceHours", Type: shim.ColumnDefinition_INT64, Key: false},
+		})
+		if err != nil {
+			logger.Errorf("Error creating table:%s - %s", schedulesTable, err.Error())
+			return errors.New("Failed creating MaintenanceSchedules table.")
+		}
+	} else {
+		logger.Info("Table already exists")
+	}
+
+	return nil
 }
 
 func (t *DeviceMaintenanceChaincode) Invoke(stub shim.ChaincodeStubInterface, function string, args []string) ([]byte, error) {
 
+	if function == "createTemplate" {
+		return t.createTemplate(stub, args)
+	}
+
 	if function == "enroll" {
 		return t.enroll(stub, args)
 	}
@@ -127,9 +376,57 @@ func (t *DeviceMaintenanceChaincode) Invoke(stub shim.ChaincodeStubInterface, fu
 		return t.signoff(stub, args)
 	}
 
-	if function == "delete" {
-		return t.delete(stub, args)
+	if function == "abortServiceCycle" {
+		return t.abortServiceCycle(stub, args)
+	}
+
+	if function == "submitSelfTest" {
+		return t.submitSelfTest(stub, args)
+	}
+
+	if function == "delegateCheck" {
+		return t.delegateCheck(stub, args)
+	}
+
+	if function == "revokeDelegation" {
+		return t.revokeDelegation(stub, args)
+	}
+
+	if function == "setMaintenanceInterval" {
+		return t.setMaintenanceInterval(stub, args)
+	}
+
+	if function == "reportOperatingHours" {
+		return t.reportOperatingHours(stub, args)
+	}
 
+	if function == "proposeTransfer" {
+		return t.proposeTransfer(stub, args)
+	}
+
+	if function == "acceptTransfer" {
+		return t.acceptTransfer(stub, args)
+	}
+
+	if function == "cancelTransfer" {
+		return t.cancelTransfer(stub, args)
+	}
+
+	if function == "proposeAdminChange" {
+		return t.proposeAdminChange(stub, args)
+	}
+
+	if function == "approveAdminChange" {
+		return t.approveAdminChange(stub, args)
+	}
+
+	if function == "migrate" {
+		return t.migrate(stub, args)
+	}
+
+	// Devices are no longer deleted, delete is kept for existing clients
+	if function == "decommission" || function == "delete" {
+		return t.decommission(stub, args)
 	}
 
 	logger.Errorf("Unimplemented method :%s called", function)
@@ -137,12 +434,12 @@ func (t *DeviceMaintenanceChaincode) Invoke(stub shim.ChaincodeStubInterface, fu
 	return nil, errors.New("Unimplemented '" + function + "' invoked")
 }
 
-// Enrolls a new device
+// Enrolls a new device against a checklist template
 func (t *DeviceMaintenanceChaincode) enroll(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
 	logger.Info("In enroll function")
-	if len(args) < 6 {
+	if len(args) != 4 {
 		logger.Error("Incorrect number of arguments")
-		return nil, errors.New("Incorrect number of arguments. Specify device id, public key, owner, owner for check1, check2 and check3.")
+		return nil, errors.New("Incorrect number of arguments. Specify device id, public key, owner and checklist template.")
 	}
 
 	deviceId := args[0]
@@ -156,54 +453,57 @@ func (t *DeviceMaintenanceChaincode) enroll(stub shim.ChaincodeStubInterface, ar
 		logger.Error("Failed decoding owner certificate")
 		return nil, errors.New("Failed decoding owner")
 	}
-	check1Owner, err := base64.StdEncoding.DecodeString(args[3])
+	templateName := args[3]
+
+	logger.Infof("Enrolling device with id:%s", deviceId)
+
+	// Only admin can enroll a device
+	err = t.checkAdmin(stub)
 	if err != nil {
-		logger.Error("Failed decoding check1 owner certificate")
-		return nil, errors.New("Failed decoding check1 owner")
+		return nil, err
 	}
-	check2Owner, err := base64.StdEncoding.DecodeString(args[4])
+
+	template, err := t.getTemplate(stub, templateName)
 	if err != nil {
-		logger.Error("Failed decoding check2 owner certificate")
-		return nil, errors.New("Failed decoding check1 owner")
+		logger.Errorf("Failed fetching template: [%s]", err)
+		return nil, fmt.Errorf("Failed fetching template [%s]", err)
 	}
-	check3Owner, err := base64.StdEncoding.DecodeString(args[5])
-	if err != nil {
-		logger.Error("Failed decoding check3 owner certificate")
-		return nil, errors.New("Failed decoding check1 owner")
+	if template == nil {
+		logger.Errorf("Template %s not found", templateName)
+		return nil, fmt.Errorf("Template %s not found", templateName)
 	}
 
-	logger.Infof("Enrolling device with id:%s", deviceId)
-
-	adminCertificate, err := stub.GetState("admin")
+	// The archive keeps decommissioned devices by id, so their ids are not reused
+	archived, err := t.getArchivedDevice(stub, deviceId)
 	if err != nil {
-		return nil, fmt.Errorf("Failed getting admin certificate:%s", err.Error())
+		logger.Errorf("Failed fetching archived device: [%s]", err)
+		return nil, fmt.Errorf("Failed fetching archived device [%s]", err)
 	}
-	// Only admin can enroll a device
-	ok, err := t.isCaller(stub, adminCertificate)
-	if err != nil {
-		logger.Error("Failed checking admin identity")
-		return nil, fmt.Errorf("Failed checking admin identity:%s", err.Error())
-	}
-	if !ok {
-		logger.Error("Caller is not administrator, cannot enroll a new device")
-		return nil, errors.New("The caller is not an administrator")
+	if archived != nil {
+		logger.Errorf("Device %s was decommissioned", deviceId)
+		return nil, fmt.Errorf("Device %s was decommissioned, its id cannot be enrolled again", deviceId)
 	}
 
-	ok, err = stub.InsertRow(deviceChecksOwnerMapTable, shim.Row{
-		Columns: []*shim.Column{
-			&shim.Column{Value: &shim.Column_String_{String_: deviceId}},
-			&shim.Column{Value: &shim.Column_Bytes{Bytes: devicePubKey}},
-			&shim.Column{Value: &shim.Column_Bytes{Bytes: owner}},
-			&shim.Column{Value: &shim.Column_Bytes{Bytes: check1Owner}},
-			&shim.Column{Value: &shim.Column_Bytes{Bytes: check2Owner}},
-			&shim.Column{Value: &shim.Column_Bytes{Bytes: check3Owner}},
-		},
-	})
+	ok, err := stub.InsertRow(deviceChecksOwnerMapTable, t.deviceRow(Device{
+		Id:        deviceId,
+		PublicKey: devicePubKey,
+		Owner:     owner,
+		Template:  templateName,
+	}))
 
 	if !ok || err != nil {
 		logger.Errorf("Error in enrolling a new device:%s", err)
 		return nil, errors.New("Error in enrolling a new device")
 	}
+
+	now, err := txTime(stub)
+	if err == nil {
+		err = t.recordOwner(stub, deviceId, owner, now.Unix())
+	}
+	if err != nil {
+		logger.Errorf("Error in enrolling a new device:%s", err)
+		return nil, errors.New("Error in enrolling a new device")
+	}
 	logger.Infof("Enrolled device %s", deviceId)
 
 	return nil, nil
@@ -226,9 +526,6 @@ func (t *DeviceMaintenanceChaincode) startServiceCycle(stub shim.ChaincodeStubIn
 	}
 
 	logger.Infof("Starting new service cycle for device:%s", deviceId)
-	// We could add check to see if there are any active service cycles
-	// going on for this device and fail if there is any active service cycle.
-	// But for now we will skip that check...
 
 	// Only owner can start a service cycle
 	ok, err := t.isCaller(stub, device.Owner)
@@ -241,37 +538,64 @@ func (t *DeviceMaintenanceChaincode) startServiceCycle(stub shim.ChaincodeStubIn
 		return nil, errors.New("The caller is not the owner of device")
 	}
 
-	ok, err = stub.InsertRow(deviceServiceTable, shim.Row{
-		Columns: []*shim.Column{
-			&shim.Column{Value: &shim.Column_String_{String_: deviceId}},
-			&shim.Column{Value: &shim.Column_String_{String_: serviceId}},
-			&shim.Column{Value: &shim.Column_Bool{Bool: false}},
-			&shim.Column{Value: &shim.Column_Bool{Bool: false}},
-			&shim.Column{Value: &shim.Column_Bool{Bool: false}},
-			&shim.Column{Value: &shim.Column_Bool{Bool: false}},
-		},
-	})
+	template, err := t.getTemplate(stub, device.Template)
+	if err != nil || template == nil {
+		logger.Errorf("Failed fetching template %s: [%s]", device.Template, err)
+		return nil, fmt.Errorf("Failed fetching template %s [%s]", device.Template, err)
+	}
+
+	// A device has one open service cycle at a time
+	err = t.openCycle(stub, deviceId, serviceId)
+	if err != nil {
+		logger.Errorf("Error in opening the service cycle:%s", err)
+		return nil, fmt.Errorf("Error in starting a new service cycle [%s]", err)
+	}
+
+	ok, err = stub.InsertRow(deviceServiceTable, t.serviceRow(DeviceServiceRecord{DeviceId: deviceId, ServiceId: serviceId, State: cycleOpen}))
 
 	if !ok || err != nil {
 		logger.Errorf("Error in starting a new service cycle:%s", err)
 		return nil, errors.New("Error in starting a new service cycle")
 	}
+
+	// Every check of the template starts out incomplete
+	for i, check := range template.Checks {
+		row, err := t.checkResultRow(deviceId, serviceId, int64(i), CheckResult{Check: check.Name})
+		if err == nil {
+			ok, err = stub.InsertRow(checkResultsTable, row)
+		}
+		if !ok || err != nil {
+			logger.Errorf("Error in adding check %s to the service cycle:%s", check.Name, err)
+			return nil, errors.New("Error in starting a new service cycle")
+		}
+	}
 	logger.Infof("New service cycle %s started for device id: %s", serviceId, deviceId)
 
 	return nil, nil
 }
 
-// Marks a check complete. Allowed only if the caller is owner of that check
+// Marks a check complete with the result given as JSON, a passed check if there is none.
+// A check can be marked again, the last result counts. Allowed only if the caller is
+// owner of that check
 func (t *DeviceMaintenanceChaincode) markCheckComplete(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
 	logger.Info("In markCheckComplete function")
-	if len(args) != 3 {
+	if len(args) != 3 && len(args) != 4 {
 		logger.Error("Incorrect number of arguments")
-		return nil, errors.New("Incorrect number of arguments. Specify device id, service id and the check being performed.")
+		return nil, errors.New("Incorrect number of arguments. Specify device id, service id, the check being performed and optionally its result.")
 	}
 
 	deviceId := args[0]
 	serviceId := args[1]
 	check := args[2]
+	details := ResultDetails{Outcome: outcomePass}
+	if len(args) == 4 {
+		var err error
+		details, err = parseResultDetails(args[3])
+		if err != nil {
+			logger.Errorf("Invalid result: [%s]", err)
+			return nil, fmt.Errorf("Invalid result [%s]", err)
+		}
+	}
 	device, err := t.getDevice(stub, deviceId)
 	if err != nil {
 		logger.Errorf("Failed fetching device: [%s]", err)
@@ -289,53 +613,69 @@ func (t *DeviceMaintenanceChaincode) markCheckComplete(stub shim.ChaincodeStubIn
 		return nil, fmt.Errorf("No service record with id [%s] found for device %s", serviceId, deviceId)
 	}
 
+	if !deviceServiceRecord.active() {
+		logger.Errorf("Service cycle %s of device %s is %s", serviceId, deviceId, deviceServiceRecord.State)
+		return nil, fmt.Errorf("Service cycle %s of device %s is %s", serviceId, deviceId, deviceServiceRecord.State)
+	}
+
 	logger.Infof("Marking check %s completed for device:%s", check, deviceId)
-	var checkOwner []byte
-	switch check {
-	case "check1":
-		logger.Debug("Mark Check1 completed")
-		checkOwner = device.Check1
-		deviceServiceRecord.Check1 = true
-	case "check2":
-		logger.Debug("Mark Check2 completed")
-		checkOwner = device.Check2
-		deviceServiceRecord.Check2 = true
-	case "check3":
-		logger.Debug("Mark Check3 completed")
-		checkOwner = device.Check3
-		deviceServiceRecord.Check3 = true
-	default:
+	template, err := t.getTemplate(stub, device.Template)
+	if err != nil || template == nil {
+		logger.Errorf("Failed fetching template %s: [%s]", device.Template, err)
+		return nil, fmt.Errorf("Failed fetching template %s [%s]", device.Template, err)
+	}
+	checkDefinition := template.check(check)
+	position := deviceServiceRecord.position(check)
+	if checkDefinition == nil || position < 0 {
 		logger.Errorf("Invalid check specified %s", check)
 		return nil, fmt.Errorf("Invalid check specified %s", check)
 	}
 
-	// Only check owner can mark check complete
-	ok, err := t.isCaller(stub, checkOwner)
+	// Prerequisites must have passed in this cycle first
+	for _, prerequisite := range checkDefinition.Prerequisites {
+		i := deviceServiceRecord.position(prerequisite)
+		if i < 0 || !deviceServiceRecord.Checks[i].Completed || deviceServiceRecord.Checks[i].Outcome != outcomePass {
+			logger.Errorf("Prerequisite %s of check %s has not passed", prerequisite, check)
+			return nil, fmt.Errorf("Check %s requires %s to pass first", check, prerequisite)
+		}
+	}
+
+	// Only check owner or its delegate in this cycle can mark check complete
+	performer, err := t.checkPerformer(stub, deviceId, serviceId, checkDefinition)
 	if err != nil {
 		logger.Error("Failed checking owner identity")
 		return nil, errors.New("Failed checking owner identity")
 	}
-	if !ok {
+	if performer == nil {
 		logger.Error("Caller is not the owner for this check, cannot mark it complete")
 		return nil, errors.New("Caller is not the owner for this check, cannot mark it complete")
 	}
 
-	ok, err = stub.ReplaceRow(deviceServiceTable, shim.Row{
-		Columns: []*shim.Column{
-			&shim.Column{Value: &shim.Column_String_{String_: deviceId}},
-			&shim.Column{Value: &shim.Column_String_{String_: serviceId}},
-			&shim.Column{Value: &shim.Column_Bool{Bool: deviceServiceRecord.Check1}},
-			&shim.Column{Value: &shim.Column_Bool{Bool: deviceServiceRecord.Check2}},
-			&shim.Column{Value: &shim.Column_Bool{Bool: deviceServiceRecord.Check3}},
-			&shim.Column{Value: &shim.Column_Bool{Bool: deviceServiceRecord.Signoff}},
-		},
-	})
+	result := deviceServiceRecord.Checks[position]
+	result.Completed = true
+	result.PerformedBy = performer
+	result.ResultDetails = details
+	row, err := t.checkResultRow(deviceId, serviceId, int64(position), result)
+	ok := false
+	if err == nil {
+		ok, err = stub.ReplaceRow(checkResultsTable, row)
+	}
 
 	if !ok || err != nil {
 		logger.Errorf("Error in marking the check complete:%s", err)
 		return nil, errors.New("Error in marking the check complete")
 	}
-	logger.Infof("Check %s completed for device %s", check, deviceId)
+
+	deviceServiceRecord.Checks[position] = result
+	if state := deviceServiceRecord.progress(); state != deviceServiceRecord.State {
+		deviceServiceRecord.State = state
+		ok, err = stub.ReplaceRow(deviceServiceTable, t.serviceRow(deviceServiceRecord))
+		if !ok || err != nil {
+			logger.Errorf("Error in updating the service cycle:%s", err)
+			return nil, errors.New("Error in marking the check complete")
+		}
+	}
+	logger.Infof("Check %s completed for device %s with outcome %s", check, deviceId, details.Outcome)
 
 	return nil, nil
 }
@@ -380,38 +720,77 @@ func (t *DeviceMaintenanceChaincode) signoff(stub shim.ChaincodeStubInterface, a
 		return nil, errors.New("The caller is not the owner of device")
 	}
 
-	if !deviceServiceRecord.Check1 || !deviceServiceRecord.Check2 || !deviceServiceRecord.Check3 {
-		logger.Error("All checks not completed, cannot close the service cycle")
-		return nil, errors.New("All checks not completed, cannot close the service cycle")
+	if !deviceServiceRecord.active() {
+		logger.Errorf("Service cycle %s of device %s is %s", serviceId, deviceId, deviceServiceRecord.State)
+		return nil, fmt.Errorf("Service cycle %s of device %s is %s", serviceId, deviceId, deviceServiceRecord.State)
 	}
 
-	ok, err = stub.ReplaceRow(deviceServiceTable, shim.Row{
-		Columns: []*shim.Column{
-			&shim.Column{Value: &shim.Column_String_{String_: deviceId}},
-			&shim.Column{Value: &shim.Column_String_{String_: serviceId}},
-			&shim.Column{Value: &shim.Column_Bool{Bool: deviceServiceRecord.Check1}},
-			&shim.Column{Value: &shim.Column_Bool{Bool: deviceServiceRecord.Check2}},
-			&shim.Column{Value: &shim.Column_Bool{Bool: deviceServiceRecord.Check3}},
-			&shim.Column{Value: &shim.Column_Bool{Bool: true}},
-		},
-	})
+	for _, result := range deviceServiceRecord.Checks {
+		if !result.Completed {
+			logger.Errorf("Check %s not completed, cannot close the service cycle", result.Check)
+			return nil, fmt.Errorf("Check %s not completed, cannot close the service cycle", result.Check)
+		}
+		if result.Outcome == outcomeFail {
+			logger.Errorf("Check %s failed, cannot close the service cycle", result.Check)
+			return nil, fmt.Errorf("Check %s failed, cannot close the service cycle", result.Check)
+		}
+	}
+
+	template, err := t.getTemplate(stub, device.Template)
+	if err != nil || template == nil {
+		logger.Errorf("Failed fetching template %s: [%s]", device.Template, err)
+		return nil, fmt.Errorf("Failed fetching template %s [%s]", device.Template, err)
+	}
+	if template.RequireSelfTest && (deviceServiceRecord.SelfTest == nil || !deviceServiceRecord.SelfTest.Passed) {
+		logger.Error("No passed self-test of the device, cannot close the service cycle")
+		return nil, errors.New("No passed self-test of the device, cannot close the service cycle")
+	}
+
+	deviceServiceRecord.State = cycleSignedOff
+	ok, err = stub.ReplaceRow(deviceServiceTable, t.serviceRow(deviceServiceRecord))
 
 	if !ok || err != nil {
 		logger.Errorf("Error in signing off the service cycle:%s", err)
 		return nil, errors.New("Error in signing off the service cycle")
 	}
+	err = t.closeCycle(stub, deviceId)
+	if err != nil {
+		logger.Errorf("Error in closing the service cycle:%s", err)
+		return nil, errors.New("Error in signing off the service cycle")
+	}
+	now, err := txTime(stub)
+	if err != nil {
+		return nil, err
+	}
+	err = t.recordService(stub, deviceId, now)
+	if err != nil {
+		logger.Errorf("Error in scheduling the next service:%s", err)
+		return nil, errors.New("Error in signing off the service cycle")
+	}
 	logger.Infof("Service %s completed for device %s", serviceId, deviceId)
 	return nil, nil
 }
 
+func (t *DeviceMaintenanceChaincode) deviceRow(device Device) shim.Row {
+	return shim.Row{
+		Columns: []*shim.Column{
+			&shim.Column{Value: &shim.Column_String_{String_: device.Id}},
+			&shim.Column{Value: &shim.Column_Bytes{Bytes: device.PublicKey}},
+			&shim.Column{Value: &shim.Column_Bytes{Bytes: device.Owner}},
+			&shim.Column{Value: &shim.Column_String_{String_: device.Template}},
+		},
+	}
+}
+
 func (t *DeviceMaintenanceChaincode) extractDevice(row shim.Row) Device {
+	if len(row.Columns) == 0 {
+		return Device{}
+	}
 	return Device{
 		Id:        row.Columns[0].GetString_(),
 		PublicKey: row.Columns[1].GetBytes(),
 		Owner:     row.Columns[2].GetBytes(),
-		Check1:    row.Columns[3].GetBytes(),
-		Check2:    row.Columns[4].GetBytes(),
-		Check3:    row.Columns[5].GetBytes(),
+		Template:  row.Columns[3].GetString_(),
 	}
 }
 
@@ -432,7 +811,7 @@ func (t *DeviceMaintenanceChaincode) getDevice(stub shim.ChaincodeStubInterface,
 func (t *DeviceMaintenanceChaincode) getDevices(stub shim.ChaincodeStubInterface) (Devices, error) {
 	var columns []shim.Column
 
-	rowChannel, err := stub.GetRows(deviceServiceTable, columns)
+	rowChannel, err := stub.GetRows(deviceChecksOwnerMapTable, columns)
 	if err != nil {
 		logger.Errorf("Error in getting rows:%s", err.Error())
 		return nil, errors.New("Error in fetching rows")
@@ -445,15 +824,105 @@ func (t *DeviceMaintenanceChaincode) getDevices(stub shim.ChaincodeStubInterface
 	return devices, nil
 }
 
-func (t *DeviceMaintenanceChaincode) extractServiceRecord(row shim.Row) DeviceServiceRecord {
-	return DeviceServiceRecord{
-		DeviceId:  row.Columns[0].GetString_(),
-		ServiceId: row.Columns[1].GetString_(),
-		Check1:    row.Columns[2].GetBool(),
-		Check2:    row.Columns[3].GetBool(),
-		Check3:    row.Columns[4].GetBool(),
-		Signoff:   row.Columns[5].GetBool(),
+// Returns the position of a check in the service record, -1 if the record has no such check
+func (r *DeviceServiceRecord) position(check string) int {
+	for i := range r.Checks {
+		if r.Checks[i].Check == check {
+			return i
+		}
+	}
+	return -1
+}
+
+func (t *DeviceMaintenanceChaincode) serviceRow(record DeviceServiceRecord) shim.Row {
+	return shim.Row{
+		Columns: []*shim.Column{
+			&shim.Column{Value: &shim.Column_String_{String_: record.DeviceId}},
+			&shim.Column{Value: &shim.Column_String_{String_: record.ServiceId}},
+			&shim.Column{Value: &shim.Column_String_{String_: record.State}},
+			&shim.Column{Value: &shim.Column_String_{String_: record.AbortReason}},
+		},
+	}
+}
+
+func (t *DeviceMaintenanceChaincode) checkResultRow(deviceId, serviceId string, position int64, result CheckResult) (shim.Row, error) {
+	details, err := result.encodeDetails()
+	if err != nil {
+		return shim.Row{}, fmt.Errorf("Failed encoding result of check %s: %s", result.Check, err)
 	}
+	return shim.Row{
+		Columns: []*shim.Column{
+			&shim.Column{Value: &shim.Column_String_{String_: deviceId}},
+			&shim.Column{Value: &shim.Column_String_{String_: serviceId}},
+			&shim.Column{Value: &shim.Column_String_{String_: result.Check}},
+			&shim.Column{Value: &shim.Column_Int64{Int64: position}},
+			&shim.Column{Value: &shim.Column_Bool{Bool: result.Completed}},
+			&shim.Column{Value: &shim.Column_String_{String_: details}},
+			&shim.Column{Value: &shim.Column_Bytes{Bytes: result.PerformedBy}},
+		},
+	}, nil
+}
+
+// Returns the check results of a service cycle in the order of the template
+func (t *DeviceMaintenanceChaincode) getCheckResults(stub shim.ChaincodeStubInterface, deviceId, serviceId string) ([]CheckResult, error) {
+	var columns []shim.Column
+	col1 := shim.Column{Value: &shim.Column_String_{String_: deviceId}}
+	col2 := shim.Column{Value: &shim.Column_String_{String_: serviceId}}
+	columns = append(columns, col1, col2)
+
+	rowChannel, err := stub.GetRows(checkResultsTable, columns)
+	if err != nil {
+		logger.Errorf("Error in getting rows:%s", err.Error())
+		return nil, errors.New("Error in fetching rows")
+	}
+	rows := make([]shim.Row, 0)
+	for row := range rowChannel {
+		rows = append(rows, row)
+	}
+
+	results := make([]CheckResult, len(rows))
+	for _, row := range rows {
+		position := row.Columns[3].GetInt64()
+		if position < 0 || position >= int64(len(rows)) {
+			return nil, fmt.Errorf("Invalid position %d of check %s", position, row.Columns[2].GetString_())
+		}
+		results[position] = CheckResult{
+			Check:     row.Columns[2].GetString_(),
+			Completed: row.Columns[4].GetBool(),
+		}
+		err = results[position].decodeDetails(row.Columns[5].GetString_())
+		if err != nil {
+			return nil, err
+		}
+		// Results from before version 9 do not record who performed them
+		if len(row.Columns) > 6 {
+			results[position].PerformedBy = row.Columns[6].GetBytes()
+		}
+	}
+	return results, nil
+}
+
+func (t *DeviceMaintenanceChaincode) extractServiceRecord(stub shim.ChaincodeStubInterface, row shim.Row) (DeviceServiceRecord, error) {
+	if len(row.Columns) == 0 {
+		return DeviceServiceRecord{}, nil
+	}
+	record := DeviceServiceRecord{
+		DeviceId:    row.Columns[0].GetString_(),
+		ServiceId:   row.Columns[1].GetString_(),
+		State:       row.Columns[2].GetString_(),
+		AbortReason: row.Columns[3].GetString_(),
+	}
+	record.Signoff = record.State == cycleSignedOff
+	checks, err := t.getCheckResults(stub, record.DeviceId, record.ServiceId)
+	if err != nil {
+		return record, err
+	}
+	record.Checks = checks
+	record.SelfTest, err = t.getSelfTest(stub, record.DeviceId, record.ServiceId)
+	if err != nil {
+		return record, err
+	}
+	return record, nil
 }
 
 func (t *DeviceMaintenanceChaincode) getDeviceServiceRecord(stub shim.ChaincodeStubInterface, deviceId, serviceId string) (DeviceServiceRecord, error) {
@@ -467,8 +936,7 @@ func (t *DeviceMaintenanceChaincode) getDeviceServiceRecord(stub shim.ChaincodeS
 		logger.Errorf("Error in getting device service record:%s", err.Error())
 		return DeviceServiceRecord{}, errors.New("Error in fetching device service record")
 	}
-	deviceServiceRecord := t.extractServiceRecord(row)
-	return deviceServiceRecord, nil
+	return t.extractServiceRecord(stub, row)
 }
 
 func (t *DeviceMaintenanceChaincode) getDeviceServiceRecords(stub shim.ChaincodeStubInterface, deviceId string) (DeviceServiceRecords, error) {
@@ -483,9 +951,16 @@ func (t *DeviceMaintenanceChaincode) getDeviceServiceRecords(stub shim.Chaincode
 		logger.Errorf("Error in getting rows:%s", err.Error())
 		return nil, errors.New("Error in fetching rows")
 	}
-	deviceServiceRecords := DeviceServiceRecords{}
+	rows := make([]shim.Row, 0)
 	for row := range rowChannel {
-		deviceServiceRecord := t.extractServiceRecord(row)
+		rows = append(rows, row)
+	}
+	deviceServiceRecords := DeviceServiceRecords{}
+	for _, row := range rows {
+		deviceServiceRecord, err := t.extractServiceRecord(stub, row)
+		if err != nil {
+			return nil, err
+		}
 		deviceServiceRecords = append(deviceServiceRecords, deviceServiceRecord)
 	}
 	return deviceServiceRecords, nil
@@ -539,32 +1014,171 @@ func (t *DeviceMaintenanceChaincode) isCaller(stub shim.ChaincodeStubInterface,
 	return ok, err
 }
 
-// Deletes an existing device and its entry
-func (t *DeviceMaintenanceChaincode) delete(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
-	logger.Info("In delete function")
-	if len(args) != 1 {
+// Deletes a service record and its check results
+func (t *DeviceMaintenanceChaincode) deleteServiceRecord(stub shim.ChaincodeStubInterface, record DeviceServiceRecord) error {
+	col1 := shim.Column{Value: &shim.Column_String_{String_: record.DeviceId}}
+	col2 := shim.Column{Value: &shim.Column_String_{String_: record.ServiceId}}
+	for _, result := range record.Checks {
+		col3 := shim.Column{Value: &shim.Column_String_{String_: result.Check}}
+		err := stub.DeleteRow(checkResultsTable, []shim.Column{col1, col2, col3})
+		if err == nil {
+			err = stub.DeleteRow(delegationsTable, []shim.Column{col1, col2, col3})
+		}
+		if err != nil {
+			return err
+		}
+	}
+	err := stub.DeleteRow(selfTestsTable, []shim.Column{col1, col2})
+	if err != nil {
+		return err
+	}
+	return stub.DeleteRow(deviceServiceTable, []shim.Column{col1, col2})
+}
+
+// Returns the time of the transaction
+func txTime(stub shim.ChaincodeStubInterface) (time.Time, error) {
+	timestamp, err := stub.GetTxTimestamp()
+	if err != nil {
+		logger.Errorf("Failed getting transaction timestamp: [%s]", err)
+		return time.Time{}, errors.New("Failed getting transaction timestamp")
+	}
+	return time.Unix(timestamp.Seconds, int64(timestamp.Nanos)), nil
+}
+
+// Decommissions a device, moving it, its ownership history, the delegations of its checks,
+// its maintenance schedule and its service records to the archive. Open service cycles
+// are aborted. Only admin can do it.
+func (t *DeviceMaintenanceChaincode) decommission(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	logger.Info("In decommission function")
+	if len(args) != 1 && len(args) != 2 {
 		logger.Error("Incorrect number of arguments")
-		return nil, errors.New("Incorrect number of arguments. Specify device ID to be deleted")
+		return nil, errors.New("Incorrect number of arguments. Specify device ID to be decommissioned and optionally the reason")
 	}
 
 	deviceId := args[0]
+	reason := ""
+	if len(args) == 2 {
+		reason = args[1]
+	}
+
+	// Only admin can decommission a device
+	err := t.checkAdmin(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	device, err := t.getDevice(stub, deviceId)
+	if err != nil {
+		logger.Errorf("Failed fetching device: [%s]", err)
+		return nil, fmt.Errorf("Failed fetching device [%s]", err)
+	}
+	if device.Id == "" {
+		logger.Errorf("Device %s not found", deviceId)
+		return nil, fmt.Errorf("Device %s not found", deviceId)
+	}
+	now, err := txTime(stub)
+	if err != nil {
+		return nil, err
+	}
 
-	logger.Infof("Deleting device with id:%s", deviceId)
+	logger.Infof("Decommissioning device with id:%s", deviceId)
+
+	// Delegations are read before the service records go, which delete those of the
+	// checks with a result
+	delegations, err := t.getDeviceDelegations(stub, deviceId)
+	if err != nil {
+		logger.Errorf("Failed fetching check delegations: [%s]", err)
+		return nil, fmt.Errorf("Failed fetching check delegations [%s]", err)
+	}
+	schedule, err := t.getSchedule(stub, deviceId)
+	if err != nil {
+		return nil, err
+	}
+
+	// Rows can only be deleted by their full key, so every service record and check
+	// result is archived and deleted on its own
+	deviceServiceRecords, err := t.getDeviceServiceRecords(stub, deviceId)
+	if err != nil {
+		logger.Errorf("Failed fetching device service records: [%s]", err)
+		return nil, fmt.Errorf("Failed fetching device service records [%s]", err)
+	}
+	for _, record := range deviceServiceRecords {
+		if record.active() {
+			record.State = cycleAborted
+			record.AbortReason = "Device decommissioned"
+		}
+		err = t.archiveServiceRecord(stub, record)
+		if err == nil {
+			err = t.deleteServiceRecord(stub, record)
+		}
+		if err != nil {
+			logger.Errorf("Error in archiving an service records for device:%s", err)
+			return nil, errors.New("Error in archiving service records")
+		}
+	}
+	err = t.closeCycle(stub, deviceId)
+	if err != nil {
+		logger.Errorf("Error in archiving an service records for device:%s", err)
+		return nil, errors.New("Error in archiving service records")
+	}
+	for _, delegation := range delegations {
+		col1 := shim.Column{Value: &shim.Column_String_{String_: deviceId}}
+		col2 := shim.Column{Value: &shim.Column_String_{String_: delegation.ServiceId}}
+		col3 := shim.Column{Value: &shim.Column_String_{String_: delegation.Check}}
+		err = stub.DeleteRow(delegationsTable, []shim.Column{col1, col2, col3})
+		if err != nil {
+			logger.Errorf("Error in deleting check delegations of device:%s", err)
+			return nil, errors.New("Error in deleting check delegations")
+		}
+	}
+
+	history, err := t.getOwnershipHistory(stub, deviceId)
+	if err != nil {
+		logger.Errorf("Failed fetching ownership history: [%s]", err)
+		return nil, fmt.Errorf("Failed fetching ownership history [%s]", err)
+	}
+	for i := range history {
+		col1 := shim.Column{Value: &shim.Column_String_{String_: deviceId}}
+		col2 := shim.Column{Value: &shim.Column_Int64{Int64: int64(i)}}
+		err = stub.DeleteRow(ownershipHistoryTable, []shim.Column{col1, col2})
+		if err != nil {
+			logger.Errorf("Error in deleting ownership history of device:%s", err)
+			return nil, errors.New("Error in deleting ownership history")
+		}
+	}
+	err = t.deleteTransfer(stub, deviceId)
+	if err != nil {
+		logger.Errorf("Error in deleting pending transfer of device:%s", err)
+		return nil, errors.New("Error in deleting pending transfer")
+	}
+	err = t.deleteSchedule(stub, deviceId)
+	if err != nil {
+		logger.Errorf("Error in deleting maintenance schedule of device:%s", err)
+		return nil, errors.New("Error in deleting maintenance schedule")
+	}
+
+	err = t.archiveDevice(stub, ArchivedDevice{
+		Device:           device,
+		Owners:           history,
+		Delegations:      delegations,
+		Schedule:         schedule,
+		DecommissionedAt: formatTime(now.Unix()),
+		Reason:           reason,
+	})
+	if err != nil {
+		logger.Errorf("Error in archiving device:%s", err)
+		return nil, errors.New("Error in archiving device")
+	}
 
 	var columns []shim.Column
 	col1 := shim.Column{Value: &shim.Column_String_{String_: deviceId}}
 	columns = append(columns, col1)
-	err := stub.DeleteRow(deviceServiceTable, columns)
-	if err != nil {
-		logger.Errorf("Error in deleting an service records for device:%s", err)
-		return nil, errors.New("Error in deleting service records")
-	}
 	err = stub.DeleteRow(deviceChecksOwnerMapTable, columns)
 	if err != nil {
 		logger.Errorf("Error in deleting device:%s", err)
 		return nil, errors.New("Error in deleting device")
 	}
-	logger.Infof("Deleted device %s", deviceId)
+	logger.Infof("Decommissioned device %s", deviceId)
 
 	return nil, nil
 }
@@ -586,6 +1200,51 @@ func (t *DeviceMaintenanceChaincode) Query(stub shim.ChaincodeStubInterface, fun
 	if function == "allServiceRecords" {
 		return t.allServiceRecords(stub, args)
 	}
+	if function == "checkDelegations" {
+		return t.checkDelegations(stub, args)
+	}
+	if function == "openServiceCycles" {
+		return t.openServiceCycles(stub, args)
+	}
+	if function == "maintenanceSchedule" {
+		return t.maintenanceSchedule(stub, args)
+	}
+	if function == "devicesDueSoon" {
+		return t.devicesDueSoon(stub, args)
+	}
+	if function == "overdueDevices" {
+		return t.overdueDevices(stub, args)
+	}
+	if function == "pendingTransfer" {
+		return t.pendingTransfer(stub, args)
+	}
+	if function == "ownershipHistory" {
+		return t.ownershipHistory(stub, args)
+	}
+	if function == "template" {
+		return t.template(stub, args)
+	}
+	if function == "templates" {
+		return t.templates(stub, args)
+	}
+	if function == "archivedDevice" {
+		return t.archivedDevice(stub, args)
+	}
+	if function == "archivedDevices" {
+		return t.archivedDevices(stub, args)
+	}
+	if function == "archivedServiceRecords" {
+		return t.archivedServiceRecords(stub, args)
+	}
+	if function == "admins" {
+		return t.admins(stub, args)
+	}
+	if function == "adminProposals" {
+		return t.adminProposals(stub, args)
+	}
+	if function == "schemaVersion" {
+		return t.schemaVersion(stub, args)
+	}
 
 	return nil, errors.New("Invalid query function name")
 }
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"math/rand"
+	"strconv"
+	"testing"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/predix/chaincode_example/energy_trading/memstub"
+)
+
+var testAdmin = []byte("admin")
+
+// Deploys the chaincode on an empty in-memory stub, the admin as deployer
+func newTestChaincode(tb testing.TB) (*DeviceMaintenanceChaincode, *memstub.Stub) {
+	logger.SetLevel(shim.LogError)
+	stub := memstub.New()
+	t := new(DeviceMaintenanceChaincode)
+	stub.Caller = testAdmin
+	_, err := t.Init(stub, "init", nil)
+	if err != nil {
+		tb.Fatalf("Init failed: %s", err)
+	}
+	return t, stub
+}
+
+func invoke(t *DeviceMaintenanceChaincode, stub *memstub.Stub, caller []byte, function string, args ...string) ([]byte, error) {
+	stub.Caller = caller
+	stub.TxID = function + strconv.Itoa(rand.Int())
+	return t.Invoke(stub, function, args)
+}
+
+func invokeAs(tb testing.TB, t *DeviceMaintenanceChaincode, stub *memstub.Stub, caller []byte, function string, args ...string) []byte {
+	payload, err := invoke(t, stub, caller, function, args...)
+	if err != nil {
+		tb.Fatalf("%s %v failed: %s", function, args, err)
+	}
+	return payload
+}
+
+func queryAs(tb testing.TB, t *DeviceMaintenanceChaincode, stub *memstub.Stub, function string, args ...string) []byte {
+	payload, err := t.Query(stub, function, args)
+	if err != nil {
+		tb.Fatalf("%s %v failed: %s", function, args, err)
+	}
+	return payload
+}
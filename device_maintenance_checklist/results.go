@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+)
+
+// Outcomes of a check
+const (
+	outcomePass          = "pass"
+	outcomeFail          = "fail"
+	outcomeNotApplicable = "n/a"
+)
+
+// Tolerance is the range a measurement has to be in for the check to pass. Either
+// bound may be left out.
+type Tolerance struct {
+	Min *float64 `json:"min,omitempty"`
+	Max *float64 `json:"max,omitempty"`
+}
+
+// ResultDetails is what the performer of a check records about it. Evidence holds the
+// SHA-256 hashes, hex encoded, of photos or reports kept off chain.
+type ResultDetails struct {
+	Outcome     string     `json:"outcome,omitempty"`
+	Measurement *float64   `json:"measurement,omitempty"`
+	Unit        string     `json:"unit,omitempty"`
+	Tolerance   *Tolerance `json:"tolerance,omitempty"`
+	Findings    string     `json:"findings,omitempty"`
+	Evidence    []string   `json:"evidence,omitempty"`
+}
+
+// Returns whether the measurement is within the tolerance
+func (d *ResultDetails) inTolerance() bool {
+	if d.Measurement == nil || d.Tolerance == nil {
+		return true
+	}
+	if d.Tolerance.Min != nil && *d.Measurement < *d.Tolerance.Min {
+		return false
+	}
+	if d.Tolerance.Max != nil && *d.Measurement > *d.Tolerance.Max {
+		return false
+	}
+	return true
+}
+
+func (d *ResultDetails) validate() error {
+	if d.Outcome != outcomePass && d.Outcome != outcomeFail && d.Outcome != outcomeNotApplicable {
+		return fmt.Errorf("Invalid outcome %s, expected %s, %s or %s", d.Outcome, outcomePass, outcomeFail, outcomeNotApplicable)
+	}
+	if d.Measurement != nil && (math.IsNaN(*d.Measurement) || math.IsInf(*d.Measurement, 0)) {
+		return errors.New("Measurement must be a finite number")
+	}
+	if d.Measurement == nil && d.Unit != "" {
+		return errors.New("Unit given without a measurement")
+	}
+	if d.Tolerance != nil {
+		if d.Measurement == nil {
+			return errors.New("Tolerance given without a measurement")
+		}
+		if d.Tolerance.Min != nil && d.Tolerance.Max != nil && *d.Tolerance.Min > *d.Tolerance.Max {
+			return errors.New("Minimum of the tolerance is above its maximum")
+		}
+	}
+	if d.Outcome == outcomePass && !d.inTolerance() {
+		return errors.New("Measurement is out of tolerance, the check cannot pass")
+	}
+	for i, hash := range d.Evidence {
+		digest, err := hex.DecodeString(hash)
+		if err != nil || len(digest) != 32 {
+			return fmt.Errorf("Evidence %s is not a hex encoded SHA-256 hash", hash)
+		}
+		d.Evidence[i] = strings.ToLower(hash)
+	}
+	return nil
+}
+
+// Decodes and validates the result of a check given as JSON
+func parseResultDetails(value string) (ResultDetails, error) {
+	var details ResultDetails
+	err := json.Unmarshal([]byte(value), &details)
+	if err != nil {
+		return details, err
+	}
+	err = details.validate()
+	return details, err
+}
+
+// Encodes the details of a result for the Result column, empty until the check is complete
+func (r *CheckResult) encodeDetails() (string, error) {
+	if !r.Completed {
+		return "", nil
+	}
+	details, err := json.Marshal(r.ResultDetails)
+	if err != nil {
+		return "", err
+	}
+	return string(details), nil
+}
+
+func (r *CheckResult) decodeDetails(value string) error {
+	if value != "" {
+		err := json.Unmarshal([]byte(value), &r.ResultDetails)
+		if err != nil {
+			return fmt.Errorf("Invalid result of check %s: %s", r.Check, err)
+		}
+	}
+	// Checks completed before results were recorded only passed
+	if r.Completed && r.Outcome == "" {
+		r.Outcome = outcomePass
+	}
+	return nil
+}
@@ -0,0 +1,385 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+const day = 24 * time.Hour
+
+// Longest interval in days, a century, so due dates stay within the range of a time
+const maxDays = 36500
+
+// Most operating hours, a century of continuous operation, so sums of hours cannot
+// overflow
+const maxHours = 876600
+
+// MaintenanceSchedule is when a device is due for maintenance: a number of days and/or
+// of operating hours after its last service. The last service is the last signed off
+// service cycle, or the time the schedule was set if there was none since.
+type MaintenanceSchedule struct {
+	DeviceId         string `json:"device_id"`
+	IntervalDays     int64  `json:"interval_days,omitempty"`
+	IntervalHours    int64  `json:"interval_hours,omitempty"`
+	OperatingHours   int64  `json:"operating_hours"`
+	LastServiceAt    string `json:"last_service_at"`
+	LastServiceHours int64  `json:"last_service_hours"`
+	NextDueAt        string `json:"next_due_at,omitempty"`
+	NextDueHours     int64  `json:"next_due_hours,omitempty"`
+	Overdue          bool   `json:"overdue"`
+
+	lastServiceAt int64
+}
+
+// Returns when the device is next due by calendar, 0 without a calendar interval
+func (s *MaintenanceSchedule) dueAt() int64 {
+	if s.IntervalDays == 0 {
+		return 0
+	}
+	return s.lastServiceAt + s.IntervalDays*int64(day/time.Second)
+}
+
+// Returns the operating hours the device is next due at, 0 without an hours interval
+func (s *MaintenanceSchedule) dueHours() int64 {
+	if s.IntervalHours == 0 {
+		return 0
+	}
+	return s.LastServiceHours + s.IntervalHours
+}
+
+// Returns whether the device is due within the given time and operating hours from now
+func (s *MaintenanceSchedule) dueWithin(now time.Time, within time.Duration, hours int64) bool {
+	dueAt := s.dueAt()
+	if dueAt != 0 && now.Add(within).Unix() >= dueAt {
+		return true
+	}
+	dueHours := s.dueHours()
+	return dueHours != 0 && s.OperatingHours+hours >= dueHours
+}
+
+func (t *DeviceMaintenanceChaincode) scheduleRow(schedule MaintenanceSchedule) shim.Row {
+	return shim.Row{
+		Columns: []*shim.Column{
+			&shim.Column{Value: &shim.Column_String_{String_: schedule.DeviceId}},
+			&shim.Column{Value: &shim.Column_Int64{Int64: schedule.IntervalDays}},
+			&shim.Column{Value: &shim.Column_Int64{Int64: schedule.IntervalHours}},
+			&shim.Column{Value: &shim.Column_Int64{Int64: schedule.OperatingHours}},
+			&shim.Column{Value: &shim.Column_Int64{Int64: schedule.lastServiceAt}},
+			&shim.Column{Value: &shim.Column_Int64{Int64: schedule.LastServiceHours}},
+		},
+	}
+}
+
+// Reads a schedule row, with the next due date and hours of the device as of now
+func (t *DeviceMaintenanceChaincode) extractSchedule(row shim.Row, now time.Time) MaintenanceSchedule {
+	schedule := MaintenanceSchedule{
+		DeviceId:         row.Columns[0].GetString_(),
+		IntervalDays:     row.Columns[1].GetInt64(),
+		IntervalHours:    row.Columns[2].GetInt64(),
+		OperatingHours:   row.Columns[3].GetInt64(),
+		LastServiceAt:    formatTime(row.Columns[4].GetInt64()),
+		LastServiceHours: row.Columns[5].GetInt64(),
+		lastServiceAt:    row.Columns[4].GetInt64(),
+	}
+	schedule.NextDueAt = formatTime(schedule.dueAt())
+	schedule.NextDueHours = schedule.dueHours()
+	schedule.Overdue = schedule.dueWithin(now, 0, 0)
+	return schedule
+}
+
+// Returns the maintenance schedule of a device, nil if it has none
+func (t *DeviceMaintenanceChaincode) getSchedule(stub shim.ChaincodeStubInterface, deviceId string) (*MaintenanceSchedule, error) {
+	var columns []shim.Column
+	col := shim.Column{Value: &shim.Column_String_{String_: deviceId}}
+	columns = append(columns, col)
+
+	row, err := stub.GetRow(schedulesTable, columns)
+	if err != nil {
+		logger.Errorf("Error in getting maintenance schedule:%s", err.Error())
+		return nil, errors.New("Error in fetching maintenance schedule")
+	}
+	if len(row.Columns) == 0 {
+		return nil, nil
+	}
+	now, err := txTime(stub)
+	if err != nil {
+		return nil, err
+	}
+	schedule := t.extractSchedule(row, now)
+	return &schedule, nil
+}
+
+func (t *DeviceMaintenanceChaincode) deleteSchedule(stub shim.ChaincodeStubInterface, deviceId string) error {
+	var columns []shim.Column
+	col := shim.Column{Value: &shim.Column_String_{String_: deviceId}}
+	columns = append(columns, col)
+	return stub.DeleteRow(schedulesTable, columns)
+}
+
+// Starts the maintenance schedule of a device over from a service signed off now
+func (t *DeviceMaintenanceChaincode) recordService(stub shim.ChaincodeStubInterface, deviceId string, now time.Time) error {
+	schedule, err := t.getSchedule(stub, deviceId)
+	if err != nil || schedule == nil {
+		return err
+	}
+	schedule.lastServiceAt = now.Unix()
+	schedule.LastServiceHours = schedule.OperatingHours
+	ok, err := stub.ReplaceRow(schedulesTable, t.scheduleRow(*schedule))
+	if !ok || err != nil {
+		return fmt.Errorf("Error in updating maintenance schedule of device %s: %s", deviceId, err)
+	}
+	logger.Infof("Device %s next due at %s or %d operating hours", deviceId, formatTime(schedule.dueAt()), schedule.dueHours())
+	return nil
+}
+
+// Parses a count of days or hours, which cannot be negative
+func parseCount(value string) (int64, error) {
+	count, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || count < 0 {
+		logger.Errorf("Invalid value of count:%s", value)
+		return 0, fmt.Errorf("Invalid value of count:%s", value)
+	}
+	return count, nil
+}
+
+// Parses a count of days, which cannot be negative or more than maxDays
+func parseDays(value string) (int64, error) {
+	days, err := parseCount(value)
+	if err != nil {
+		return 0, err
+	}
+	if days > maxDays {
+		logger.Errorf("Days %d exceed the maximum of %d", days, maxDays)
+		return 0, fmt.Errorf("Invalid value of days:%s, at most %d", value, maxDays)
+	}
+	return days, nil
+}
+
+// Parses a count of operating hours, which cannot be negative or more than maxHours
+func parseHours(value string) (int64, error) {
+	hours, err := parseCount(value)
+	if err != nil {
+		return 0, err
+	}
+	if hours > maxHours {
+		logger.Errorf("Hours %d exceed the maximum of %d", hours, maxHours)
+		return 0, fmt.Errorf("Invalid value of hours:%s, at most %d", value, maxHours)
+	}
+	return hours, nil
+}
+
+// Sets the maintenance interval of a device in days and in operating hours, 0 for no
+// interval of the kind. With neither the device has no schedule. Only owner can do it.
+func (t *DeviceMaintenanceChaincode) setMaintenanceInterval(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	logger.Info("In setMaintenanceInterval function")
+	if len(args) != 3 {
+		logger.Error("Incorrect number of arguments")
+		return nil, errors.New("Incorrect number of arguments. Specify device id, the interval in days and the interval in operating hours.")
+	}
+
+	deviceId := args[0]
+	days, err := parseDays(args[1])
+	if err != nil {
+		return nil, err
+	}
+	hours, err := parseHours(args[2])
+	if err != nil {
+		return nil, err
+	}
+
+	device, err := t.getDevice(stub, deviceId)
+	if err != nil {
+		logger.Errorf("Failed fetching device: [%s]", err)
+		return nil, fmt.Errorf("Failed fetching device [%s]", err)
+	}
+	err = t.checkDeviceOwner(stub, device)
+	if err != nil {
+		return nil, err
+	}
+
+	schedule, err := t.getSchedule(stub, deviceId)
+	if err != nil {
+		return nil, err
+	}
+	if days == 0 && hours == 0 {
+		err = t.deleteSchedule(stub, deviceId)
+		if err != nil {
+			logger.Errorf("Error in removing maintenance schedule:%s", err)
+			return nil, errors.New("Error in removing maintenance schedule")
+		}
+		logger.Infof("Removed maintenance schedule of device %s", deviceId)
+		return nil, nil
+	}
+
+	ok := false
+	if schedule != nil {
+		schedule.IntervalDays = days
+		schedule.IntervalHours = hours
+		ok, err = stub.ReplaceRow(schedulesTable, t.scheduleRow(*schedule))
+	} else {
+		var now time.Time
+		now, err = txTime(stub)
+		if err != nil {
+			return nil, err
+		}
+		schedule = &MaintenanceSchedule{
+			DeviceId:      deviceId,
+			IntervalDays:  days,
+			IntervalHours: hours,
+			lastServiceAt: now.Unix(),
+		}
+		ok, err = stub.InsertRow(schedulesTable, t.scheduleRow(*schedule))
+	}
+	if !ok || err != nil {
+		logger.Errorf("Error in setting maintenance interval:%s", err)
+		return nil, errors.New("Error in setting maintenance interval")
+	}
+	logger.Infof("Device %s is due every %d days and %d operating hours", deviceId, days, hours)
+
+	return nil, nil
+}
+
+// Records the operating hours meter reading of a device with a maintenance schedule.
+// Readings cannot go back. Only owner can do it.
+func (t *DeviceMaintenanceChaincode) reportOperatingHours(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	logger.Info("In reportOperatingHours function")
+	if len(args) != 2 {
+		logger.Error("Incorrect number of arguments")
+		return nil, errors.New("Incorrect number of arguments. Specify device id and its operating hours.")
+	}
+
+	deviceId := args[0]
+	hours, err := parseHours(args[1])
+	if err != nil {
+		return nil, err
+	}
+
+	device, err := t.getDevice(stub, deviceId)
+	if err != nil {
+		logger.Errorf("Failed fetching device: [%s]", err)
+		return nil, fmt.Errorf("Failed fetching device [%s]", err)
+	}
+	err = t.checkDeviceOwner(stub, device)
+	if err != nil {
+		return nil, err
+	}
+
+	schedule, err := t.getSchedule(stub, deviceId)
+	if err != nil {
+		return nil, err
+	}
+	if schedule == nil {
+		logger.Errorf("No maintenance schedule for device %s", deviceId)
+		return nil, fmt.Errorf("No maintenance schedule for device %s", deviceId)
+	}
+	if hours < schedule.OperatingHours {
+		logger.Errorf("Operating hours %d of device %s are below the last reported %d", hours, deviceId, schedule.OperatingHours)
+		return nil, fmt.Errorf("Operating hours of device %s cannot go back from %d", deviceId, schedule.OperatingHours)
+	}
+
+	schedule.OperatingHours = hours
+	ok, err := stub.ReplaceRow(schedulesTable, t.scheduleRow(*schedule))
+	if !ok || err != nil {
+		logger.Errorf("Error in reporting operating hours:%s", err)
+		return nil, errors.New("Error in reporting operating hours")
+	}
+	logger.Infof("Device %s has run %d hours", deviceId, hours)
+
+	return nil, nil
+}
+
+// Return the maintenance schedule of a device
+func (t *DeviceMaintenanceChaincode) maintenanceSchedule(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	logger.Info("In maintenanceSchedule function")
+	if len(args) != 1 {
+		logger.Error("Incorrect number of arguments")
+		return nil, errors.New("Incorrect number of arguments. Specify device id.")
+	}
+
+	schedule, err := t.getSchedule(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	if schedule == nil {
+		logger.Errorf("No maintenance schedule for device %s", args[0])
+		return nil, fmt.Errorf("No maintenance schedule for device %s", args[0])
+	}
+
+	payload, err := json.Marshal(schedule)
+	if err != nil {
+		logger.Errorf("Failed marshalling payload: [%s]", err)
+		return nil, fmt.Errorf("Failed marshalling payload [%s]", err)
+	}
+
+	return payload, nil
+}
+
+// Returns the schedules of the devices due within the given time and operating hours,
+// either only those overdue already or only those not overdue yet
+func (t *DeviceMaintenanceChaincode) dueSchedules(stub shim.ChaincodeStubInterface, within time.Duration, hours int64, overdue bool) ([]byte, error) {
+	var columns []shim.Column
+	rowChannel, err := stub.GetRows(schedulesTable, columns)
+	if err != nil {
+		logger.Errorf("Error in getting rows:%s", err.Error())
+		return nil, errors.New("Error in fetching rows")
+	}
+	now, err := txTime(stub)
+	if err != nil {
+		return nil, err
+	}
+	schedules := make([]MaintenanceSchedule, 0)
+	for row := range rowChannel {
+		schedule := t.extractSchedule(row, now)
+		if schedule.Overdue == overdue && schedule.dueWithin(now, within, hours) {
+			schedules = append(schedules, schedule)
+		}
+	}
+
+	payload, err := json.Marshal(schedules)
+	if err != nil {
+		logger.Errorf("Failed marshalling payload: [%s]", err)
+		return nil, fmt.Errorf("Failed marshalling payload [%s]", err)
+	}
+
+	return payload, nil
+}
+
+// Return the devices that are not overdue but due within a number of days and optionally
+// of operating hours
+func (t *DeviceMaintenanceChaincode) devicesDueSoon(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	logger.Info("In devicesDueSoon function")
+	if len(args) != 1 && len(args) != 2 {
+		logger.Error("Incorrect number of arguments")
+		return nil, errors.New("Incorrect number of arguments. Specify the days and optionally the operating hours.")
+	}
+
+	days, err := parseDays(args[0])
+	if err != nil {
+		return nil, err
+	}
+	var hours int64
+	if len(args) == 2 {
+		hours, err = parseHours(args[1])
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return t.dueSchedules(stub, time.Duration(days)*day, hours, false)
+}
+
+// Return the devices overdue for maintenance
+func (t *DeviceMaintenanceChaincode) overdueDevices(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	logger.Info("In overdueDevices function")
+	if len(args) > 0 {
+		logger.Error("Incorrect number of arguments")
+		return nil, errors.New("Incorrect number of arguments. No arguments required")
+	}
+
+	return t.dueSchedules(stub, 0, 0, true)
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/predix/chaincode_example/energy_trading/memstub"
+)
+
+// Enrolls device d1 of the test owner against a template with a single check of the owner
+func enrollScheduled(t *testing.T, cc *DeviceMaintenanceChaincode, stub *memstub.Stub) {
+	checks, _ := json.Marshal([]CheckDefinition{{Name: "check1", Owner: testOwner}})
+	invokeAs(t, cc, stub, testAdmin, "createTemplate", "scheduled", string(checks))
+	invokeAs(t, cc, stub, testAdmin, "enroll", "d1", base64.StdEncoding.EncodeToString([]byte("key")), base64.StdEncoding.EncodeToString(testOwner), "scheduled")
+}
+
+func TestDevicesDueSoonBoundsDays(t *testing.T) {
+	cc, stub := newTestChaincode(t)
+	enrollScheduled(t, cc, stub)
+	invokeAs(t, cc, stub, testOwner, "setMaintenanceInterval", "d1", "30", "100")
+	invokeAs(t, cc, stub, testOwner, "reportOperatingHours", "d1", "90")
+
+	for _, args := range [][]string{{"d1", "36501", "0"}, {"d1", "0", "876601"}} {
+		_, err := invoke(cc, stub, testOwner, "setMaintenanceInterval", args...)
+		if err == nil || !strings.HasPrefix(err.Error(), "Invalid value of") {
+			t.Errorf("Interval %v beyond the maximum returned %v", args[1:], err)
+		}
+	}
+	// Used to overflow the hours next due at and never be due
+	_, err := invoke(cc, stub, testOwner, "reportOperatingHours", "d1", "9223372036854775807")
+	if err == nil || !strings.HasPrefix(err.Error(), "Invalid value of hours:9223372036854775807") {
+		t.Errorf("Operating hours beyond the maximum returned %v", err)
+	}
+
+	tests := []struct {
+		args []string
+		due  int
+		err  string
+	}{
+		{args: []string{"29"}, due: 0},
+		{args: []string{"30"}, due: 1},
+		{args: []string{"36500"}, due: 1},
+		{args: []string{"0", "9"}, due: 0},
+		{args: []string{"0", "10"}, due: 1},
+		{args: []string{"0", "876600"}, due: 1},
+		// Used to overflow the duration and report nothing due
+		{args: []string{"106751"}, err: "Invalid value of days:106751"},
+		{args: []string{"9223372036854775807"}, err: "Invalid value of days:9223372036854775807"},
+		// Used to overflow the hours and report nothing due
+		{args: []string{"0", "9223372036854775807"}, err: "Invalid value of hours:9223372036854775807"},
+	}
+	for _, test := range tests {
+		payload, err := cc.Query(stub, "devicesDueSoon", test.args)
+		if test.err != "" {
+			if err == nil || !strings.HasPrefix(err.Error(), test.err) {
+				t.Errorf("Due within %v returned %v, want %s", test.args, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		var schedules []MaintenanceSchedule
+		err = json.Unmarshal(payload, &schedules)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(schedules) != test.due {
+			t.Errorf("%d devices due within %v, want %d", len(schedules), test.args, test.due)
+		}
+	}
+}
+
+// Signoff starts the schedule over from the time of the transaction and the hours last
+// reported
+func TestSignoffRecomputesNextDue(t *testing.T) {
+	cc, stub := newTestChaincode(t)
+	enrollScheduled(t, cc, stub)
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	stub.Now = start
+	invokeAs(t, cc, stub, testOwner, "setMaintenanceInterval", "d1", "30", "100")
+
+	stub.Now = start.Add(40 * day)
+	invokeAs(t, cc, stub, testOwner, "reportOperatingHours", "d1", "120")
+	var overdue []MaintenanceSchedule
+	err := json.Unmarshal(queryAs(t, cc, stub, "overdueDevices"), &overdue)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(overdue) != 1 {
+		t.Fatalf("%d devices overdue, want 1", len(overdue))
+	}
+
+	invokeAs(t, cc, stub, testOwner, "startServiceCycle", "d1", "s1")
+	invokeAs(t, cc, stub, testOwner, "markCheckComplete", "d1", "s1", "check1")
+	invokeAs(t, cc, stub, testOwner, "signoff", "d1", "s1")
+
+	var schedule MaintenanceSchedule
+	err = json.Unmarshal(queryAs(t, cc, stub, "maintenanceSchedule", "d1"), &schedule)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signedOff := start.Add(40 * day)
+	if schedule.LastServiceAt != formatTime(signedOff.Unix()) || schedule.NextDueAt != formatTime(signedOff.Add(30*day).Unix()) {
+		t.Errorf("Schedule after signoff serviced at %s, next due at %s", schedule.LastServiceAt, schedule.NextDueAt)
+	}
+	if schedule.LastServiceHours != 120 || schedule.NextDueHours != 220 || schedule.Overdue {
+		t.Errorf("Schedule after signoff %+v", schedule)
+	}
+}
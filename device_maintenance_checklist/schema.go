@@ -0,0 +1,489 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// Version of the table layout written by this chaincode. Deployments without a
+// schema_version in state predate versioning and are at version 1.
+const currentSchemaVersion = 10
+
+// A migration upgrades the tables from one schema version to the next
+type migration func(t *DeviceMaintenanceChaincode, stub shim.ChaincodeStubInterface) error
+
+// The migration at index i takes the tables from version i+1 to i+2
+var migrations = []migration{
+	(*DeviceMaintenanceChaincode).migrateChecklistTemplates,
+	(*DeviceMaintenanceChaincode).migrateCheckResults,
+	(*DeviceMaintenanceChaincode).migrateServiceCycles,
+	(*DeviceMaintenanceChaincode).migrateOwnershipHistory,
+	(*DeviceMaintenanceChaincode).migrateAdmins,
+	// Version 7 only adds the archive tables
+	(*DeviceMaintenanceChaincode).createTables,
+	(*DeviceMaintenanceChaincode).migrateSelfTests,
+	(*DeviceMaintenanceChaincode).migrateCheckPerformers,
+	// Version 10 only adds the maintenance schedules
+	(*DeviceMaintenanceChaincode).createTables,
+}
+
+// An empty ledger has neither a schema version nor the device table. Init records the
+// current version only then; tables left by an earlier deploy wait for migrate.
+func (t *DeviceMaintenanceChaincode) isFreshDeploy(stub shim.ChaincodeStubInterface) (bool, error) {
+	versionStr, err := stub.GetState("schema_version")
+	if err != nil {
+		logger.Error("Failed to retrieve schema version")
+		return false, errors.New("Failed to retrieve schema version")
+	}
+	if len(versionStr) > 0 {
+		return false, nil
+	}
+	_, err = stub.GetTable(deviceChecksOwnerMapTable)
+	if err == shim.ErrTableNotFound {
+		return true, nil
+	}
+	if err != nil {
+		logger.Errorf("Error in fetching table %s: %s", deviceChecksOwnerMapTable, err)
+		return false, fmt.Errorf("Error in fetching table %s: %s", deviceChecksOwnerMapTable, err)
+	}
+	return false, nil
+}
+
+func (t *DeviceMaintenanceChaincode) getSchemaVersion(stub shim.ChaincodeStubInterface) (int64, error) {
+	versionStr, err := stub.GetState("schema_version")
+	if err != nil {
+		logger.Error("Failed to retrieve schema version")
+		return 0, errors.New("Failed to retrieve schema version")
+	}
+	if len(versionStr) == 0 {
+		return 1, nil
+	}
+	version, err := strconv.ParseInt(string(versionStr), 10, 64)
+	if err != nil {
+		logger.Errorf("Invalid value %s for schema version", versionStr)
+		return 0, errors.New("Invalid value for schema version")
+	}
+	return version, nil
+}
+
+// Moves the three fixed checks of every device into a checklist template of its own,
+// named device-<id>, with the checks check1, check2 and check3. The device and service
+// tables lose their check columns, so they are read, dropped and written again.
+func (t *DeviceMaintenanceChaincode) migrateChecklistTemplates(stub shim.ChaincodeStubInterface) error {
+	table, err := stub.GetTable(deviceChecksOwnerMapTable)
+	if err != nil {
+		return fmt.Errorf("Error in fetching table %s: %s", deviceChecksOwnerMapTable, err)
+	}
+	if len(table.ColumnDefinitions) != 6 {
+		return t.createTables(stub)
+	}
+
+	checkNames := []string{"check1", "check2", "check3"}
+
+	var columns []shim.Column
+	rowChannel, err := stub.GetRows(deviceChecksOwnerMapTable, columns)
+	if err != nil {
+		return fmt.Errorf("Error in fetching rows: %s", err)
+	}
+	devices := make([]shim.Row, 0)
+	for row := range rowChannel {
+		devices = append(devices, row)
+	}
+	rowChannel, err = stub.GetRows(deviceServiceTable, columns)
+	if err != nil {
+		return fmt.Errorf("Error in fetching rows: %s", err)
+	}
+	services := make([]shim.Row, 0)
+	for row := range rowChannel {
+		services = append(services, row)
+	}
+
+	err = stub.DeleteTable(deviceChecksOwnerMapTable)
+	if err != nil {
+		return fmt.Errorf("Error in deleting table %s: %s", deviceChecksOwnerMapTable, err)
+	}
+	err = stub.DeleteTable(deviceServiceTable)
+	if err != nil {
+		return fmt.Errorf("Error in deleting table %s: %s", deviceServiceTable, err)
+	}
+	err = t.createTables(stub)
+	if err != nil {
+		return err
+	}
+
+	for _, row := range devices {
+		device := Device{
+			Id:        row.Columns[0].GetString_(),
+			PublicKey: row.Columns[1].GetBytes(),
+			Owner:     row.Columns[2].GetBytes(),
+			Template:  "device-" + row.Columns[0].GetString_(),
+		}
+		template := ChecklistTemplate{Name: device.Template}
+		for i, name := range checkNames {
+			template.Checks = append(template.Checks, CheckDefinition{Name: name, Owner: row.Columns[3+i].GetBytes()})
+		}
+		logger.Debugf("Adding template %s", template.Name)
+		ok, err := t.insertTemplate(stub, template)
+		if !ok || err != nil {
+			return fmt.Errorf("Error in adding template %s: %s", template.Name, err)
+		}
+		ok, err = stub.InsertRow(deviceChecksOwnerMapTable, t.deviceRow(device))
+		if !ok || err != nil {
+			return fmt.Errorf("Error in adding device %s: %s", device.Id, err)
+		}
+	}
+
+	for _, row := range services {
+		record := DeviceServiceRecord{
+			DeviceId:  row.Columns[0].GetString_(),
+			ServiceId: row.Columns[1].GetString_(),
+		}
+		for i, name := range checkNames {
+			record.Checks = append(record.Checks, CheckResult{Check: name, Completed: row.Columns[2+i].GetBool()})
+		}
+		record.State = legacyCycleState(row.Columns[5].GetBool(), &record)
+		ok, err := stub.InsertRow(deviceServiceTable, t.serviceRow(record))
+		if !ok || err != nil {
+			return fmt.Errorf("Error in adding service record %s of device %s: %s", record.ServiceId, record.DeviceId, err)
+		}
+		for i, result := range record.Checks {
+			row, err := t.checkResultRow(record.DeviceId, record.ServiceId, int64(i), result)
+			if err == nil {
+				ok, err = stub.InsertRow(checkResultsTable, row)
+			}
+			if !ok || err != nil {
+				return fmt.Errorf("Error in adding check %s of service record %s: %s", result.Check, record.ServiceId, err)
+			}
+		}
+	}
+	return nil
+}
+
+// Adds the Result column to the check results. Results completed before it are read
+// as passed.
+func (t *DeviceMaintenanceChaincode) migrateCheckResults(stub shim.ChaincodeStubInterface) error {
+	table, err := stub.GetTable(checkResultsTable)
+	if err != nil {
+		return fmt.Errorf("Error in fetching table %s: %s", checkResultsTable, err)
+	}
+	if len(table.ColumnDefinitions) != 5 {
+		return nil
+	}
+
+	var columns []shim.Column
+	rowChannel, err := stub.GetRows(checkResultsTable, columns)
+	if err != nil {
+		return fmt.Errorf("Error in fetching rows: %s", err)
+	}
+	rows := make([]shim.Row, 0)
+	for row := range rowChannel {
+		rows = append(rows, row)
+	}
+
+	err = stub.DeleteTable(checkResultsTable)
+	if err != nil {
+		return fmt.Errorf("Error in deleting table %s: %s", checkResultsTable, err)
+	}
+	err = t.createTables(stub)
+	if err != nil {
+		return err
+	}
+
+	// The table is created in its latest layout, which also records the performer
+	for _, row := range rows {
+		row.Columns = append(row.Columns,
+			&shim.Column{Value: &shim.Column_String_{String_: ""}},
+			&shim.Column{Value: &shim.Column_Bytes{Bytes: nil}})
+		ok, err := stub.InsertRow(checkResultsTable, row)
+		if !ok || err != nil {
+			return fmt.Errorf("Error in adding result of check %s: %s", row.Columns[2].GetString_(), err)
+		}
+	}
+	return nil
+}
+
+// State of a service cycle recorded before cycles had states
+func legacyCycleState(signoff bool, record *DeviceServiceRecord) string {
+	if signoff {
+		return cycleSignedOff
+	}
+	return record.progress()
+}
+
+// Replaces the signoff flag of the service records with the state of the cycle and
+// records the open cycle of every device. Devices used to have any number of open
+// cycles; all but the last one, in the order of their ids, are aborted.
+func (t *DeviceMaintenanceChaincode) migrateServiceCycles(stub shim.ChaincodeStubInterface) error {
+	table, err := stub.GetTable(deviceServiceTable)
+	if err != nil {
+		return fmt.Errorf("Error in fetching table %s: %s", deviceServiceTable, err)
+	}
+	if len(table.ColumnDefinitions) == 3 {
+		var columns []shim.Column
+		rowChannel, err := stub.GetRows(deviceServiceTable, columns)
+		if err != nil {
+			return fmt.Errorf("Error in fetching rows: %s", err)
+		}
+		rows := make([]shim.Row, 0)
+		for row := range rowChannel {
+			rows = append(rows, row)
+		}
+
+		err = stub.DeleteTable(deviceServiceTable)
+		if err != nil {
+			return fmt.Errorf("Error in deleting table %s: %s", deviceServiceTable, err)
+		}
+		err = t.createTables(stub)
+		if err != nil {
+			return err
+		}
+
+		for _, row := range rows {
+			record := DeviceServiceRecord{
+				DeviceId:  row.Columns[0].GetString_(),
+				ServiceId: row.Columns[1].GetString_(),
+			}
+			record.Checks, err = t.getCheckResults(stub, record.DeviceId, record.ServiceId)
+			if err != nil {
+				return err
+			}
+			record.State = legacyCycleState(row.Columns[2].GetBool(), &record)
+			ok, err := stub.InsertRow(deviceServiceTable, t.serviceRow(record))
+			if !ok || err != nil {
+				return fmt.Errorf("Error in adding service record %s of device %s: %s", record.ServiceId, record.DeviceId, err)
+			}
+		}
+	} else {
+		err = t.createTables(stub)
+		if err != nil {
+			return err
+		}
+	}
+
+	records, err := t.getDeviceServiceRecords(stub, "")
+	if err != nil {
+		return err
+	}
+	open := make(map[string]int)
+	for i := range records {
+		if records[i].active() {
+			open[records[i].DeviceId] = i
+		}
+	}
+	for i, record := range records {
+		last, ok := open[record.DeviceId]
+		if !record.active() || !ok {
+			continue
+		}
+		if i == last {
+			openServiceId, err := t.getOpenCycle(stub, record.DeviceId)
+			if err != nil {
+				return err
+			}
+			if openServiceId == "" {
+				err = t.openCycle(stub, record.DeviceId, record.ServiceId)
+				if err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		logger.Debugf("Aborting service cycle %s of device %s", record.ServiceId, record.DeviceId)
+		record.State = cycleAborted
+		record.AbortReason = "Superseded by service cycle " + records[last].ServiceId
+		ok, err := stub.ReplaceRow(deviceServiceTable, t.serviceRow(record))
+		if !ok || err != nil {
+			return fmt.Errorf("Error in aborting service record %s of device %s: %s", record.ServiceId, record.DeviceId, err)
+		}
+	}
+	return nil
+}
+
+// Starts the ownership history of every device with its current owner, since an
+// unknown time
+func (t *DeviceMaintenanceChaincode) migrateOwnershipHistory(stub shim.ChaincodeStubInterface) error {
+	err := t.createTables(stub)
+	if err != nil {
+		return err
+	}
+
+	devices, err := t.getDevices(stub)
+	if err != nil {
+		return err
+	}
+	for _, device := range devices {
+		history, err := t.getOwnershipHistory(stub, device.Id)
+		if err != nil {
+			return err
+		}
+		if len(history) > 0 {
+			continue
+		}
+		logger.Debugf("Adding owner of device %s", device.Id)
+		err = t.recordOwner(stub, device.Id, device.Owner, 0)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Moves the single admin certificate in state into the admin set
+func (t *DeviceMaintenanceChaincode) migrateAdmins(stub shim.ChaincodeStubInterface) error {
+	err := t.createTables(stub)
+	if err != nil {
+		return err
+	}
+
+	adminCertificate, err := stub.GetState("admin")
+	if err != nil {
+		return fmt.Errorf("Failed getting admin certificate:%s", err.Error())
+	}
+	if len(adminCertificate) == 0 {
+		return nil
+	}
+	_, err = t.insertAdmin(stub, adminCertificate)
+	if err != nil {
+		return fmt.Errorf("Error in adding administrator: %s", err)
+	}
+	return stub.DelState("admin")
+}
+
+// Adds the self-test requirement to the templates, off for the existing ones
+func (t *DeviceMaintenanceChaincode) migrateSelfTests(stub shim.ChaincodeStubInterface) error {
+	table, err := stub.GetTable(templatesTable)
+	if err != nil {
+		return fmt.Errorf("Error in fetching table %s: %s", templatesTable, err)
+	}
+	if len(table.ColumnDefinitions) != 2 {
+		return t.createTables(stub)
+	}
+
+	var columns []shim.Column
+	rowChannel, err := stub.GetRows(templatesTable, columns)
+	if err != nil {
+		return fmt.Errorf("Error in fetching rows: %s", err)
+	}
+	rows := make([]shim.Row, 0)
+	for row := range rowChannel {
+		rows = append(rows, row)
+	}
+
+	err = stub.DeleteTable(templatesTable)
+	if err != nil {
+		return fmt.Errorf("Error in deleting table %s: %s", templatesTable, err)
+	}
+	err = t.createTables(stub)
+	if err != nil {
+		return err
+	}
+
+	for _, row := range rows {
+		row.Columns = append(row.Columns, &shim.Column{Value: &shim.Column_Bool{Bool: false}})
+		ok, err := stub.InsertRow(templatesTable, row)
+		if !ok || err != nil {
+			return fmt.Errorf("Error in adding template %s: %s", row.Columns[0].GetString_(), err)
+		}
+	}
+	return nil
+}
+
+// Adds the performer to the check results and creates the delegations table. Checks
+// completed before have no performer recorded.
+func (t *DeviceMaintenanceChaincode) migrateCheckPerformers(stub shim.ChaincodeStubInterface) error {
+	table, err := stub.GetTable(checkResultsTable)
+	if err != nil {
+		return fmt.Errorf("Error in fetching table %s: %s", checkResultsTable, err)
+	}
+	if len(table.ColumnDefinitions) != 6 {
+		return t.createTables(stub)
+	}
+
+	var columns []shim.Column
+	rowChannel, err := stub.GetRows(checkResultsTable, columns)
+	if err != nil {
+		return fmt.Errorf("Error in fetching rows: %s", err)
+	}
+	rows := make([]shim.Row, 0)
+	for row := range rowChannel {
+		rows = append(rows, row)
+	}
+
+	err = stub.DeleteTable(checkResultsTable)
+	if err != nil {
+		return fmt.Errorf("Error in deleting table %s: %s", checkResultsTable, err)
+	}
+	err = t.createTables(stub)
+	if err != nil {
+		return err
+	}
+
+	for _, row := range rows {
+		row.Columns = append(row.Columns, &shim.Column{Value: &shim.Column_Bytes{Bytes: nil}})
+		ok, err := stub.InsertRow(checkResultsTable, row)
+		if !ok || err != nil {
+			return fmt.Errorf("Error in adding result of check %s: %s", row.Columns[2].GetString_(), err)
+		}
+	}
+	return nil
+}
+
+// Upgrades the tables to the schema version of this chaincode, running the migrations
+// of every version in between. Only the administrator can do it.
+func (t *DeviceMaintenanceChaincode) migrate(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	logger.Info("In migrate function")
+	if len(args) > 0 {
+		logger.Error("Incorrect number of arguments")
+		return nil, errors.New("Incorrect number of arguments. No arguments necessary")
+	}
+
+	err := t.checkAdmin(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	version, err := t.getSchemaVersion(stub)
+	if err != nil {
+		return nil, err
+	}
+	if version > currentSchemaVersion {
+		logger.Errorf("Schema version %d is newer than %d", version, currentSchemaVersion)
+		return nil, fmt.Errorf("Schema version %d is newer than this chaincode supports (%d)", version, currentSchemaVersion)
+	}
+
+	for ; version < currentSchemaVersion; version++ {
+		logger.Infof("Migrating schema from version %d to %d", version, version+1)
+		err = migrations[version-1](t, stub)
+		if err != nil {
+			logger.Errorf("Failed migrating schema to version %d: %s", version+1, err)
+			return nil, fmt.Errorf("Failed migrating schema to version %d: %s", version+1, err)
+		}
+		err = stub.PutState("schema_version", []byte(strconv.FormatInt(version+1, 10)))
+		if err != nil {
+			logger.Errorf("Error saving schema version %s", err.Error())
+			return nil, errors.New("Schema version cannot be saved")
+		}
+	}
+	logger.Infof("Schema is at version %d", version)
+
+	return nil, nil
+}
+
+// Return the schema version of the tables
+func (t *DeviceMaintenanceChaincode) schemaVersion(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	logger.Info("In schemaVersion function")
+	if len(args) > 0 {
+		logger.Error("Incorrect number of arguments")
+		return nil, errors.New("Incorrect number of arguments. No arguments necessary")
+	}
+
+	version, err := t.getSchemaVersion(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	return []byte(strconv.FormatInt(version, 10)), nil
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bytes"
+	"strconv"
+	"testing"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/predix/chaincode_example/energy_trading/memstub"
+)
+
+// Loads the ledger of a version 1 deploy: devices with three fixed check owners,
+// service records with three check flags and a signoff, and the single admin in state
+func loadVersion1(tb testing.TB, stub *memstub.Stub) {
+	err := stub.CreateTable(deviceChecksOwnerMapTable, []*shim.ColumnDefinition{
+		&shim.ColumnDefinition{Name: "DeviceId", Type: shim.ColumnDefinition_STRING, Key: true},
+		&shim.ColumnDefinition{Name: "PublicKey", Type: shim.ColumnDefinition_BYTES, Key: false},
+		&shim.ColumnDefinition{Name: "Owner", Type: shim.ColumnDefinition_BYTES, Key: false},
+		&shim.ColumnDefinition{Name: "Check1", Type: shim.ColumnDefinition_BYTES, Key: false},
+		&shim.ColumnDefinition{Name: "Check2", Type: shim.ColumnDefinition_BYTES, Key: false},
+		&shim.ColumnDefinition{Name: "Check3", Type: shim.ColumnDefinition_BYTES, Key: false},
+	})
+	if err != nil {
+		tb.Fatal(err)
+	}
+	err = stub.CreateTable(deviceServiceTable, []*shim.ColumnDefinition{
+		&shim.ColumnDefinition{Name: "DeviceId", Type: shim.ColumnDefinition_STRING, Key: true},
+		&shim.ColumnDefinition{Name: "ServiceId", Type: shim.ColumnDefinition_STRING, Key: true},
+		&shim.ColumnDefinition{Name: "Check1", Type: shim.ColumnDefinition_BOOL, Key: false},
+		&shim.ColumnDefinition{Name: "Check2", Type: shim.ColumnDefinition_BOOL, Key: false},
+		&shim.ColumnDefinition{Name: "Check3", Type: shim.ColumnDefinition_BOOL, Key: false},
+		&shim.ColumnDefinition{Name: "SignOff", Type: shim.ColumnDefinition_BOOL, Key: false},
+	})
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	for _, deviceId := range []string{"d1", "d2"} {
+		ok, err := stub.InsertRow(deviceChecksOwnerMapTable, shim.Row{
+			Columns: []*shim.Column{
+				&shim.Column{Value: &shim.Column_String_{String_: deviceId}},
+				&shim.Column{Value: &shim.Column_Bytes{Bytes: []byte("key-" + deviceId)}},
+				&shim.Column{Value: &shim.Column_Bytes{Bytes: []byte("owner-" + deviceId)}},
+				&shim.Column{Value: &shim.Column_Bytes{Bytes: []byte("tech-a")}},
+				&shim.Column{Value: &shim.Column_Bytes{Bytes: []byte("tech-b")}},
+				&shim.Column{Value: &shim.Column_Bytes{Bytes: []byte("tech-c")}},
+			},
+		})
+		if !ok || err != nil {
+			tb.Fatalf("Failed loading device %s: %s", deviceId, err)
+		}
+	}
+
+	services := []struct {
+		deviceId, serviceId string
+		checks              [3]bool
+		signoff             bool
+	}{
+		{"d1", "s1", [3]bool{true, true, true}, true},
+		{"d1", "s2", [3]bool{true, false, false}, false},
+		{"d1", "s3", [3]bool{false, false, false}, false},
+		{"d2", "s1", [3]bool{true, true, true}, false},
+	}
+	for _, s := range services {
+		ok, err := stub.InsertRow(deviceServiceTable, shim.Row{
+			Columns: []*shim.Column{
+				&shim.Column{Value: &shim.Column_String_{String_: s.deviceId}},
+				&shim.Column{Value: &shim.Column_String_{String_: s.serviceId}},
+				&shim.Column{Value: &shim.Column_Bool{Bool: s.checks[0]}},
+				&shim.Column{Value: &shim.Column_Bool{Bool: s.checks[1]}},
+				&shim.Column{Value: &shim.Column_Bool{Bool: s.checks[2]}},
+				&shim.Column{Value: &shim.Column_Bool{Bool: s.signoff}},
+			},
+		})
+		if !ok || err != nil {
+			tb.Fatalf("Failed loading service %s of device %s: %s", s.serviceId, s.deviceId, err)
+		}
+	}
+	stub.PutState("admin", testAdmin)
+}
+
+func TestInitWritesSchemaVersionOnFreshDeploy(t *testing.T) {
+	cc, stub := newTestChaincode(t)
+	version, err := cc.getSchemaVersion(stub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != currentSchemaVersion {
+		t.Errorf("Schema version %d after deploy, want %d", version, currentSchemaVersion)
+	}
+}
+
+func TestMigrateFromVersion1(t *testing.T) {
+	logger.SetLevel(shim.LogError)
+	stub := memstub.New()
+	cc := new(DeviceMaintenanceChaincode)
+	loadVersion1(t, stub)
+
+	// Deploying the new chaincode over the old tables leaves the version to migrate
+	stub.Caller = testAdmin
+	_, err := cc.Init(stub, "init", nil)
+	if err != nil {
+		t.Fatalf("Init failed: %s", err)
+	}
+	version, err := cc.getSchemaVersion(stub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != 1 {
+		t.Fatalf("Schema version %d after deploying over version 1, want 1", version)
+	}
+
+	invokeAs(t, cc, stub, testAdmin, "migrate")
+
+	version, err = cc.getSchemaVersion(stub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != currentSchemaVersion {
+		t.Fatalf("Schema version %d after migrate, want %d", version, currentSchemaVersion)
+	}
+
+	// Every device gets a template of its own with the three checks and their owners
+	for _, deviceId := range []string{"d1", "d2"} {
+		device, err := cc.getDevice(stub, deviceId)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if device.Template != "device-"+deviceId || string(device.Owner) != "owner-"+deviceId || string(device.PublicKey) != "key-"+deviceId {
+			t.Errorf("Device %s: %+v", deviceId, device)
+		}
+		template, err := cc.getTemplate(stub, device.Template)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if template == nil || len(template.Checks) != 3 || template.RequireSelfTest {
+			t.Fatalf("Template of device %s: %+v", deviceId, template)
+		}
+		for i, owner := range []string{"tech-a", "tech-b", "tech-c"} {
+			check := template.Checks[i]
+			if check.Name != "check"+strconv.Itoa(i+1) || string(check.Owner) != owner {
+				t.Errorf("Check %d of template %s: %+v", i, template.Name, check)
+			}
+		}
+
+		history, err := cc.getOwnershipHistory(stub, deviceId)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(history) != 1 || string(history[0].Owner) != "owner-"+deviceId {
+			t.Errorf("Ownership history of device %s: %+v", deviceId, history)
+		}
+	}
+
+	// The signoff flag becomes the state of the cycle and only the last open cycle of
+	// a device stays open
+	states := []struct {
+		deviceId, serviceId, state, abortReason string
+	}{
+		{"d1", "s1", cycleSignedOff, ""},
+		{"d1", "s2", cycleAborted, "Superseded by service cycle s3"},
+		{"d1", "s3", cycleOpen, ""},
+		{"d2", "s1", cycleAwaitingSignoff, ""},
+	}
+	for _, want := range states {
+		record, err := cc.getDeviceServiceRecord(stub, want.deviceId, want.serviceId)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if record.State != want.state || record.AbortReason != want.abortReason {
+			t.Errorf("Service %s of device %s: state %s (%q), want %s (%q)", want.serviceId, want.deviceId, record.State, record.AbortReason, want.state, want.abortReason)
+		}
+	}
+	for deviceId, serviceId := range map[string]string{"d1": "s3", "d2": "s1"} {
+		open, err := cc.getOpenCycle(stub, deviceId)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if open != serviceId {
+			t.Errorf("Open cycle of device %s is %q, want %s", deviceId, open, serviceId)
+		}
+	}
+
+	// Check results are in the current layout, without performer
+	record, err := cc.getDeviceServiceRecord(stub, "d1", "s2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	completed := []bool{true, false, false}
+	if len(record.Checks) != 3 {
+		t.Fatalf("Checks of service s2: %+v", record.Checks)
+	}
+	for i, result := range record.Checks {
+		if result.Completed != completed[i] || result.PerformedBy != nil {
+			t.Errorf("Check %d of service s2: %+v", i, result)
+		}
+	}
+	rowChannel, err := stub.GetRows(checkResultsTable, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows := 0
+	for row := range rowChannel {
+		rows++
+		if len(row.Columns) != 7 {
+			t.Errorf("Check result %s has %d columns", row.Columns[2].GetString_(), len(row.Columns))
+		}
+	}
+	if rows != 12 {
+		t.Errorf("%d check results, want 12", rows)
+	}
+
+	// The single admin moved into the admin set
+	admins, err := cc.getAdmins(stub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(admins) != 1 || !bytes.Equal(admins[0].Certificate, testAdmin) {
+		t.Errorf("Admins: %+v", admins)
+	}
+	adminCertificate, err := stub.GetState("admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(adminCertificate) != 0 {
+		t.Error("Admin certificate left in state")
+	}
+}
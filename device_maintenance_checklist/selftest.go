@@ -0,0 +1,185 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/hyperledger/fabric/core/crypto/primitives"
+)
+
+// SelfTest is a self-test report of a device attached to a service cycle. The report is
+// kept as the device signed it.
+type SelfTest struct {
+	Report      string `json:"report"`
+	Signature   []byte `json:"signature"`
+	Passed      bool   `json:"passed"`
+	SubmittedAt string `json:"submitted_at"`
+}
+
+// Fields of a self-test report the chaincode reads, the device may add any others
+type selfTestReport struct {
+	DeviceId  string `json:"device_id"`
+	ServiceId string `json:"service_id"`
+	Passed    *bool  `json:"passed"`
+	Sequence  *int64 `json:"sequence"`
+}
+
+// Returns the sequence number of a stored report. Reports submitted before sequence
+// numbers were required count as zero.
+func (s *SelfTest) sequence() int64 {
+	var fields selfTestReport
+	if json.Unmarshal([]byte(s.Report), &fields) != nil || fields.Sequence == nil {
+		return 0
+	}
+	return *fields.Sequence
+}
+
+// Verifies an ECDSA signature of the message with the DER encoded public key of a device
+func verifyDeviceSignature(publicKey, message, signature []byte) (bool, error) {
+	key, err := primitives.DERToPublicKey(publicKey)
+	if err != nil {
+		return false, fmt.Errorf("Invalid public key of device: %s", err)
+	}
+	ecdsaKey, ok := key.(*ecdsa.PublicKey)
+	if !ok {
+		return false, errors.New("Public key of device is not an ECDSA key")
+	}
+	return primitives.ECDSAVerify(ecdsaKey, message, signature)
+}
+
+// Returns the self-test of a service cycle, nil if none was submitted
+func (t *DeviceMaintenanceChaincode) getSelfTest(stub shim.ChaincodeStubInterface, deviceId, serviceId string) (*SelfTest, error) {
+	var columns []shim.Column
+	col1 := shim.Column{Value: &shim.Column_String_{String_: deviceId}}
+	col2 := shim.Column{Value: &shim.Column_String_{String_: serviceId}}
+	columns = append(columns, col1, col2)
+
+	row, err := stub.GetRow(selfTestsTable, columns)
+	if err != nil {
+		logger.Errorf("Error in getting self-test:%s", err.Error())
+		return nil, errors.New("Error in fetching self-test")
+	}
+	if len(row.Columns) == 0 {
+		return nil, nil
+	}
+	return &SelfTest{
+		Report:      row.Columns[2].GetString_(),
+		Signature:   row.Columns[3].GetBytes(),
+		Passed:      row.Columns[4].GetBool(),
+		SubmittedAt: formatTime(row.Columns[5].GetInt64()),
+	}, nil
+}
+
+// Attaches a self-test report to an open service cycle of a device. The report is JSON
+// with the device_id, the service_id, whether the device passed and a sequence number,
+// signed by the device with the key it was enrolled with. A new report replaces the one
+// submitted before if its sequence number is higher, so a replayed report cannot.
+func (t *DeviceMaintenanceChaincode) submitSelfTest(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	logger.Info("In submitSelfTest function")
+	if len(args) != 4 {
+		logger.Error("Incorrect number of arguments")
+		return nil, errors.New("Incorrect number of arguments. Specify device id, service id, report and signature.")
+	}
+
+	deviceId := args[0]
+	serviceId := args[1]
+	report := args[2]
+	signature, err := base64.StdEncoding.DecodeString(args[3])
+	if err != nil {
+		logger.Error("Failed decoding signature")
+		return nil, errors.New("Failed decoding signature")
+	}
+
+	var fields selfTestReport
+	err = json.Unmarshal([]byte(report), &fields)
+	if err != nil {
+		logger.Errorf("Failed decoding report: [%s]", err)
+		return nil, fmt.Errorf("Failed decoding report [%s]", err)
+	}
+	if fields.DeviceId != deviceId || fields.ServiceId != serviceId {
+		logger.Error("Report is not for this service cycle")
+		return nil, fmt.Errorf("Report is not for service cycle %s of device %s", serviceId, deviceId)
+	}
+	if fields.Passed == nil {
+		logger.Error("Report does not say whether the device passed")
+		return nil, errors.New("Report does not say whether the device passed")
+	}
+	if fields.Sequence == nil {
+		logger.Error("Report has no sequence number")
+		return nil, errors.New("Report has no sequence number")
+	}
+
+	device, err := t.getDevice(stub, deviceId)
+	if err != nil {
+		logger.Errorf("Failed fetching device: [%s]", err)
+		return nil, fmt.Errorf("Failed fetching device [%s]", err)
+	}
+	if device.Id == "" {
+		logger.Errorf("Device %s not found", deviceId)
+		return nil, fmt.Errorf("Device %s not found", deviceId)
+	}
+
+	// The device signs the report, whoever submits it
+	ok, err := verifyDeviceSignature(device.PublicKey, []byte(report), signature)
+	if err != nil {
+		logger.Errorf("Failed checking device signature: [%s]", err)
+		return nil, fmt.Errorf("Failed checking device signature [%s]", err)
+	}
+	if !ok {
+		logger.Error("Invalid device signature")
+		return nil, errors.New("The report is not signed by the device")
+	}
+
+	deviceServiceRecord, err := t.getDeviceServiceRecord(stub, deviceId, serviceId)
+	if err != nil {
+		logger.Errorf("Failed fetching device service record: [%s]", err)
+		return nil, fmt.Errorf("Failed fetching device service record [%s]", err)
+	}
+	if deviceServiceRecord.ServiceId == "" {
+		logger.Errorf("No service record with id [%s] found for device %s", serviceId, deviceId)
+		return nil, fmt.Errorf("No service record with id [%s] found for device %s", serviceId, deviceId)
+	}
+	if !deviceServiceRecord.active() {
+		logger.Errorf("Service cycle %s of device %s is %s", serviceId, deviceId, deviceServiceRecord.State)
+		return nil, fmt.Errorf("Service cycle %s of device %s is %s", serviceId, deviceId, deviceServiceRecord.State)
+	}
+
+	existing, err := t.getSelfTest(stub, deviceId, serviceId)
+	if err != nil {
+		return nil, err
+	}
+	if existing != nil && *fields.Sequence <= existing.sequence() {
+		logger.Errorf("Report %d of device %s is not newer than report %d", *fields.Sequence, deviceId, existing.sequence())
+		return nil, fmt.Errorf("Report %d is not newer than the report %d submitted before", *fields.Sequence, existing.sequence())
+	}
+
+	now, err := txTime(stub)
+	if err != nil {
+		return nil, err
+	}
+	row := shim.Row{
+		Columns: []*shim.Column{
+			&shim.Column{Value: &shim.Column_String_{String_: deviceId}},
+			&shim.Column{Value: &shim.Column_String_{String_: serviceId}},
+			&shim.Column{Value: &shim.Column_String_{String_: report}},
+			&shim.Column{Value: &shim.Column_Bytes{Bytes: signature}},
+			&shim.Column{Value: &shim.Column_Bool{Bool: *fields.Passed}},
+			&shim.Column{Value: &shim.Column_Int64{Int64: now.Unix()}},
+		},
+	}
+	ok, err = stub.InsertRow(selfTestsTable, row)
+	if err == nil && !ok {
+		ok, err = stub.ReplaceRow(selfTestsTable, row)
+	}
+	if !ok || err != nil {
+		logger.Errorf("Error in submitting self-test:%s", err)
+		return nil, errors.New("Error in submitting self-test")
+	}
+	logger.Infof("Self-test of device %s attached to service cycle %s, passed: %t", deviceId, serviceId, *fields.Passed)
+
+	return nil, nil
+}
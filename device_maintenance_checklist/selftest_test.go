@@ -0,0 +1,103 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/hyperledger/fabric/core/crypto/primitives"
+	"github.com/predix/chaincode_example/energy_trading/memstub"
+)
+
+var testOwner = []byte("owner")
+
+// Enrolls device d1 with a new key against a template requiring a self-test and starts
+// service cycle s1. Returns the key of the device.
+func enrollSelfTesting(t *testing.T, cc *DeviceMaintenanceChaincode, stub *memstub.Stub) *ecdsa.PrivateKey {
+	err := primitives.InitSecurityLevel("SHA3", 256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := primitives.NewECDSAKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicKey, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checks, _ := json.Marshal([]CheckDefinition{{Name: "check1", Owner: testOwner}})
+	invokeAs(t, cc, stub, testAdmin, "createTemplate", "tested", string(checks), "true")
+	invokeAs(t, cc, stub, testAdmin, "enroll", "d1", base64.StdEncoding.EncodeToString(publicKey), base64.StdEncoding.EncodeToString(testOwner), "tested")
+	invokeAs(t, cc, stub, testOwner, "startServiceCycle", "d1", "s1")
+	return key
+}
+
+func submitSelfTest(t *testing.T, cc *DeviceMaintenanceChaincode, stub *memstub.Stub, key *ecdsa.PrivateKey, report string) error {
+	signature, err := primitives.ECDSASign(key, []byte(report))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = invoke(cc, stub, testOwner, "submitSelfTest", "d1", "s1", report, base64.StdEncoding.EncodeToString(signature))
+	return err
+}
+
+func signedReport(sequence int64, passed bool) string {
+	return fmt.Sprintf(`{"device_id":"d1","service_id":"s1","passed":%t,"sequence":%d}`, passed, sequence)
+}
+
+func TestSelfTestReplayRejected(t *testing.T) {
+	cc, stub := newTestChaincode(t)
+	key := enrollSelfTesting(t, cc, stub)
+
+	err := submitSelfTest(t, cc, stub, key, `{"device_id":"d1","service_id":"s1","passed":true}`)
+	if err == nil || err.Error() != "Report has no sequence number" {
+		t.Fatalf("Report without sequence number returned %v", err)
+	}
+
+	passed := signedReport(1, true)
+	err = submitSelfTest(t, cc, stub, key, passed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = submitSelfTest(t, cc, stub, key, signedReport(2, false))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The earlier passed report, as the device signed it, replayed over the failed one
+	err = submitSelfTest(t, cc, stub, key, passed)
+	if err == nil || !strings.HasPrefix(err.Error(), "Report 1 is not newer") {
+		t.Fatalf("Replayed report returned %v", err)
+	}
+	err = submitSelfTest(t, cc, stub, key, signedReport(2, true))
+	if err == nil {
+		t.Fatal("Report with the same sequence number accepted")
+	}
+
+	selfTest, err := cc.getSelfTest(stub, "d1", "s1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if selfTest == nil || selfTest.Passed || selfTest.Report != signedReport(2, false) {
+		t.Fatalf("Self-test %+v after replay", selfTest)
+	}
+	_, err = invoke(cc, stub, testOwner, "markCheckComplete", "d1", "s1", "check1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = invoke(cc, stub, testOwner, "signoff", "d1", "s1")
+	if err == nil || !strings.Contains(err.Error(), "No passed self-test") {
+		t.Errorf("Signoff with a failed self-test returned %v", err)
+	}
+
+	err = submitSelfTest(t, cc, stub, key, signedReport(3, true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	invokeAs(t, cc, stub, testOwner, "signoff", "d1", "s1")
+}
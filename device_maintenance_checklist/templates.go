@@ -0,0 +1,274 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// Certificate attribute holding the role of the caller
+const roleAttribute = "role"
+
+// CheckDefinition is one check of a checklist template. The check is performed either by
+// the holder of the owner certificate or by anyone whose certificate carries the role,
+// once the checks it names as prerequisites have passed in the same service cycle.
+type CheckDefinition struct {
+	Name          string   `json:"name"`
+	Owner         []byte   `json:"owner,omitempty"`
+	Role          string   `json:"role,omitempty"`
+	Prerequisites []string `json:"prerequisites,omitempty"`
+}
+
+// ChecklistTemplate is the list of checks a service cycle of a device goes through.
+// With RequireSelfTest a cycle is signed off only with a passed self-test of the device.
+type ChecklistTemplate struct {
+	Name            string            `json:"name"`
+	Checks          []CheckDefinition `json:"checks"`
+	RequireSelfTest bool              `json:"require_self_test"`
+}
+
+// Returns the definition of a check, nil if the template has no such check
+func (t *ChecklistTemplate) check(name string) *CheckDefinition {
+	for i := range t.Checks {
+		if t.Checks[i].Name == name {
+			return &t.Checks[i]
+		}
+	}
+	return nil
+}
+
+func (t *ChecklistTemplate) validate() error {
+	if t.Name == "" {
+		return errors.New("Template name cannot be empty")
+	}
+	if len(t.Checks) == 0 {
+		return errors.New("Template needs at least one check")
+	}
+	names := make(map[string]bool)
+	for _, check := range t.Checks {
+		if check.Name == "" {
+			return errors.New("Check name cannot be empty")
+		}
+		if names[check.Name] {
+			return fmt.Errorf("Duplicate check %s", check.Name)
+		}
+		names[check.Name] = true
+		if (len(check.Owner) == 0) == (check.Role == "") {
+			return fmt.Errorf("Check %s needs either an owner certificate or a role", check.Name)
+		}
+	}
+	for _, check := range t.Checks {
+		for _, prerequisite := range check.Prerequisites {
+			if !names[prerequisite] {
+				return fmt.Errorf("Prerequisite %s of check %s is not in the template", prerequisite, check.Name)
+			}
+		}
+	}
+	return t.checkDependencies()
+}
+
+// Fails if the prerequisites of the checks form a cycle, no check of which could ever be
+// performed
+func (t *ChecklistTemplate) checkDependencies() error {
+	const (
+		visiting = 1
+		visited  = 2
+	)
+	state := make(map[string]int)
+	var visit func(name string) error
+	visit = func(name string) error {
+		switch state[name] {
+		case visiting:
+			return fmt.Errorf("Check %s depends on itself through its prerequisites", name)
+		case visited:
+			return nil
+		}
+		state[name] = visiting
+		for _, prerequisite := range t.check(name).Prerequisites {
+			if err := visit(prerequisite); err != nil {
+				return err
+			}
+		}
+		state[name] = visited
+		return nil
+	}
+	for _, check := range t.Checks {
+		if err := visit(check.Name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t *DeviceMaintenanceChaincode) insertTemplate(stub shim.ChaincodeStubInterface, template ChecklistTemplate) (bool, error) {
+	checks, err := json.Marshal(template.Checks)
+	if err != nil {
+		return false, err
+	}
+	return stub.InsertRow(templatesTable, shim.Row{
+		Columns: []*shim.Column{
+			&shim.Column{Value: &shim.Column_String_{String_: template.Name}},
+			&shim.Column{Value: &shim.Column_String_{String_: string(checks)}},
+			&shim.Column{Value: &shim.Column_Bool{Bool: template.RequireSelfTest}},
+		},
+	})
+}
+
+func (t *DeviceMaintenanceChaincode) extractTemplate(row shim.Row) (ChecklistTemplate, error) {
+	template := ChecklistTemplate{
+		Name:            row.Columns[0].GetString_(),
+		RequireSelfTest: row.Columns[2].GetBool(),
+	}
+	err := json.Unmarshal([]byte(row.Columns[1].GetString_()), &template.Checks)
+	if err != nil {
+		return template, fmt.Errorf("Invalid checks of template %s: %s", template.Name, err)
+	}
+	return template, nil
+}
+
+// Returns a checklist template, nil if there is none with the name
+func (t *DeviceMaintenanceChaincode) getTemplate(stub shim.ChaincodeStubInterface, name string) (*ChecklistTemplate, error) {
+	var columns []shim.Column
+	col := shim.Column{Value: &shim.Column_String_{String_: name}}
+	columns = append(columns, col)
+
+	row, err := stub.GetRow(templatesTable, columns)
+	if err != nil {
+		logger.Errorf("Error in getting template:%s", err.Error())
+		return nil, errors.New("Error in fetching template")
+	}
+	if len(row.Columns) == 0 {
+		return nil, nil
+	}
+	template, err := t.extractTemplate(row)
+	if err != nil {
+		return nil, err
+	}
+	return &template, nil
+}
+
+// Checks that the caller may perform a check, either holding the owner certificate or
+// the role of the check
+func (t *DeviceMaintenanceChaincode) isCheckPerformer(stub shim.ChaincodeStubInterface, check *CheckDefinition) (bool, error) {
+	if len(check.Owner) > 0 {
+		return t.isCaller(stub, check.Owner)
+	}
+	// Verification fails with an error for certificates without the role attribute, their
+	// holders are not performers but may still act by delegation
+	ok, err := stub.VerifyAttribute(roleAttribute, []byte(check.Role))
+	if err != nil {
+		logger.Debugf("Caller does not hold role %s: %s", check.Role, err)
+		return false, nil
+	}
+	return ok, nil
+}
+
+// Creates a checklist template from a JSON list of checks, optionally requiring a passed
+// self-test of the device for signoff. Templates cannot be changed once created, devices
+// enrolled against them keep the same checks. Only admin can do it.
+func (t *DeviceMaintenanceChaincode) createTemplate(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	logger.Info("In createTemplate function")
+	if len(args) != 2 && len(args) != 3 {
+		logger.Error("Incorrect number of arguments")
+		return nil, errors.New("Incorrect number of arguments. Specify template name, the checks and optionally whether a self-test is required.")
+	}
+
+	template := ChecklistTemplate{Name: args[0]}
+	err := json.Unmarshal([]byte(args[1]), &template.Checks)
+	if err != nil {
+		logger.Errorf("Failed decoding checks: [%s]", err)
+		return nil, fmt.Errorf("Failed decoding checks [%s]", err)
+	}
+	if len(args) == 3 {
+		template.RequireSelfTest, err = strconv.ParseBool(args[2])
+		if err != nil {
+			logger.Errorf("Error in converting to bool:%s", err.Error())
+			return nil, fmt.Errorf("Invalid value of self-test requirement:%s", args[2])
+		}
+	}
+	err = template.validate()
+	if err != nil {
+		logger.Errorf("Invalid template: [%s]", err)
+		return nil, fmt.Errorf("Invalid template [%s]", err)
+	}
+
+	err = t.checkAdmin(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	ok, err := t.insertTemplate(stub, template)
+	if err != nil {
+		logger.Errorf("Error in creating template:%s", err)
+		return nil, errors.New("Error in creating template")
+	}
+	if !ok {
+		logger.Errorf("Template %s already exists", template.Name)
+		return nil, fmt.Errorf("Template %s already exists", template.Name)
+	}
+	logger.Infof("Created template %s with %d checks", template.Name, len(template.Checks))
+
+	return nil, nil
+}
+
+// Return a checklist template
+func (t *DeviceMaintenanceChaincode) template(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	logger.Info("In template function")
+	if len(args) != 1 {
+		logger.Error("Incorrect number of arguments")
+		return nil, errors.New("Incorrect number of arguments. Specify template name.")
+	}
+	template, err := t.getTemplate(stub, args[0])
+	if err != nil {
+		logger.Errorf("Failed fetching template: [%s]", err)
+		return nil, fmt.Errorf("Failed fetching template [%s]", err)
+	}
+	if template == nil {
+		logger.Errorf("Template %s not found", args[0])
+		return nil, fmt.Errorf("Template %s not found", args[0])
+	}
+
+	payload, err := json.Marshal(template)
+	if err != nil {
+		logger.Errorf("Failed marshalling payload: [%s]", err)
+		return nil, fmt.Errorf("Failed marshalling payload [%s]", err)
+	}
+
+	return payload, nil
+}
+
+// Return all checklist templates
+func (t *DeviceMaintenanceChaincode) templates(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	logger.Info("In templates function")
+	if len(args) > 0 {
+		logger.Error("Incorrect number of arguments")
+		return nil, errors.New("Incorrect number of arguments. No arguments required")
+	}
+
+	var columns []shim.Column
+	rowChannel, err := stub.GetRows(templatesTable, columns)
+	if err != nil {
+		logger.Errorf("Error in getting rows:%s", err.Error())
+		return nil, errors.New("Error in fetching rows")
+	}
+	templates := make([]ChecklistTemplate, 0)
+	for row := range rowChannel {
+		template, err := t.extractTemplate(row)
+		if err != nil {
+			logger.Errorf("Failed fetching templates: [%s]", err)
+			return nil, fmt.Errorf("Failed fetching templates [%s]", err)
+		}
+		templates = append(templates, template)
+	}
+
+	payload, err := json.Marshal(templates)
+	if err != nil {
+		logger.Errorf("Failed marshalling payload: [%s]", err)
+		return nil, fmt.Errorf("Failed marshalling payload [%s]", err)
+	}
+
+	return payload, nil
+}
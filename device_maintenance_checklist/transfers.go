@@ -0,0 +1,364 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// Time a proposed transfer can be accepted in, unless the owner gives another
+const defaultTransferValidity = 7 * 24 * time.Hour
+
+// OwnershipTransfer is a transfer of a device proposed by its owner and not accepted yet
+type OwnershipTransfer struct {
+	DeviceId   string `json:"device_id"`
+	NewOwner   []byte `json:"new_owner"`
+	ProposedAt string `json:"proposed_at"`
+	ExpiresAt  string `json:"expires_at"`
+	Expired    bool   `json:"expired"`
+}
+
+// OwnershipRecord is an owner of a device and when the device passed to it. The time is
+// unknown for owners from before the history was kept.
+type OwnershipRecord struct {
+	DeviceId string `json:"device_id"`
+	Owner    []byte `json:"owner"`
+	Since    string `json:"since,omitempty"`
+}
+
+func formatTime(seconds int64) string {
+	if seconds == 0 {
+		return ""
+	}
+	return time.Unix(seconds, 0).UTC().Format(time.RFC3339)
+}
+
+// Appends an owner to the ownership history of a device
+func (t *DeviceMaintenanceChaincode) recordOwner(stub shim.ChaincodeStubInterface, deviceId string, owner []byte, since int64) error {
+	history, err := t.getOwnershipHistory(stub, deviceId)
+	if err != nil {
+		return err
+	}
+	ok, err := stub.InsertRow(ownershipHistoryTable, shim.Row{
+		Columns: []*shim.Column{
+			&shim.Column{Value: &shim.Column_String_{String_: deviceId}},
+			&shim.Column{Value: &shim.Column_Int64{Int64: int64(len(history))}},
+			&shim.Column{Value: &shim.Column_Bytes{Bytes: owner}},
+			&shim.Column{Value: &shim.Column_Int64{Int64: since}},
+		},
+	})
+	if !ok || err != nil {
+		return fmt.Errorf("Error in recording owner of device %s: %s", deviceId, err)
+	}
+	return nil
+}
+
+// Returns the owners of a device, the first one first
+func (t *DeviceMaintenanceChaincode) getOwnershipHistory(stub shim.ChaincodeStubInterface, deviceId string) ([]OwnershipRecord, error) {
+	var columns []shim.Column
+	col := shim.Column{Value: &shim.Column_String_{String_: deviceId}}
+	columns = append(columns, col)
+
+	rowChannel, err := stub.GetRows(ownershipHistoryTable, columns)
+	if err != nil {
+		logger.Errorf("Error in getting rows:%s", err.Error())
+		return nil, errors.New("Error in fetching rows")
+	}
+	rows := make([]shim.Row, 0)
+	for row := range rowChannel {
+		rows = append(rows, row)
+	}
+
+	// Sequence keys compare as strings, so rows do not come back in order
+	history := make([]OwnershipRecord, len(rows))
+	for _, row := range rows {
+		sequence := row.Columns[1].GetInt64()
+		if sequence < 0 || sequence >= int64(len(rows)) {
+			return nil, fmt.Errorf("Invalid sequence %d of owner of device %s", sequence, deviceId)
+		}
+		history[sequence] = OwnershipRecord{
+			DeviceId: row.Columns[0].GetString_(),
+			Owner:    row.Columns[2].GetBytes(),
+			Since:    formatTime(row.Columns[3].GetInt64()),
+		}
+	}
+	return history, nil
+}
+
+func (t *DeviceMaintenanceChaincode) transferRow(deviceId string, newOwner []byte, proposedAt, expiresAt int64) shim.Row {
+	return shim.Row{
+		Columns: []*shim.Column{
+			&shim.Column{Value: &shim.Column_String_{String_: deviceId}},
+			&shim.Column{Value: &shim.Column_Bytes{Bytes: newOwner}},
+			&shim.Column{Value: &shim.Column_Int64{Int64: proposedAt}},
+			&shim.Column{Value: &shim.Column_Int64{Int64: expiresAt}},
+		},
+	}
+}
+
+// Returns the pending transfer of a device and when it expires, nil if there is none
+func (t *DeviceMaintenanceChaincode) getTransfer(stub shim.ChaincodeStubInterface, deviceId string) (*OwnershipTransfer, int64, error) {
+	var columns []shim.Column
+	col := shim.Column{Value: &shim.Column_String_{String_: deviceId}}
+	columns = append(columns, col)
+
+	row, err := stub.GetRow(pendingTransfersTable, columns)
+	if err != nil {
+		logger.Errorf("Error in getting transfer:%s", err.Error())
+		return nil, 0, errors.New("Error in fetching transfer")
+	}
+	if len(row.Columns) == 0 {
+		return nil, 0, nil
+	}
+	expiresAt := row.Columns[3].GetInt64()
+	return &OwnershipTransfer{
+		DeviceId:   row.Columns[0].GetString_(),
+		NewOwner:   row.Columns[1].GetBytes(),
+		ProposedAt: formatTime(row.Columns[2].GetInt64()),
+		ExpiresAt:  formatTime(expiresAt),
+	}, expiresAt, nil
+}
+
+func (t *DeviceMaintenanceChaincode) deleteTransfer(stub shim.ChaincodeStubInterface, deviceId string) error {
+	var columns []shim.Column
+	col := shim.Column{Value: &shim.Column_String_{String_: deviceId}}
+	columns = append(columns, col)
+	return stub.DeleteRow(pendingTransfersTable, columns)
+}
+
+// Checks that the caller owns the device
+func (t *DeviceMaintenanceChaincode) checkDeviceOwner(stub shim.ChaincodeStubInterface, device Device) error {
+	if device.Id == "" {
+		logger.Error("Device not found")
+		return errors.New("Device not found")
+	}
+	ok, err := t.isCaller(stub, device.Owner)
+	if err != nil {
+		logger.Error("Failed checking owner identity")
+		return errors.New("Failed checking owner identity")
+	}
+	if !ok {
+		logger.Error("Caller is not the owner of the device")
+		return errors.New("The caller is not the owner of device")
+	}
+	return nil
+}
+
+// Proposes to transfer a device to a new owner, who has to accept it before it expires.
+// A new proposal replaces the pending one. Only owner can do it.
+func (t *DeviceMaintenanceChaincode) proposeTransfer(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	logger.Info("In proposeTransfer function")
+	if len(args) != 2 && len(args) != 3 {
+		logger.Error("Incorrect number of arguments")
+		return nil, errors.New("Incorrect number of arguments. Specify device id, new owner and optionally the hours the transfer is valid.")
+	}
+
+	deviceId := args[0]
+	newOwner, err := base64.StdEncoding.DecodeString(args[1])
+	if err != nil || len(newOwner) == 0 {
+		logger.Error("Failed decoding new owner certificate")
+		return nil, errors.New("Failed decoding new owner")
+	}
+	validity := defaultTransferValidity
+	if len(args) == 3 {
+		hours, err := strconv.ParseInt(args[2], 10, 64)
+		if err != nil || hours <= 0 {
+			logger.Errorf("Invalid value of validity:%s", args[2])
+			return nil, fmt.Errorf("Invalid value of validity:%s", args[2])
+		}
+		validity = time.Duration(hours) * time.Hour
+	}
+
+	device, err := t.getDevice(stub, deviceId)
+	if err != nil {
+		logger.Errorf("Failed fetching device: [%s]", err)
+		return nil, fmt.Errorf("Failed fetching device [%s]", err)
+	}
+	err = t.checkDeviceOwner(stub, device)
+	if err != nil {
+		return nil, err
+	}
+
+	now, err := txTime(stub)
+	if err != nil {
+		return nil, err
+	}
+	expiresAt := now.Add(validity)
+
+	row := t.transferRow(deviceId, newOwner, now.Unix(), expiresAt.Unix())
+	ok, err := stub.InsertRow(pendingTransfersTable, row)
+	if err == nil && !ok {
+		ok, err = stub.ReplaceRow(pendingTransfersTable, row)
+	}
+	if !ok || err != nil {
+		logger.Errorf("Error in proposing the transfer:%s", err)
+		return nil, errors.New("Error in proposing the transfer")
+	}
+	logger.Infof("Transfer of device %s proposed, expires at %s", deviceId, formatTime(expiresAt.Unix()))
+
+	return nil, nil
+}
+
+// Withdraws the pending transfer of a device. Only owner can do it.
+func (t *DeviceMaintenanceChaincode) cancelTransfer(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	logger.Info("In cancelTransfer function")
+	if len(args) != 1 {
+		logger.Error("Incorrect number of arguments")
+		return nil, errors.New("Incorrect number of arguments. Specify device id.")
+	}
+
+	deviceId := args[0]
+	device, err := t.getDevice(stub, deviceId)
+	if err != nil {
+		logger.Errorf("Failed fetching device: [%s]", err)
+		return nil, fmt.Errorf("Failed fetching device [%s]", err)
+	}
+	err = t.checkDeviceOwner(stub, device)
+	if err != nil {
+		return nil, err
+	}
+
+	transfer, _, err := t.getTransfer(stub, deviceId)
+	if err != nil {
+		return nil, err
+	}
+	if transfer == nil {
+		logger.Errorf("No pending transfer of device %s", deviceId)
+		return nil, fmt.Errorf("No pending transfer of device %s", deviceId)
+	}
+
+	err = t.deleteTransfer(stub, deviceId)
+	if err != nil {
+		logger.Errorf("Error in cancelling the transfer:%s", err)
+		return nil, errors.New("Error in cancelling the transfer")
+	}
+	logger.Infof("Transfer of device %s cancelled", deviceId)
+
+	return nil, nil
+}
+
+// Accepts the pending transfer of a device, making the caller its owner. Only the new
+// owner can do it, before the transfer expires.
+func (t *DeviceMaintenanceChaincode) acceptTransfer(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	logger.Info("In acceptTransfer function")
+	if len(args) != 1 {
+		logger.Error("Incorrect number of arguments")
+		return nil, errors.New("Incorrect number of arguments. Specify device id.")
+	}
+
+	deviceId := args[0]
+	device, err := t.getDevice(stub, deviceId)
+	if err != nil {
+		logger.Errorf("Failed fetching device: [%s]", err)
+		return nil, fmt.Errorf("Failed fetching device [%s]", err)
+	}
+	if device.Id == "" {
+		logger.Errorf("Device %s not found", deviceId)
+		return nil, fmt.Errorf("Device %s not found", deviceId)
+	}
+
+	transfer, expiresAt, err := t.getTransfer(stub, deviceId)
+	if err != nil {
+		return nil, err
+	}
+	if transfer == nil {
+		logger.Errorf("No pending transfer of device %s", deviceId)
+		return nil, fmt.Errorf("No pending transfer of device %s", deviceId)
+	}
+
+	ok, err := t.isCaller(stub, transfer.NewOwner)
+	if err != nil {
+		logger.Error("Failed checking new owner identity")
+		return nil, errors.New("Failed checking new owner identity")
+	}
+	if !ok {
+		logger.Error("Caller is not the new owner, cannot accept the transfer")
+		return nil, errors.New("The caller is not the new owner of device")
+	}
+
+	now, err := txTime(stub)
+	if err != nil {
+		return nil, err
+	}
+	if now.Unix() >= expiresAt {
+		logger.Errorf("Transfer of device %s expired at %s", deviceId, transfer.ExpiresAt)
+		return nil, fmt.Errorf("Transfer of device %s expired at %s", deviceId, transfer.ExpiresAt)
+	}
+
+	device.Owner = transfer.NewOwner
+	ok, err = stub.ReplaceRow(deviceChecksOwnerMapTable, t.deviceRow(device))
+	if !ok || err != nil {
+		logger.Errorf("Error in transferring the device:%s", err)
+		return nil, errors.New("Error in transferring the device")
+	}
+	err = t.deleteTransfer(stub, deviceId)
+	if err == nil {
+		err = t.recordOwner(stub, deviceId, device.Owner, now.Unix())
+	}
+	if err != nil {
+		logger.Errorf("Error in transferring the device:%s", err)
+		return nil, errors.New("Error in transferring the device")
+	}
+	logger.Infof("Device %s transferred to its new owner", deviceId)
+
+	return nil, nil
+}
+
+// Return the pending transfer of a device
+func (t *DeviceMaintenanceChaincode) pendingTransfer(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	logger.Info("In pendingTransfer function")
+	if len(args) != 1 {
+		logger.Error("Incorrect number of arguments")
+		return nil, errors.New("Incorrect number of arguments. Specify device id.")
+	}
+
+	transfer, expiresAt, err := t.getTransfer(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	if transfer == nil {
+		logger.Errorf("No pending transfer of device %s", args[0])
+		return nil, fmt.Errorf("No pending transfer of device %s", args[0])
+	}
+	now, err := txTime(stub)
+	if err != nil {
+		return nil, err
+	}
+	transfer.Expired = now.Unix() >= expiresAt
+
+	payload, err := json.Marshal(transfer)
+	if err != nil {
+		logger.Errorf("Failed marshalling payload: [%s]", err)
+		return nil, fmt.Errorf("Failed marshalling payload [%s]", err)
+	}
+
+	return payload, nil
+}
+
+// Return the owners of a device, the first one first
+func (t *DeviceMaintenanceChaincode) ownershipHistory(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	logger.Info("In ownershipHistory function")
+	if len(args) != 1 {
+		logger.Error("Incorrect number of arguments")
+		return nil, errors.New("Incorrect number of arguments. Specify device id.")
+	}
+
+	history, err := t.getOwnershipHistory(stub, args[0])
+	if err != nil {
+		logger.Errorf("Failed fetching ownership history: [%s]", err)
+		return nil, fmt.Errorf("Failed fetching ownership history [%s]", err)
+	}
+
+	payload, err := json.Marshal(history)
+	if err != nil {
+		logger.Errorf("Failed marshalling payload: [%s]", err)
+		return nil, fmt.Errorf("Failed marshalling payload [%s]", err)
+	}
+
+	return payload, nil
+}
@@ -0,0 +1,432 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/predix/chaincode_example/energy_trading/settlement"
+)
+
+// CarbonRecord is the CO2 attributed to a buyer for one trade of a settlement round.
+// Emission factors are in kg CO2 per kwh and taken at the time of settlement. Grid is
+// set for energy bought from a meter of generation type grid and for consumption drawn
+// from the grid, which has the exchange account as seller.
+type CarbonRecord struct {
+	AccountId string  `json:"account_id"`
+	Round     int64   `json:"round"`
+	Trade     int64   `json:"trade"`
+	Seller    string  `json:"seller"`
+	Kwh       int64   `json:"kwh"`
+	Factor    float64 `json:"factor"`
+	Co2Kg     float64 `json:"co2_kg"`
+	Grid      bool    `json:"grid"`
+}
+
+// CarbonSummary totals the emissions attributed to a meter, or to all meters in a round
+type CarbonSummary struct {
+	AccountId string         `json:"account_id,omitempty"`
+	Round     int64          `json:"round,omitempty"`
+	Kwh       int64          `json:"kwh"`
+	GridKwh   int64          `json:"grid_kwh"`
+	Co2Kg     float64        `json:"co2_kg"`
+	Records   []CarbonRecord `json:"records,omitempty"`
+}
+
+func (s *CarbonSummary) add(record CarbonRecord) {
+	s.Kwh = s.Kwh + record.Kwh
+	if record.Grid {
+		s.GridKwh = s.GridKwh + record.Kwh
+	}
+	s.Co2Kg = s.Co2Kg + record.Co2Kg
+}
+
+// Returns the emission factor used for sellers that have none of their own
+func (t *EnergyTradingChainCode) getGridEmissionFactor(stub shim.ChaincodeStubInterface) (float64, error) {
+	factorStr, err := stub.GetState("grid_emission_factor")
+	if err != nil {
+		return 0, errors.New("Failed to retrieve grid emission factor")
+	}
+	if len(factorStr) == 0 {
+		return 0, nil
+	}
+	factor, err := strconv.ParseFloat(string(factorStr), 64)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid value %s for grid emission factor", factorStr)
+	}
+	return factor, nil
+}
+
+// Returns the emission factor set for a seller, false if it has none
+func (t *EnergyTradingChainCode) getEmissionFactor(stub shim.ChaincodeStubInterface, accountId string) (float64, bool, error) {
+	var columns []shim.Column
+	col1 := shim.Column{Value: &shim.Column_String_{String_: accountId}}
+	columns = append(columns, col1)
+
+	row, err := stub.GetRow(emissionFactorsTableName, columns)
+	if err != nil {
+		return 0, false, err
+	}
+	if len(row.Columns) == 0 {
+		return 0, false, nil
+	}
+	factor, err := strconv.ParseFloat(row.Columns[1].GetString_(), 64)
+	if err != nil {
+		return 0, false, fmt.Errorf("Invalid value of emission factor:%s", row.Columns[1].GetString_())
+	}
+	return factor, true, nil
+}
+
+// Attributes the emissions of every trade of a settlement round to its buyer, using the
+// factor of the seller or the grid default if the seller has none. Consumption of the
+// round left unmatched is drawn from the grid and attributed at the grid default.
+func (t *EnergyTradingChainCode) recordCarbon(stub shim.ChaincodeStubInterface, round int64, trades []settlement.Trade, meters []*settlement.MeterInfo) error {
+	gridFactor, err := t.getGridEmissionFactor(stub)
+	if err != nil {
+		return err
+	}
+	gridSellers := make(map[string]bool)
+	for _, meter := range meters {
+		gridSellers[meter.Id] = meter.Metadata != nil && meter.Metadata.GenerationType == settlement.GenerationGrid
+	}
+
+	for i, trade := range trades {
+		factor, ok, err := t.getEmissionFactor(stub, trade.Seller)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			factor = gridFactor
+		}
+		err = t.insertCarbonRecord(stub, CarbonRecord{
+			AccountId: trade.Buyer,
+			Round:     round,
+			Trade:     int64(i),
+			Seller:    trade.Seller,
+			Kwh:       trade.Kwh,
+			Factor:    factor,
+			Co2Kg:     float64(trade.Kwh) * factor,
+			Grid:      gridSellers[trade.Seller],
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	// Unmatched consumption is carried over to the next round, only what was consumed
+	// during this round is attributed so carried over energy is not counted twice
+	next := int64(len(trades))
+	for _, meter := range meters {
+		if meter.Kwh >= 0 {
+			continue
+		}
+		reported, err := t.getRoundEnergy(stub, meter.Id, round)
+		if err != nil {
+			return err
+		}
+		unmatched := -meter.Kwh
+		if unmatched > -reported {
+			unmatched = -reported
+		}
+		if unmatched <= 0 {
+			continue
+		}
+		err = t.insertCarbonRecord(stub, CarbonRecord{
+			AccountId: meter.Id,
+			Round:     round,
+			Trade:     next,
+			Seller:    exchangeAccountId,
+			Kwh:       unmatched,
+			Factor:    gridFactor,
+			Co2Kg:     float64(unmatched) * gridFactor,
+			Grid:      true,
+		})
+		if err != nil {
+			return err
+		}
+		next++
+	}
+	return nil
+}
+
+func (t *EnergyTradingChainCode) insertCarbonRecord(stub shim.ChaincodeStubInterface, record CarbonRecord) error {
+	ok, err := stub.InsertRow(carbonTableName, shim.Row{
+		Columns: []*shim.Column{
+			&shim.Column{Value: &shim.Column_String_{String_: record.AccountId}},
+			&shim.Column{Value: &shim.Column_Int64{Int64: record.Round}},
+			&shim.Column{Value: &shim.Column_Int64{Int64: record.Trade}},
+			&shim.Column{Value: &shim.Column_String_{String_: record.Seller}},
+			&shim.Column{Value: &shim.Column_Int64{Int64: record.Kwh}},
+			&shim.Column{Value: &shim.Column_String_{String_: strconv.FormatFloat(record.Factor, 'f', 6, 64)}},
+			&shim.Column{Value: &shim.Column_String_{String_: strconv.FormatFloat(record.Co2Kg, 'f', 6, 64)}},
+			&shim.Column{Value: &shim.Column_Bool{Bool: record.Grid}},
+		},
+	})
+	if !ok || err != nil {
+		return fmt.Errorf("Error in recording emissions of trade %d of round %d: %s", record.Trade, record.Round, err)
+	}
+	return nil
+}
+
+func (t *EnergyTradingChainCode) extractCarbonRecord(row shim.Row) (CarbonRecord, error) {
+	record := CarbonRecord{
+		AccountId: row.Columns[0].GetString_(),
+		Round:     row.Columns[1].GetInt64(),
+		Trade:     row.Columns[2].GetInt64(),
+		Seller:    row.Columns[3].GetString_(),
+		Kwh:       row.Columns[4].GetInt64(),
+		Grid:      row.Columns[7].GetBool(),
+	}
+	var err error
+	record.Factor, err = strconv.ParseFloat(row.Columns[5].GetString_(), 64)
+	if err != nil {
+		return record, fmt.Errorf("Invalid value of emission factor:%s", row.Columns[5].GetString_())
+	}
+	record.Co2Kg, err = strconv.ParseFloat(row.Columns[6].GetString_(), 64)
+	if err != nil {
+		return record, fmt.Errorf("Invalid value of CO2:%s", row.Columns[6].GetString_())
+	}
+	return record, nil
+}
+
+// Parses the optional first and last round of a carbon query. Without them all settled
+// rounds are covered, the last round is capped at the last settled one.
+func (t *EnergyTradingChainCode) parseRoundRange(stub shim.ChaincodeStubInterface, args []string) (int64, int64, error) {
+	from := int64(1)
+	current, err := t.getCurrentRound(stub)
+	if err != nil {
+		return 0, 0, err
+	}
+	settled := current - 1
+	to := settled
+
+	if len(args) > 0 {
+		from, err = strconv.ParseInt(args[0], 10, 64)
+		if err != nil {
+			logger.Errorf("Error in converting to int:%s", err.Error())
+			return 0, 0, fmt.Errorf("Invalid value of first round:%s", args[0])
+		}
+	}
+	if len(args) > 1 {
+		to, err = strconv.ParseInt(args[1], 10, 64)
+		if err != nil {
+			logger.Errorf("Error in converting to int:%s", err.Error())
+			return 0, 0, fmt.Errorf("Invalid value of last round:%s", args[1])
+		}
+	}
+	if from < 1 {
+		return 0, 0, fmt.Errorf("Invalid value of first round:%d, rounds start at 1", from)
+	}
+	if to > settled {
+		to = settled
+	}
+	if to < from {
+		return 0, 0, fmt.Errorf("Last round %d is before first round %d", to, from)
+	}
+	return from, to, nil
+}
+
+// Sets the emission factor of a selling meter in kg CO2 per kwh. Only the administrator
+// can do it.
+func (t *EnergyTradingChainCode) setEmissionFactor(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	logger.Info("In setEmissionFactor function")
+	if len(args) != 2 {
+		logger.Error("Incorrect number of arguments")
+		return nil, errors.New("Incorrect number of arguments. Specify account number and emission factor in kg CO2 per kwh")
+	}
+
+	accountId := args[0]
+	factor, err := strconv.ParseFloat(args[1], 64)
+	if err != nil || factor < 0 {
+		logger.Errorf("Invalid value %s for emission factor", args[1])
+		return nil, fmt.Errorf("Invalid value of emission factor:%s", args[1])
+	}
+
+	err = t.checkAdmin(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	row, err := t.getRow(stub, accountId)
+	if err != nil {
+		logger.Errorf("Failed retrieving account [%s]: [%s]", accountId, err)
+		return nil, fmt.Errorf("Failed retrieving account [%s]: [%s]", accountId, err)
+	}
+	if len(row.Columns) == 0 {
+		logger.Errorf("Account %s not found", accountId)
+		return nil, fmt.Errorf("Account %s not found", accountId)
+	}
+
+	factorRow := shim.Row{
+		Columns: []*shim.Column{
+			&shim.Column{Value: &shim.Column_String_{String_: accountId}},
+			&shim.Column{Value: &shim.Column_String_{String_: strconv.FormatFloat(factor, 'f', 6, 64)}},
+		},
+	}
+	ok, err := stub.InsertRow(emissionFactorsTableName, factorRow)
+	if err == nil && !ok {
+		ok, err = stub.ReplaceRow(emissionFactorsTableName, factorRow)
+	}
+	if !ok || err != nil {
+		logger.Errorf("Error in saving emission factor of account %s:%s", accountId, err)
+		return nil, errors.New("Error in saving emission factor")
+	}
+	logger.Infof("Emission factor of account %s set to %f", accountId, factor)
+
+	return nil, nil
+}
+
+// Sets the emission factor in kg CO2 per kwh used for sellers without a factor of
+// their own. Only the administrator can do it.
+func (t *EnergyTradingChainCode) setGridEmissionFactor(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	logger.Info("In setGridEmissionFactor function")
+	if len(args) != 1 {
+		logger.Error("Incorrect number of arguments")
+		return nil, errors.New("Incorrect number of arguments. Specify emission factor in kg CO2 per kwh")
+	}
+
+	factor, err := strconv.ParseFloat(args[0], 64)
+	if err != nil || factor < 0 {
+		logger.Errorf("Invalid value %s for grid emission factor", args[0])
+		return nil, errors.New("Invalid value for grid emission factor")
+	}
+
+	err = t.checkAdmin(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	err = stub.PutState("grid_emission_factor", []byte(strconv.FormatFloat(factor, 'f', 6, 64)))
+	if err != nil {
+		logger.Errorf("Error saving grid emission factor %s", err.Error())
+		return nil, errors.New("Grid emission factor cannot be saved")
+	}
+	logger.Infof("Grid emission factor set to %f", factor)
+
+	return nil, nil
+}
+
+// Return the emission factor applied to a seller, or the grid default without account
+func (t *EnergyTradingChainCode) emissionFactor(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	logger.Info("In emissionFactor function")
+	if len(args) > 1 {
+		logger.Error("Incorrect number of arguments")
+		return nil, errors.New("Incorrect number of arguments. Specify account number, if any")
+	}
+
+	factor, err := t.getGridEmissionFactor(stub)
+	if err != nil {
+		return nil, err
+	}
+	if len(args) == 1 {
+		sellerFactor, ok, err := t.getEmissionFactor(stub, args[0])
+		if err != nil {
+			logger.Errorf("Failed retrieving emission factor of account [%s]: [%s]", args[0], err)
+			return nil, fmt.Errorf("Failed retrieving emission factor of account [%s]: [%s]", args[0], err)
+		}
+		if ok {
+			factor = sellerFactor
+		}
+	}
+
+	return []byte(strconv.FormatFloat(factor, 'f', 6, 64)), nil
+}
+
+// Return the emissions attributed to a meter over a range of settled rounds, with the
+// trades they come from
+func (t *EnergyTradingChainCode) carbon(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	logger.Info("In carbon function")
+	if len(args) < 1 || len(args) > 3 {
+		logger.Error("Incorrect number of arguments")
+		return nil, errors.New("Incorrect number of arguments. Specify account number and optionally first and last round")
+	}
+
+	from, to, err := t.parseRoundRange(stub, args[1:])
+	if err != nil {
+		return nil, err
+	}
+
+	var columns []shim.Column
+	col1 := shim.Column{Value: &shim.Column_String_{String_: args[0]}}
+	columns = append(columns, col1)
+
+	rowChannel, err := stub.GetRows(carbonTableName, columns)
+	if err != nil {
+		logger.Errorf("Error in getting rows:%s", err.Error())
+		return nil, errors.New("Error in fetching rows")
+	}
+	summary := CarbonSummary{AccountId: args[0], Records: make([]CarbonRecord, 0)}
+	for row := range rowChannel {
+		record, err := t.extractCarbonRecord(row)
+		if err != nil {
+			logger.Errorf("Invalid carbon record: %s", err)
+			return nil, err
+		}
+		if record.Round < from || record.Round > to {
+			continue
+		}
+		summary.add(record)
+		summary.Records = append(summary.Records, record)
+	}
+
+	payload, err := json.Marshal(summary)
+	if err != nil {
+		logger.Errorf("Failed marshalling payload")
+		return nil, fmt.Errorf("Failed marshalling payload [%s]", err)
+	}
+
+	return payload, nil
+}
+
+// Return the emissions attributed to all meters in each of a range of settled rounds
+func (t *EnergyTradingChainCode) carbonByRound(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	logger.Info("In carbonByRound function")
+	if len(args) > 2 {
+		logger.Error("Incorrect number of arguments")
+		return nil, errors.New("Incorrect number of arguments. Specify first and last round, if any")
+	}
+
+	from, to, err := t.parseRoundRange(stub, args)
+	if err != nil {
+		return nil, err
+	}
+
+	var columns []shim.Column
+	rowChannel, err := stub.GetRows(carbonTableName, columns)
+	if err != nil {
+		logger.Errorf("Error in getting rows:%s", err.Error())
+		return nil, errors.New("Error in fetching rows")
+	}
+	rounds := make(map[int64]*CarbonSummary)
+	for row := range rowChannel {
+		record, err := t.extractCarbonRecord(row)
+		if err != nil {
+			logger.Errorf("Invalid carbon record: %s", err)
+			return nil, err
+		}
+		if record.Round < from || record.Round > to {
+			continue
+		}
+		if rounds[record.Round] == nil {
+			rounds[record.Round] = &CarbonSummary{Round: record.Round}
+		}
+		rounds[record.Round].add(record)
+	}
+
+	summaries := make([]CarbonSummary, 0, len(rounds))
+	for _, summary := range rounds {
+		summaries = append(summaries, *summary)
+	}
+	sort.Slice(summaries, func(i, j int) bool { return summaries[i].Round < summaries[j].Round })
+
+	payload, err := json.Marshal(summaries)
+	if err != nil {
+		logger.Errorf("Failed marshalling payload")
+		return nil, fmt.Errorf("Failed marshalling payload [%s]", err)
+	}
+
+	return payload, nil
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"math/rand"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// Consumption left unmatched by the settlement is attributed to the grid, once
+func TestCarbonAttributesUnmatchedConsumptionToGrid(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	cc, stub := newTestChaincode(t)
+	enrollMeters(t, cc, stub, r, 2)
+	invokeAs(t, cc, stub, testAdmin, "setGridEmissionFactor", "0.5")
+	invokeAs(t, cc, stub, testAdmin, "setEmissionFactor", "1", "0.1")
+
+	invokeAs(t, cc, stub, testAdmin, "reportDelta", "1", "4")
+	invokeAs(t, cc, stub, testAdmin, "reportDelta", "2", "-10")
+	invokeAs(t, cc, stub, testAdmin, "settle")
+	// Meter 2 carries 6 unmatched kwh over and consumes 3 more in round 2
+	invokeAs(t, cc, stub, testAdmin, "reportDelta", "2", "-3")
+	invokeAs(t, cc, stub, testAdmin, "settle")
+
+	var summary CarbonSummary
+	err := json.Unmarshal(queryAs(t, cc, stub, "carbon", "2"), &summary)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []CarbonRecord{
+		{AccountId: "2", Round: 1, Trade: 0, Seller: "1", Kwh: 4, Factor: 0.1, Co2Kg: 0.4},
+		{AccountId: "2", Round: 1, Trade: 1, Seller: exchangeAccountId, Kwh: 6, Factor: 0.5, Co2Kg: 3, Grid: true},
+		{AccountId: "2", Round: 2, Trade: 0, Seller: exchangeAccountId, Kwh: 3, Factor: 0.5, Co2Kg: 1.5, Grid: true},
+	}
+	if len(summary.Records) != len(want) {
+		t.Fatalf("Records %+v, want %+v", summary.Records, want)
+	}
+	for i := range want {
+		if summary.Records[i] != want[i] {
+			t.Errorf("Record %d is %+v, want %+v", i, summary.Records[i], want[i])
+		}
+	}
+	if summary.Kwh != 13 || summary.GridKwh != 9 || summary.Co2Kg != 4.9 {
+		t.Errorf("Summary %d kwh, %d grid kwh, %f kg CO2", summary.Kwh, summary.GridKwh, summary.Co2Kg)
+	}
+}
+
+func TestCarbonRoundRange(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	cc, stub := newTestChaincode(t)
+	enrollMeters(t, cc, stub, r, 2)
+	invokeAs(t, cc, stub, testAdmin, "setGridEmissionFactor", "0.5")
+	for _, kwh := range []string{"-2", "-3", "-4"} {
+		invokeAs(t, cc, stub, testAdmin, "reportDelta", "2", kwh)
+		invokeAs(t, cc, stub, testAdmin, "settle")
+	}
+
+	tests := []struct {
+		args   []string
+		rounds []int64
+		err    string
+	}{
+		{args: nil, rounds: []int64{1, 2, 3}},
+		{args: []string{"2"}, rounds: []int64{2, 3}},
+		// The last round is capped at the last settled one, also at the end of int64
+		{args: []string{"2", "9223372036854775807"}, rounds: []int64{2, 3}},
+		{args: []string{"0", "2"}, err: "Invalid value of first round:0"},
+		{args: []string{"4"}, err: "Last round 3 is before first round 4"},
+	}
+	for _, test := range tests {
+		payload, err := cc.Query(stub, "carbonByRound", test.args)
+		if test.err != "" {
+			if err == nil || !strings.HasPrefix(err.Error(), test.err) {
+				t.Errorf("Rounds %v returned %v, want %s", test.args, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		var summaries []CarbonSummary
+		err = json.Unmarshal(payload, &summaries)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rounds := make([]int64, 0)
+		for _, summary := range summaries {
+			rounds = append(rounds, summary.Round)
+		}
+		if !reflect.DeepEqual(rounds, test.rounds) {
+			t.Errorf("Rounds %v returned %v, want %v", test.args, rounds, test.rounds)
+		}
+	}
+}
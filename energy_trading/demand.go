@@ -0,0 +1,430 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// Length of a reading interval assumed until the administrator sets a demand tariff
+const defaultDemandIntervalMinutes = 60
+
+// DemandTariff charges meters for their peak demand over a billing cycle. Demand is the
+// energy consumed in one reading interval converted to kw, only the part above the
+// threshold is charged.
+type DemandTariff struct {
+	RatePerKw       float64 `json:"rate_per_kw"`
+	ThresholdKw     float64 `json:"threshold_kw"`
+	IntervalMinutes int64   `json:"interval_minutes"`
+}
+
+// Converts the energy consumed in one interval to demand in kw
+func (d DemandTariff) demandKw(kwh int64) float64 {
+	return float64(kwh) * 60 / float64(d.IntervalMinutes)
+}
+
+// DemandCharge is the peak demand of a meter over a billing cycle and what it was charged
+type DemandCharge struct {
+	AccountId    string  `json:"account_id"`
+	Cycle        int64   `json:"cycle"`
+	Intervals    int64   `json:"intervals"`
+	PeakKw       float64 `json:"peak_kw"`
+	PeakInterval string  `json:"peak_interval,omitempty"`
+	Charge       float64 `json:"charge"`
+}
+
+func (t *EnergyTradingChainCode) getDemandTariff(stub shim.ChaincodeStubInterface) (DemandTariff, error) {
+	tariff := DemandTariff{IntervalMinutes: defaultDemandIntervalMinutes}
+
+	rateStr, err := stub.GetState("demand_rate")
+	if err != nil {
+		return tariff, errors.New("Failed to retrieve demand rate")
+	}
+	if len(rateStr) > 0 {
+		tariff.RatePerKw, err = strconv.ParseFloat(string(rateStr), 64)
+		if err != nil {
+			return tariff, fmt.Errorf("Invalid value %s for demand rate", rateStr)
+		}
+	}
+	thresholdStr, err := stub.GetState("demand_threshold")
+	if err != nil {
+		return tariff, errors.New("Failed to retrieve demand threshold")
+	}
+	if len(thresholdStr) > 0 {
+		tariff.ThresholdKw, err = strconv.ParseFloat(string(thresholdStr), 64)
+		if err != nil {
+			return tariff, fmt.Errorf("Invalid value %s for demand threshold", thresholdStr)
+		}
+	}
+	minutesStr, err := stub.GetState("demand_interval_minutes")
+	if err != nil {
+		return tariff, errors.New("Failed to retrieve demand interval")
+	}
+	if len(minutesStr) > 0 {
+		tariff.IntervalMinutes, err = strconv.ParseInt(string(minutesStr), 10, 64)
+		if err != nil || tariff.IntervalMinutes <= 0 {
+			return tariff, fmt.Errorf("Invalid value %s for demand interval", minutesStr)
+		}
+	}
+	return tariff, nil
+}
+
+// Returns whether the administrator has set a demand tariff
+func (t *EnergyTradingChainCode) hasDemandTariff(stub shim.ChaincodeStubInterface) (bool, error) {
+	rateStr, err := stub.GetState("demand_rate")
+	if err != nil {
+		logger.Error("Failed to retrieve demand rate")
+		return false, errors.New("Failed to retrieve demand rate")
+	}
+	return len(rateStr) > 0, nil
+}
+
+// Returns the billing cycle that is currently open
+func (t *EnergyTradingChainCode) getBillingCycle(stub shim.ChaincodeStubInterface) (int64, error) {
+	cycleStr, err := stub.GetState("billing_cycle")
+	if err != nil {
+		logger.Error("Failed to retrieve billing cycle")
+		return 0, errors.New("Failed to retrieve billing cycle")
+	}
+	if len(cycleStr) == 0 {
+		return 1, nil
+	}
+	cycle, err := strconv.ParseInt(string(cycleStr), 10, 64)
+	if err != nil {
+		logger.Errorf("Invalid value %s for billing cycle", cycleStr)
+		return 0, errors.New("Invalid value for billing cycle")
+	}
+	return cycle, nil
+}
+
+// Records the energy a meter consumed in an interval of the open billing cycle. Intervals
+// in which the meter produced energy have no demand and are not recorded.
+func (t *EnergyTradingChainCode) recordConsumption(stub shim.ChaincodeStubInterface, accountId, interval string, kwh int64) error {
+	if kwh >= 0 {
+		return nil
+	}
+	cycle, err := t.getBillingCycle(stub)
+	if err != nil {
+		return err
+	}
+	ok, err := stub.InsertRow(consumptionTableName, shim.Row{
+		Columns: []*shim.Column{
+			&shim.Column{Value: &shim.Column_String_{String_: accountId}},
+			&shim.Column{Value: &shim.Column_Int64{Int64: cycle}},
+			&shim.Column{Value: &shim.Column_String_{String_: interval}},
+			&shim.Column{Value: &shim.Column_Int64{Int64: -kwh}},
+		},
+	})
+	if !ok || err != nil {
+		return fmt.Errorf("Error in recording consumption of account %s for interval %s: %s", accountId, interval, err)
+	}
+	return nil
+}
+
+// Computes the peak demand of a meter over a billing cycle from its recorded consumption
+func (t *EnergyTradingChainCode) getPeakDemand(stub shim.ChaincodeStubInterface, accountId string, cycle int64, tariff DemandTariff) (DemandCharge, error) {
+	demand := DemandCharge{AccountId: accountId, Cycle: cycle}
+
+	var columns []shim.Column
+	col1 := shim.Column{Value: &shim.Column_String_{String_: accountId}}
+	col2 := shim.Column{Value: &shim.Column_Int64{Int64: cycle}}
+	columns = append(columns, col1, col2)
+
+	rowChannel, err := stub.GetRows(consumptionTableName, columns)
+	if err != nil {
+		return demand, err
+	}
+	var peakKwh int64
+	for row := range rowChannel {
+		demand.Intervals++
+		kwh := row.Columns[3].GetInt64()
+		interval := row.Columns[2].GetString_()
+		// Ties go to the earliest interval so the result does not depend on row order
+		if kwh > peakKwh || (kwh == peakKwh && interval < demand.PeakInterval) {
+			peakKwh = kwh
+			demand.PeakInterval = interval
+		}
+	}
+	demand.PeakKw = tariff.demandKw(peakKwh)
+	if demand.PeakKw > tariff.ThresholdKw {
+		demand.Charge = (demand.PeakKw - tariff.ThresholdKw) * tariff.RatePerKw
+	}
+	return demand, nil
+}
+
+func (t *EnergyTradingChainCode) demandChargeRow(demand DemandCharge) shim.Row {
+	return shim.Row{
+		Columns: []*shim.Column{
+			&shim.Column{Value: &shim.Column_String_{String_: demand.AccountId}},
+			&shim.Column{Value: &shim.Column_Int64{Int64: demand.Cycle}},
+			&shim.Column{Value: &shim.Column_Int64{Int64: demand.Intervals}},
+			&shim.Column{Value: &shim.Column_String_{String_: strconv.FormatFloat(demand.PeakKw, 'f', 6, 64)}},
+			&shim.Column{Value: &shim.Column_String_{String_: demand.PeakInterval}},
+			&shim.Column{Value: &shim.Column_String_{String_: strconv.FormatFloat(demand.Charge, 'f', 6, 64)}},
+		},
+	}
+}
+
+func (t *EnergyTradingChainCode) extractDemandCharge(row shim.Row) (DemandCharge, error) {
+	demand := DemandCharge{
+		AccountId:    row.Columns[0].GetString_(),
+		Cycle:        row.Columns[1].GetInt64(),
+		Intervals:    row.Columns[2].GetInt64(),
+		PeakInterval: row.Columns[4].GetString_(),
+	}
+	var err error
+	demand.PeakKw, err = strconv.ParseFloat(row.Columns[3].GetString_(), 64)
+	if err != nil {
+		return demand, fmt.Errorf("Invalid value of peak demand:%s", row.Columns[3].GetString_())
+	}
+	demand.Charge, err = strconv.ParseFloat(row.Columns[5].GetString_(), 64)
+	if err != nil {
+		return demand, fmt.Errorf("Invalid value of demand charge:%s", row.Columns[5].GetString_())
+	}
+	return demand, nil
+}
+
+// Sets the demand tariff: charge per kw of peak demand above the threshold and the
+// length of a reading interval in minutes. Only the administrator can do it.
+func (t *EnergyTradingChainCode) setDemandTariff(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	logger.Info("In setDemandTariff function")
+	if len(args) != 3 {
+		logger.Error("Incorrect number of arguments")
+		return nil, errors.New("Incorrect number of arguments. Specify the charge per kw, the threshold in kw and the interval length in minutes")
+	}
+
+	rate, err := strconv.ParseFloat(args[0], 64)
+	if err != nil || rate < 0 {
+		logger.Errorf("Invalid value %s for demand rate", args[0])
+		return nil, errors.New("Invalid value for demand rate")
+	}
+	threshold, err := strconv.ParseFloat(args[1], 64)
+	if err != nil || threshold < 0 {
+		logger.Errorf("Invalid value %s for demand threshold", args[1])
+		return nil, errors.New("Invalid value for demand threshold")
+	}
+	minutes, err := strconv.ParseInt(args[2], 10, 64)
+	if err != nil || minutes <= 0 {
+		logger.Errorf("Invalid value %s for demand interval", args[2])
+		return nil, errors.New("Invalid value for demand interval")
+	}
+
+	err = t.checkAdmin(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	err = stub.PutState("demand_rate", []byte(strconv.FormatFloat(rate, 'f', 6, 64)))
+	if err == nil {
+		err = stub.PutState("demand_threshold", []byte(strconv.FormatFloat(threshold, 'f', 6, 64)))
+	}
+	if err == nil {
+		err = stub.PutState("demand_interval_minutes", []byte(strconv.FormatInt(minutes, 10)))
+	}
+	if err != nil {
+		logger.Errorf("Error saving demand tariff %s", err.Error())
+		return nil, errors.New("Demand tariff cannot be saved")
+	}
+	logger.Infof("Demand tariff set to %f per kw above %f kw with %d minute intervals", rate, threshold, minutes)
+
+	return nil, nil
+}
+
+// Closes the open billing cycle. Every meter is charged for its peak demand over the
+// cycle, the charges go to the exchange account. Only the administrator can do it.
+func (t *EnergyTradingChainCode) closeBillingCycle(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	logger.Info("In closeBillingCycle function")
+	if len(args) > 0 {
+		logger.Error("Incorrect number of arguments")
+		return nil, errors.New("Incorrect number of arguments. No arguments necessary")
+	}
+
+	err := t.checkAdmin(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	cycle, err := t.getBillingCycle(stub)
+	if err != nil {
+		return nil, err
+	}
+	tariff, err := t.getDemandTariff(stub)
+	if err != nil {
+		logger.Errorf("Failed retrieving demand tariff: %s", err)
+		return nil, err
+	}
+
+	var columns []shim.Column
+	rowChannel, err := stub.GetRows(tableName, columns)
+	if err != nil {
+		logger.Errorf("Error in getting rows:%s", err.Error())
+		return nil, errors.New("Error in fetching rows")
+	}
+	accountIds := make([]string, 0)
+	for row := range rowChannel {
+		accountIds = append(accountIds, row.Columns[0].GetString_())
+	}
+
+	ledger := ledgerDeltas{}
+	var total float64
+	for _, accountId := range accountIds {
+		demand, err := t.getPeakDemand(stub, accountId, cycle, tariff)
+		if err != nil {
+			logger.Errorf("Failed computing peak demand of account %s: %s", accountId, err)
+			return nil, fmt.Errorf("Failed computing peak demand of account %s", accountId)
+		}
+		if demand.Intervals == 0 {
+			continue
+		}
+		logger.Debugf("Meter %s peaked at %f kw in cycle %d, charging %f", accountId, demand.PeakKw, cycle, demand.Charge)
+
+		if demand.Charge > 0 {
+			err = t.adjustBalance(stub, accountId, -demand.Charge)
+			if err != nil {
+				logger.Errorf("Error in charging account %s:%s", accountId, err)
+				return nil, fmt.Errorf("Error in charging account %s", accountId)
+			}
+			ledger.transfer(accountId, exchangeAccountId, demand.Charge)
+			total = total + demand.Charge
+		}
+
+		ok, err := stub.InsertRow(demandChargesTableName, t.demandChargeRow(demand))
+		if !ok || err != nil {
+			logger.Errorf("Error in recording demand charge of account %s:%s", accountId, err)
+			return nil, errors.New("Error in recording demand charge")
+		}
+	}
+
+	if total > 0 {
+		err = t.adjustBalance(stub, exchangeAccountId, total)
+		if err != nil {
+			logger.Errorf("Error in crediting exchange account:%s", err)
+			return nil, errors.New("Error in crediting exchange account")
+		}
+	}
+	err = t.commitLedger(stub, ledger)
+	if err != nil {
+		logger.Errorf("Error in updating account totals:%s", err.Error())
+		return nil, errors.New("Error in updating account totals")
+	}
+
+	err = stub.PutState("billing_cycle", []byte(strconv.FormatInt(cycle+1, 10)))
+	if err != nil {
+		logger.Errorf("Error saving billing cycle %s", err.Error())
+		return nil, errors.New("Billing cycle cannot be saved")
+	}
+	logger.Infof("Closed billing cycle %d, demand charges of %f", cycle, total)
+
+	return nil, nil
+}
+
+// Return the demand tariff
+func (t *EnergyTradingChainCode) demandTariff(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	logger.Info("In demandTariff function")
+	if len(args) > 0 {
+		logger.Error("Incorrect number of arguments")
+		return nil, errors.New("Incorrect number of arguments. No arguments necessary")
+	}
+
+	tariff, err := t.getDemandTariff(stub)
+	if err != nil {
+		logger.Errorf("Failed retrieving demand tariff: %s", err)
+		return nil, err
+	}
+
+	payload, err := json.Marshal(tariff)
+	if err != nil {
+		logger.Errorf("Failed marshalling payload: [%s]", err)
+		return nil, fmt.Errorf("Failed marshalling payload [%s]", err)
+	}
+
+	return payload, nil
+}
+
+// Return the billing cycle that is currently open
+func (t *EnergyTradingChainCode) billingCycle(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	logger.Info("In billingCycle function")
+	if len(args) > 0 {
+		logger.Error("Incorrect number of arguments")
+		return nil, errors.New("Incorrect number of arguments. No arguments necessary")
+	}
+
+	cycle, err := t.getBillingCycle(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	return []byte(strconv.FormatInt(cycle, 10)), nil
+}
+
+// Return the peak demand of a meter so far in the open billing cycle, along with the
+// charge it would incur if the cycle was closed now
+func (t *EnergyTradingChainCode) peakDemand(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	logger.Info("In peakDemand function")
+	if len(args) != 1 {
+		logger.Error("Incorrect number of arguments")
+		return nil, errors.New("Incorrect number of arguments. Specify account number")
+	}
+
+	cycle, err := t.getBillingCycle(stub)
+	if err != nil {
+		return nil, err
+	}
+	tariff, err := t.getDemandTariff(stub)
+	if err != nil {
+		logger.Errorf("Failed retrieving demand tariff: %s", err)
+		return nil, err
+	}
+	demand, err := t.getPeakDemand(stub, args[0], cycle, tariff)
+	if err != nil {
+		logger.Errorf("Failed computing peak demand of account %s: %s", args[0], err)
+		return nil, fmt.Errorf("Failed computing peak demand of account %s", args[0])
+	}
+
+	payload, err := json.Marshal(demand)
+	if err != nil {
+		logger.Errorf("Failed marshalling payload: [%s]", err)
+		return nil, fmt.Errorf("Failed marshalling payload [%s]", err)
+	}
+
+	return payload, nil
+}
+
+// Return the demand charges of a meter for all closed billing cycles
+func (t *EnergyTradingChainCode) demandCharges(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	logger.Info("In demandCharges function")
+	if len(args) != 1 {
+		logger.Error("Incorrect number of arguments")
+		return nil, errors.New("Incorrect number of arguments. Specify account number")
+	}
+
+	var columns []shim.Column
+	col1 := shim.Column{Value: &shim.Column_String_{String_: args[0]}}
+	columns = append(columns, col1)
+
+	rowChannel, err := stub.GetRows(demandChargesTableName, columns)
+	if err != nil {
+		logger.Errorf("Error in getting rows:%s", err.Error())
+		return nil, errors.New("Error in fetching rows")
+	}
+	charges := make([]DemandCharge, 0)
+	for row := range rowChannel {
+		demand, err := t.extractDemandCharge(row)
+		if err != nil {
+			logger.Errorf("Invalid demand charge: %s", err)
+			return nil, err
+		}
+		charges = append(charges, demand)
+	}
+
+	payload, err := json.Marshal(charges)
+	if err != nil {
+		logger.Errorf("Failed marshalling payload")
+		return nil, fmt.Errorf("Failed marshalling payload [%s]", err)
+	}
+
+	return payload, nil
+}
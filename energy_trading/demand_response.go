@@ -0,0 +1,556 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// Demand response event states
+const (
+	eventAnnounced = "announced"
+	eventClosed    = "closed"
+)
+
+// DemandResponseEvent asks meters to cut their consumption during the settlement rounds
+// StartRound to EndRound. Meters that opted in are paid IncentivePerKwh for every kwh
+// they consumed below their baseline, the average consumption over the BaselineRounds
+// rounds before the event.
+type DemandResponseEvent struct {
+	Id              int64   `json:"id"`
+	StartRound      int64   `json:"start_round"`
+	EndRound        int64   `json:"end_round"`
+	TargetKwh       int64   `json:"target_kwh"`
+	IncentivePerKwh float64 `json:"incentive_per_kwh"`
+	BaselineRounds  int64   `json:"baseline_rounds"`
+	Status          string  `json:"status"`
+	// Filled in when the event is closed
+	ReductionKwh float64                `json:"reduction_kwh"`
+	TargetMet    bool                   `json:"target_met"`
+	Incentives   float64                `json:"incentives"`
+	Participants []DemandResponseResult `json:"participants,omitempty"`
+}
+
+// DemandResponseResult is the outcome of an event for one participating meter
+type DemandResponseResult struct {
+	AccountId    string  `json:"account_id"`
+	BaselineKwh  float64 `json:"baseline_kwh"`
+	ActualKwh    int64   `json:"actual_kwh"`
+	ReductionKwh float64 `json:"reduction_kwh"`
+	Incentive    float64 `json:"incentive"`
+}
+
+// Adds energy reported by a meter to its history for the open settlement round
+func (t *EnergyTradingChainCode) recordRoundEnergy(stub shim.ChaincodeStubInterface, accountId string, kwh int64) error {
+	round, err := t.getCurrentRound(stub)
+	if err != nil {
+		return err
+	}
+	var columns []shim.Column
+	col1 := shim.Column{Value: &shim.Column_String_{String_: accountId}}
+	col2 := shim.Column{Value: &shim.Column_Int64{Int64: round}}
+	columns = append(columns, col1, col2)
+
+	row, err := stub.GetRow(roundEnergyTableName, columns)
+	if err != nil {
+		return err
+	}
+	exists := len(row.Columns) > 0
+	var total int64
+	if exists {
+		total = row.Columns[2].GetInt64()
+	}
+	row = shim.Row{
+		Columns: []*shim.Column{
+			&shim.Column{Value: &shim.Column_String_{String_: accountId}},
+			&shim.Column{Value: &shim.Column_Int64{Int64: round}},
+			&shim.Column{Value: &shim.Column_Int64{Int64: total + kwh}},
+		},
+	}
+
+	var ok bool
+	if exists {
+		ok, err = stub.ReplaceRow(roundEnergyTableName, row)
+	} else {
+		ok, err = stub.InsertRow(roundEnergyTableName, row)
+	}
+	if !ok || err != nil {
+		return fmt.Errorf("Error in recording energy of account %s for round %d: %s", accountId, round, err)
+	}
+	return nil
+}
+
+// Returns the energy a meter reported during a round, without what was carried over
+// from earlier rounds. Returns zero if it reported nothing.
+func (t *EnergyTradingChainCode) getRoundEnergy(stub shim.ChaincodeStubInterface, accountId string, round int64) (int64, error) {
+	var columns []shim.Column
+	col1 := shim.Column{Value: &shim.Column_String_{String_: accountId}}
+	col2 := shim.Column{Value: &shim.Column_Int64{Int64: round}}
+	columns = append(columns, col1, col2)
+
+	row, err := stub.GetRow(roundEnergyTableName, columns)
+	if err != nil {
+		return 0, err
+	}
+	if len(row.Columns) == 0 {
+		return 0, nil
+	}
+	return row.Columns[2].GetInt64(), nil
+}
+
+// Returns the energy a meter consumed during the rounds from to to, inclusive. Rounds in
+// which it produced more than it consumed count as zero.
+func (t *EnergyTradingChainCode) getConsumption(stub shim.ChaincodeStubInterface, accountId string, from, to int64) (int64, error) {
+	var consumed int64
+	for round := from; round <= to; round++ {
+		kwh, err := t.getRoundEnergy(stub, accountId, round)
+		if err != nil {
+			return 0, err
+		}
+		if kwh < 0 {
+			consumed = consumed - kwh
+		}
+	}
+	return consumed, nil
+}
+
+func (t *EnergyTradingChainCode) eventRow(event DemandResponseEvent) shim.Row {
+	return shim.Row{
+		Columns: []*shim.Column{
+			&shim.Column{Value: &shim.Column_Int64{Int64: event.Id}},
+			&shim.Column{Value: &shim.Column_Int64{Int64: event.StartRound}},
+			&shim.Column{Value: &shim.Column_Int64{Int64: event.EndRound}},
+			&shim.Column{Value: &shim.Column_Int64{Int64: event.TargetKwh}},
+			&shim.Column{Value: &shim.Column_String_{String_: strconv.FormatFloat(event.IncentivePerKwh, 'f', 6, 64)}},
+			&shim.Column{Value: &shim.Column_Int64{Int64: event.BaselineRounds}},
+			&shim.Column{Value: &shim.Column_String_{String_: event.Status}},
+			&shim.Column{Value: &shim.Column_String_{String_: strconv.FormatFloat(event.ReductionKwh, 'f', 6, 64)}},
+			&shim.Column{Value: &shim.Column_Bool{Bool: event.TargetMet}},
+			&shim.Column{Value: &shim.Column_String_{String_: strconv.FormatFloat(event.Incentives, 'f', 6, 64)}},
+		},
+	}
+}
+
+func (t *EnergyTradingChainCode) extractEvent(row shim.Row) (DemandResponseEvent, error) {
+	event := DemandResponseEvent{
+		Id:             row.Columns[0].GetInt64(),
+		StartRound:     row.Columns[1].GetInt64(),
+		EndRound:       row.Columns[2].GetInt64(),
+		TargetKwh:      row.Columns[3].GetInt64(),
+		BaselineRounds: row.Columns[5].GetInt64(),
+		Status:         row.Columns[6].GetString_(),
+		TargetMet:      row.Columns[8].GetBool(),
+	}
+	amounts := map[int]*float64{4: &event.IncentivePerKwh, 7: &event.ReductionKwh, 9: &event.Incentives}
+	for i, amount := range amounts {
+		value, err := strconv.ParseFloat(row.Columns[i].GetString_(), 64)
+		if err != nil {
+			return event, fmt.Errorf("Invalid amount %s in demand response event %d", row.Columns[i].GetString_(), event.Id)
+		}
+		*amount = value
+	}
+	return event, nil
+}
+
+func (t *EnergyTradingChainCode) participantRow(eventId int64, result DemandResponseResult) shim.Row {
+	return shim.Row{
+		Columns: []*shim.Column{
+			&shim.Column{Value: &shim.Column_Int64{Int64: eventId}},
+			&shim.Column{Value: &shim.Column_String_{String_: result.AccountId}},
+			&shim.Column{Value: &shim.Column_String_{String_: strconv.FormatFloat(result.BaselineKwh, 'f', 6, 64)}},
+			&shim.Column{Value: &shim.Column_Int64{Int64: result.ActualKwh}},
+			&shim.Column{Value: &shim.Column_String_{String_: strconv.FormatFloat(result.ReductionKwh, 'f', 6, 64)}},
+			&shim.Column{Value: &shim.Column_String_{String_: strconv.FormatFloat(result.Incentive, 'f', 6, 64)}},
+		},
+	}
+}
+
+func (t *EnergyTradingChainCode) extractParticipant(row shim.Row) (DemandResponseResult, error) {
+	result := DemandResponseResult{
+		AccountId: row.Columns[1].GetString_(),
+		ActualKwh: row.Columns[3].GetInt64(),
+	}
+	amounts := map[int]*float64{2: &result.BaselineKwh, 4: &result.ReductionKwh, 5: &result.Incentive}
+	for i, amount := range amounts {
+		value, err := strconv.ParseFloat(row.Columns[i].GetString_(), 64)
+		if err != nil {
+			return result, fmt.Errorf("Invalid amount %s in result of account %s", row.Columns[i].GetString_(), result.AccountId)
+		}
+		*amount = value
+	}
+	return result, nil
+}
+
+// Returns a demand response event with its participants. Returns nil if there is no such event.
+func (t *EnergyTradingChainCode) getEvent(stub shim.ChaincodeStubInterface, id int64) (*DemandResponseEvent, error) {
+	var columns []shim.Column
+	col1 := shim.Column{Value: &shim.Column_Int64{Int64: id}}
+	columns = append(columns, col1)
+
+	row, err := stub.GetRow(eventsTableName, columns)
+	if err != nil {
+		return nil, err
+	}
+	if len(row.Columns) == 0 {
+		return nil, nil
+	}
+	event, err := t.extractEvent(row)
+	if err != nil {
+		return nil, err
+	}
+
+	rowChannel, err := stub.GetRows(participantsTableName, columns)
+	if err != nil {
+		return nil, err
+	}
+	rows := make([]shim.Row, 0)
+	for row := range rowChannel {
+		rows = append(rows, row)
+	}
+	event.Participants = make([]DemandResponseResult, 0, len(rows))
+	for _, row := range rows {
+		result, err := t.extractParticipant(row)
+		if err != nil {
+			return nil, err
+		}
+		event.Participants = append(event.Participants, result)
+	}
+	return &event, nil
+}
+
+// Declares a demand response event over a window of upcoming settlement rounds. Only the
+// administrator can do it.
+func (t *EnergyTradingChainCode) declareDemandResponse(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	logger.Info("In declareDemandResponse function")
+	if len(args) != 5 {
+		logger.Error("Incorrect number of arguments")
+		return nil, errors.New("Incorrect number of arguments. Specify start round, end round, target reduction in kwh, incentive per kwh and number of baseline rounds")
+	}
+
+	startRound, err := strconv.ParseInt(args[0], 10, 64)
+	if err != nil {
+		logger.Errorf("Error in converting to int:%s", err.Error())
+		return nil, fmt.Errorf("Invalid value of start round:%s", args[0])
+	}
+	endRound, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil {
+		logger.Errorf("Error in converting to int:%s", err.Error())
+		return nil, fmt.Errorf("Invalid value of end round:%s", args[1])
+	}
+	targetKwh, err := strconv.ParseInt(args[2], 10, 64)
+	if err != nil {
+		logger.Errorf("Error in converting to int:%s", err.Error())
+		return nil, fmt.Errorf("Invalid value of target reduction:%s", args[2])
+	}
+	incentive, err := strconv.ParseFloat(args[3], 64)
+	if err != nil {
+		logger.Errorf("Error in converting to float:%s", err.Error())
+		return nil, fmt.Errorf("Invalid value of incentive:%s", args[3])
+	}
+	baselineRounds, err := strconv.ParseInt(args[4], 10, 64)
+	if err != nil {
+		logger.Errorf("Error in converting to int:%s", err.Error())
+		return nil, fmt.Errorf("Invalid value of baseline rounds:%s", args[4])
+	}
+	event := DemandResponseEvent{
+		StartRound:      startRound,
+		EndRound:        endRound,
+		TargetKwh:       targetKwh,
+		IncentivePerKwh: incentive,
+		BaselineRounds:  baselineRounds,
+		Status:          eventAnnounced,
+	}
+	if event.EndRound < event.StartRound || event.TargetKwh < 0 || event.IncentivePerKwh < 0 || event.BaselineRounds <= 0 {
+		logger.Error("Invalid demand response event")
+		return nil, errors.New("Invalid demand response event. The window cannot be empty, the target and incentive cannot be negative and at least one baseline round is needed")
+	}
+
+	err = t.checkAdmin(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	currentRound, err := t.getCurrentRound(stub)
+	if err != nil {
+		return nil, err
+	}
+	if event.StartRound <= currentRound {
+		logger.Errorf("Demand response event starting in round %d declared while round %d is open", event.StartRound, currentRound)
+		return nil, fmt.Errorf("Demand response events must start after the open round %d", currentRound)
+	}
+
+	countStr, err := stub.GetState("event_count")
+	if err != nil {
+		logger.Error("Failed to retrieve event count")
+		return nil, errors.New("Failed to retrieve event count")
+	}
+	var count int64
+	if len(countStr) > 0 {
+		count, err = strconv.ParseInt(string(countStr), 10, 64)
+		if err != nil {
+			logger.Errorf("Invalid value %s for event count", countStr)
+			return nil, errors.New("Invalid value for event count")
+		}
+	}
+	event.Id = count + 1
+
+	ok, err := stub.InsertRow(eventsTableName, t.eventRow(event))
+	if !ok || err != nil {
+		logger.Errorf("Error in declaring demand response event:%s", err)
+		return nil, errors.New("Error in declaring demand response event")
+	}
+	err = stub.PutState("event_count", []byte(strconv.FormatInt(event.Id, 10)))
+	if err != nil {
+		logger.Errorf("Error saving event count %s", err.Error())
+		return nil, errors.New("Event count cannot be saved")
+	}
+	logger.Infof("Declared demand response event %d for rounds %d to %d", event.Id, event.StartRound, event.EndRound)
+
+	return []byte(strconv.FormatInt(event.Id, 10)), nil
+}
+
+// Opts a meter in to a demand response event before the event starts. Only the meter
+// owner can do it.
+func (t *EnergyTradingChainCode) optInDemandResponse(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	logger.Info("In optInDemandResponse function")
+	if len(args) != 2 {
+		logger.Error("Incorrect number of arguments")
+		return nil, errors.New("Incorrect number of arguments. Specify event id and account number")
+	}
+
+	id, err := strconv.ParseInt(args[0], 10, 64)
+	if err != nil {
+		logger.Errorf("Error in converting to int:%s", err.Error())
+		return nil, fmt.Errorf("Invalid value of event id:%s", args[0])
+	}
+	accountId := args[1]
+
+	_, _, err = t.checkMeterOwner(stub, accountId)
+	if err != nil {
+		return nil, err
+	}
+
+	event, err := t.getEvent(stub, id)
+	if err != nil {
+		logger.Errorf("Failed retrieving demand response event [%d]: [%s]", id, err)
+		return nil, fmt.Errorf("Failed retrieving demand response event [%d]: [%s]", id, err)
+	}
+	if event == nil {
+		return nil, fmt.Errorf("Demand response event %d not found", id)
+	}
+	currentRound, err := t.getCurrentRound(stub)
+	if err != nil {
+		return nil, err
+	}
+	if event.Status != eventAnnounced || currentRound >= event.StartRound {
+		logger.Errorf("Demand response event %d already started", id)
+		return nil, fmt.Errorf("Demand response event %d already started", id)
+	}
+
+	ok, err := stub.InsertRow(participantsTableName, t.participantRow(id, DemandResponseResult{AccountId: accountId}))
+	if err != nil {
+		logger.Errorf("Error in opting in account %s:%s", accountId, err)
+		return nil, errors.New("Error in opting in to demand response event")
+	}
+	if !ok {
+		return nil, fmt.Errorf("Account %s already opted in to demand response event %d", accountId, id)
+	}
+	logger.Infof("Account %s opted in to demand response event %d", accountId, id)
+
+	return nil, nil
+}
+
+// Closes a demand response event once all its rounds are settled. Each participant is
+// credited for its reduction below baseline from the exchange account, which must hold
+// enough to pay all incentives. Only the administrator can do it.
+func (t *EnergyTradingChainCode) closeDemandResponse(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	logger.Info("In closeDemandResponse function")
+	if len(args) != 1 {
+		logger.Error("Incorrect number of arguments")
+		return nil, errors.New("Incorrect number of arguments. Specify event id")
+	}
+
+	id, err := strconv.ParseInt(args[0], 10, 64)
+	if err != nil {
+		logger.Errorf("Error in converting to int:%s", err.Error())
+		return nil, fmt.Errorf("Invalid value of event id:%s", args[0])
+	}
+
+	err = t.checkAdmin(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	event, err := t.getEvent(stub, id)
+	if err != nil {
+		logger.Errorf("Failed retrieving demand response event [%d]: [%s]", id, err)
+		return nil, fmt.Errorf("Failed retrieving demand response event [%d]: [%s]", id, err)
+	}
+	if event == nil {
+		return nil, fmt.Errorf("Demand response event %d not found", id)
+	}
+	if event.Status != eventAnnounced {
+		return nil, fmt.Errorf("Demand response event %d is already %s", id, event.Status)
+	}
+	currentRound, err := t.getCurrentRound(stub)
+	if err != nil {
+		return nil, err
+	}
+	if currentRound <= event.EndRound {
+		logger.Errorf("Demand response event %d ends in round %d, open round is %d", id, event.EndRound, currentRound)
+		return nil, fmt.Errorf("Demand response event %d cannot be closed before round %d is settled", id, event.EndRound)
+	}
+
+	baselineFrom := event.StartRound - event.BaselineRounds
+	if baselineFrom < 1 {
+		baselineFrom = 1
+	}
+	baselineRounds := event.StartRound - baselineFrom
+	eventRounds := event.EndRound - event.StartRound + 1
+
+	ledger := ledgerDeltas{}
+	for i := range event.Participants {
+		result := &event.Participants[i]
+		if baselineRounds > 0 {
+			consumed, err := t.getConsumption(stub, result.AccountId, baselineFrom, event.StartRound-1)
+			if err != nil {
+				logger.Errorf("Failed retrieving baseline of account %s: %s", result.AccountId, err)
+				return nil, fmt.Errorf("Failed retrieving baseline of account %s", result.AccountId)
+			}
+			result.BaselineKwh = float64(consumed) / float64(baselineRounds)
+		}
+		result.ActualKwh, err = t.getConsumption(stub, result.AccountId, event.StartRound, event.EndRound)
+		if err != nil {
+			logger.Errorf("Failed retrieving consumption of account %s: %s", result.AccountId, err)
+			return nil, fmt.Errorf("Failed retrieving consumption of account %s", result.AccountId)
+		}
+		result.ReductionKwh = math.Max(0, result.BaselineKwh*float64(eventRounds)-float64(result.ActualKwh))
+		result.Incentive = result.ReductionKwh * event.IncentivePerKwh
+		logger.Debugf("Account %s reduced consumption by %f kwh in event %d", result.AccountId, result.ReductionKwh, id)
+
+		event.ReductionKwh = event.ReductionKwh + result.ReductionKwh
+		event.Incentives = event.Incentives + result.Incentive
+	}
+
+	xchngBalanceStr, err := stub.GetState("exchange_account_balance")
+	if err != nil {
+		logger.Error("Failed to retrieve exchange account balance")
+		return nil, fmt.Errorf("Failed to retrieve exchange account balance")
+	}
+	xchngBalance, err := strconv.ParseFloat(string(xchngBalanceStr), 64)
+	if err != nil {
+		logger.Errorf("Invalid value %s for exchange account balance", xchngBalanceStr)
+		return nil, errors.New("Invalid value for exchange account balance")
+	}
+	if xchngBalance < event.Incentives {
+		logger.Errorf("Exchange account balance %f cannot cover incentives of %f", xchngBalance, event.Incentives)
+		return nil, fmt.Errorf("Insufficient funds in exchange account to pay incentives of %f", event.Incentives)
+	}
+
+	for _, result := range event.Participants {
+		if result.Incentive > 0 {
+			err = t.adjustBalance(stub, result.AccountId, result.Incentive)
+			if err != nil {
+				logger.Errorf("Error in crediting account %s:%s", result.AccountId, err)
+				return nil, fmt.Errorf("Error in crediting account %s", result.AccountId)
+			}
+			ledger.transfer(exchangeAccountId, result.AccountId, result.Incentive)
+		}
+		ok, err := stub.ReplaceRow(participantsTableName, t.participantRow(id, result))
+		if !ok || err != nil {
+			logger.Errorf("Error in recording result of account %s:%s", result.AccountId, err)
+			return nil, errors.New("Error in recording demand response result")
+		}
+	}
+	if event.Incentives > 0 {
+		err = t.adjustBalance(stub, exchangeAccountId, -event.Incentives)
+		if err != nil {
+			logger.Errorf("Error in debiting exchange account:%s", err)
+			return nil, errors.New("Error in debiting exchange account")
+		}
+	}
+	err = t.commitLedger(stub, ledger)
+	if err != nil {
+		logger.Errorf("Error in updating account totals:%s", err.Error())
+		return nil, errors.New("Error in updating account totals")
+	}
+
+	event.Status = eventClosed
+	event.TargetMet = event.ReductionKwh >= float64(event.TargetKwh)
+	ok, err := stub.ReplaceRow(eventsTableName, t.eventRow(*event))
+	if !ok || err != nil {
+		logger.Errorf("Error in closing demand response event %d:%s", id, err)
+		return nil, errors.New("Error in closing demand response event")
+	}
+	logger.Infof("Closed demand response event %d, reduction of %f kwh, incentives of %f", id, event.ReductionKwh, event.Incentives)
+
+	return nil, nil
+}
+
+// Return a demand response event with its participants and their results
+func (t *EnergyTradingChainCode) demandResponseEvent(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	logger.Info("In demandResponseEvent function")
+	if len(args) != 1 {
+		logger.Error("Incorrect number of arguments")
+		return nil, errors.New("Incorrect number of arguments. Specify event id")
+	}
+
+	id, err := strconv.ParseInt(args[0], 10, 64)
+	if err != nil {
+		logger.Errorf("Error in converting to int:%s", err.Error())
+		return nil, fmt.Errorf("Invalid value of event id:%s", args[0])
+	}
+	event, err := t.getEvent(stub, id)
+	if err != nil {
+		logger.Errorf("Failed retrieving demand response event [%d]: [%s]", id, err)
+		return nil, fmt.Errorf("Failed retrieving demand response event [%d]: [%s]", id, err)
+	}
+	if event == nil {
+		return nil, fmt.Errorf("Demand response event %d not found", id)
+	}
+
+	payload, err := json.Marshal(event)
+	if err != nil {
+		logger.Errorf("Failed marshalling payload: [%s]", err)
+		return nil, fmt.Errorf("Failed marshalling payload [%s]", err)
+	}
+
+	return payload, nil
+}
+
+// Return all demand response events without their participants
+func (t *EnergyTradingChainCode) demandResponseEvents(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	logger.Info("In demandResponseEvents function")
+	if len(args) > 0 {
+		logger.Error("Incorrect number of arguments")
+		return nil, errors.New("Incorrect number of arguments. No arguments necessary")
+	}
+
+	var columns []shim.Column
+	rowChannel, err := stub.GetRows(eventsTableName, columns)
+	if err != nil {
+		logger.Errorf("Error in getting rows:%s", err.Error())
+		return nil, errors.New("Error in fetching rows")
+	}
+	events := make([]DemandResponseEvent, 0)
+	for row := range rowChannel {
+		event, err := t.extractEvent(row)
+		if err != nil {
+			logger.Errorf("Invalid demand response event: %s", err)
+			return nil, err
+		}
+		events = append(events, event)
+	}
+
+	payload, err := json.Marshal(events)
+	if err != nil {
+		logger.Errorf("Failed marshalling payload")
+		return nil, fmt.Errorf("Failed marshalling payload [%s]", err)
+	}
+
+	return payload, nil
+}
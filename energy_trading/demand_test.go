@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/json"
+	"math/rand"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/predix/chaincode_example/energy_trading/memstub"
+)
+
+func queryAs(tb testing.TB, t *EnergyTradingChainCode, stub *memstub.Stub, function string, args ...string) []byte {
+	payload, err := t.Query(stub, function, args)
+	if err != nil {
+		tb.Fatalf("%s %v failed: %s", function, args, err)
+	}
+	return payload
+}
+
+// Reports the same reading of an interval from meter and head-end, so that it counts.
+// The meter reports as its owner, the head-end as the administrator.
+func reportInterval(tb testing.TB, t *EnergyTradingChainCode, stub *memstub.Stub, accountId string, kwh int64, interval string) {
+	invokeAs(tb, t, stub, []byte("owner-"+accountId), "reportDelta", accountId, strconv.FormatInt(kwh, 10), sourceMeter, interval)
+	invokeAs(tb, t, stub, testAdmin, "reportDelta", accountId, strconv.FormatInt(kwh, 10), sourceHeadEnd, interval)
+}
+
+func TestPlainDeltaRejectedUnderDemandTariff(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	cc, stub := newTestChaincode(t)
+	enrollMeters(t, cc, stub, r, 2)
+
+	invokeAs(t, cc, stub, testAdmin, "reportDelta", "2", "-5")
+	invokeAs(t, cc, stub, testAdmin, "setDemandTariff", "2.5", "1", "60")
+
+	_, err := invokeChaincode(cc, stub, testAdmin, "reportDelta", "2", "-5")
+	if err == nil || !strings.Contains(err.Error(), "Specify the reading source and interval") {
+		t.Fatalf("Plain delta under a demand tariff returned %v", err)
+	}
+	reportInterval(t, cc, stub, "2", -4, "2026-10-01T10:00:00Z")
+
+	var demand DemandCharge
+	err = json.Unmarshal(queryAs(t, cc, stub, "peakDemand", "2"), &demand)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if demand.Intervals != 1 || demand.PeakKw != 4 || demand.PeakInterval != "2026-10-01T10:00:00Z" || demand.Charge != 7.5 {
+		t.Errorf("Peak demand %+v", demand)
+	}
+	kwh := string(queryAs(t, cc, stub, "reportedKwh", "2"))
+	if kwh != "-9" {
+		t.Errorf("Reported kwh %s, want -9", kwh)
+	}
+}
+
+// Deploying again keeps the open billing cycle, so the consumption of the next cycle
+// does not collide with that already charged
+func TestInitKeepsBillingCycle(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	cc, stub := newTestChaincode(t)
+	enrollMeters(t, cc, stub, r, 2)
+	invokeAs(t, cc, stub, testAdmin, "setDemandTariff", "2.5", "1", "60")
+	reportInterval(t, cc, stub, "2", -4, "2026-10-01T10:00:00Z")
+	invokeAs(t, cc, stub, testAdmin, "closeBillingCycle")
+
+	stub.Caller = testAdmin
+	_, err := cc.Init(stub, "init", []string{"0.01"})
+	if err != nil {
+		t.Fatalf("Init failed: %s", err)
+	}
+	cycle := string(queryAs(t, cc, stub, "billingCycle"))
+	if cycle != "2" {
+		t.Fatalf("Open billing cycle %s after deploying again, want 2", cycle)
+	}
+
+	// The same interval in the new cycle is recorded anew
+	reportInterval(t, cc, stub, "2", -3, "2026-11-01T10:00:00Z")
+	var demand DemandCharge
+	err = json.Unmarshal(queryAs(t, cc, stub, "peakDemand", "2"), &demand)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if demand.Cycle != 2 || demand.Intervals != 1 || demand.PeakKw != 3 {
+		t.Errorf("Peak demand %+v", demand)
+	}
+}
@@ -0,0 +1,463 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/predix/chaincode_example/energy_trading/settlement"
+)
+
+// Dispute states
+const (
+	disputeOpen     = "open"
+	disputeResolved = "resolved"
+)
+
+// Adjustment is money moved between two accounts to correct a settlement
+type Adjustment struct {
+	From   string  `json:"from"`
+	To     string  `json:"to"`
+	Amount float64 `json:"amount"`
+}
+
+// Dispute raised by a meter owner against a settled round. Adjustments are the
+// compensating transfers posted by the administrator when resolving it, Trades the
+// trades of the disputing meter in the round.
+type Dispute struct {
+	Id          int64              `json:"id"`
+	AccountId   string             `json:"account_id"`
+	Round       int64              `json:"round"`
+	Reason      string             `json:"reason"`
+	Status      string             `json:"status"`
+	Resolution  string             `json:"resolution,omitempty"`
+	Adjustments []Adjustment       `json:"adjustments,omitempty"`
+	Trades      []settlement.Trade `json:"trades,omitempty"`
+}
+
+// Records the trades of a settlement round so they can be looked up later
+func (t *EnergyTradingChainCode) recordTrades(stub shim.ChaincodeStubInterface, round int64, trades []settlement.Trade) error {
+	for i, trade := range trades {
+		ok, err := stub.InsertRow(tradesTableName, shim.Row{
+			Columns: []*shim.Column{
+				&shim.Column{Value: &shim.Column_Int64{Int64: round}},
+				&shim.Column{Value: &shim.Column_Int64{Int64: int64(i)}},
+				&shim.Column{Value: &shim.Column_String_{String_: trade.Seller}},
+				&shim.Column{Value: &shim.Column_String_{String_: trade.Buyer}},
+				&shim.Column{Value: &shim.Column_Int64{Int64: trade.Kwh}},
+				&shim.Column{Value: &shim.Column_Int64{Int64: trade.RatePerKwh}},
+				&shim.Column{Value: &shim.Column_String_{String_: strconv.FormatFloat(trade.Amount, 'f', 6, 64)}},
+				&shim.Column{Value: &shim.Column_String_{String_: strconv.FormatFloat(trade.Fee, 'f', 6, 64)}},
+			},
+		})
+		if !ok || err != nil {
+			return fmt.Errorf("Error in recording trade %d of round %d: %s", i, round, err)
+		}
+	}
+	return nil
+}
+
+// Returns the trades of a round, only those of one meter if accountId is not empty
+func (t *EnergyTradingChainCode) getTrades(stub shim.ChaincodeStubInterface, round int64, accountId string) ([]settlement.Trade, error) {
+	var columns []shim.Column
+	col1 := shim.Column{Value: &shim.Column_Int64{Int64: round}}
+	columns = append(columns, col1)
+
+	rowChannel, err := stub.GetRows(tradesTableName, columns)
+	if err != nil {
+		return nil, err
+	}
+	rows := make([]shim.Row, 0)
+	for row := range rowChannel {
+		rows = append(rows, row)
+	}
+
+	trades := make([]settlement.Trade, len(rows))
+	for _, row := range rows {
+		seq := row.Columns[1].GetInt64()
+		if seq < 0 || seq >= int64(len(rows)) {
+			return nil, fmt.Errorf("Invalid trade %d in round %d", seq, round)
+		}
+		amount, err := strconv.ParseFloat(row.Columns[6].GetString_(), 64)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid value of amount:%s", row.Columns[6].GetString_())
+		}
+		fee, err := strconv.ParseFloat(row.Columns[7].GetString_(), 64)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid value of fee:%s", row.Columns[7].GetString_())
+		}
+		trades[seq] = settlement.Trade{
+			Seller:     row.Columns[2].GetString_(),
+			Buyer:      row.Columns[3].GetString_(),
+			Kwh:        row.Columns[4].GetInt64(),
+			RatePerKwh: row.Columns[5].GetInt64(),
+			Amount:     amount,
+			Fee:        fee,
+		}
+	}
+
+	if accountId == "" {
+		return trades, nil
+	}
+	filtered := make([]settlement.Trade, 0)
+	for _, trade := range trades {
+		if trade.Seller == accountId || trade.Buyer == accountId {
+			filtered = append(filtered, trade)
+		}
+	}
+	return filtered, nil
+}
+
+func (t *EnergyTradingChainCode) disputeRow(dispute Dispute) shim.Row {
+	return shim.Row{
+		Columns: []*shim.Column{
+			&shim.Column{Value: &shim.Column_Int64{Int64: dispute.Id}},
+			&shim.Column{Value: &shim.Column_String_{String_: dispute.AccountId}},
+			&shim.Column{Value: &shim.Column_Int64{Int64: dispute.Round}},
+			&shim.Column{Value: &shim.Column_String_{String_: dispute.Reason}},
+			&shim.Column{Value: &shim.Column_String_{String_: dispute.Status}},
+			&shim.Column{Value: &shim.Column_String_{String_: dispute.Resolution}},
+		},
+	}
+}
+
+func (t *EnergyTradingChainCode) extractDispute(row shim.Row) Dispute {
+	return Dispute{
+		Id:         row.Columns[0].GetInt64(),
+		AccountId:  row.Columns[1].GetString_(),
+		Round:      row.Columns[2].GetInt64(),
+		Reason:     row.Columns[3].GetString_(),
+		Status:     row.Columns[4].GetString_(),
+		Resolution: row.Columns[5].GetString_(),
+	}
+}
+
+// Returns a dispute along with its adjustments and the trades it refers to. Returns nil
+// if there is no such dispute.
+func (t *EnergyTradingChainCode) getDispute(stub shim.ChaincodeStubInterface, id int64) (*Dispute, error) {
+	var columns []shim.Column
+	col1 := shim.Column{Value: &shim.Column_Int64{Int64: id}}
+	columns = append(columns, col1)
+
+	row, err := stub.GetRow(disputesTableName, columns)
+	if err != nil {
+		return nil, err
+	}
+	if len(row.Columns) == 0 {
+		return nil, nil
+	}
+	dispute := t.extractDispute(row)
+
+	rowChannel, err := stub.GetRows(adjustmentsTableName, columns)
+	if err != nil {
+		return nil, err
+	}
+	rows := make([]shim.Row, 0)
+	for row := range rowChannel {
+		rows = append(rows, row)
+	}
+	dispute.Adjustments = make([]Adjustment, len(rows))
+	for _, row := range rows {
+		seq := row.Columns[1].GetInt64()
+		if seq < 0 || seq >= int64(len(rows)) {
+			return nil, fmt.Errorf("Invalid adjustment %d of dispute %d", seq, id)
+		}
+		amount, err := strconv.ParseFloat(row.Columns[4].GetString_(), 64)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid value of amount:%s", row.Columns[4].GetString_())
+		}
+		dispute.Adjustments[seq] = Adjustment{From: row.Columns[2].GetString_(), To: row.Columns[3].GetString_(), Amount: amount}
+	}
+
+	dispute.Trades, err = t.getTrades(stub, dispute.Round, dispute.AccountId)
+	if err != nil {
+		return nil, err
+	}
+	return &dispute, nil
+}
+
+// Adds delta to the balance of a meter or of the exchange account
+func (t *EnergyTradingChainCode) adjustBalance(stub shim.ChaincodeStubInterface, accountId string, delta float64) error {
+	if accountId == exchangeAccountId {
+		xchngBalanceStr, err := stub.GetState("exchange_account_balance")
+		if err != nil {
+			return errors.New("Failed to retrieve exchange account balance")
+		}
+		xchngBalance, err := strconv.ParseFloat(string(xchngBalanceStr), 64)
+		if err != nil {
+			return fmt.Errorf("Invalid value %s for exchange account balance", xchngBalanceStr)
+		}
+		return stub.PutState("exchange_account_balance", []byte(strconv.FormatFloat(xchngBalance+delta, 'f', 6, 64)))
+	}
+
+	row, err := t.getRow(stub, accountId)
+	if err != nil {
+		return fmt.Errorf("Failed retrieving account [%s]: [%s]", accountId, err)
+	}
+	if len(row.Columns) == 0 {
+		return fmt.Errorf("Account %s not found", accountId)
+	}
+	balance, err := strconv.ParseFloat(row.Columns[3].GetString_(), 64)
+	if err != nil {
+		return fmt.Errorf("Invalid value of accountBalance:%s", row.Columns[3].GetString_())
+	}
+	row.Columns[3] = &shim.Column{Value: &shim.Column_String_{String_: strconv.FormatFloat(balance+delta, 'f', 6, 64)}}
+	ok, err := t.updateRow(stub, row)
+	if !ok || err != nil {
+		return fmt.Errorf("Error in updating balance of account %s: %s", accountId, err)
+	}
+	return nil
+}
+
+// Opens a dispute against a settled round. Only the meter owner can do it.
+func (t *EnergyTradingChainCode) openDispute(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	logger.Info("In openDispute function")
+	if len(args) != 3 {
+		logger.Error("Incorrect number of arguments")
+		return nil, errors.New("Incorrect number of arguments. Specify account number, settlement round and reason")
+	}
+
+	accountId := args[0]
+	round, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil {
+		logger.Errorf("Error in converting to int:%s", err.Error())
+		return nil, fmt.Errorf("Invalid value of settlement round:%s", args[1])
+	}
+	reason := strings.TrimSpace(args[2])
+	if reason == "" {
+		logger.Error("Empty dispute reason")
+		return nil, errors.New("Specify the reason of the dispute")
+	}
+
+	currentRound, err := t.getCurrentRound(stub)
+	if err != nil {
+		return nil, err
+	}
+	if round < 1 || round >= currentRound {
+		logger.Errorf("Dispute on round %d while round %d is open", round, currentRound)
+		return nil, fmt.Errorf("Round %d has not been settled", round)
+	}
+
+	_, _, err = t.checkMeterOwner(stub, accountId)
+	if err != nil {
+		return nil, err
+	}
+
+	countStr, err := stub.GetState("dispute_count")
+	if err != nil {
+		logger.Error("Failed to retrieve dispute count")
+		return nil, errors.New("Failed to retrieve dispute count")
+	}
+	var count int64
+	if len(countStr) > 0 {
+		count, err = strconv.ParseInt(string(countStr), 10, 64)
+		if err != nil {
+			logger.Errorf("Invalid value %s for dispute count", countStr)
+			return nil, errors.New("Invalid value for dispute count")
+		}
+	}
+
+	dispute := Dispute{Id: count + 1, AccountId: accountId, Round: round, Reason: reason, Status: disputeOpen}
+	ok, err := stub.InsertRow(disputesTableName, t.disputeRow(dispute))
+	if !ok || err != nil {
+		logger.Errorf("Error in opening dispute of account %s:%s", accountId, err)
+		return nil, errors.New("Error in opening dispute")
+	}
+	err = stub.PutState("dispute_count", []byte(strconv.FormatInt(dispute.Id, 10)))
+	if err != nil {
+		logger.Errorf("Error saving dispute count %s", err.Error())
+		return nil, errors.New("Dispute count cannot be saved")
+	}
+	logger.Infof("Opened dispute %d of account %s on round %d", dispute.Id, accountId, round)
+
+	return []byte(strconv.FormatInt(dispute.Id, 10)), nil
+}
+
+// Resolves an open dispute by moving money between accounts. The adjustments are a JSON
+// list of {"from", "to", "amount"} transfers, the exchange account can take part as
+// "exchange". An empty list closes the dispute without changes. Only the administrator
+// can do it.
+func (t *EnergyTradingChainCode) resolveDispute(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	logger.Info("In resolveDispute function")
+	if len(args) < 2 || len(args) > 3 {
+		logger.Error("Incorrect number of arguments")
+		return nil, errors.New("Incorrect number of arguments. Specify dispute id, adjustments and optionally a resolution note")
+	}
+
+	id, err := strconv.ParseInt(args[0], 10, 64)
+	if err != nil {
+		logger.Errorf("Error in converting to int:%s", err.Error())
+		return nil, fmt.Errorf("Invalid value of dispute id:%s", args[0])
+	}
+	var adjustments []Adjustment
+	err = json.Unmarshal([]byte(args[1]), &adjustments)
+	if err != nil {
+		logger.Errorf("Invalid adjustments %s", args[1])
+		return nil, fmt.Errorf("Invalid adjustments [%s]", err)
+	}
+	for _, adjustment := range adjustments {
+		if adjustment.Amount <= 0 || adjustment.From == "" || adjustment.To == "" || adjustment.From == adjustment.To {
+			logger.Errorf("Invalid adjustment of %f from %s to %s", adjustment.Amount, adjustment.From, adjustment.To)
+			return nil, fmt.Errorf("Invalid adjustment of %f from %s to %s", adjustment.Amount, adjustment.From, adjustment.To)
+		}
+	}
+	resolution := ""
+	if len(args) == 3 {
+		resolution = args[2]
+	}
+
+	err = t.checkAdmin(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	dispute, err := t.getDispute(stub, id)
+	if err != nil {
+		logger.Errorf("Failed retrieving dispute [%d]: [%s]", id, err)
+		return nil, fmt.Errorf("Failed retrieving dispute [%d]: [%s]", id, err)
+	}
+	if dispute == nil {
+		return nil, fmt.Errorf("Dispute %d not found", id)
+	}
+	if dispute.Status != disputeOpen {
+		logger.Errorf("Dispute %d is already %s", id, dispute.Status)
+		return nil, fmt.Errorf("Dispute %d is already %s", id, dispute.Status)
+	}
+
+	ledger := ledgerDeltas{}
+	for i, adjustment := range adjustments {
+		err = t.adjustBalance(stub, adjustment.From, -adjustment.Amount)
+		if err == nil {
+			err = t.adjustBalance(stub, adjustment.To, adjustment.Amount)
+		}
+		if err != nil {
+			logger.Errorf("Error in applying adjustment %d of dispute %d:%s", i, id, err)
+			return nil, fmt.Errorf("Error in applying adjustment of %f from %s to %s: %s", adjustment.Amount, adjustment.From, adjustment.To, err)
+		}
+		ledger.transfer(adjustment.From, adjustment.To, adjustment.Amount)
+
+		ok, err := stub.InsertRow(adjustmentsTableName, shim.Row{
+			Columns: []*shim.Column{
+				&shim.Column{Value: &shim.Column_Int64{Int64: id}},
+				&shim.Column{Value: &shim.Column_Int64{Int64: int64(i)}},
+				&shim.Column{Value: &shim.Column_String_{String_: adjustment.From}},
+				&shim.Column{Value: &shim.Column_String_{String_: adjustment.To}},
+				&shim.Column{Value: &shim.Column_String_{String_: strconv.FormatFloat(adjustment.Amount, 'f', 6, 64)}},
+			},
+		})
+		if !ok || err != nil {
+			logger.Errorf("Error in recording adjustment %d of dispute %d:%s", i, id, err)
+			return nil, errors.New("Error in recording adjustment")
+		}
+	}
+
+	err = t.commitLedger(stub, ledger)
+	if err != nil {
+		logger.Errorf("Error in updating account totals:%s", err.Error())
+		return nil, errors.New("Error in updating account totals")
+	}
+
+	dispute.Status = disputeResolved
+	dispute.Resolution = resolution
+	ok, err := stub.ReplaceRow(disputesTableName, t.disputeRow(*dispute))
+	if !ok || err != nil {
+		logger.Errorf("Error in resolving dispute %d:%s", id, err)
+		return nil, errors.New("Error in resolving dispute")
+	}
+	logger.Infof("Resolved dispute %d with %d adjustments", id, len(adjustments))
+
+	return nil, nil
+}
+
+// Return a dispute with its adjustments and the trades of the disputed round
+func (t *EnergyTradingChainCode) dispute(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	logger.Info("In dispute function")
+	if len(args) != 1 {
+		logger.Error("Incorrect number of arguments")
+		return nil, errors.New("Incorrect number of arguments. Specify dispute id")
+	}
+
+	id, err := strconv.ParseInt(args[0], 10, 64)
+	if err != nil {
+		logger.Errorf("Error in converting to int:%s", err.Error())
+		return nil, fmt.Errorf("Invalid value of dispute id:%s", args[0])
+	}
+	dispute, err := t.getDispute(stub, id)
+	if err != nil {
+		logger.Errorf("Failed retrieving dispute [%d]: [%s]", id, err)
+		return nil, fmt.Errorf("Failed retrieving dispute [%d]: [%s]", id, err)
+	}
+	if dispute == nil {
+		return nil, fmt.Errorf("Dispute %d not found", id)
+	}
+
+	payload, err := json.Marshal(dispute)
+	if err != nil {
+		logger.Errorf("Failed marshalling payload: [%s]", err)
+		return nil, fmt.Errorf("Failed marshalling payload [%s]", err)
+	}
+
+	return payload, nil
+}
+
+// Return all disputes, optionally only those of one meter
+func (t *EnergyTradingChainCode) disputes(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	logger.Info("In disputes function")
+	if len(args) > 1 {
+		logger.Error("Incorrect number of arguments")
+		return nil, errors.New("Incorrect number of arguments. Optionally specify account number")
+	}
+
+	var columns []shim.Column
+	rowChannel, err := stub.GetRows(disputesTableName, columns)
+	if err != nil {
+		logger.Errorf("Error in getting rows:%s", err.Error())
+		return nil, errors.New("Error in fetching rows")
+	}
+	disputes := make([]Dispute, 0)
+	for row := range rowChannel {
+		dispute := t.extractDispute(row)
+		if len(args) == 0 || dispute.AccountId == args[0] {
+			disputes = append(disputes, dispute)
+		}
+	}
+
+	payload, err := json.Marshal(disputes)
+	if err != nil {
+		logger.Errorf("Failed marshalling payload")
+		return nil, fmt.Errorf("Failed marshalling payload [%s]", err)
+	}
+
+	return payload, nil
+}
+
+// Return the trades of a settled round
+func (t *EnergyTradingChainCode) trades(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	logger.Info("In trades function")
+	if len(args) != 1 {
+		logger.Error("Incorrect number of arguments")
+		return nil, errors.New("Incorrect number of arguments. Specify settlement round")
+	}
+
+	round, err := strconv.ParseInt(args[0], 10, 64)
+	if err != nil {
+		logger.Errorf("Error in converting to int:%s", err.Error())
+		return nil, fmt.Errorf("Invalid value of settlement round:%s", args[0])
+	}
+	trades, err := t.getTrades(stub, round, "")
+	if err != nil {
+		logger.Errorf("Failed retrieving trades of round %d: [%s]", round, err)
+		return nil, fmt.Errorf("Failed retrieving trades of round %d: [%s]", round, err)
+	}
+
+	payload, err := json.Marshal(trades)
+	if err != nil {
+		logger.Errorf("Failed marshalling payload")
+		return nil, fmt.Errorf("Failed marshalling payload [%s]", err)
+	}
+
+	return payload, nil
+}
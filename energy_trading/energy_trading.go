@@ -1,43 +1,41 @@
 package main
 
 import (
+	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"sort"
 	"strconv"
 
 	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/predix/chaincode_example/energy_trading/settlement"
 )
 
 var logger = shim.NewLogger("energy_trading")
 
 const (
-	tableName = "Meters"
+	tableName                = "Meters"
+	metadataTableName        = "MeterMetadata"
+	forecastTableName        = "Forecasts"
+	forecastStatsTableName   = "ForecastStats"
+	readingsTableName        = "Readings"
+	discrepanciesTableName   = "Discrepancies"
+	totalsTableName          = "AccountTotals"
+	tradesTableName          = "Trades"
+	disputesTableName        = "Disputes"
+	adjustmentsTableName     = "Adjustments"
+	consumptionTableName     = "IntervalConsumption"
+	demandChargesTableName   = "DemandCharges"
+	roundEnergyTableName     = "RoundEnergy"
+	eventsTableName          = "DemandResponseEvents"
+	participantsTableName    = "DemandResponseParticipants"
+	fundsRequestsTableName   = "FundsRequests"
+	fundsReferencesTableName = "FundsReferences"
+	emissionFactorsTableName = "EmissionFactors"
+	carbonTableName          = "CarbonRecords"
+	rateHistoryTableName     = "RateHistory"
 )
 
-type MeterInfo struct {
-	Id             string  `json:"id"`
-	Name           string  `json:"name"`
-	Kwh            int64   `json:"kwh"`
-	AccountBalance float64 `json:"account_balance"`
-	RatePerKwh     int64   `json:"rate_per_kwh"`
-}
-
-type ByRate []*MeterInfo
-
-func (a ByRate) Len() int {
-	return len(a)
-}
-
-func (a ByRate) Swap(i, j int) {
-	a[i], a[j] = a[j], a[i]
-}
-
-func (a ByRate) Less(i, j int) bool {
-	return a[i].RatePerKwh < a[j].RatePerKwh
-}
-
 // EnergyTradingChainCode implementation. This smart contract enables multiple smart meters
 // to enroll and report their production/consumption of energy. It then lets user settle
 // their accounts by moving funds from consumers to producers.
@@ -65,14 +63,125 @@ func (t *EnergyTradingChainCode) Init(stub shim.ChaincodeStubInterface, function
 		return nil, errors.New("Exchange rate cannot be saved")
 	}
 
-	var exchangeAccountBalance float64
-	exchangeAccountBalance = 0.0
-	err = stub.PutState("exchange_account_balance", []byte(strconv.FormatFloat(exchangeAccountBalance, 'f', 6, 64)))
+	// A deploy over an earlier one keeps the balance of the exchange account
+	xchngBalanceStr, err := stub.GetState("exchange_account_balance")
 	if err != nil {
-		logger.Errorf("Error saving exchange account balance %s", err.Error())
-		return nil, errors.New("Exchange account balance cannot be saved")
+		logger.Error("Failed to retrieve exchange account balance")
+		return nil, errors.New("Failed to retrieve exchange account balance")
+	}
+	if len(xchngBalanceStr) == 0 {
+		var exchangeAccountBalance float64
+		exchangeAccountBalance = 0.0
+		err = stub.PutState("exchange_account_balance", []byte(strconv.FormatFloat(exchangeAccountBalance, 'f', 6, 64)))
+		if err != nil {
+			logger.Errorf("Error saving exchange account balance %s", err.Error())
+			return nil, errors.New("Exchange account balance cannot be saved")
+		}
+	}
+
+	fresh, err := t.isFreshDeploy(stub)
+	if err != nil {
+		return nil, err
 	}
 
+	err = t.createTables(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	if fresh {
+		err = stub.PutState("schema_version", []byte(strconv.FormatInt(currentSchemaVersion, 10)))
+		if err != nil {
+			logger.Errorf("Error saving schema version %s", err.Error())
+			return nil, errors.New("Schema version cannot be saved")
+		}
+	}
+
+	// Trades and emissions are keyed by round, a deploy over an earlier one continues
+	// with its open round
+	roundStr, err := stub.GetState("settlement_round")
+	if err != nil {
+		logger.Error("Failed to retrieve settlement round")
+		return nil, errors.New("Failed to retrieve settlement round")
+	}
+	if len(roundStr) == 0 {
+		err = stub.PutState("settlement_round", []byte(strconv.FormatInt(1, 10)))
+		if err != nil {
+			logger.Errorf("Error saving settlement round %s", err.Error())
+			return nil, errors.New("Settlement round cannot be saved")
+		}
+	}
+
+	// A deploy over an earlier one keeps the imbalance rate the administrator set
+	rateStr, err := stub.GetState("imbalance_rate")
+	if err != nil {
+		logger.Error("Failed to retrieve imbalance rate")
+		return nil, errors.New("Failed to retrieve imbalance rate")
+	}
+	if len(rateStr) == 0 {
+		err = stub.PutState("imbalance_rate", []byte(strconv.FormatFloat(0.0, 'f', 6, 64)))
+		if err != nil {
+			logger.Errorf("Error saving imbalance rate %s", err.Error())
+			return nil, errors.New("Imbalance rate cannot be saved")
+		}
+	}
+
+	// A deploy over an earlier one keeps the reading tolerance the administrator set
+	toleranceStr, err := stub.GetState("reading_tolerance")
+	if err != nil {
+		logger.Error("Failed to retrieve reading tolerance")
+		return nil, errors.New("Failed to retrieve reading tolerance")
+	}
+	if len(toleranceStr) == 0 {
+		err = stub.PutState("reading_tolerance", []byte(strconv.FormatInt(0, 10)))
+		if err != nil {
+			logger.Errorf("Error saving reading tolerance %s", err.Error())
+			return nil, errors.New("Reading tolerance cannot be saved")
+		}
+	}
+
+	// Consumption and demand charges are keyed by billing cycle, a deploy over an earlier
+	// one continues with its open cycle
+	cycleStr, err := stub.GetState("billing_cycle")
+	if err != nil {
+		logger.Error("Failed to retrieve billing cycle")
+		return nil, errors.New("Failed to retrieve billing cycle")
+	}
+	if len(cycleStr) == 0 {
+		err = stub.PutState("billing_cycle", []byte(strconv.FormatInt(1, 10)))
+		if err != nil {
+			logger.Errorf("Error saving billing cycle %s", err.Error())
+			return nil, errors.New("Billing cycle cannot be saved")
+		}
+	}
+
+	// Set the admin, if the deployer signed the transaction
+	// The metadata will contain the certificate of the administrator
+	adminCert, err := stub.GetCallerMetadata()
+	if err != nil {
+		logger.Debug("Failed getting metadata")
+		return nil, errors.New("Failed getting metadata.")
+	}
+	if len(adminCert) > 0 {
+		logger.Debugf("The administrator is [%x]", adminCert)
+		err = stub.PutState("admin", adminCert)
+		if err != nil {
+			logger.Errorf("Error saving administrator %s", err.Error())
+			return nil, errors.New("Administrator cannot be saved")
+		}
+	} else {
+		logger.Info("No administrator certificate supplied, administrative functions are disabled")
+	}
+
+	logger.Info("Successfully deployed chain code")
+
+	return nil, nil
+}
+
+// Creates the tables that do not exist yet
+func (t *EnergyTradingChainCode) createTables(stub shim.ChaincodeStubInterface) error {
+	var err error
+
 	_, err = stub.GetTable(tableName)
 	if err == shim.ErrTableNotFound {
 		err = stub.CreateTable(tableName, []*shim.ColumnDefinition{
@@ -84,15 +193,352 @@ func (t *EnergyTradingChainCode) Init(stub shim.ChaincodeStubInterface, function
 		})
 		if err != nil {
 			logger.Errorf("Error creating table:%s", err.Error())
-			return nil, errors.New("Failed creating AssetsOnwership table.")
+			return errors.New("Failed creating AssetsOnwership table.")
 		}
 	} else {
 		logger.Info("Table already exists")
 	}
 
-	logger.Info("Successfully deployed chain code")
+	_, err = stub.GetTable(metadataTableName)
+	if err == shim.ErrTableNotFound {
+		err = stub.CreateTable(metadataTableName, []*shim.ColumnDefinition{
+			&shim.ColumnDefinition{Name: "AccountId", Type: shim.ColumnDefinition_STRING, Key: true},
+			&shim.ColumnDefinition{Name: "Owner", Type: shim.ColumnDefinition_BYTES, Key: false},
+			&shim.ColumnDefinition{Name: "Location", Type: shim.ColumnDefinition_STRING, Key: false},
+			&shim.ColumnDefinition{Name: "CapacityKw", Type: shim.ColumnDefinition_STRING, Key: false},
+			&shim.ColumnDefinition{Name: "GenerationType", Type: shim.ColumnDefinition_STRING, Key: false},
+			&shim.ColumnDefinition{Name: "InstallationDate", Type: shim.ColumnDefinition_STRING, Key: false},
+			&shim.ColumnDefinition{Name: "SourcePreference", Type: shim.ColumnDefinition_STRING, Key: false},
+		})
+		if err != nil {
+			logger.Errorf("Error creating table:%s - %s", metadataTableName, err.Error())
+			return errors.New("Failed creating MeterMetadata table.")
+		}
+	} else {
+		logger.Info("Table already exists")
+	}
 
-	return nil, nil
+	_, err = stub.GetTable(forecastTableName)
+	if err == shim.ErrTableNotFound {
+		err = stub.CreateTable(forecastTableName, []*shim.ColumnDefinition{
+			&shim.ColumnDefinition{Name: "AccountId", Type: shim.ColumnDefinition_STRING, Key: true},
+			&shim.ColumnDefinition{Name: "Round", Type: shim.ColumnDefinition_INT64, Key: true},
+			&shim.ColumnDefinition{Name: "ForecastKWH", Type: shim.ColumnDefinition_INT64, Key: false},
+			&shim.ColumnDefinition{Name: "ReportedKWH", Type: shim.ColumnDefinition_INT64, Key: false},
+			&shim.ColumnDefinition{Name: "DeviationKWH", Type: shim.ColumnDefinition_INT64, Key: false},
+			&shim.ColumnDefinition{Name: "ImbalanceCharge", Type: shim.ColumnDefinition_STRING, Key: false},
+			&shim.ColumnDefinition{Name: "Settled", Type: shim.ColumnDefinition_BOOL, Key: false},
+		})
+		if err != nil {
+			logger.Errorf("Error creating table:%s - %s", forecastTableName, err.Error())
+			return errors.New("Failed creating Forecasts table.")
+		}
+	} else {
+		logger.Info("Table already exists")
+	}
+
+	_, err = stub.GetTable(forecastStatsTableName)
+	if err == shim.ErrTableNotFound {
+		err = stub.CreateTable(forecastStatsTableName, []*shim.ColumnDefinition{
+			&shim.ColumnDefinition{Name: "AccountId", Type: shim.ColumnDefinition_STRING, Key: true},
+			&shim.ColumnDefinition{Name: "Rounds", Type: shim.ColumnDefinition_INT64, Key: false},
+			&shim.ColumnDefinition{Name: "TotalDeviationKWH", Type: shim.ColumnDefinition_INT64, Key: false},
+			&shim.ColumnDefinition{Name: "TotalReportedKWH", Type: shim.ColumnDefinition_INT64, Key: false},
+			&shim.ColumnDefinition{Name: "TotalImbalanceCharge", Type: shim.ColumnDefinition_STRING, Key: false},
+		})
+		if err != nil {
+			logger.Errorf("Error creating table:%s - %s", forecastStatsTableName, err.Error())
+			return errors.New("Failed creating ForecastStats table.")
+		}
+	} else {
+		logger.Info("Table already exists")
+	}
+
+	_, err = stub.GetTable(readingsTableName)
+	if err == shim.ErrTableNotFound {
+		err = stub.CreateTable(readingsTableName, []*shim.ColumnDefinition{
+			&shim.ColumnDefinition{Name: "AccountId", Type: shim.ColumnDefinition_STRING, Key: true},
+			&shim.ColumnDefinition{Name: "Interval", Type: shim.ColumnDefinition_STRING, Key: true},
+			&shim.ColumnDefinition{Name: "MeterKWH", Type: shim.ColumnDefinition_INT64, Key: false},
+			&shim.ColumnDefinition{Name: "MeterReported", Type: shim.ColumnDefinition_BOOL, Key: false},
+			&shim.ColumnDefinition{Name: "HeadEndKWH", Type: shim.ColumnDefinition_INT64, Key: false},
+			&shim.ColumnDefinition{Name: "HeadEndReported", Type: shim.ColumnDefinition_BOOL, Key: false},
+			&shim.ColumnDefinition{Name: "Status", Type: shim.ColumnDefinition_STRING, Key: false},
+			&shim.ColumnDefinition{Name: "AcceptedKWH", Type: shim.ColumnDefinition_INT64, Key: false},
+		})
+		if err != nil {
+			logger.Errorf("Error creating table:%s - %s", readingsTableName, err.Error())
+			return errors.New("Failed creating Readings table.")
+		}
+	} else {
+		logger.Info("Table already exists")
+	}
+
+	// Holds the readings currently in discrepancy so settle can find them quickly
+	_, err = stub.GetTable(discrepanciesTableName)
+	if err == shim.ErrTableNotFound {
+		err = stub.CreateTable(discrepanciesTableName, []*shim.ColumnDefinition{
+			&shim.ColumnDefinition{Name: "AccountId", Type: shim.ColumnDefinition_STRING, Key: true},
+			&shim.ColumnDefinition{Name: "Interval", Type: shim.ColumnDefinition_STRING, Key: true},
+		})
+		if err != nil {
+			logger.Errorf("Error creating table:%s - %s", discrepanciesTableName, err.Error())
+			return errors.New("Failed creating Discrepancies table.")
+		}
+	} else {
+		logger.Info("Table already exists")
+	}
+
+	_, err = stub.GetTable(totalsTableName)
+	if err == shim.ErrTableNotFound {
+		err = stub.CreateTable(totalsTableName, []*shim.ColumnDefinition{
+			&shim.ColumnDefinition{Name: "AccountId", Type: shim.ColumnDefinition_STRING, Key: true},
+			&shim.ColumnDefinition{Name: "Deposits", Type: shim.ColumnDefinition_STRING, Key: false},
+			&shim.ColumnDefinition{Name: "Withdrawals", Type: shim.ColumnDefinition_STRING, Key: false},
+			&shim.ColumnDefinition{Name: "Credits", Type: shim.ColumnDefinition_STRING, Key: false},
+			&shim.ColumnDefinition{Name: "Debits", Type: shim.ColumnDefinition_STRING, Key: false},
+			&shim.ColumnDefinition{Name: "KWHSold", Type: shim.ColumnDefinition_INT64, Key: false},
+			&shim.ColumnDefinition{Name: "KWHBought", Type: shim.ColumnDefinition_INT64, Key: false},
+		})
+		if err != nil {
+			logger.Errorf("Error creating table:%s - %s", totalsTableName, err.Error())
+			return errors.New("Failed creating AccountTotals table.")
+		}
+	} else {
+		logger.Info("Table already exists")
+	}
+
+	_, err = stub.GetTable(tradesTableName)
+	if err == shim.ErrTableNotFound {
+		err = stub.CreateTable(tradesTableName, []*shim.ColumnDefinition{
+			&shim.ColumnDefinition{Name: "Round", Type: shim.ColumnDefinition_INT64, Key: true},
+			&shim.ColumnDefinition{Name: "Seq", Type: shim.ColumnDefinition_INT64, Key: true},
+			&shim.ColumnDefinition{Name: "Seller", Type: shim.ColumnDefinition_STRING, Key: false},
+			&shim.ColumnDefinition{Name: "Buyer", Type: shim.ColumnDefinition_STRING, Key: false},
+			&shim.ColumnDefinition{Name: "KWH", Type: shim.ColumnDefinition_INT64, Key: false},
+			&shim.ColumnDefinition{Name: "RatePerKWH", Type: shim.ColumnDefinition_INT64, Key: false},
+			&shim.ColumnDefinition{Name: "Amount", Type: shim.ColumnDefinition_STRING, Key: false},
+			&shim.ColumnDefinition{Name: "Fee", Type: shim.ColumnDefinition_STRING, Key: false},
+		})
+		if err != nil {
+			logger.Errorf("Error creating table:%s - %s", tradesTableName, err.Error())
+			return errors.New("Failed creating Trades table.")
+		}
+	} else {
+		logger.Info("Table already exists")
+	}
+
+	_, err = stub.GetTable(disputesTableName)
+	if err == shim.ErrTableNotFound {
+		err = stub.CreateTable(disputesTableName, []*shim.ColumnDefinition{
+			&shim.ColumnDefinition{Name: "DisputeId", Type: shim.ColumnDefinition_INT64, Key: true},
+			&shim.ColumnDefinition{Name: "AccountId", Type: shim.ColumnDefinition_STRING, Key: false},
+			&shim.ColumnDefinition{Name: "Round", Type: shim.ColumnDefinition_INT64, Key: false},
+			&shim.ColumnDefinition{Name: "Reason", Type: shim.ColumnDefinition_STRING, Key: false},
+			&shim.ColumnDefinition{Name: "Status", Type: shim.ColumnDefinition_STRING, Key: false},
+			&shim.ColumnDefinition{Name: "Resolution", Type: shim.ColumnDefinition_STRING, Key: false},
+		})
+		if err != nil {
+			logger.Errorf("Error creating table:%s - %s", disputesTableName, err.Error())
+			return errors.New("Failed creating Disputes table.")
+		}
+	} else {
+		logger.Info("Table already exists")
+	}
+
+	_, err = stub.GetTable(adjustmentsTableName)
+	if err == shim.ErrTableNotFound {
+		err = stub.CreateTable(adjustmentsTableName, []*shim.ColumnDefinition{
+			&shim.ColumnDefinition{Name: "DisputeId", Type: shim.ColumnDefinition_INT64, Key: true},
+			&shim.ColumnDefinition{Name: "Seq", Type: shim.ColumnDefinition_INT64, Key: true},
+			&shim.ColumnDefinition{Name: "From", Type: shim.ColumnDefinition_STRING, Key: false},
+			&shim.ColumnDefinition{Name: "To", Type: shim.ColumnDefinition_STRING, Key: false},
+			&shim.ColumnDefinition{Name: "Amount", Type: shim.ColumnDefinition_STRING, Key: false},
+		})
+		if err != nil {
+			logger.Errorf("Error creating table:%s - %s", adjustmentsTableName, err.Error())
+			return errors.New("Failed creating Adjustments table.")
+		}
+	} else {
+		logger.Info("Table already exists")
+	}
+
+	// Energy consumed per interval, from which the peak demand of a billing cycle is taken
+	_, err = stub.GetTable(consumptionTableName)
+	if err == shim.ErrTableNotFound {
+		err = stub.CreateTable(consumptionTableName, []*shim.ColumnDefinition{
+			&shim.ColumnDefinition{Name: "AccountId", Type: shim.ColumnDefinition_STRING, Key: true},
+			&shim.ColumnDefinition{Name: "Cycle", Type: shim.ColumnDefinition_INT64, Key: true},
+			&shim.ColumnDefinition{Name: "Interval", Type: shim.ColumnDefinition_STRING, Key: true},
+			&shim.ColumnDefinition{Name: "KWH", Type: shim.ColumnDefinition_INT64, Key: false},
+		})
+		if err != nil {
+			logger.Errorf("Error creating table:%s - %s", consumptionTableName, err.Error())
+			return errors.New("Failed creating IntervalConsumption table.")
+		}
+	} else {
+		logger.Info("Table already exists")
+	}
+
+	_, err = stub.GetTable(demandChargesTableName)
+	if err == shim.ErrTableNotFound {
+		err = stub.CreateTable(demandChargesTableName, []*shim.ColumnDefinition{
+			&shim.ColumnDefinition{Name: "AccountId", Type: shim.ColumnDefinition_STRING, Key: true},
+			&shim.ColumnDefinition{Name: "Cycle", Type: shim.ColumnDefinition_INT64, Key: true},
+			&shim.ColumnDefinition{Name: "Intervals", Type: shim.ColumnDefinition_INT64, Key: false},
+			&shim.ColumnDefinition{Name: "PeakKW", Type: shim.ColumnDefinition_STRING, Key: false},
+			&shim.ColumnDefinition{Name: "PeakInterval", Type: shim.ColumnDefinition_STRING, Key: false},
+			&shim.ColumnDefinition{Name: "Charge", Type: shim.ColumnDefinition_STRING, Key: false},
+		})
+		if err != nil {
+			logger.Errorf("Error creating table:%s - %s", demandChargesTableName, err.Error())
+			return errors.New("Failed creating DemandCharges table.")
+		}
+	} else {
+		logger.Info("Table already exists")
+	}
+
+	// Energy reported by each meter per settlement round, the history demand response
+	// baselines are computed from
+	_, err = stub.GetTable(roundEnergyTableName)
+	if err == shim.ErrTableNotFound {
+		err = stub.CreateTable(roundEnergyTableName, []*shim.ColumnDefinition{
+			&shim.ColumnDefinition{Name: "AccountId", Type: shim.ColumnDefinition_STRING, Key: true},
+			&shim.ColumnDefinition{Name: "Round", Type: shim.ColumnDefinition_INT64, Key: true},
+			&shim.ColumnDefinition{Name: "KWH", Type: shim.ColumnDefinition_INT64, Key: false},
+		})
+		if err != nil {
+			logger.Errorf("Error creating table:%s - %s", roundEnergyTableName, err.Error())
+			return errors.New("Failed creating RoundEnergy table.")
+		}
+	} else {
+		logger.Info("Table already exists")
+	}
+
+	_, err = stub.GetTable(eventsTableName)
+	if err == shim.ErrTableNotFound {
+		err = stub.CreateTable(eventsTableName, []*shim.ColumnDefinition{
+			&shim.ColumnDefinition{Name: "EventId", Type: shim.ColumnDefinition_INT64, Key: true},
+			&shim.ColumnDefinition{Name: "StartRound", Type: shim.ColumnDefinition_INT64, Key: false},
+			&shim.ColumnDefinition{Name: "EndRound", Type: shim.ColumnDefinition_INT64, Key: false},
+			&shim.ColumnDefinition{Name: "TargetKWH", Type: shim.ColumnDefinition_INT64, Key: false},
+			&shim.ColumnDefinition{Name: "IncentivePerKWH", Type: shim.ColumnDefinition_STRING, Key: false},
+			&shim.ColumnDefinition{Name: "BaselineRounds", Type: shim.ColumnDefinition_INT64, Key: false},
+			&shim.ColumnDefinition{Name: "Status", Type: shim.ColumnDefinition_STRING, Key: false},
+			&shim.ColumnDefinition{Name: "ReductionKWH", Type: shim.ColumnDefinition_STRING, Key: false},
+			&shim.ColumnDefinition{Name: "TargetMet", Type: shim.ColumnDefinition_BOOL, Key: false},
+			&shim.ColumnDefinition{Name: "Incentives", Type: shim.ColumnDefinition_STRING, Key: false},
+		})
+		if err != nil {
+			logger.Errorf("Error creating table:%s - %s", eventsTableName, err.Error())
+			return errors.New("Failed creating DemandResponseEvents table.")
+		}
+	} else {
+		logger.Info("Table already exists")
+	}
+
+	_, err = stub.GetTable(participantsTableName)
+	if err == shim.ErrTableNotFound {
+		err = stub.CreateTable(participantsTableName, []*shim.ColumnDefinition{
+			&shim.ColumnDefinition{Name: "EventId", Type: shim.ColumnDefinition_INT64, Key: true},
+			&shim.ColumnDefinition{Name: "AccountId", Type: shim.ColumnDefinition_STRING, Key: true},
+			&shim.ColumnDefinition{Name: "BaselineKWH", Type: shim.ColumnDefinition_STRING, Key: false},
+			&shim.ColumnDefinition{Name: "ActualKWH", Type: shim.ColumnDefinition_INT64, Key: false},
+			&shim.ColumnDefinition{Name: "ReductionKWH", Type: shim.ColumnDefinition_STRING, Key: false},
+			&shim.ColumnDefinition{Name: "Incentive", Type: shim.ColumnDefinition_STRING, Key: false},
+		})
+		if err != nil {
+			logger.Errorf("Error creating table:%s - %s", participantsTableName, err.Error())
+			return errors.New("Failed creating DemandResponseParticipants table.")
+		}
+	} else {
+		logger.Info("Table already exists")
+	}
+
+	_, err = stub.GetTable(fundsRequestsTableName)
+	if err == shim.ErrTableNotFound {
+		err = stub.CreateTable(fundsRequestsTableName, []*shim.ColumnDefinition{
+			&shim.ColumnDefinition{Name: "RequestId", Type: shim.ColumnDefinition_INT64, Key: true},
+			&shim.ColumnDefinition{Name: "AccountId", Type: shim.ColumnDefinition_STRING, Key: false},
+			&shim.ColumnDefinition{Name: "Kind", Type: shim.ColumnDefinition_STRING, Key: false},
+			&shim.ColumnDefinition{Name: "Amount", Type: shim.ColumnDefinition_STRING, Key: false},
+			&shim.ColumnDefinition{Name: "Reference", Type: shim.ColumnDefinition_STRING, Key: false},
+			&shim.ColumnDefinition{Name: "Status", Type: shim.ColumnDefinition_STRING, Key: false},
+			&shim.ColumnDefinition{Name: "Note", Type: shim.ColumnDefinition_STRING, Key: false},
+		})
+		if err != nil {
+			logger.Errorf("Error creating table:%s - %s", fundsRequestsTableName, err.Error())
+			return errors.New("Failed creating FundsRequests table.")
+		}
+	} else {
+		logger.Info("Table already exists")
+	}
+
+	// Payment references already used by a funds request
+	_, err = stub.GetTable(fundsReferencesTableName)
+	if err == shim.ErrTableNotFound {
+		err = stub.CreateTable(fundsReferencesTableName, []*shim.ColumnDefinition{
+			&shim.ColumnDefinition{Name: "Reference", Type: shim.ColumnDefinition_STRING, Key: true},
+			&shim.ColumnDefinition{Name: "RequestId", Type: shim.ColumnDefinition_INT64, Key: false},
+		})
+		if err != nil {
+			logger.Errorf("Error creating table:%s - %s", fundsReferencesTableName, err.Error())
+			return errors.New("Failed creating FundsReferences table.")
+		}
+	} else {
+		logger.Info("Table already exists")
+	}
+
+	_, err = stub.GetTable(emissionFactorsTableName)
+	if err == shim.ErrTableNotFound {
+		err = stub.CreateTable(emissionFactorsTableName, []*shim.ColumnDefinition{
+			&shim.ColumnDefinition{Name: "AccountId", Type: shim.ColumnDefinition_STRING, Key: true},
+			&shim.ColumnDefinition{Name: "Factor", Type: shim.ColumnDefinition_STRING, Key: false},
+		})
+		if err != nil {
+			logger.Errorf("Error creating table:%s - %s", emissionFactorsTableName, err.Error())
+			return errors.New("Failed creating EmissionFactors table.")
+		}
+	} else {
+		logger.Info("Table already exists")
+	}
+
+	_, err = stub.GetTable(carbonTableName)
+	if err == shim.ErrTableNotFound {
+		err = stub.CreateTable(carbonTableName, []*shim.ColumnDefinition{
+			&shim.ColumnDefinition{Name: "AccountId", Type: shim.ColumnDefinition_STRING, Key: true},
+			&shim.ColumnDefinition{Name: "Round", Type: shim.ColumnDefinition_INT64, Key: true},
+			&shim.ColumnDefinition{Name: "Trade", Type: shim.ColumnDefinition_INT64, Key: true},
+			&shim.ColumnDefinition{Name: "Seller", Type: shim.ColumnDefinition_STRING, Key: false},
+			&shim.ColumnDefinition{Name: "Kwh", Type: shim.ColumnDefinition_INT64, Key: false},
+			&shim.ColumnDefinition{Name: "Factor", Type: shim.ColumnDefinition_STRING, Key: false},
+			&shim.ColumnDefinition{Name: "Co2Kg", Type: shim.ColumnDefinition_STRING, Key: false},
+			&shim.ColumnDefinition{Name: "Grid", Type: shim.ColumnDefinition_BOOL, Key: false},
+		})
+		if err != nil {
+			logger.Errorf("Error creating table:%s - %s", carbonTableName, err.Error())
+			return errors.New("Failed creating CarbonRecords table.")
+		}
+	} else {
+		logger.Info("Table already exists")
+	}
+
+	_, err = stub.GetTable(rateHistoryTableName)
+	if err == shim.ErrTableNotFound {
+		err = stub.CreateTable(rateHistoryTableName, []*shim.ColumnDefinition{
+			&shim.ColumnDefinition{Name: "AccountId", Type: shim.ColumnDefinition_STRING, Key: true},
+			&shim.ColumnDefinition{Name: "Round", Type: shim.ColumnDefinition_INT64, Key: true},
+			&shim.ColumnDefinition{Name: "RatePerKwh", Type: shim.ColumnDefinition_INT64, Key: false},
+		})
+		if err != nil {
+			logger.Errorf("Error creating table:%s - %s", rateHistoryTableName, err.Error())
+			return errors.New("Failed creating RateHistory table.")
+		}
+	} else {
+		logger.Info("Table already exists")
+	}
+
+	return nil
 }
 
 func (t *EnergyTradingChainCode) Invoke(stub shim.ChaincodeStubInterface, function string, args []string) ([]byte, error) {
@@ -118,17 +564,106 @@ func (t *EnergyTradingChainCode) Invoke(stub shim.ChaincodeStubInterface, functi
 		return t.settle(stub, args)
 	}
 
+	if function == "updateMeterMetadata" {
+		return t.updateMeterMetadata(stub, args)
+	}
+
+	if function == "setSourcePreference" {
+		return t.setSourcePreference(stub, args)
+	}
+
+	if function == "submitForecast" {
+		return t.submitForecast(stub, args)
+	}
+
+	if function == "setImbalanceRate" {
+		return t.setImbalanceRate(stub, args)
+	}
+
+	if function == "setReadingTolerance" {
+		return t.setReadingTolerance(stub, args)
+	}
+
+	if function == "setHeadEnd" {
+		return t.setHeadEnd(stub, args)
+	}
+
+	if function == "resolveDiscrepancy" {
+		return t.resolveDiscrepancy(stub, args)
+	}
+
+	if function == "openDispute" {
+		return t.openDispute(stub, args)
+	}
+
+	if function == "resolveDispute" {
+		return t.resolveDispute(stub, args)
+	}
+
+	if function == "setDemandTariff" {
+		return t.setDemandTariff(stub, args)
+	}
+
+	if function == "closeBillingCycle" {
+		return t.closeBillingCycle(stub, args)
+	}
+
+	if function == "updateRate" {
+		return t.updateRate(stub, args)
+	}
+
+	if function == "setEmissionFactor" {
+		return t.setEmissionFactor(stub, args)
+	}
+
+	if function == "setGridEmissionFactor" {
+		return t.setGridEmissionFactor(stub, args)
+	}
+
+	if function == "migrate" {
+		return t.migrate(stub, args)
+	}
+
+	if function == "requestDeposit" {
+		return t.requestDeposit(stub, args)
+	}
+
+	if function == "requestWithdrawal" {
+		return t.requestWithdrawal(stub, args)
+	}
+
+	if function == "approveFundsRequest" {
+		return t.approveFundsRequest(stub, args)
+	}
+
+	if function == "rejectFundsRequest" {
+		return t.rejectFundsRequest(stub, args)
+	}
+
+	if function == "declareDemandResponse" {
+		return t.declareDemandResponse(stub, args)
+	}
+
+	if function == "optInDemandResponse" {
+		return t.optInDemandResponse(stub, args)
+	}
+
+	if function == "closeDemandResponse" {
+		return t.closeDemandResponse(stub, args)
+	}
+
 	logger.Errorf("Unimplemented method :%s called", function)
 
 	return nil, errors.New("Unimplemented '" + function + "' invoked")
 }
 
-// Enrolls a new meter
+// Enrolls a new meter. The optional fourth argument is the base64 encoded certificate
+// of the meter owner, who is then allowed to maintain the meter metadata.
 func (t *EnergyTradingChainCode) enroll(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
 	logger.Info("In enroll function")
 	if len(args) < 3 {
 		logger.Error("Incorrect number of arguments")
-		return nil, errors.New("Incorrect number of arguments. Specify account number, name and rate per kwh")
+		return nil, errors.New("Incorrect number of arguments. Specify account number, name, rate per kwh and optionally the owner certificate")
 	}
 
 	accountId := args[0]
@@ -139,6 +674,19 @@ func (t *EnergyTradingChainCode) enroll(stub shim.ChaincodeStubInterface, args [
 		logger.Errorf("Error in converting to int:%s", err.Error())
 		return nil, fmt.Errorf("Invalid value of rate per kwh:%s", rateKwhStr)
 	}
+	if accountId == exchangeAccountId {
+		logger.Errorf("Account id %s is reserved", accountId)
+		return nil, fmt.Errorf("Account id %s is reserved for the exchange", accountId)
+	}
+
+	var owner []byte
+	if len(args) > 3 {
+		owner, err = base64.StdEncoding.DecodeString(args[3])
+		if err != nil {
+			logger.Error("Failed decoding owner certificate")
+			return nil, errors.New("Failed decoding owner")
+		}
+	}
 
 	logger.Infof("Enrolling meter with id:%s, name:%s and target rate:%d", accountId, accountName, rateKwh)
 
@@ -156,6 +704,22 @@ func (t *EnergyTradingChainCode) enroll(stub shim.ChaincodeStubInterface, args [
 		logger.Errorf("Error in enrolling a new account:%s", err)
 		return nil, errors.New("Error in enrolling a new account")
 	}
+
+	ok, err = stub.InsertRow(metadataTableName, t.metadataRow(accountId, owner, settlement.MeterMetadata{SourcePreference: settlement.SourceAny}))
+	if !ok || err != nil {
+		logger.Errorf("Error in saving metadata for account %s:%s", accountId, err)
+		return nil, errors.New("Error in enrolling a new account")
+	}
+
+	round, err := t.getCurrentRound(stub)
+	if err != nil {
+		return nil, err
+	}
+	err = t.recordRate(stub, accountId, round, rateKwh)
+	if err != nil {
+		logger.Errorf("Error in saving rate for account %s:%s", accountId, err)
+		return nil, errors.New("Error in enrolling a new account")
+	}
 	logger.Infof("Enrolled account %s", accountId)
 
 	return nil, nil
@@ -173,14 +737,43 @@ func (t *EnergyTradingChainCode) delete(stub shim.ChaincodeStubInterface, args [
 
 	logger.Infof("Deleting meter with id:%s", accountId)
 
+	row, err := t.getRow(stub, accountId)
+	if err != nil {
+		logger.Errorf("Failed retrieving account [%s]: [%s]", accountId, err)
+		return nil, fmt.Errorf("Failed retrieving account [%s]: [%s]", accountId, err)
+	}
+	if len(row.Columns) > 0 {
+		// The remaining balance leaves the exchange with the account
+		balance, err := strconv.ParseFloat(row.Columns[3].GetString_(), 64)
+		if err != nil {
+			logger.Errorf("Error in converting to float:%s", err.Error())
+			return nil, fmt.Errorf("Invalid value of accountBalance:%s", row.Columns[3].GetString_())
+		}
+		err = t.recordDeposit(stub, accountId, -balance)
+		if err != nil {
+			logger.Errorf("Error in closing the totals of account %s:%s", accountId, err)
+			return nil, errors.New("Error in deleting an account")
+		}
+	}
+
 	var columns []shim.Column
 	col1 := shim.Column{Value: &shim.Column_String_{String_: accountId}}
 	columns = append(columns, col1)
-	err := stub.DeleteRow(tableName, columns)
+	err = stub.DeleteRow(tableName, columns)
 	if err != nil {
 		logger.Errorf("Error in deleting an account:%s", err)
 		return nil, errors.New("Error in deleting an account")
 	}
+	err = stub.DeleteRow(metadataTableName, columns)
+	if err != nil {
+		logger.Errorf("Error in deleting metadata of an account:%s", err)
+		return nil, errors.New("Error in deleting an account")
+	}
+	err = stub.DeleteRow(emissionFactorsTableName, columns)
+	if err != nil {
+		logger.Errorf("Error in deleting emission factor of an account:%s", err)
+		return nil, errors.New("Error in deleting an account")
+	}
 	logger.Infof("Deleted account %s", accountId)
 
 	return nil, nil
@@ -198,7 +791,92 @@ func (t *EnergyTradingChainCode) updateRow(stub shim.ChaincodeStubInterface, row
 	return stub.ReplaceRow(tableName, row)
 }
 
-// Change account balance. +ve value means deposit and -ve value means withdrawal
+func (t *EnergyTradingChainCode) isCaller(stub shim.ChaincodeStubInterface, certificate []byte) (bool, error) {
+	logger.Debug("Checking caller...")
+
+	// In order to enforce access control, we require that the
+	// metadata contains the signature under the signing key corresponding
+	// to the verification key inside certificate of
+	// the payload of the transaction (namely, function name and args) and
+	// the transaction binding (to avoid copying attacks)
+
+	// Verify \sigma=Sign(certificate.sk, tx.Payload||tx.Binding) against certificate.vk
+	// \sigma is in the metadata
+
+	sigma, err := stub.GetCallerMetadata()
+	if err != nil {
+		return false, errors.New("Failed getting metadata")
+	}
+	payload, err := stub.GetPayload()
+	if err != nil {
+		return false, errors.New("Failed getting payload")
+	}
+	binding, err := stub.GetBinding()
+	if err != nil {
+		return false, errors.New("Failed getting binding")
+	}
+
+	ok, err := stub.VerifySignature(
+		certificate,
+		sigma,
+		append(payload, binding...),
+	)
+	if err != nil {
+		logger.Errorf("Failed checking signature [%s]", err)
+		return ok, fmt.Errorf("Failed checking signature [%s]", err)
+	}
+	if !ok {
+		logger.Error("Invalid signature")
+	}
+
+	return ok, err
+}
+
+// Verifies that the caller is the administrator of the exchange
+func (t *EnergyTradingChainCode) checkAdmin(stub shim.ChaincodeStubInterface) error {
+	adminCertificate, err := stub.GetState("admin")
+	if err != nil {
+		return fmt.Errorf("Failed getting admin certificate:%s", err.Error())
+	}
+	if len(adminCertificate) == 0 {
+		logger.Error("No administrator configured")
+		return errors.New("No administrator configured for this exchange")
+	}
+
+	ok, err := t.isCaller(stub, adminCertificate)
+	if err != nil {
+		logger.Error("Failed checking admin identity")
+		return fmt.Errorf("Failed checking admin identity:%s", err.Error())
+	}
+	if !ok {
+		logger.Error("Caller is not administrator")
+		return errors.New("The caller is not an administrator")
+	}
+	return nil
+}
+
+// Returns the settlement round that is currently open, i.e. the round the next
+// settle call will close
+func (t *EnergyTradingChainCode) getCurrentRound(stub shim.ChaincodeStubInterface) (int64, error) {
+	roundStr, err := stub.GetState("settlement_round")
+	if err != nil {
+		logger.Error("Failed to retrieve settlement round")
+		return 0, errors.New("Failed to retrieve settlement round")
+	}
+	if len(roundStr) == 0 {
+		return 1, nil
+	}
+	round, err := strconv.ParseInt(string(roundStr), 10, 64)
+	if err != nil {
+		logger.Errorf("Invalid value %s for settlement round", roundStr)
+		return 0, errors.New("Invalid value for settlement round")
+	}
+	return round, nil
+}
+
+// Change account balance. +ve value means deposit and -ve value means withdrawal.
+// Meters go through requestDeposit and requestWithdrawal, this is left to the
+// administrator for corrections.
 func (t *EnergyTradingChainCode) changeAccountBalance(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
 	logger.Info("In changeAccountBalance function")
 	if len(args) < 2 {
@@ -206,6 +884,11 @@ func (t *EnergyTradingChainCode) changeAccountBalance(stub shim.ChaincodeStubInt
 		return nil, errors.New("Incorrect number of arguments. Specify account number and fund to be deposited")
 	}
 
+	err := t.checkAdmin(stub)
+	if err != nil {
+		return nil, err
+	}
+
 	accountId := args[0]
 	amountToBeDeposited := args[1]
 
@@ -221,6 +904,10 @@ func (t *EnergyTradingChainCode) changeAccountBalance(stub shim.ChaincodeStubInt
 		logger.Errorf("Failed retrieving account [%s]: [%s]", accountId, err)
 		return nil, fmt.Errorf("Failed retrieving account [%s]: [%s]", accountId, err)
 	}
+	if len(row.Columns) == 0 {
+		logger.Errorf("Account %s not found", accountId)
+		return nil, fmt.Errorf("Account %s not found", accountId)
+	}
 	prevBalanceStr := row.Columns[3].GetString_()
 	logger.Debugf("Previous balance for account:%s is %s", accountId, prevBalanceStr)
 	prevBalance, err := strconv.ParseFloat(string(prevBalanceStr), 64)
@@ -238,33 +925,77 @@ func (t *EnergyTradingChainCode) changeAccountBalance(stub shim.ChaincodeStubInt
 		logger.Errorf("Error in updating account:%s with balance:%s", accountId, newBalanceStr)
 		return nil, errors.New("Error in updating account")
 	}
+
+	err = t.recordDeposit(stub, accountId, numCoins)
+	if err != nil {
+		logger.Errorf("Error in updating totals of account %s:%s", accountId, err)
+		return nil, errors.New("Error in updating account")
+	}
 	logger.Infof("Changed account balance for account: %s", accountId)
 
 	return nil, nil
 }
 
-// Report energy produced or consumed. +ve value means produced and -ve value means consumed
+// Report energy produced or consumed. +ve value means produced and -ve value means consumed.
+// Optionally the source of the reading ("meter" or "headend") and the interval it covers
+// can be specified, in which case the reading is reconciled against the other source
+// before it counts towards settlement.
 func (t *EnergyTradingChainCode) reportDelta(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
 	logger.Info("In reportDelta function")
-	if len(args) < 2 {
+	if len(args) < 2 || len(args) == 3 {
 		logger.Error("Incorrect number of arguments")
-		return nil, errors.New("Incorrect number of arguments. Specify account number and fund to be deposited")
+		return nil, errors.New("Incorrect number of arguments. Specify account number, reported kwh and optionally the reading source and interval")
 	}
 
 	accountId := args[0]
 	amountKwhReported := args[1]
 
-	logger.Debugf("Accumulating energy reported %s kwh to meter with id:%s", amountKwhReported, accountId)
 	reportedKwhDelta, err := strconv.ParseInt(string(amountKwhReported), 10, 64)
 	if err != nil {
 		logger.Errorf("Error in converting to int:%s", err.Error())
 		return nil, fmt.Errorf("Invalid value of reported kwh to be accumulated:%s", amountKwhReported)
 	}
 
+	if len(args) > 3 {
+		return nil, t.recordReading(stub, accountId, args[2], args[3], reportedKwhDelta)
+	}
+
+	// Peak demand is computed per interval, energy reported without one cannot be charged
+	tariffSet, err := t.hasDemandTariff(stub)
+	if err != nil {
+		return nil, err
+	}
+	if tariffSet {
+		logger.Errorf("Delta of account %s reported without interval under a demand tariff", accountId)
+		return nil, errors.New("A demand tariff is set. Specify the reading source and interval")
+	}
+
+	// A plain delta would bypass the reconciliation of a meter reporting interval readings
+	interval, err := t.hasReadings(stub, accountId)
+	if err != nil {
+		logger.Errorf("Error in retrieving readings of account %s:%s", accountId, err.Error())
+		return nil, errors.New("Error in retrieving readings")
+	}
+	if interval {
+		logger.Errorf("Delta of account %s reported without interval", accountId)
+		return nil, fmt.Errorf("Meter %s reports interval readings. Specify the reading source and interval", accountId)
+	}
+
+	return nil, t.addReportedKwh(stub, accountId, reportedKwhDelta)
+}
+
+// Accumulates energy reported to the meter
+func (t *EnergyTradingChainCode) addReportedKwh(stub shim.ChaincodeStubInterface, accountId string, reportedKwhDelta int64) error {
+	logger.Debugf("Accumulating energy reported %d kwh to meter with id:%s", reportedKwhDelta, accountId)
+
 	row, err := t.getRow(stub, accountId)
 	if err != nil {
 		logger.Errorf("Failed retrieving account [%s]: [%s]", accountId, err)
-		return nil, fmt.Errorf("Failed retrieving account [%s]: [%s]", accountId, err)
+		return fmt.Errorf("Failed retrieving account [%s]: [%s]", accountId, err)
+	}
+	if len(row.Columns) == 0 {
+		logger.Errorf("Account %s not found", accountId)
+		return fmt.Errorf("Account %s not found", accountId)
 	}
 	prevBalance := row.Columns[2].GetInt64()
 	logger.Debugf("Previous reported kwh for account:%s is %d", accountId, prevBalance)
@@ -275,11 +1006,17 @@ func (t *EnergyTradingChainCode) reportDelta(stub shim.ChaincodeStubInterface, a
 	ok, err := t.updateRow(stub, row)
 	if !ok && err == nil {
 		logger.Errorf("Error in updating reported kwh:%s with balance:%d", accountId, newBalance)
-		return nil, errors.New("Error in updating account")
+		return errors.New("Error in updating account")
 	}
 	logger.Infof("Changed reported kwh for account: %s", accountId)
 
-	return nil, nil
+	err = t.recordRoundEnergy(stub, accountId, reportedKwhDelta)
+	if err != nil {
+		logger.Errorf("Error in recording energy history of account %s:%s", accountId, err)
+		return errors.New("Error in recording energy history")
+	}
+
+	return nil
 }
 
 // Settles the accounts and resets the reported kwh back to 0 for all meters
@@ -292,14 +1029,14 @@ func (t *EnergyTradingChainCode) settle(stub shim.ChaincodeStubInterface, args [
 		logger.Errorf("Error in getting rows:%s", err.Error())
 		return nil, errors.New("Error in fetching rows")
 	}
-	meters := make([]*MeterInfo, 0)
+	meters := make([]*settlement.MeterInfo, 0)
 	for row := range rowChannel {
 		balance, err := strconv.ParseFloat(row.Columns[3].GetString_(), 64)
 		if err != nil {
 			logger.Errorf("Error in converting to float:%s", err.Error())
 			return nil, fmt.Errorf("Invalid value of accountBalance:%s", row.Columns[3].GetString_())
 		}
-		meter := MeterInfo{
+		meter := settlement.MeterInfo{
 			Id:             row.Columns[0].GetString_(),
 			Name:           row.Columns[1].GetString_(),
 			Kwh:            row.Columns[2].GetInt64(),
@@ -310,6 +1047,30 @@ func (t *EnergyTradingChainCode) settle(stub shim.ChaincodeStubInterface, args [
 	}
 	logger.Infof("Number of rows in table:%d", len(meters))
 
+	round, err := t.getCurrentRound(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	// Rate changes scheduled for this round take effect before matching
+	for _, meter := range meters {
+		change, err := t.getRateChange(stub, meter.Id, round)
+		if err != nil {
+			logger.Errorf("Error in fetching rate change of account %s:%s", meter.Id, err.Error())
+			return nil, errors.New("Error in fetching rate changes")
+		}
+		if change != nil {
+			logger.Infof("Rate of account %s changes from %d to %d", meter.Id, meter.RatePerKwh, change.RatePerKwh)
+			meter.RatePerKwh = change.RatePerKwh
+		}
+	}
+
+	err = t.attachMetadata(stub, meters)
+	if err != nil {
+		logger.Errorf("Error in fetching meter metadata:%s", err.Error())
+		return nil, errors.New("Error in fetching meter metadata")
+	}
+
 	xchngRateStr, err := stub.GetState("exchange_rate")
 	if err != nil {
 		logger.Error("Failed to retrieve exchange rate")
@@ -335,69 +1096,65 @@ func (t *EnergyTradingChainCode) settle(stub shim.ChaincodeStubInterface, args [
 		return nil, errors.New("Invalid value for exchange account balance")
 	}
 
-	logger.Debug("Seggregating buyers and sellers")
-	buyers := make([]*MeterInfo, 0)
-	sellers := make([]*MeterInfo, 0)
+	// Meters with unresolved reading discrepancies sit out this round. Their reported
+	// energy is carried over until an administrator resolves the discrepancy.
+	tradable := make([]*settlement.MeterInfo, 0)
 	for _, meter := range meters {
-		if meter.Kwh < 0 {
-			logger.Debugf("Meter %s is a buyer", meter.Id)
-			buyers = append(buyers, meter)
-		} else {
-			logger.Debugf("Meter %s is a seller", meter.Id)
-			sellers = append(sellers, meter)
-		}
-	}
-	// Sort the buyers so we can match buyers with lower asking rate with sellers offering
-	// lower rates
-	sort.Sort(ByRate(buyers))
-	// Sort the sellers so buyers can purchase from sellers offering lower rates first
-	sort.Sort(ByRate(sellers))
-
-	logger.Infof("Number of buyers: %d, number of sellers: %d", len(buyers), len(sellers))
-	for _, buyer := range buyers {
-		logger.Debugf("Finding sellers for buyer:%s with rate less than %d for %d KWH", buyer.Id, buyer.RatePerKwh, buyer.Kwh)
-		// Very crude way of setteling...O(n^2) complexity...need to improve
-		for _, seller := range sellers {
-			if buyer.Kwh == 0 {
-				logger.Debugf("Buyer %s has all its energy need satisfied", buyer.Id)
-				break
-			}
-			if seller.RatePerKwh <= buyer.RatePerKwh && seller.Kwh > 0 {
-				logger.Debugf("Seller %s has produced %d at rate less or equal to buyer's requirement", seller.Id, seller.Kwh)
-				energyConsumed := buyer.Kwh * -1
-				if energyConsumed <= seller.Kwh {
-					seller.Kwh = seller.Kwh - energyConsumed
-					// Set the energy consumed by buyer to 0
-					buyer.Kwh = 0
-					amountDebited := float64(energyConsumed * seller.RatePerKwh)
-					buyer.AccountBalance = buyer.AccountBalance - amountDebited
-					feeAssessed := amountDebited * xchngRate
-					xchngBalance = xchngBalance + feeAssessed
-					amountCredited := amountDebited - feeAssessed
-					logger.Debugf("Amount debited from buyer %s is %f and amount credited to seller %s is %f", buyer.Id, amountDebited, seller.Id, amountCredited)
-					logger.Debugf("Fee charged for this transaction: %f", feeAssessed)
-					seller.AccountBalance = seller.AccountBalance + amountCredited
-				} else {
-					logger.Debugf("Only partial need of buyer %s is satisfied by seller %s", buyer.Id, seller.Id)
-					// Add seller Kwh to buyer, which will essentially reduce buyer Kwh consumption
-					// as buyer Kwh is -ve
-					buyer.Kwh = buyer.Kwh + seller.Kwh
-					partialEnergyConsumed := seller.Kwh
-					logger.Debugf("Total unsatisfied energy need for buyer:%s is %d", buyer.Id, buyer.Kwh)
-					// Set the energy produced by seller to 0
-					seller.Kwh = 0
-					amountDebited := float64(partialEnergyConsumed * seller.RatePerKwh)
-					buyer.AccountBalance = buyer.AccountBalance - amountDebited
-					feeAssessed := amountDebited * xchngRate
-					xchngBalance = xchngBalance + feeAssessed
-					amountCredited := amountDebited - feeAssessed
-					logger.Debugf("Amount debited from buyer %s is %f and amount credited to seller %s is %f", buyer.Id, amountDebited, seller.Id, amountCredited)
-					logger.Debugf("Fee charged for this transaction: %f", feeAssessed)
-					seller.AccountBalance = seller.AccountBalance + amountCredited
-				}
-			}
+		inDiscrepancy, err := t.hasOpenDiscrepancy(stub, meter.Id)
+		if err != nil {
+			logger.Errorf("Error in checking discrepancies of account %s:%s", meter.Id, err.Error())
+			return nil, errors.New("Error in checking reading discrepancies")
+		}
+		if inDiscrepancy {
+			logger.Infof("Meter %s has unresolved reading discrepancies, excluding it from settlement", meter.Id)
+			continue
 		}
+		tradable = append(tradable, meter)
+	}
+
+	// Money and energy moved by this settlement, recorded in the account totals
+	ledger := ledgerDeltas{}
+
+	// Charge the deviation from the forecast before the reported energy is consumed
+	// by the matching below
+	imbalanceCharged, err := t.applyImbalanceCharges(stub, round, tradable, ledger)
+	if err != nil {
+		logger.Errorf("Error in applying imbalance charges:%s", err.Error())
+		return nil, errors.New("Error in applying imbalance charges")
 	}
+	xchngBalance = xchngBalance + imbalanceCharged
+
+	tradableMeters := make([]settlement.MeterInfo, 0, len(tradable))
+	for _, meter := range tradable {
+		tradableMeters = append(tradableMeters, *meter)
+	}
+	result := settlement.Settle(tradableMeters, xchngRate)
+	logger.Infof("Number of trades: %d, fees collected: %f", len(result.Trades), result.Fees)
+
+	for i, meter := range tradable {
+		meter.Kwh = result.Meters[i].Kwh
+		meter.AccountBalance = result.Meters[i].AccountBalance
+	}
+	for _, trade := range result.Trades {
+		logger.Debugf("Meter %s sold %d kwh at %d to meter %s, fee charged %f", trade.Seller, trade.Kwh, trade.RatePerKwh, trade.Buyer, trade.Fee)
+		ledger.transfer(trade.Buyer, trade.Seller, trade.Amount-trade.Fee)
+		ledger.transfer(trade.Buyer, exchangeAccountId, trade.Fee)
+		ledger.trade(trade.Seller, trade.Buyer, trade.Kwh)
+	}
+	xchngBalance = xchngBalance + result.Fees
+
+	err = t.recordTrades(stub, round, result.Trades)
+	if err != nil {
+		logger.Errorf("Error in recording trades:%s", err.Error())
+		return nil, errors.New("Error in recording trades")
+	}
+
+	err = t.recordCarbon(stub, round, result.Trades, tradable)
+	if err != nil {
+		logger.Errorf("Error in recording emissions:%s", err.Error())
+		return nil, errors.New("Error in recording emissions")
+	}
+
 	// Now update the table
 	for _, meter := range meters {
 		row, err := t.getRow(stub, meter.Id)
@@ -409,6 +1166,7 @@ func (t *EnergyTradingChainCode) settle(stub shim.ChaincodeStubInterface, args [
 		newBalanceStr := strconv.FormatFloat(meter.AccountBalance, 'f', 6, 64)
 		row.Columns[3] = &shim.Column{Value: &shim.Column_String_{String_: newBalanceStr}}
 		row.Columns[2] = &shim.Column{Value: &shim.Column_Int64{Int64: meter.Kwh}}
+		row.Columns[4] = &shim.Column{Value: &shim.Column_Int64{Int64: meter.RatePerKwh}}
 
 		ok, err := t.updateRow(stub, row)
 		if !ok && err == nil {
@@ -423,7 +1181,19 @@ func (t *EnergyTradingChainCode) settle(stub shim.ChaincodeStubInterface, args [
 		logger.Errorf("Error saving exchange account balance %s", err.Error())
 		return nil, errors.New("Exchange account balance cannot be saved")
 	}
-	logger.Info("Done settling")
+
+	err = t.commitLedger(stub, ledger)
+	if err != nil {
+		logger.Errorf("Error in updating account totals:%s", err.Error())
+		return nil, errors.New("Error in updating account totals")
+	}
+
+	err = stub.PutState("settlement_round", []byte(strconv.FormatInt(round+1, 10)))
+	if err != nil {
+		logger.Errorf("Error saving settlement round %s", err.Error())
+		return nil, errors.New("Settlement round cannot be saved")
+	}
+	logger.Infof("Done settling round %d", round)
 
 	return nil, nil
 }
@@ -455,6 +1225,106 @@ func (t *EnergyTradingChainCode) Query(stub shim.ChaincodeStubInterface, functio
 		return t.meters(stub, args)
 	}
 
+	if function == "metersByGenerationType" {
+		return t.metersByGenerationType(stub, args)
+	}
+
+	if function == "currentRound" {
+		return t.currentRound(stub, args)
+	}
+
+	if function == "imbalanceRate" {
+		return t.imbalanceRate(stub, args)
+	}
+
+	if function == "forecast" {
+		return t.forecast(stub, args)
+	}
+
+	if function == "forecastAccuracy" {
+		return t.forecastAccuracy(stub, args)
+	}
+
+	if function == "reading" {
+		return t.reading(stub, args)
+	}
+
+	if function == "discrepancies" {
+		return t.discrepancies(stub, args)
+	}
+
+	if function == "dispute" {
+		return t.dispute(stub, args)
+	}
+
+	if function == "disputes" {
+		return t.disputes(stub, args)
+	}
+
+	if function == "trades" {
+		return t.trades(stub, args)
+	}
+
+	if function == "demandTariff" {
+		return t.demandTariff(stub, args)
+	}
+
+	if function == "billingCycle" {
+		return t.billingCycle(stub, args)
+	}
+
+	if function == "peakDemand" {
+		return t.peakDemand(stub, args)
+	}
+
+	if function == "demandCharges" {
+		return t.demandCharges(stub, args)
+	}
+
+	if function == "demandResponseEvent" {
+		return t.demandResponseEvent(stub, args)
+	}
+
+	if function == "demandResponseEvents" {
+		return t.demandResponseEvents(stub, args)
+	}
+
+	if function == "fundsRequest" {
+		return t.fundsRequest(stub, args)
+	}
+
+	if function == "fundsRequests" {
+		return t.fundsRequests(stub, args)
+	}
+
+	if function == "rateAt" {
+		return t.rateAt(stub, args)
+	}
+
+	if function == "rateHistory" {
+		return t.rateHistory(stub, args)
+	}
+
+	if function == "emissionFactor" {
+		return t.emissionFactor(stub, args)
+	}
+
+	if function == "carbon" {
+		return t.carbon(stub, args)
+	}
+
+	if function == "carbonByRound" {
+		return t.carbonByRound(stub, args)
+	}
+
+	if function == "schemaVersion" {
+		return t.schemaVersion(stub, args)
+	}
+
+	if function == "auditInvariants" {
+		return t.auditInvariants(stub, args)
+	}
+
 	return nil, errors.New("Invalid query function name")
 }
 
@@ -528,7 +1398,7 @@ func (t *EnergyTradingChainCode) meterInfo(stub shim.ChaincodeStubInterface, arg
 		return nil, fmt.Errorf("Invalid value of accountBalance:%s", row.Columns[3].GetString_())
 	}
 
-	meter := MeterInfo{
+	meter := settlement.MeterInfo{
 		Id:             row.Columns[0].GetString_(),
 		Name:           row.Columns[1].GetString_(),
 		Kwh:            row.Columns[2].GetInt64(),
@@ -536,6 +1406,13 @@ func (t *EnergyTradingChainCode) meterInfo(stub shim.ChaincodeStubInterface, arg
 		RatePerKwh:     row.Columns[4].GetInt64(),
 	}
 
+	metadata, _, err := t.getMeterMetadata(stub, accountId)
+	if err != nil {
+		logger.Errorf("Failed retrieving metadata of account [%s]: [%s]", accountId, err)
+		return nil, fmt.Errorf("Failed retrieving metadata of account [%s]: [%s]", accountId, err)
+	}
+	meter.Metadata = metadata
+
 	payload, err := json.Marshal(meter)
 	if err != nil {
 		logger.Errorf("Failed retrieving account [%s]: [%s]", accountId, err)
@@ -560,14 +1437,14 @@ func (t *EnergyTradingChainCode) meters(stub shim.ChaincodeStubInterface, args [
 		logger.Errorf("Error in getting rows:%s", err.Error())
 		return nil, errors.New("Error in fetching rows")
 	}
-	meters := make([]MeterInfo, 0)
+	meters := make([]settlement.MeterInfo, 0)
 	for row := range rowChannel {
 		balance, err := strconv.ParseFloat(row.Columns[3].GetString_(), 64)
 		if err != nil {
 			logger.Errorf("Error in converting to float:%s", err.Error())
 			return nil, fmt.Errorf("Invalid value of accountBalance:%s", row.Columns[3].GetString_())
 		}
-		meter := MeterInfo{
+		meter := settlement.MeterInfo{
 			Id:             row.Columns[0].GetString_(),
 			Name:           row.Columns[1].GetString_(),
 			Kwh:            row.Columns[2].GetInt64(),
@@ -577,6 +1454,15 @@ func (t *EnergyTradingChainCode) meters(stub shim.ChaincodeStubInterface, args [
 		meters = append(meters, meter)
 	}
 
+	for i := range meters {
+		metadata, _, err := t.getMeterMetadata(stub, meters[i].Id)
+		if err != nil {
+			logger.Errorf("Failed retrieving metadata of account [%s]: [%s]", meters[i].Id, err)
+			return nil, fmt.Errorf("Failed retrieving metadata of account [%s]: [%s]", meters[i].Id, err)
+		}
+		meters[i].Metadata = metadata
+	}
+
 	payload, err := json.Marshal(meters)
 	if err != nil {
 		logger.Errorf("Failed marshalling payload")
@@ -617,10 +1503,3 @@ func (t *EnergyTradingChainCode) exchangeAccountBalance(stub shim.ChaincodeStubI
 
 	return xchngRate, nil
 }
-
-func main() {
-	err := shim.Start(new(EnergyTradingChainCode))
-	if err != nil {
-		fmt.Printf("Error starting Energy trading chaincode: %s", err)
-	}
-}
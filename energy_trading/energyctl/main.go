@@ -0,0 +1,247 @@
+// Command energyctl drives the energy trading chaincode through the JSON-RPC endpoint of
+// a peer. The endpoint and the chaincode id are read from a JSON config file, see
+// energyctl.json for an example.
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"text/tabwriter"
+
+	"github.com/predix/chaincode_example/energy_trading/rpc"
+	"github.com/predix/chaincode_example/energy_trading/settlement"
+)
+
+type command struct {
+	usage string
+	help  string
+	// Number of arguments accepted, max < 0 means no upper bound
+	min, max int
+	run      func(c *rpc.Client, args []string) error
+}
+
+var (
+	configPath string
+	rawOutput  bool
+	out        io.Writer = os.Stdout
+)
+
+var commands = map[string]command{
+	"deploy":           {"deploy <exchange rate>", "Deploy the chaincode and store its id in the config", 1, 1, deploy},
+	"enroll":           {"enroll <account> <name> <rate per kwh> [owner certificate file]", "Enroll a new meter", 3, 4, enroll},
+	"delete":           {"delete <account>", "Delete a meter", 1, 1, invoke("delete")},
+	"deposit":          {"deposit <account> <amount> <payment reference>", "Request a deposit to a meter account", 3, 3, invoke("requestDeposit")},
+	"withdraw":         {"withdraw <account> <amount> <payment reference>", "Request a withdrawal from a meter account", 3, 3, invoke("requestWithdrawal")},
+	"approve":          {"approve <request>", "Approve a deposit or withdrawal request", 1, 1, invoke("approveFundsRequest")},
+	"reject":           {"reject <request> [reason]", "Reject a deposit or withdrawal request", 1, 2, invoke("rejectFundsRequest")},
+	"funds-requests":   {"funds-requests [status] [account]", "List deposit and withdrawal requests", 0, 2, query("fundsRequests")},
+	"adjust-balance":   {"adjust-balance <account> <amount>", "Correct the balance of a meter account, +ve credits and -ve debits", 2, 2, invoke("changeAccountBalance")},
+	"update-rate":      {"update-rate <account> <rate per kwh>", "Change the rate of a meter from the next round on", 2, 2, invoke("updateRate")},
+	"rate":             {"rate <account> <round>", "Show the rate of a meter in force in a round", 2, 2, query("rateAt")},
+	"rates":            {"rates <account>", "Show the rate history of a meter", 1, 1, query("rateHistory")},
+	"report":           {"report <account> <kwh> [<source> <interval>]", "Report energy produced (+ve) or consumed (-ve)", 2, 4, invoke("reportDelta")},
+	"forecast":         {"forecast <account> <round> <kwh>", "Submit a forecast for an upcoming round", 3, 3, invoke("submitForecast")},
+	"settle":           {"settle", "Settle the open round", 0, 0, invoke("settle")},
+	"meters":           {"meters", "List all meters", 0, 0, meters},
+	"meter":            {"meter <account>", "Show a meter", 1, 1, meter},
+	"balance":          {"balance <account>", "Show the balance of a meter account", 1, 1, query("balance")},
+	"kwh":              {"kwh <account>", "Show the reported kwh of a meter", 1, 1, query("reportedKwh")},
+	"exchange-balance": {"exchange-balance", "Show the balance of the exchange account", 0, 0, query("exchangeAccountBalance")},
+	"exchange-rate":    {"exchange-rate", "Show the commission charged by the exchange", 0, 0, query("exchangeRate")},
+	"round":            {"round", "Show the open settlement round", 0, 0, query("currentRound")},
+	"audit":            {"audit", "Check the ledger invariants", 0, 0, query("auditInvariants")},
+	"emission-factor":  {"emission-factor <account> <kg co2 per kwh>", "Set the emission factor of a seller", 2, 2, invoke("setEmissionFactor")},
+	"grid-factor":      {"grid-factor <kg co2 per kwh>", "Set the emission factor of sellers without one", 1, 1, invoke("setGridEmissionFactor")},
+	"carbon":           {"carbon <account> [first round] [last round]", "Show the emissions attributed to a meter", 1, 3, query("carbon")},
+	"carbon-rounds":    {"carbon-rounds [first round] [last round]", "Show the emissions of all meters per round", 0, 2, query("carbonByRound")},
+	"schema-version":   {"schema-version", "Show the schema version of the tables", 0, 0, query("schemaVersion")},
+	"migrate":          {"migrate", "Migrate the tables to the schema version of the chaincode", 0, 0, invoke("migrate")},
+	"trades":           {"trades <round>", "Show the trades of a settled round", 1, 1, query("trades")},
+	"dispute":          {"dispute <account> <round> <reason>", "Dispute a settled round", 3, 3, invoke("openDispute")},
+	"resolve-dispute":  {"resolve-dispute <dispute> <adjustments> [note]", "Resolve a dispute with a JSON list of adjustments", 2, 3, invoke("resolveDispute")},
+	"disputes":         {"disputes [account]", "List disputes", 0, 1, query("disputes")},
+	"demand-tariff":    {"demand-tariff <rate per kw> <threshold kw> <interval minutes>", "Set the demand tariff", 3, 3, invoke("setDemandTariff")},
+	"close-cycle":      {"close-cycle", "Close the billing cycle and charge peak demand", 0, 0, invoke("closeBillingCycle")},
+	"peak-demand":      {"peak-demand <account>", "Show the peak demand of a meter in the open billing cycle", 1, 1, query("peakDemand")},
+	"demand-charges":   {"demand-charges <account>", "Show the demand charges of a meter", 1, 1, query("demandCharges")},
+	"dr-declare":       {"dr-declare <start round> <end round> <target kwh> <incentive per kwh> <baseline rounds>", "Declare a demand response event", 5, 5, invoke("declareDemandResponse")},
+	"dr-opt-in":        {"dr-opt-in <event> <account>", "Opt a meter in to a demand response event", 2, 2, invoke("optInDemandResponse")},
+	"dr-close":         {"dr-close <event>", "Close a demand response event and pay incentives", 1, 1, invoke("closeDemandResponse")},
+	"dr-event":         {"dr-event <event>", "Show a demand response event and its results", 1, 1, query("demandResponseEvent")},
+	"dr-events":        {"dr-events", "List demand response events", 0, 0, query("demandResponseEvents")},
+	"invoke":           {"invoke <function> [args...]", "Invoke any chaincode function", 1, -1, func(c *rpc.Client, args []string) error { return invoke(args[0])(c, args[1:]) }},
+	"query":            {"query <function> [args...]", "Query any chaincode function", 1, -1, func(c *rpc.Client, args []string) error { return query(args[0])(c, args[1:]) }},
+}
+
+// Returns a command that invokes the given chaincode function with the command arguments
+func invoke(function string) func(c *rpc.Client, args []string) error {
+	return func(c *rpc.Client, args []string) error {
+		txId, err := c.Invoke(function, args...)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "Submitted transaction %s\n", txId)
+		return nil
+	}
+}
+
+// Returns a command that runs the given query with the command arguments
+func query(function string) func(c *rpc.Client, args []string) error {
+	return func(c *rpc.Client, args []string) error {
+		payload, err := c.Query(function, args...)
+		if err != nil {
+			return err
+		}
+		return printJSON(payload)
+	}
+}
+
+func deploy(c *rpc.Client, args []string) error {
+	name, err := c.Deploy(args...)
+	if err != nil {
+		return err
+	}
+	c.Config.ChaincodeId = name
+	err = rpc.SaveConfig(configPath, c.Config)
+	if err != nil {
+		return fmt.Errorf("Deployed chaincode %s but failed saving config: %s", name, err)
+	}
+	fmt.Fprintf(out, "Deployed chaincode %s\n", name)
+	return nil
+}
+
+func enroll(c *rpc.Client, args []string) error {
+	if len(args) == 4 {
+		certificate, err := ioutil.ReadFile(args[3])
+		if err != nil {
+			return fmt.Errorf("Failed reading owner certificate: %s", err)
+		}
+		args[3] = base64.StdEncoding.EncodeToString(certificate)
+	}
+	return invoke("enroll")(c, args)
+}
+
+func meters(c *rpc.Client, args []string) error {
+	payload, err := c.Query("meters")
+	if err != nil {
+		return err
+	}
+	if rawOutput {
+		return printJSON(payload)
+	}
+	var meters []settlement.MeterInfo
+	err = json.Unmarshal(payload, &meters)
+	if err != nil {
+		return fmt.Errorf("Invalid meters: %s", err)
+	}
+	printMeters(meters)
+	return nil
+}
+
+func meter(c *rpc.Client, args []string) error {
+	payload, err := c.Query("meterInfo", args...)
+	if err != nil {
+		return err
+	}
+	if rawOutput {
+		return printJSON(payload)
+	}
+	var meter settlement.MeterInfo
+	err = json.Unmarshal(payload, &meter)
+	if err != nil {
+		return fmt.Errorf("Invalid meter: %s", err)
+	}
+	printMeters([]settlement.MeterInfo{meter})
+	return nil
+}
+
+func printMeters(meters []settlement.MeterInfo) {
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(w, "ID\tNAME\tKWH\tBALANCE\tRATE/KWH\tGENERATION\tPREFERENCE\t")
+	for _, meter := range meters {
+		generation, preference := "-", "-"
+		if meter.Metadata != nil {
+			if meter.Metadata.GenerationType != "" {
+				generation = meter.Metadata.GenerationType
+			}
+			if meter.Metadata.SourcePreference != "" {
+				preference = meter.Metadata.SourcePreference
+			}
+		}
+		fmt.Fprintf(w, "%s\t%s\t%d\t%.2f\t%d\t%s\t%s\t\n", meter.Id, meter.Name, meter.Kwh, meter.AccountBalance, meter.RatePerKwh, generation, preference)
+	}
+	w.Flush()
+}
+
+// Prints a query result, indented if it is JSON
+func printJSON(payload []byte) error {
+	var indented bytes.Buffer
+	if !rawOutput && json.Indent(&indented, payload, "", "  ") == nil {
+		payload = indented.Bytes()
+	}
+	_, err := fmt.Fprintln(out, string(payload))
+	return err
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "Usage: energyctl [-config file] [-raw] <command> [args...]\n\nCommands:")
+	w := tabwriter.NewWriter(os.Stderr, 0, 4, 2, ' ', 0)
+	for _, name := range sortedCommands() {
+		fmt.Fprintf(w, "  %s\t%s\n", commands[name].usage, commands[name].help)
+	}
+	w.Flush()
+	fmt.Fprintln(os.Stderr, "\nFlags:")
+	flag.PrintDefaults()
+}
+
+func sortedCommands() []string {
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func run(args []string) error {
+	if len(args) == 0 {
+		usage()
+		return errors.New("No command specified")
+	}
+	cmd, ok := commands[args[0]]
+	if !ok {
+		usage()
+		return fmt.Errorf("Unknown command %s", args[0])
+	}
+	args = args[1:]
+	if len(args) < cmd.min || (cmd.max >= 0 && len(args) > cmd.max) {
+		return fmt.Errorf("Usage: energyctl %s", cmd.usage)
+	}
+
+	config, err := rpc.LoadConfig(configPath)
+	if err != nil {
+		return err
+	}
+	return cmd.run(rpc.NewClient(config), args)
+}
+
+func main() {
+	flag.StringVar(&configPath, "config", "energyctl.json", "Path of the config file")
+	flag.BoolVar(&rawOutput, "raw", false, "Print query results as returned by the chaincode")
+	flag.Usage = usage
+	flag.Parse()
+
+	err := run(flag.Args())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+		os.Exit(1)
+	}
+}
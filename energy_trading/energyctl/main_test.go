@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/predix/chaincode_example/energy_trading/rpc"
+)
+
+// peer is a fake of the peer REST API. It records the requests posted to /chaincode
+// and answers them with the response of the called function.
+type peer struct {
+	t         *testing.T
+	requests  []rpc.Request
+	responses map[string]rpc.Response
+}
+
+func (p *peer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" || r.URL.Path != "/chaincode" {
+		p.t.Errorf("Unexpected %s %s", r.Method, r.URL.Path)
+		http.NotFound(w, r)
+		return
+	}
+	if contentType := r.Header.Get("Content-Type"); contentType != "application/json" {
+		p.t.Errorf("Content type %s", contentType)
+	}
+	var request rpc.Request
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		p.t.Errorf("Invalid request: %s", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	p.requests = append(p.requests, request)
+
+	response, ok := p.responses[request.Params.CtorMsg.Function]
+	if !ok {
+		response = rpc.Response{Result: &rpc.Result{Status: "OK", Message: "tx-" + request.Params.CtorMsg.Function}}
+	}
+	response.JSONRPC = "2.0"
+	response.ID = request.ID
+	json.NewEncoder(w).Encode(response)
+}
+
+// Starts a fake peer and points the config of energyctl at it. The output of the
+// commands is collected in the returned buffer.
+func newPeer(t *testing.T) (*peer, *bytes.Buffer) {
+	p := &peer{t: t, responses: make(map[string]rpc.Response)}
+	server := httptest.NewServer(p)
+	t.Cleanup(server.Close)
+
+	configPath = filepath.Join(t.TempDir(), "energyctl.json")
+	err := rpc.SaveConfig(configPath, rpc.Config{Endpoint: server.URL + "/", ChaincodeId: "energy", SecureContext: "alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rawOutput = false
+	output := new(bytes.Buffer)
+	out = output
+	return p, output
+}
+
+// Checks the single request posted to the peer
+func expectRequest(t *testing.T, p *peer, method, function string, args ...string) {
+	if len(p.requests) != 1 {
+		t.Fatalf("%d requests posted, want 1", len(p.requests))
+	}
+	request := p.requests[0]
+	// The peer expects the arguments as an array, also when there are none
+	if args == nil {
+		args = []string{}
+	}
+	want := rpc.Request{
+		JSONRPC: "2.0",
+		Method:  method,
+		Params: rpc.Params{
+			Type:          1,
+			ChaincodeID:   rpc.ChaincodeID{Name: "energy"},
+			CtorMsg:       rpc.CtorMsg{Function: function, Args: args},
+			SecureContext: "alice",
+		},
+		ID: 1,
+	}
+	if !reflect.DeepEqual(request, want) {
+		t.Errorf("Request %+v, want %+v", request, want)
+	}
+}
+
+func TestEnroll(t *testing.T) {
+	p, output := newPeer(t)
+	certificatePath := filepath.Join(t.TempDir(), "owner.der")
+	err := ioutil.WriteFile(certificatePath, []byte("owner certificate"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = run([]string{"enroll", "42", "meter 42", "7", certificatePath})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectRequest(t, p, "invoke", "enroll", "42", "meter 42", "7", base64.StdEncoding.EncodeToString([]byte("owner certificate")))
+	if output.String() != "Submitted transaction tx-enroll\n" {
+		t.Errorf("Output %q", output.String())
+	}
+}
+
+func TestReportDelta(t *testing.T) {
+	p, output := newPeer(t)
+
+	err := run([]string{"report", "42", "-12", "headend", "2017-01-01T10:00:00Z"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectRequest(t, p, "invoke", "reportDelta", "42", "-12", "headend", "2017-01-01T10:00:00Z")
+	if output.String() != "Submitted transaction tx-reportDelta\n" {
+		t.Errorf("Output %q", output.String())
+	}
+}
+
+func TestSettle(t *testing.T) {
+	p, output := newPeer(t)
+
+	err := run([]string{"settle"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectRequest(t, p, "invoke", "settle")
+	if output.String() != "Submitted transaction tx-settle\n" {
+		t.Errorf("Output %q", output.String())
+	}
+
+	err = run([]string{"settle", "now"})
+	if err == nil || err.Error() != "Usage: energyctl settle" {
+		t.Errorf("Settle with an argument returned %v", err)
+	}
+	if len(p.requests) != 1 {
+		t.Errorf("Invalid command posted a request")
+	}
+}
+
+func TestQuery(t *testing.T) {
+	p, output := newPeer(t)
+	p.responses["meterInfo"] = rpc.Response{Result: &rpc.Result{Status: "OK", Message: `{"id":"42","name":"meter 42","kwh":-12,"account_balance":99.5,"rate_per_kwh":7,"metadata":{"generation_type":"solar"}}`}}
+
+	err := run([]string{"meter", "42"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectRequest(t, p, "query", "meterInfo", "42")
+	lines := strings.Split(strings.TrimRight(output.String(), "\n"), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Output %q", output.String())
+	}
+	fields := strings.Fields(lines[1])
+	want := []string{"42", "meter", "42", "-12", "99.50", "7", "solar", "-"}
+	if !reflect.DeepEqual(fields, want) {
+		t.Errorf("Meter printed as %q, want %q", fields, want)
+	}
+
+	p.requests = nil
+	output.Reset()
+	p.responses["trades"] = rpc.Response{Result: &rpc.Result{Status: "OK", Message: `[{"seller":"1","kwh":5}]`}}
+	err = run([]string{"trades", "3"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectRequest(t, p, "query", "trades", "3")
+	if output.String() != "[\n  {\n    \"seller\": \"1\",\n    \"kwh\": 5\n  }\n]\n" {
+		t.Errorf("Output %q", output.String())
+	}
+}
+
+func TestErrorResponse(t *testing.T) {
+	p, output := newPeer(t)
+	p.responses["settle"] = rpc.Response{Error: &rpc.Error{Code: -32003, Message: "Invocation failure", Data: "Error when invoking chaincode"}}
+
+	err := run([]string{"settle"})
+	if err == nil {
+		t.Fatal("Error response not reported")
+	}
+	if err.Error() != "Invocation failure (-32003): Error when invoking chaincode" {
+		t.Errorf("Error %q", err)
+	}
+	if output.Len() != 0 {
+		t.Errorf("Output %q on error", output.String())
+	}
+}
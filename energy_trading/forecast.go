@@ -0,0 +1,392 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/predix/chaincode_example/energy_trading/settlement"
+)
+
+// Forecast is the day-ahead generation (+ve) or consumption (-ve) a meter expects
+// for a settlement round, together with the outcome once the round is settled
+type Forecast struct {
+	AccountId       string  `json:"account_id"`
+	Round           int64   `json:"round"`
+	ForecastKwh     int64   `json:"forecast_kwh"`
+	ReportedKwh     int64   `json:"reported_kwh"`
+	DeviationKwh    int64   `json:"deviation_kwh"`
+	ImbalanceCharge float64 `json:"imbalance_charge"`
+	Settled         bool    `json:"settled"`
+}
+
+// ForecastAccuracy summarizes how well a meter forecasts its energy over all settled rounds
+type ForecastAccuracy struct {
+	AccountId             string  `json:"account_id"`
+	Rounds                int64   `json:"rounds"`
+	TotalDeviationKwh     int64   `json:"total_deviation_kwh"`
+	MeanAbsoluteDeviation float64 `json:"mean_absolute_deviation"`
+	// Percentage of the reported energy that was forecast correctly
+	Accuracy             float64 `json:"accuracy"`
+	TotalImbalanceCharge float64 `json:"total_imbalance_charge"`
+}
+
+func abs(v int64) int64 {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
+
+func (t *EnergyTradingChainCode) forecastRow(forecast Forecast) shim.Row {
+	return shim.Row{
+		Columns: []*shim.Column{
+			&shim.Column{Value: &shim.Column_String_{String_: forecast.AccountId}},
+			&shim.Column{Value: &shim.Column_Int64{Int64: forecast.Round}},
+			&shim.Column{Value: &shim.Column_Int64{Int64: forecast.ForecastKwh}},
+			&shim.Column{Value: &shim.Column_Int64{Int64: forecast.ReportedKwh}},
+			&shim.Column{Value: &shim.Column_Int64{Int64: forecast.DeviationKwh}},
+			&shim.Column{Value: &shim.Column_String_{String_: strconv.FormatFloat(forecast.ImbalanceCharge, 'f', 6, 64)}},
+			&shim.Column{Value: &shim.Column_Bool{Bool: forecast.Settled}},
+		},
+	}
+}
+
+// Returns the forecast of a meter for a round. Returns nil if the meter did not submit one.
+func (t *EnergyTradingChainCode) getForecast(stub shim.ChaincodeStubInterface, accountId string, round int64) (*Forecast, error) {
+	var columns []shim.Column
+	col1 := shim.Column{Value: &shim.Column_String_{String_: accountId}}
+	col2 := shim.Column{Value: &shim.Column_Int64{Int64: round}}
+	columns = append(columns, col1, col2)
+
+	row, err := stub.GetRow(forecastTableName, columns)
+	if err != nil {
+		return nil, err
+	}
+	if len(row.Columns) == 0 {
+		return nil, nil
+	}
+	charge, err := strconv.ParseFloat(row.Columns[5].GetString_(), 64)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid value of imbalance charge:%s", row.Columns[5].GetString_())
+	}
+	return &Forecast{
+		AccountId:       row.Columns[0].GetString_(),
+		Round:           row.Columns[1].GetInt64(),
+		ForecastKwh:     row.Columns[2].GetInt64(),
+		ReportedKwh:     row.Columns[3].GetInt64(),
+		DeviationKwh:    row.Columns[4].GetInt64(),
+		ImbalanceCharge: charge,
+		Settled:         row.Columns[6].GetBool(),
+	}, nil
+}
+
+func (t *EnergyTradingChainCode) getImbalanceRate(stub shim.ChaincodeStubInterface) (float64, error) {
+	rateStr, err := stub.GetState("imbalance_rate")
+	if err != nil {
+		logger.Error("Failed to retrieve imbalance rate")
+		return 0, errors.New("Failed to retrieve imbalance rate")
+	}
+	if len(rateStr) == 0 {
+		return 0, nil
+	}
+	rate, err := strconv.ParseFloat(string(rateStr), 64)
+	if err != nil {
+		logger.Errorf("Invalid value %s for imbalance rate", rateStr)
+		return 0, errors.New("Invalid value for imbalance rate")
+	}
+	return rate, nil
+}
+
+// Submits the forecast of a meter for an upcoming settlement round. A forecast can be
+// revised until the round opens. Only the meter owner can do it.
+func (t *EnergyTradingChainCode) submitForecast(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	logger.Info("In submitForecast function")
+	if len(args) != 3 {
+		logger.Error("Incorrect number of arguments")
+		return nil, errors.New("Incorrect number of arguments. Specify account number, settlement round and forecast kwh")
+	}
+
+	accountId := args[0]
+	round, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil {
+		logger.Errorf("Error in converting to int:%s", err.Error())
+		return nil, fmt.Errorf("Invalid value of settlement round:%s", args[1])
+	}
+	forecastKwh, err := strconv.ParseInt(args[2], 10, 64)
+	if err != nil {
+		logger.Errorf("Error in converting to int:%s", err.Error())
+		return nil, fmt.Errorf("Invalid value of forecast kwh:%s", args[2])
+	}
+
+	currentRound, err := t.getCurrentRound(stub)
+	if err != nil {
+		return nil, err
+	}
+	if round <= currentRound {
+		logger.Errorf("Forecast for round %d submitted while round %d is open", round, currentRound)
+		return nil, fmt.Errorf("Forecasts must be submitted ahead of the round. Next round is %d", currentRound+1)
+	}
+
+	_, _, err = t.checkMeterOwner(stub, accountId)
+	if err != nil {
+		return nil, err
+	}
+
+	forecast := Forecast{AccountId: accountId, Round: round, ForecastKwh: forecastKwh}
+	existing, err := t.getForecast(stub, accountId, round)
+	if err != nil {
+		logger.Errorf("Failed retrieving forecast [%s]: [%s]", accountId, err)
+		return nil, fmt.Errorf("Failed retrieving forecast [%s]: [%s]", accountId, err)
+	}
+
+	var ok bool
+	if existing == nil {
+		ok, err = stub.InsertRow(forecastTableName, t.forecastRow(forecast))
+	} else {
+		ok, err = stub.ReplaceRow(forecastTableName, t.forecastRow(forecast))
+	}
+	if !ok || err != nil {
+		logger.Errorf("Error in saving forecast of account %s:%s", accountId, err)
+		return nil, errors.New("Error in saving forecast")
+	}
+	logger.Infof("Forecast of %d kwh for round %d saved for account %s", forecastKwh, round, accountId)
+
+	return nil, nil
+}
+
+// Sets the charge per kwh of deviation between forecast and reported energy. Only the
+// administrator can do it.
+func (t *EnergyTradingChainCode) setImbalanceRate(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	logger.Info("In setImbalanceRate function")
+	if len(args) != 1 {
+		logger.Error("Incorrect number of arguments")
+		return nil, errors.New("Incorrect number of arguments. Specify the imbalance charge per kwh")
+	}
+
+	rate, err := strconv.ParseFloat(args[0], 64)
+	if err != nil || rate < 0 {
+		logger.Errorf("Invalid value %s for imbalance rate", args[0])
+		return nil, errors.New("Invalid value for imbalance rate")
+	}
+
+	err = t.checkAdmin(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	err = stub.PutState("imbalance_rate", []byte(strconv.FormatFloat(rate, 'f', 6, 64)))
+	if err != nil {
+		logger.Errorf("Error saving imbalance rate %s", err.Error())
+		return nil, errors.New("Imbalance rate cannot be saved")
+	}
+	logger.Infof("Imbalance rate set to %f", rate)
+
+	return nil, nil
+}
+
+// Charges every meter that submitted a forecast for the round for the deviation from
+// the energy it reported during the round. Returns the total amount charged, which goes to the exchange account.
+func (t *EnergyTradingChainCode) applyImbalanceCharges(stub shim.ChaincodeStubInterface, round int64, meters []*settlement.MeterInfo, ledger ledgerDeltas) (float64, error) {
+	rate, err := t.getImbalanceRate(stub)
+	if err != nil {
+		return 0, err
+	}
+
+	var total float64
+	for _, meter := range meters {
+		forecast, err := t.getForecast(stub, meter.Id, round)
+		if err != nil {
+			return 0, err
+		}
+		if forecast == nil {
+			continue
+		}
+
+		// Energy carried over from earlier rounds was not part of the forecast
+		reported, err := t.getRoundEnergy(stub, meter.Id, round)
+		if err != nil {
+			return 0, err
+		}
+		forecast.ReportedKwh = reported
+		forecast.DeviationKwh = abs(reported - forecast.ForecastKwh)
+		forecast.ImbalanceCharge = float64(forecast.DeviationKwh) * rate
+		forecast.Settled = true
+		logger.Debugf("Meter %s deviated %d kwh from its forecast, charging %f", meter.Id, forecast.DeviationKwh, forecast.ImbalanceCharge)
+
+		meter.AccountBalance = meter.AccountBalance - forecast.ImbalanceCharge
+		total = total + forecast.ImbalanceCharge
+		ledger.transfer(meter.Id, exchangeAccountId, forecast.ImbalanceCharge)
+
+		ok, err := stub.ReplaceRow(forecastTableName, t.forecastRow(*forecast))
+		if !ok || err != nil {
+			return 0, fmt.Errorf("Error in updating forecast of account %s: %s", meter.Id, err)
+		}
+		err = t.updateForecastStats(stub, *forecast)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return total, nil
+}
+
+func (t *EnergyTradingChainCode) updateForecastStats(stub shim.ChaincodeStubInterface, forecast Forecast) error {
+	var columns []shim.Column
+	col1 := shim.Column{Value: &shim.Column_String_{String_: forecast.AccountId}}
+	columns = append(columns, col1)
+
+	row, err := stub.GetRow(forecastStatsTableName, columns)
+	if err != nil {
+		return err
+	}
+
+	var rounds, totalDeviation, totalReported int64
+	var totalCharge float64
+	exists := len(row.Columns) > 0
+	if exists {
+		rounds = row.Columns[1].GetInt64()
+		totalDeviation = row.Columns[2].GetInt64()
+		totalReported = row.Columns[3].GetInt64()
+		totalCharge, err = strconv.ParseFloat(row.Columns[4].GetString_(), 64)
+		if err != nil {
+			return fmt.Errorf("Invalid value of imbalance charge:%s", row.Columns[4].GetString_())
+		}
+	}
+
+	row = shim.Row{
+		Columns: []*shim.Column{
+			&shim.Column{Value: &shim.Column_String_{String_: forecast.AccountId}},
+			&shim.Column{Value: &shim.Column_Int64{Int64: rounds + 1}},
+			&shim.Column{Value: &shim.Column_Int64{Int64: totalDeviation + forecast.DeviationKwh}},
+			&shim.Column{Value: &shim.Column_Int64{Int64: totalReported + abs(forecast.ReportedKwh)}},
+			&shim.Column{Value: &shim.Column_String_{String_: strconv.FormatFloat(totalCharge+forecast.ImbalanceCharge, 'f', 6, 64)}},
+		},
+	}
+
+	var ok bool
+	if exists {
+		ok, err = stub.ReplaceRow(forecastStatsTableName, row)
+	} else {
+		ok, err = stub.InsertRow(forecastStatsTableName, row)
+	}
+	if !ok || err != nil {
+		return fmt.Errorf("Error in updating forecast statistics of account %s: %s", forecast.AccountId, err)
+	}
+	return nil
+}
+
+// Return the settlement round that is currently open
+func (t *EnergyTradingChainCode) currentRound(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	logger.Info("In currentRound function")
+	if len(args) > 0 {
+		logger.Error("Incorrect number of arguments")
+		return nil, errors.New("Incorrect number of arguments. No arguments necessary")
+	}
+
+	round, err := t.getCurrentRound(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	return []byte(strconv.FormatInt(round, 10)), nil
+}
+
+func (t *EnergyTradingChainCode) imbalanceRate(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	logger.Info("In imbalanceRate function")
+	if len(args) > 0 {
+		logger.Error("Incorrect number of arguments")
+		return nil, errors.New("Incorrect number of arguments. No arguments necessary")
+	}
+
+	rate, err := stub.GetState("imbalance_rate")
+	if err != nil {
+		logger.Error("Failed to retrieve imbalance rate")
+		return nil, fmt.Errorf("Failed to retrieve imbalance rate")
+	}
+
+	return rate, nil
+}
+
+// Return the forecast of a meter for a round
+func (t *EnergyTradingChainCode) forecast(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	logger.Info("In forecast function")
+	if len(args) != 2 {
+		logger.Error("Incorrect number of arguments")
+		return nil, errors.New("Incorrect number of arguments. Specify account number and settlement round")
+	}
+
+	accountId := args[0]
+	round, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil {
+		logger.Errorf("Error in converting to int:%s", err.Error())
+		return nil, fmt.Errorf("Invalid value of settlement round:%s", args[1])
+	}
+
+	forecast, err := t.getForecast(stub, accountId, round)
+	if err != nil {
+		logger.Errorf("Failed retrieving forecast [%s]: [%s]", accountId, err)
+		return nil, fmt.Errorf("Failed retrieving forecast [%s]: [%s]", accountId, err)
+	}
+	if forecast == nil {
+		return nil, fmt.Errorf("No forecast for round %d found for account %s", round, accountId)
+	}
+
+	payload, err := json.Marshal(forecast)
+	if err != nil {
+		logger.Errorf("Failed marshalling payload: [%s]", err)
+		return nil, fmt.Errorf("Failed marshalling payload [%s]", err)
+	}
+
+	return payload, nil
+}
+
+// Return the forecast accuracy statistics of a meter
+func (t *EnergyTradingChainCode) forecastAccuracy(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	logger.Info("In forecastAccuracy function")
+	if len(args) != 1 {
+		logger.Error("Incorrect number of arguments")
+		return nil, errors.New("Incorrect number of arguments. Specify account number")
+	}
+
+	accountId := args[0]
+	var columns []shim.Column
+	col1 := shim.Column{Value: &shim.Column_String_{String_: accountId}}
+	columns = append(columns, col1)
+
+	row, err := stub.GetRow(forecastStatsTableName, columns)
+	if err != nil {
+		logger.Errorf("Failed retrieving forecast statistics [%s]: [%s]", accountId, err)
+		return nil, fmt.Errorf("Failed retrieving forecast statistics [%s]: [%s]", accountId, err)
+	}
+
+	accuracy := ForecastAccuracy{AccountId: accountId}
+	if len(row.Columns) > 0 {
+		accuracy.Rounds = row.Columns[1].GetInt64()
+		accuracy.TotalDeviationKwh = row.Columns[2].GetInt64()
+		totalReported := row.Columns[3].GetInt64()
+		accuracy.TotalImbalanceCharge, err = strconv.ParseFloat(row.Columns[4].GetString_(), 64)
+		if err != nil {
+			logger.Errorf("Error in converting to float:%s", err.Error())
+			return nil, fmt.Errorf("Invalid value of imbalance charge:%s", row.Columns[4].GetString_())
+		}
+		if accuracy.Rounds > 0 {
+			accuracy.MeanAbsoluteDeviation = float64(accuracy.TotalDeviationKwh) / float64(accuracy.Rounds)
+		}
+		if totalReported > 0 {
+			accuracy.Accuracy = 100 * (1 - float64(accuracy.TotalDeviationKwh)/float64(totalReported))
+			if accuracy.Accuracy < 0 {
+				accuracy.Accuracy = 0
+			}
+		}
+	}
+
+	payload, err := json.Marshal(accuracy)
+	if err != nil {
+		logger.Errorf("Failed marshalling payload: [%s]", err)
+		return nil, fmt.Errorf("Failed marshalling payload [%s]", err)
+	}
+
+	return payload, nil
+}
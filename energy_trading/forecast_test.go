@@ -0,0 +1,51 @@
+package main
+
+import (
+	"encoding/json"
+	"math/rand"
+	"testing"
+)
+
+// Energy a seller could not sell is carried over to the next round, but only the energy
+// reported during a round is compared with its forecast
+func TestImbalanceIgnoresCarriedOverEnergy(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	cc, stub := newTestChaincode(t)
+	enrollMeters(t, cc, stub, r, 2)
+	owner := []byte("owner-1")
+	invokeAs(t, cc, stub, testAdmin, "setImbalanceRate", "2")
+	invokeAs(t, cc, stub, owner, "submitForecast", "1", "2", "5")
+
+	// Nobody buys in round 1
+	invokeAs(t, cc, stub, testAdmin, "reportDelta", "1", "20")
+	invokeAs(t, cc, stub, testAdmin, "settle")
+	if kwh := string(queryAs(t, cc, stub, "reportedKwh", "1")); kwh != "20" {
+		t.Fatalf("%s kwh carried over, want 20", kwh)
+	}
+
+	invokeAs(t, cc, stub, testAdmin, "reportDelta", "1", "6")
+	invokeAs(t, cc, stub, testAdmin, "settle")
+
+	var forecast Forecast
+	err := json.Unmarshal(queryAs(t, cc, stub, "forecast", "1", "2"), &forecast)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !forecast.Settled || forecast.ReportedKwh != 6 || forecast.DeviationKwh != 1 || forecast.ImbalanceCharge != 2 {
+		t.Errorf("Forecast %+v", forecast)
+	}
+}
+
+func TestInitKeepsImbalanceRate(t *testing.T) {
+	cc, stub := newTestChaincode(t)
+	invokeAs(t, cc, stub, testAdmin, "setImbalanceRate", "2.5")
+
+	stub.Caller = testAdmin
+	_, err := cc.Init(stub, "init", []string{"0.01"})
+	if err != nil {
+		t.Fatalf("Init failed: %s", err)
+	}
+	if rate := string(queryAs(t, cc, stub, "imbalanceRate")); rate != "2.500000" {
+		t.Errorf("Imbalance rate %s after deploying again, want 2.500000", rate)
+	}
+}
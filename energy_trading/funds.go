@@ -0,0 +1,381 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// Kinds of funds requests
+const (
+	fundsDeposit    = "deposit"
+	fundsWithdrawal = "withdrawal"
+)
+
+// States of a funds request
+const (
+	fundsPending  = "pending"
+	fundsApproved = "approved"
+	fundsRejected = "rejected"
+)
+
+// FundsRequest is a deposit to or a withdrawal from a meter account waiting for, or
+// decided by, the exchange operator. Reference identifies the payment outside of the
+// exchange, e.g. the bank transfer, and can only be used once.
+type FundsRequest struct {
+	Id        int64   `json:"id"`
+	AccountId string  `json:"account_id"`
+	Kind      string  `json:"kind"`
+	Amount    float64 `json:"amount"`
+	Reference string  `json:"reference"`
+	Status    string  `json:"status"`
+	Note      string  `json:"note,omitempty"`
+}
+
+func (t *EnergyTradingChainCode) fundsRequestRow(request FundsRequest) shim.Row {
+	return shim.Row{
+		Columns: []*shim.Column{
+			&shim.Column{Value: &shim.Column_Int64{Int64: request.Id}},
+			&shim.Column{Value: &shim.Column_String_{String_: request.AccountId}},
+			&shim.Column{Value: &shim.Column_String_{String_: request.Kind}},
+			&shim.Column{Value: &shim.Column_String_{String_: strconv.FormatFloat(request.Amount, 'f', 6, 64)}},
+			&shim.Column{Value: &shim.Column_String_{String_: request.Reference}},
+			&shim.Column{Value: &shim.Column_String_{String_: request.Status}},
+			&shim.Column{Value: &shim.Column_String_{String_: request.Note}},
+		},
+	}
+}
+
+func (t *EnergyTradingChainCode) extractFundsRequest(row shim.Row) (FundsRequest, error) {
+	request := FundsRequest{
+		Id:        row.Columns[0].GetInt64(),
+		AccountId: row.Columns[1].GetString_(),
+		Kind:      row.Columns[2].GetString_(),
+		Reference: row.Columns[4].GetString_(),
+		Status:    row.Columns[5].GetString_(),
+		Note:      row.Columns[6].GetString_(),
+	}
+	amount, err := strconv.ParseFloat(row.Columns[3].GetString_(), 64)
+	if err != nil {
+		return request, fmt.Errorf("Invalid value of amount:%s", row.Columns[3].GetString_())
+	}
+	request.Amount = amount
+	return request, nil
+}
+
+// Returns a funds request. Returns nil if there is no such request.
+func (t *EnergyTradingChainCode) getFundsRequest(stub shim.ChaincodeStubInterface, id int64) (*FundsRequest, error) {
+	var columns []shim.Column
+	col1 := shim.Column{Value: &shim.Column_Int64{Int64: id}}
+	columns = append(columns, col1)
+
+	row, err := stub.GetRow(fundsRequestsTableName, columns)
+	if err != nil {
+		return nil, err
+	}
+	if len(row.Columns) == 0 {
+		return nil, nil
+	}
+	request, err := t.extractFundsRequest(row)
+	if err != nil {
+		return nil, err
+	}
+	return &request, nil
+}
+
+// Returns the balance of a meter account
+func (t *EnergyTradingChainCode) getBalance(stub shim.ChaincodeStubInterface, accountId string) (float64, error) {
+	row, err := t.getRow(stub, accountId)
+	if err != nil {
+		return 0, fmt.Errorf("Failed retrieving account [%s]: [%s]", accountId, err)
+	}
+	if len(row.Columns) == 0 {
+		return 0, fmt.Errorf("Account %s not found", accountId)
+	}
+	balance, err := strconv.ParseFloat(row.Columns[3].GetString_(), 64)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid value of accountBalance:%s", row.Columns[3].GetString_())
+	}
+	return balance, nil
+}
+
+// Files a deposit or withdrawal request. Only the meter owner can do it.
+func (t *EnergyTradingChainCode) requestFunds(stub shim.ChaincodeStubInterface, kind string, args []string) ([]byte, error) {
+	if len(args) != 3 {
+		logger.Error("Incorrect number of arguments")
+		return nil, errors.New("Incorrect number of arguments. Specify account number, amount and payment reference")
+	}
+
+	accountId := args[0]
+	amount, err := strconv.ParseFloat(args[1], 64)
+	if err != nil || amount <= 0 {
+		logger.Errorf("Invalid value %s for amount", args[1])
+		return nil, fmt.Errorf("Invalid value of amount:%s", args[1])
+	}
+	reference := strings.TrimSpace(args[2])
+	if reference == "" {
+		logger.Error("Empty payment reference")
+		return nil, errors.New("Specify the payment reference")
+	}
+
+	_, _, err = t.checkMeterOwner(stub, accountId)
+	if err != nil {
+		return nil, err
+	}
+
+	if kind == fundsWithdrawal {
+		balance, err := t.getBalance(stub, accountId)
+		if err != nil {
+			logger.Errorf("Failed retrieving balance of account %s: %s", accountId, err)
+			return nil, err
+		}
+		if balance < amount {
+			logger.Errorf("Account %s has %f, cannot withdraw %f", accountId, balance, amount)
+			return nil, fmt.Errorf("Insufficient funds in account %s", accountId)
+		}
+	}
+
+	countStr, err := stub.GetState("funds_request_count")
+	if err != nil {
+		logger.Error("Failed to retrieve funds request count")
+		return nil, errors.New("Failed to retrieve funds request count")
+	}
+	var count int64
+	if len(countStr) > 0 {
+		count, err = strconv.ParseInt(string(countStr), 10, 64)
+		if err != nil {
+			logger.Errorf("Invalid value %s for funds request count", countStr)
+			return nil, errors.New("Invalid value for funds request count")
+		}
+	}
+	request := FundsRequest{Id: count + 1, AccountId: accountId, Kind: kind, Amount: amount, Reference: reference, Status: fundsPending}
+
+	// Claim the reference first so the same payment cannot be requested twice
+	ok, err := stub.InsertRow(fundsReferencesTableName, shim.Row{
+		Columns: []*shim.Column{
+			&shim.Column{Value: &shim.Column_String_{String_: reference}},
+			&shim.Column{Value: &shim.Column_Int64{Int64: request.Id}},
+		},
+	})
+	if err != nil {
+		logger.Errorf("Error in recording payment reference %s:%s", reference, err)
+		return nil, errors.New("Error in recording payment reference")
+	}
+	if !ok {
+		logger.Errorf("Payment reference %s already used", reference)
+		return nil, fmt.Errorf("Payment reference %s has already been used", reference)
+	}
+
+	ok, err = stub.InsertRow(fundsRequestsTableName, t.fundsRequestRow(request))
+	if !ok || err != nil {
+		logger.Errorf("Error in filing %s request of account %s:%s", kind, accountId, err)
+		return nil, fmt.Errorf("Error in filing %s request", kind)
+	}
+	err = stub.PutState("funds_request_count", []byte(strconv.FormatInt(request.Id, 10)))
+	if err != nil {
+		logger.Errorf("Error saving funds request count %s", err.Error())
+		return nil, errors.New("Funds request count cannot be saved")
+	}
+	logger.Infof("Filed %s request %d of %f for account %s", kind, request.Id, amount, accountId)
+
+	return []byte(strconv.FormatInt(request.Id, 10)), nil
+}
+
+// Requests a deposit to a meter account
+func (t *EnergyTradingChainCode) requestDeposit(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	logger.Info("In requestDeposit function")
+	return t.requestFunds(stub, fundsDeposit, args)
+}
+
+// Requests a withdrawal from a meter account
+func (t *EnergyTradingChainCode) requestWithdrawal(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	logger.Info("In requestWithdrawal function")
+	return t.requestFunds(stub, fundsWithdrawal, args)
+}
+
+// Returns a pending funds request, for the administrator to decide on
+func (t *EnergyTradingChainCode) getPendingFundsRequest(stub shim.ChaincodeStubInterface, idStr string) (*FundsRequest, error) {
+	id, err := strconv.ParseInt(idStr, 10, 64)
+	if err != nil {
+		logger.Errorf("Error in converting to int:%s", err.Error())
+		return nil, fmt.Errorf("Invalid value of request id:%s", idStr)
+	}
+
+	err = t.checkAdmin(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	request, err := t.getFundsRequest(stub, id)
+	if err != nil {
+		logger.Errorf("Failed retrieving funds request [%d]: [%s]", id, err)
+		return nil, fmt.Errorf("Failed retrieving funds request [%d]: [%s]", id, err)
+	}
+	if request == nil {
+		return nil, fmt.Errorf("Funds request %d not found", id)
+	}
+	if request.Status != fundsPending {
+		logger.Errorf("Funds request %d is already %s", id, request.Status)
+		return nil, fmt.Errorf("Funds request %d is already %s", id, request.Status)
+	}
+	return request, nil
+}
+
+// Approves a pending funds request and moves the money. Only the administrator can do it.
+func (t *EnergyTradingChainCode) approveFundsRequest(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	logger.Info("In approveFundsRequest function")
+	if len(args) != 1 {
+		logger.Error("Incorrect number of arguments")
+		return nil, errors.New("Incorrect number of arguments. Specify request id")
+	}
+
+	request, err := t.getPendingFundsRequest(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+
+	amount := request.Amount
+	if request.Kind == fundsWithdrawal {
+		balance, err := t.getBalance(stub, request.AccountId)
+		if err != nil {
+			logger.Errorf("Failed retrieving balance of account %s: %s", request.AccountId, err)
+			return nil, err
+		}
+		if balance < amount {
+			logger.Errorf("Account %s has %f, cannot withdraw %f", request.AccountId, balance, amount)
+			return nil, fmt.Errorf("Insufficient funds in account %s", request.AccountId)
+		}
+		amount = -amount
+	}
+
+	err = t.adjustBalance(stub, request.AccountId, amount)
+	if err != nil {
+		logger.Errorf("Error in updating balance of account %s:%s", request.AccountId, err)
+		return nil, errors.New("Error in updating account")
+	}
+	err = t.recordDeposit(stub, request.AccountId, amount)
+	if err != nil {
+		logger.Errorf("Error in updating totals of account %s:%s", request.AccountId, err)
+		return nil, errors.New("Error in updating account")
+	}
+
+	request.Status = fundsApproved
+	ok, err := stub.ReplaceRow(fundsRequestsTableName, t.fundsRequestRow(*request))
+	if !ok || err != nil {
+		logger.Errorf("Error in approving funds request %d:%s", request.Id, err)
+		return nil, errors.New("Error in approving funds request")
+	}
+	logger.Infof("Approved %s request %d of account %s", request.Kind, request.Id, request.AccountId)
+
+	return nil, nil
+}
+
+// Rejects a pending funds request with an optional reason. Only the administrator can do it.
+func (t *EnergyTradingChainCode) rejectFundsRequest(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	logger.Info("In rejectFundsRequest function")
+	if len(args) < 1 || len(args) > 2 {
+		logger.Error("Incorrect number of arguments")
+		return nil, errors.New("Incorrect number of arguments. Specify request id and optionally the reason")
+	}
+
+	request, err := t.getPendingFundsRequest(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+
+	request.Status = fundsRejected
+	if len(args) == 2 {
+		request.Note = args[1]
+	}
+	ok, err := stub.ReplaceRow(fundsRequestsTableName, t.fundsRequestRow(*request))
+	if !ok || err != nil {
+		logger.Errorf("Error in rejecting funds request %d:%s", request.Id, err)
+		return nil, errors.New("Error in rejecting funds request")
+	}
+	logger.Infof("Rejected %s request %d of account %s", request.Kind, request.Id, request.AccountId)
+
+	return nil, nil
+}
+
+// Return a funds request
+func (t *EnergyTradingChainCode) fundsRequest(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	logger.Info("In fundsRequest function")
+	if len(args) != 1 {
+		logger.Error("Incorrect number of arguments")
+		return nil, errors.New("Incorrect number of arguments. Specify request id")
+	}
+
+	id, err := strconv.ParseInt(args[0], 10, 64)
+	if err != nil {
+		logger.Errorf("Error in converting to int:%s", err.Error())
+		return nil, fmt.Errorf("Invalid value of request id:%s", args[0])
+	}
+	request, err := t.getFundsRequest(stub, id)
+	if err != nil {
+		logger.Errorf("Failed retrieving funds request [%d]: [%s]", id, err)
+		return nil, fmt.Errorf("Failed retrieving funds request [%d]: [%s]", id, err)
+	}
+	if request == nil {
+		return nil, fmt.Errorf("Funds request %d not found", id)
+	}
+
+	payload, err := json.Marshal(request)
+	if err != nil {
+		logger.Errorf("Failed marshalling payload: [%s]", err)
+		return nil, fmt.Errorf("Failed marshalling payload [%s]", err)
+	}
+
+	return payload, nil
+}
+
+// Return funds requests, optionally only those with a status and of one meter. An empty
+// status matches all requests.
+func (t *EnergyTradingChainCode) fundsRequests(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	logger.Info("In fundsRequests function")
+	if len(args) > 2 {
+		logger.Error("Incorrect number of arguments")
+		return nil, errors.New("Incorrect number of arguments. Optionally specify status and account number")
+	}
+
+	status, accountId := "", ""
+	if len(args) > 0 {
+		status = args[0]
+	}
+	if len(args) > 1 {
+		accountId = args[1]
+	}
+	if status != "" && status != fundsPending && status != fundsApproved && status != fundsRejected {
+		logger.Errorf("Invalid status %s", status)
+		return nil, fmt.Errorf("Invalid status %s. Specify %s, %s or %s", status, fundsPending, fundsApproved, fundsRejected)
+	}
+
+	var columns []shim.Column
+	rowChannel, err := stub.GetRows(fundsRequestsTableName, columns)
+	if err != nil {
+		logger.Errorf("Error in getting rows:%s", err.Error())
+		return nil, errors.New("Error in fetching rows")
+	}
+	requests := make([]FundsRequest, 0)
+	for row := range rowChannel {
+		request, err := t.extractFundsRequest(row)
+		if err != nil {
+			logger.Errorf("Invalid funds request: %s", err)
+			return nil, err
+		}
+		if (status == "" || request.Status == status) && (accountId == "" || request.AccountId == accountId) {
+			requests = append(requests, request)
+		}
+	}
+
+	payload, err := json.Marshal(requests)
+	if err != nil {
+		logger.Errorf("Failed marshalling payload")
+		return nil, fmt.Errorf("Failed marshalling payload [%s]", err)
+	}
+
+	return payload, nil
+}
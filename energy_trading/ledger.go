@@ -0,0 +1,284 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// Account id under which the totals of the exchange account are tracked. It cannot be
+// used to enroll a meter.
+const exchangeAccountId = "exchange"
+
+// Largest difference tolerated by the audit, balances are stored with 6 decimals
+const auditTolerance = 0.001
+
+// AccountTotals tracks all money and energy that moved in and out of an account. Deposits
+// and withdrawals cross the boundary of the exchange, credits and debits move money between
+// accounts of the exchange.
+type AccountTotals struct {
+	AccountId   string  `json:"account_id"`
+	Deposits    float64 `json:"deposits"`
+	Withdrawals float64 `json:"withdrawals"`
+	Credits     float64 `json:"credits"`
+	Debits      float64 `json:"debits"`
+	KwhSold     int64   `json:"kwh_sold"`
+	KwhBought   int64   `json:"kwh_bought"`
+}
+
+// Balance the account should have according to its totals
+func (a AccountTotals) expectedBalance() float64 {
+	return a.Deposits - a.Withdrawals + a.Credits - a.Debits
+}
+
+// Violation describes one failed invariant found by the audit
+type Violation struct {
+	Check     string  `json:"check"`
+	AccountId string  `json:"account_id,omitempty"`
+	Expected  float64 `json:"expected"`
+	Actual    float64 `json:"actual"`
+}
+
+type byAccountId []Violation
+
+func (a byAccountId) Len() int {
+	return len(a)
+}
+
+func (a byAccountId) Swap(i, j int) {
+	a[i], a[j] = a[j], a[i]
+}
+
+func (a byAccountId) Less(i, j int) bool {
+	return a[i].AccountId < a[j].AccountId
+}
+
+// AuditReport is the result of the auditInvariants query
+type AuditReport struct {
+	Ok                     bool        `json:"ok"`
+	TotalMeterBalances     float64     `json:"total_meter_balances"`
+	ExchangeAccountBalance float64     `json:"exchange_account_balance"`
+	NetDeposits            float64     `json:"net_deposits"`
+	KwhSold                int64       `json:"kwh_sold"`
+	KwhBought              int64       `json:"kwh_bought"`
+	Violations             []Violation `json:"violations"`
+}
+
+// ledgerDeltas collects the changes to the account totals made by one transaction
+type ledgerDeltas map[string]*AccountTotals
+
+func (l ledgerDeltas) get(accountId string) *AccountTotals {
+	totals, ok := l[accountId]
+	if !ok {
+		totals = &AccountTotals{AccountId: accountId}
+		l[accountId] = totals
+	}
+	return totals
+}
+
+// Records a transfer of money between two accounts of the exchange
+func (l ledgerDeltas) transfer(from, to string, amount float64) {
+	l.get(from).Debits += amount
+	l.get(to).Credits += amount
+}
+
+// Records energy sold by one meter to another
+func (l ledgerDeltas) trade(seller, buyer string, kwh int64) {
+	l.get(seller).KwhSold += kwh
+	l.get(buyer).KwhBought += kwh
+}
+
+func (t *EnergyTradingChainCode) totalsRow(totals AccountTotals) shim.Row {
+	return shim.Row{
+		Columns: []*shim.Column{
+			&shim.Column{Value: &shim.Column_String_{String_: totals.AccountId}},
+			&shim.Column{Value: &shim.Column_String_{String_: strconv.FormatFloat(totals.Deposits, 'f', 6, 64)}},
+			&shim.Column{Value: &shim.Column_String_{String_: strconv.FormatFloat(totals.Withdrawals, 'f', 6, 64)}},
+			&shim.Column{Value: &shim.Column_String_{String_: strconv.FormatFloat(totals.Credits, 'f', 6, 64)}},
+			&shim.Column{Value: &shim.Column_String_{String_: strconv.FormatFloat(totals.Debits, 'f', 6, 64)}},
+			&shim.Column{Value: &shim.Column_Int64{Int64: totals.KwhSold}},
+			&shim.Column{Value: &shim.Column_Int64{Int64: totals.KwhBought}},
+		},
+	}
+}
+
+func (t *EnergyTradingChainCode) extractTotals(row shim.Row) (AccountTotals, error) {
+	totals := AccountTotals{
+		AccountId: row.Columns[0].GetString_(),
+		KwhSold:   row.Columns[5].GetInt64(),
+		KwhBought: row.Columns[6].GetInt64(),
+	}
+	amounts := []*float64{&totals.Deposits, &totals.Withdrawals, &totals.Credits, &totals.Debits}
+	for i, amount := range amounts {
+		value, err := strconv.ParseFloat(row.Columns[i+1].GetString_(), 64)
+		if err != nil {
+			return totals, fmt.Errorf("Invalid amount %s in totals of account %s", row.Columns[i+1].GetString_(), totals.AccountId)
+		}
+		*amount = value
+	}
+	return totals, nil
+}
+
+// Adds the deltas to the stored totals of each account
+func (t *EnergyTradingChainCode) commitLedger(stub shim.ChaincodeStubInterface, deltas ledgerDeltas) error {
+	accountIds := make([]string, 0, len(deltas))
+	for accountId := range deltas {
+		accountIds = append(accountIds, accountId)
+	}
+	sort.Strings(accountIds)
+
+	for _, accountId := range accountIds {
+		delta := deltas[accountId]
+		var columns []shim.Column
+		col1 := shim.Column{Value: &shim.Column_String_{String_: accountId}}
+		columns = append(columns, col1)
+
+		row, err := stub.GetRow(totalsTableName, columns)
+		if err != nil {
+			return err
+		}
+
+		totals := AccountTotals{AccountId: accountId}
+		exists := len(row.Columns) > 0
+		if exists {
+			totals, err = t.extractTotals(row)
+			if err != nil {
+				return err
+			}
+		}
+		totals.Deposits += delta.Deposits
+		totals.Withdrawals += delta.Withdrawals
+		totals.Credits += delta.Credits
+		totals.Debits += delta.Debits
+		totals.KwhSold += delta.KwhSold
+		totals.KwhBought += delta.KwhBought
+
+		var ok bool
+		if exists {
+			ok, err = stub.ReplaceRow(totalsTableName, t.totalsRow(totals))
+		} else {
+			ok, err = stub.InsertRow(totalsTableName, t.totalsRow(totals))
+		}
+		if !ok || err != nil {
+			return fmt.Errorf("Error in updating totals of account %s: %s", accountId, err)
+		}
+	}
+	return nil
+}
+
+// Records a single deposit (+ve) or withdrawal (-ve) of an account
+func (t *EnergyTradingChainCode) recordDeposit(stub shim.ChaincodeStubInterface, accountId string, amount float64) error {
+	deltas := ledgerDeltas{}
+	if amount >= 0 {
+		deltas.get(accountId).Deposits = amount
+	} else {
+		deltas.get(accountId).Withdrawals = -amount
+	}
+	return t.commitLedger(stub, deltas)
+}
+
+// Checks that no money was created or destroyed and that all energy sold was bought
+func (t *EnergyTradingChainCode) auditInvariants(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	logger.Info("In auditInvariants function")
+	if len(args) > 0 {
+		logger.Error("Incorrect number of arguments")
+		return nil, errors.New("Incorrect number of arguments. No arguments required")
+	}
+
+	var columns []shim.Column
+	rowChannel, err := stub.GetRows(tableName, columns)
+	if err != nil {
+		logger.Errorf("Error in getting rows:%s", err.Error())
+		return nil, errors.New("Error in fetching rows")
+	}
+	balances := make(map[string]float64)
+	for row := range rowChannel {
+		balance, err := strconv.ParseFloat(row.Columns[3].GetString_(), 64)
+		if err != nil {
+			logger.Errorf("Error in converting to float:%s", err.Error())
+			return nil, fmt.Errorf("Invalid value of accountBalance:%s", row.Columns[3].GetString_())
+		}
+		balances[row.Columns[0].GetString_()] = balance
+	}
+
+	xchngBalanceStr, err := stub.GetState("exchange_account_balance")
+	if err != nil {
+		logger.Error("Failed to retrieve exchange account balance")
+		return nil, fmt.Errorf("Failed to retrieve exchange account balance")
+	}
+	xchngBalance, err := strconv.ParseFloat(string(xchngBalanceStr), 64)
+	if err != nil {
+		logger.Errorf("Invalid value %s for exchange account balance", xchngBalanceStr)
+		return nil, errors.New("Invalid value for exchange account balance")
+	}
+
+	rowChannel, err = stub.GetRows(totalsTableName, columns)
+	if err != nil {
+		logger.Errorf("Error in getting rows:%s", err.Error())
+		return nil, errors.New("Error in fetching rows")
+	}
+	totals := make(map[string]AccountTotals)
+	for row := range rowChannel {
+		accountTotals, err := t.extractTotals(row)
+		if err != nil {
+			logger.Errorf("Invalid totals: %s", err)
+			return nil, err
+		}
+		totals[accountTotals.AccountId] = accountTotals
+	}
+
+	report := AuditReport{ExchangeAccountBalance: xchngBalance, Violations: make([]Violation, 0)}
+	var credits, debits float64
+	for _, accountTotals := range totals {
+		report.NetDeposits += accountTotals.Deposits - accountTotals.Withdrawals
+		report.KwhSold += accountTotals.KwhSold
+		report.KwhBought += accountTotals.KwhBought
+		credits += accountTotals.Credits
+		debits += accountTotals.Debits
+	}
+
+	// Every account, including deleted ones, must hold what its totals say
+	for accountId, accountTotals := range totals {
+		actual := balances[accountId]
+		if accountId == exchangeAccountId {
+			actual = xchngBalance
+		}
+		if math.Abs(actual-accountTotals.expectedBalance()) > auditTolerance {
+			report.Violations = append(report.Violations, Violation{Check: "account_balance", AccountId: accountId, Expected: accountTotals.expectedBalance(), Actual: actual})
+		}
+	}
+	for accountId, balance := range balances {
+		report.TotalMeterBalances += balance
+		if _, ok := totals[accountId]; !ok && math.Abs(balance) > auditTolerance {
+			report.Violations = append(report.Violations, Violation{Check: "account_balance", AccountId: accountId, Expected: 0, Actual: balance})
+		}
+	}
+	if _, ok := totals[exchangeAccountId]; !ok && math.Abs(xchngBalance) > auditTolerance {
+		report.Violations = append(report.Violations, Violation{Check: "account_balance", AccountId: exchangeAccountId, Expected: 0, Actual: xchngBalance})
+	}
+
+	if math.Abs(credits-debits) > auditTolerance {
+		report.Violations = append(report.Violations, Violation{Check: "internal_transfers", Expected: debits, Actual: credits})
+	}
+	if math.Abs(report.TotalMeterBalances+xchngBalance-report.NetDeposits) > auditTolerance {
+		report.Violations = append(report.Violations, Violation{Check: "conservation", Expected: report.NetDeposits, Actual: report.TotalMeterBalances + xchngBalance})
+	}
+	if report.KwhSold != report.KwhBought {
+		report.Violations = append(report.Violations, Violation{Check: "energy", Expected: float64(report.KwhSold), Actual: float64(report.KwhBought)})
+	}
+	sort.Stable(byAccountId(report.Violations))
+	report.Ok = len(report.Violations) == 0
+
+	payload, err := json.Marshal(report)
+	if err != nil {
+		logger.Errorf("Failed marshalling payload: [%s]", err)
+		return nil, fmt.Errorf("Failed marshalling payload [%s]", err)
+	}
+
+	return payload, nil
+}
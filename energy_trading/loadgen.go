@@ -0,0 +1,235 @@
+//go:build loadgen
+// +build loadgen
+
+// Load generator for the settlement. Built with the loadgen tag it replaces the chaincode
+// main: it enrolls synthetic meters in an in-memory stub, reports energy drawn from the
+// configured distributions and runs settle, reporting the time taken, the state reads
+// and writes and the memory allocated by each settlement round.
+//
+//	go build -tags loadgen -o loadgen .
+//	./loadgen -meters 10000 -rounds 3
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"math"
+	"math/rand"
+	"os"
+	"runtime"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/predix/chaincode_example/energy_trading/memstub"
+	"github.com/predix/chaincode_example/energy_trading/settlement"
+)
+
+type loadConfig struct {
+	meters    int
+	sellers   float64
+	kwhDist   string
+	kwhMean   float64
+	kwhSpread float64
+	rateMin   int64
+	rateMax   int64
+	renewable float64
+	intervals int
+	rounds    int
+	seed      int64
+}
+
+// Measurements of one settlement round
+type roundStats struct {
+	Round      int64   `json:"round"`
+	Meters     int     `json:"meters"`
+	Trades     int     `json:"trades"`
+	ReportMs   float64 `json:"report_ms"`
+	SettleMs   float64 `json:"settle_ms"`
+	Reads      int64   `json:"reads"`
+	Writes     int64   `json:"writes"`
+	RowScans   int64   `json:"row_scans"`
+	AllocBytes uint64  `json:"alloc_bytes"`
+	Mallocs    uint64  `json:"mallocs"`
+	HeapBytes  uint64  `json:"heap_bytes"`
+}
+
+var generationMix = []string{
+	settlement.GenerationSolar,
+	settlement.GenerationWind,
+	settlement.GenerationHydro,
+	settlement.GenerationGas,
+	settlement.GenerationGrid,
+}
+
+// Draws the energy of a meter in kwh, always at least 1
+func drawKwh(r *rand.Rand, config loadConfig) int64 {
+	var kwh float64
+	switch config.kwhDist {
+	case "normal":
+		kwh = config.kwhMean + r.NormFloat64()*config.kwhSpread
+	case "exponential":
+		kwh = r.ExpFloat64() * config.kwhMean
+	default:
+		kwh = config.kwhMean + (r.Float64()*2-1)*config.kwhSpread
+	}
+	return int64(math.Max(1, math.Floor(kwh+0.5)))
+}
+
+func invoke(t *EnergyTradingChainCode, stub *memstub.Stub, caller []byte, function string, args ...string) {
+	stub.Caller = caller
+	stub.TxID = strconv.FormatInt(time.Now().UnixNano(), 10)
+	_, err := t.Invoke(stub, function, args)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s %v failed: %s\n", function, args, err)
+		os.Exit(1)
+	}
+}
+
+func run(config loadConfig) ([]roundStats, error) {
+	r := rand.New(rand.NewSource(config.seed))
+	stub := memstub.New()
+	t := new(EnergyTradingChainCode)
+	admin := []byte("admin")
+
+	stub.Caller = admin
+	_, err := t.Init(stub, "init", []string{"0.01"})
+	if err != nil {
+		return nil, err
+	}
+
+	owners := make([][]byte, config.meters)
+	sellers := make([]bool, config.meters)
+	for i := 0; i < config.meters; i++ {
+		accountId := strconv.Itoa(i + 1)
+		owners[i] = []byte("owner-" + accountId)
+		rate := config.rateMin + r.Int63n(config.rateMax-config.rateMin+1)
+		invoke(t, stub, admin, "enroll", accountId, "meter "+accountId, strconv.FormatInt(rate, 10), base64.StdEncoding.EncodeToString(owners[i]))
+		invoke(t, stub, admin, "changeAccountBalance", accountId, "1000")
+
+		sellers[i] = r.Float64() < config.sellers
+		if sellers[i] {
+			generationType := generationMix[r.Intn(len(generationMix))]
+			invoke(t, stub, owners[i], "updateMeterMetadata", accountId, "site "+accountId, "10", generationType, "2017-01-01")
+		} else if r.Float64() < config.renewable {
+			invoke(t, stub, owners[i], "setSourcePreference", accountId, settlement.SourceRenewable)
+		}
+	}
+
+	stats := make([]roundStats, 0, config.rounds)
+	start := time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+	for n := 0; n < config.rounds; n++ {
+		round, err := t.getCurrentRound(stub)
+		if err != nil {
+			return nil, err
+		}
+
+		reportStart := time.Now()
+		for i := 0; i < config.meters; i++ {
+			accountId := strconv.Itoa(i + 1)
+			kwh := drawKwh(r, config)
+			if !sellers[i] {
+				kwh = -kwh
+			}
+			if config.intervals == 0 {
+				invoke(t, stub, admin, "reportDelta", accountId, strconv.FormatInt(kwh, 10))
+				continue
+			}
+			// Split the energy over the intervals, both sources report the same reading, the
+			// meter signed by its owner and the head-end by the administrator
+			for j := 0; j < config.intervals; j++ {
+				part := kwh / int64(config.intervals)
+				if j == 0 {
+					part = part + kwh%int64(config.intervals)
+				}
+				interval := start.Add(time.Duration(n*config.intervals+j) * time.Hour).Format(time.RFC3339)
+				invoke(t, stub, owners[i], "reportDelta", accountId, strconv.FormatInt(part, 10), sourceMeter, interval)
+				invoke(t, stub, admin, "reportDelta", accountId, strconv.FormatInt(part, 10), sourceHeadEnd, interval)
+			}
+		}
+		reportTime := time.Since(reportStart)
+
+		runtime.GC()
+		var before, after runtime.MemStats
+		runtime.ReadMemStats(&before)
+		stub.ResetCounts()
+
+		settleStart := time.Now()
+		invoke(t, stub, admin, "settle")
+		settleTime := time.Since(settleStart)
+
+		runtime.ReadMemStats(&after)
+		counts := stub.Counts
+
+		trades, err := t.getTrades(stub, round, "")
+		if err != nil {
+			return nil, err
+		}
+		stats = append(stats, roundStats{
+			Round:      round,
+			Meters:     config.meters,
+			Trades:     len(trades),
+			ReportMs:   float64(reportTime) / float64(time.Millisecond),
+			SettleMs:   float64(settleTime) / float64(time.Millisecond),
+			Reads:      counts.Reads(),
+			Writes:     counts.Writes(),
+			RowScans:   counts.RowScans,
+			AllocBytes: after.TotalAlloc - before.TotalAlloc,
+			Mallocs:    after.Mallocs - before.Mallocs,
+			HeapBytes:  after.HeapAlloc,
+		})
+	}
+	return stats, nil
+}
+
+func main() {
+	config := loadConfig{}
+	flag.IntVar(&config.meters, "meters", 1000, "Number of meters")
+	flag.Float64Var(&config.sellers, "sellers", 0.4, "Share of meters producing energy")
+	flag.StringVar(&config.kwhDist, "kwh-dist", "uniform", "Distribution of the energy reported per round: uniform, normal or exponential")
+	flag.Float64Var(&config.kwhMean, "kwh-mean", 20, "Mean energy reported per meter and round in kwh")
+	flag.Float64Var(&config.kwhSpread, "kwh-spread", 10, "Half width of the uniform distribution or standard deviation of the normal one")
+	flag.Int64Var(&config.rateMin, "rate-min", 1, "Lowest rate per kwh")
+	flag.Int64Var(&config.rateMax, "rate-max", 10, "Highest rate per kwh")
+	flag.Float64Var(&config.renewable, "renewable", 0, "Share of buyers that only accept renewable energy")
+	flag.IntVar(&config.intervals, "intervals", 0, "Interval readings per meter and round, reported by meter and head-end. With 0 energy is reported as plain deltas")
+	flag.IntVar(&config.rounds, "rounds", 1, "Settlement rounds to run")
+	flag.Int64Var(&config.seed, "seed", 1, "Seed of the random generator")
+	jsonOutput := flag.Bool("json", false, "Print the measurements as JSON")
+	flag.Parse()
+
+	if config.meters <= 0 || config.rounds <= 0 || config.intervals < 0 || config.rateMin > config.rateMax {
+		fmt.Fprintln(os.Stderr, "Invalid configuration")
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	// Logging every call of the chaincode would dominate the measurements
+	shim.SetLoggingLevel(shim.LogError)
+	logger.SetLevel(shim.LogError)
+
+	stats, err := run(config)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+		os.Exit(1)
+	}
+
+	if *jsonOutput {
+		payload, err := json.MarshalIndent(stats, "", "  ")
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+			os.Exit(1)
+		}
+		fmt.Println(string(payload))
+		return
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(w, "round\tmeters\ttrades\treport ms\tsettle ms\treads\twrites\tscans\talloc KiB\tmallocs\theap KiB\t")
+	for _, s := range stats {
+		fmt.Fprintf(w, "%d\t%d\t%d\t%.1f\t%.1f\t%d\t%d\t%d\t%d\t%d\t%d\t\n", s.Round, s.Meters, s.Trades, s.ReportMs, s.SettleMs, s.Reads, s.Writes, s.RowScans, s.AllocBytes/1024, s.Mallocs, s.HeapBytes/1024)
+	}
+	w.Flush()
+}
@@ -0,0 +1,17 @@
+//go:build !loadgen
+// +build !loadgen
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+func main() {
+	err := shim.Start(new(EnergyTradingChainCode))
+	if err != nil {
+		fmt.Printf("Error starting Energy trading chaincode: %s", err)
+	}
+}
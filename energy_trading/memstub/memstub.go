@@ -0,0 +1,434 @@
+// Package memstub provides an in-memory implementation of the chaincode stub with
+// support for tables, which the MockStub of the shim lacks. It counts the reads and
+// writes made through it, so the cost of a chaincode function can be measured outside
+// of a peer.
+//
+// Signatures are not real: the caller is identified by the certificate set in Caller,
+// which is returned as the caller metadata, and VerifySignature succeeds when the
+// certificate checked is the caller's.
+package memstub
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/hyperledger/fabric/core/chaincode/shim/crypto/attr"
+)
+
+// Counts of the operations made through a stub. Rows read counts every row returned,
+// by GetRow as well as GetRows.
+type Counts struct {
+	StateReads  int64 `json:"state_reads"`
+	StateWrites int64 `json:"state_writes"`
+	RowReads    int64 `json:"row_reads"`
+	RowWrites   int64 `json:"row_writes"`
+	RowScans    int64 `json:"row_scans"`
+}
+
+// Reads returns the number of state reads and rows read
+func (c Counts) Reads() int64 {
+	return c.StateReads + c.RowReads
+}
+
+// Writes returns the number of state writes and rows written
+func (c Counts) Writes() int64 {
+	return c.StateWrites + c.RowWrites
+}
+
+type table struct {
+	columns []*shim.ColumnDefinition
+	keys    []string
+	rows    map[string]shim.Row
+}
+
+// The shim returns the Timestamp of the protobuf vendored by fabric, which cannot be
+// imported from outside of fabric. The stub gets GetTxTimestamp from an embedded clock
+// whose Timestamp type is inferred from the shim interface instead.
+type clockStub = shim.ChaincodeStubInterface
+
+type clock[T any] struct {
+	shim.ChaincodeStubInterface
+	stub *Stub
+}
+
+func newClock[T any](_ func(shim.ChaincodeStubInterface) (*T, error), stub *Stub) clock[T] {
+	return clock[T]{stub: stub}
+}
+
+// GetTxTimestamp returns the Now of the stub
+func (c clock[T]) GetTxTimestamp() (*T, error) {
+	timestamp := new(T)
+	value := reflect.ValueOf(timestamp).Elem()
+	value.FieldByName("Seconds").SetInt(c.stub.Now.Unix())
+	value.FieldByName("Nanos").SetInt(int64(c.stub.Now.Nanosecond()))
+	return timestamp, nil
+}
+
+// Stub is an in-memory chaincode stub
+type Stub struct {
+	clockStub
+
+	// Certificate of the caller of the next transactions
+	Caller []byte
+	// Certificate attributes of the caller
+	Attributes map[string][]byte
+	// Timestamp of the next transactions
+	Now  time.Time
+	TxID string
+
+	Counts Counts
+
+	state  map[string][]byte
+	tables map[string]*table
+}
+
+// New returns an empty stub
+func New() *Stub {
+	s := &Stub{
+		Attributes: make(map[string][]byte),
+		Now:        time.Now(),
+		state:      make(map[string][]byte),
+		tables:     make(map[string]*table),
+	}
+	s.clockStub = newClock(shim.ChaincodeStubInterface.GetTxTimestamp, s)
+	return s
+}
+
+// ResetCounts clears the operation counts
+func (s *Stub) ResetCounts() {
+	s.Counts = Counts{}
+}
+
+// Builds the key of a row from its key columns. Values are length prefixed so that
+// the key of a row starts with the key of every prefix of its key columns.
+func buildKey(columns []shim.Column) (string, error) {
+	var buffer bytes.Buffer
+	for _, column := range columns {
+		var value string
+		switch v := column.Value.(type) {
+		case *shim.Column_String_:
+			value = v.String_
+		case *shim.Column_Int32:
+			value = strconv.FormatInt(int64(v.Int32), 10)
+		case *shim.Column_Int64:
+			value = strconv.FormatInt(v.Int64, 10)
+		case *shim.Column_Uint32:
+			value = strconv.FormatUint(uint64(v.Uint32), 10)
+		case *shim.Column_Uint64:
+			value = strconv.FormatUint(v.Uint64, 10)
+		case *shim.Column_Bytes:
+			value = string(v.Bytes)
+		case *shim.Column_Bool:
+			value = strconv.FormatBool(v.Bool)
+		default:
+			return "", errors.New("Unsupported key column type")
+		}
+		buffer.WriteString(strconv.Itoa(len(value)))
+		buffer.WriteString(":")
+		buffer.WriteString(value)
+	}
+	return buffer.String(), nil
+}
+
+// Returns a copy of the row, callers replace columns in the rows they get
+func copyRow(row shim.Row) shim.Row {
+	columns := make([]*shim.Column, len(row.Columns))
+	copy(columns, row.Columns)
+	return shim.Row{Columns: columns}
+}
+
+func (s *Stub) getTable(name string) (*table, error) {
+	t, ok := s.tables[name]
+	if !ok {
+		return nil, shim.ErrTableNotFound
+	}
+	return t, nil
+}
+
+func (t *table) rowKey(row shim.Row) (string, error) {
+	if len(row.Columns) != len(t.columns) {
+		return "", fmt.Errorf("Row has %d columns, table has %d", len(row.Columns), len(t.columns))
+	}
+	key := make([]shim.Column, 0)
+	for i, definition := range t.columns {
+		if definition.Key {
+			if row.Columns[i] == nil {
+				return "", fmt.Errorf("Key column %s is missing", definition.Name)
+			}
+			key = append(key, *row.Columns[i])
+		}
+	}
+	return buildKey(key)
+}
+
+func (s *Stub) GetArgs() [][]byte {
+	return nil
+}
+
+func (s *Stub) GetStringArgs() []string {
+	return nil
+}
+
+func (s *Stub) GetTxID() string {
+	return s.TxID
+}
+
+// Not implemented
+func (s *Stub) InvokeChaincode(chaincodeName string, args [][]byte) ([]byte, error) {
+	return nil, errors.New("Not implemented")
+}
+
+// Not implemented
+func (s *Stub) QueryChaincode(chaincodeName string, args [][]byte) ([]byte, error) {
+	return nil, errors.New("Not implemented")
+}
+
+func (s *Stub) GetState(key string) ([]byte, error) {
+	s.Counts.StateReads++
+	return s.state[key], nil
+}
+
+func (s *Stub) PutState(key string, value []byte) error {
+	s.Counts.StateWrites++
+	s.state[key] = value
+	return nil
+}
+
+func (s *Stub) DelState(key string) error {
+	s.Counts.StateWrites++
+	delete(s.state, key)
+	return nil
+}
+
+type rangeIterator struct {
+	stub *Stub
+	keys []string
+}
+
+func (it *rangeIterator) HasNext() bool {
+	return len(it.keys) > 0
+}
+
+func (it *rangeIterator) Next() (string, []byte, error) {
+	if len(it.keys) == 0 {
+		return "", nil, errors.New("No more keys")
+	}
+	key := it.keys[0]
+	it.keys = it.keys[1:]
+	it.stub.Counts.StateReads++
+	return key, it.stub.state[key], nil
+}
+
+func (it *rangeIterator) Close() error {
+	it.keys = nil
+	return nil
+}
+
+// RangeQueryState returns the keys from startKey up to, but excluding, endKey
+func (s *Stub) RangeQueryState(startKey, endKey string) (shim.StateRangeQueryIteratorInterface, error) {
+	keys := make([]string, 0)
+	for key := range s.state {
+		if key >= startKey && key < endKey {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return &rangeIterator{stub: s, keys: keys}, nil
+}
+
+func (s *Stub) CreateTable(name string, columnDefinitions []*shim.ColumnDefinition) error {
+	if _, ok := s.tables[name]; ok {
+		return fmt.Errorf("CreateTable operation failed. Table %s already exists", name)
+	}
+	if len(columnDefinitions) == 0 || !columnDefinitions[0].Key {
+		return errors.New("The first column of a table must be a key")
+	}
+	s.Counts.StateWrites++
+	s.tables[name] = &table{columns: columnDefinitions, rows: make(map[string]shim.Row)}
+	return nil
+}
+
+func (s *Stub) GetTable(tableName string) (*shim.Table, error) {
+	s.Counts.StateReads++
+	t, err := s.getTable(tableName)
+	if err != nil {
+		return nil, err
+	}
+	return &shim.Table{Name: tableName, ColumnDefinitions: t.columns}, nil
+}
+
+func (s *Stub) DeleteTable(tableName string) error {
+	s.Counts.StateWrites++
+	delete(s.tables, tableName)
+	return nil
+}
+
+// InsertRow returns false without error if a row with the same key exists
+func (s *Stub) InsertRow(tableName string, row shim.Row) (bool, error) {
+	t, err := s.getTable(tableName)
+	if err != nil {
+		return false, err
+	}
+	key, err := t.rowKey(row)
+	if err != nil {
+		return false, err
+	}
+	s.Counts.RowReads++
+	if _, ok := t.rows[key]; ok {
+		return false, nil
+	}
+
+	s.Counts.RowWrites++
+	t.rows[key] = copyRow(row)
+	i := sort.SearchStrings(t.keys, key)
+	t.keys = append(t.keys, "")
+	copy(t.keys[i+1:], t.keys[i:])
+	t.keys[i] = key
+	return true, nil
+}
+
+// ReplaceRow returns false without error if there is no row with the same key
+func (s *Stub) ReplaceRow(tableName string, row shim.Row) (bool, error) {
+	t, err := s.getTable(tableName)
+	if err != nil {
+		return false, err
+	}
+	key, err := t.rowKey(row)
+	if err != nil {
+		return false, err
+	}
+	s.Counts.RowReads++
+	if _, ok := t.rows[key]; !ok {
+		return false, nil
+	}
+
+	s.Counts.RowWrites++
+	t.rows[key] = copyRow(row)
+	return true, nil
+}
+
+// GetRow returns an empty row if there is no row with the key
+func (s *Stub) GetRow(tableName string, key []shim.Column) (shim.Row, error) {
+	t, err := s.getTable(tableName)
+	if err != nil {
+		return shim.Row{}, err
+	}
+	rowKey, err := buildKey(key)
+	if err != nil {
+		return shim.Row{}, err
+	}
+	row, ok := t.rows[rowKey]
+	if !ok {
+		return shim.Row{}, nil
+	}
+	s.Counts.RowReads++
+	return copyRow(row), nil
+}
+
+// GetRows returns the rows whose key starts with the given key columns, in key order
+func (s *Stub) GetRows(tableName string, key []shim.Column) (<-chan shim.Row, error) {
+	t, err := s.getTable(tableName)
+	if err != nil {
+		return nil, err
+	}
+	prefix, err := buildKey(key)
+	if err != nil {
+		return nil, err
+	}
+	s.Counts.RowScans++
+
+	rows := make([]shim.Row, 0)
+	for i := sort.SearchStrings(t.keys, prefix); i < len(t.keys); i++ {
+		if !bytes.HasPrefix([]byte(t.keys[i]), []byte(prefix)) {
+			break
+		}
+		rows = append(rows, copyRow(t.rows[t.keys[i]]))
+	}
+	s.Counts.RowReads += int64(len(rows))
+
+	rowChannel := make(chan shim.Row, len(rows))
+	for _, row := range rows {
+		rowChannel <- row
+	}
+	close(rowChannel)
+	return rowChannel, nil
+}
+
+func (s *Stub) DeleteRow(tableName string, key []shim.Column) error {
+	t, err := s.getTable(tableName)
+	if err != nil {
+		return err
+	}
+	rowKey, err := buildKey(key)
+	if err != nil {
+		return err
+	}
+	s.Counts.RowWrites++
+	if _, ok := t.rows[rowKey]; !ok {
+		return nil
+	}
+	delete(t.rows, rowKey)
+	i := sort.SearchStrings(t.keys, rowKey)
+	t.keys = append(t.keys[:i], t.keys[i+1:]...)
+	return nil
+}
+
+func (s *Stub) ReadCertAttribute(attributeName string) ([]byte, error) {
+	value, ok := s.Attributes[attributeName]
+	if !ok {
+		return nil, fmt.Errorf("Attribute %s not found", attributeName)
+	}
+	return value, nil
+}
+
+// VerifyAttribute fails like the peer does for a certificate without the attribute
+func (s *Stub) VerifyAttribute(attributeName string, attributeValue []byte) (bool, error) {
+	value, ok := s.Attributes[attributeName]
+	if !ok {
+		return false, fmt.Errorf("Attribute %s not found", attributeName)
+	}
+	return bytes.Equal(value, attributeValue), nil
+}
+
+func (s *Stub) VerifyAttributes(attrs ...*attr.Attribute) (bool, error) {
+	for _, attribute := range attrs {
+		ok, err := s.VerifyAttribute(attribute.Name, attribute.Value)
+		if !ok || err != nil {
+			return ok, err
+		}
+	}
+	return true, nil
+}
+
+// VerifySignature succeeds if the certificate is the caller's and the signature is the
+// caller metadata
+func (s *Stub) VerifySignature(certificate, signature, message []byte) (bool, error) {
+	return len(s.Caller) > 0 && bytes.Equal(certificate, s.Caller) && bytes.Equal(signature, s.Caller), nil
+}
+
+func (s *Stub) GetCallerCertificate() ([]byte, error) {
+	return s.Caller, nil
+}
+
+func (s *Stub) GetCallerMetadata() ([]byte, error) {
+	return s.Caller, nil
+}
+
+func (s *Stub) GetBinding() ([]byte, error) {
+	return []byte(s.TxID), nil
+}
+
+func (s *Stub) GetPayload() ([]byte, error) {
+	return nil, nil
+}
+
+// Not implemented
+func (s *Stub) SetEvent(name string, payload []byte) error {
+	return nil
+}
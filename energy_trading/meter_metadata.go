@@ -0,0 +1,214 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/predix/chaincode_example/energy_trading/settlement"
+)
+
+const installationDateLayout = "2006-01-02"
+
+func (t *EnergyTradingChainCode) metadataRow(accountId string, owner []byte, metadata settlement.MeterMetadata) shim.Row {
+	return shim.Row{
+		Columns: []*shim.Column{
+			&shim.Column{Value: &shim.Column_String_{String_: accountId}},
+			&shim.Column{Value: &shim.Column_Bytes{Bytes: owner}},
+			&shim.Column{Value: &shim.Column_String_{String_: metadata.Location}},
+			&shim.Column{Value: &shim.Column_String_{String_: strconv.FormatFloat(metadata.CapacityKw, 'f', 6, 64)}},
+			&shim.Column{Value: &shim.Column_String_{String_: metadata.GenerationType}},
+			&shim.Column{Value: &shim.Column_String_{String_: metadata.InstallationDate}},
+			&shim.Column{Value: &shim.Column_String_{String_: metadata.SourcePreference}},
+		},
+	}
+}
+
+func (t *EnergyTradingChainCode) extractMetadata(row shim.Row) (*settlement.MeterMetadata, error) {
+	capacity, err := strconv.ParseFloat(row.Columns[3].GetString_(), 64)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid value of capacity:%s", row.Columns[3].GetString_())
+	}
+	return &settlement.MeterMetadata{
+		Location:         row.Columns[2].GetString_(),
+		CapacityKw:       capacity,
+		GenerationType:   row.Columns[4].GetString_(),
+		InstallationDate: row.Columns[5].GetString_(),
+		SourcePreference: row.Columns[6].GetString_(),
+	}, nil
+}
+
+// Returns the metadata and the owner certificate of a meter. Meters enrolled before
+// metadata was introduced have neither, in which case nil is returned for both.
+func (t *EnergyTradingChainCode) getMeterMetadata(stub shim.ChaincodeStubInterface, accountId string) (*settlement.MeterMetadata, []byte, error) {
+	var columns []shim.Column
+	col1 := shim.Column{Value: &shim.Column_String_{String_: accountId}}
+	columns = append(columns, col1)
+
+	row, err := stub.GetRow(metadataTableName, columns)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(row.Columns) == 0 {
+		return nil, nil, nil
+	}
+	metadata, err := t.extractMetadata(row)
+	if err != nil {
+		return nil, nil, err
+	}
+	return metadata, row.Columns[1].GetBytes(), nil
+}
+
+// Fills in the metadata for each of the meters
+func (t *EnergyTradingChainCode) attachMetadata(stub shim.ChaincodeStubInterface, meters []*settlement.MeterInfo) error {
+	for _, meter := range meters {
+		metadata, _, err := t.getMeterMetadata(stub, meter.Id)
+		if err != nil {
+			return err
+		}
+		meter.Metadata = metadata
+	}
+	return nil
+}
+
+// Verifies that the caller is the owner of the meter and returns the current metadata
+// along with the owner certificate
+func (t *EnergyTradingChainCode) checkMeterOwner(stub shim.ChaincodeStubInterface, accountId string) (*settlement.MeterMetadata, []byte, error) {
+	metadata, owner, err := t.getMeterMetadata(stub, accountId)
+	if err != nil {
+		logger.Errorf("Failed retrieving metadata of account [%s]: [%s]", accountId, err)
+		return nil, nil, fmt.Errorf("Failed retrieving metadata of account [%s]: [%s]", accountId, err)
+	}
+	if len(owner) == 0 {
+		logger.Errorf("Meter %s has no owner", accountId)
+		return nil, nil, fmt.Errorf("Meter %s has no owner", accountId)
+	}
+
+	ok, err := t.isCaller(stub, owner)
+	if err != nil {
+		logger.Error("Failed checking owner identity")
+		return nil, nil, errors.New("Failed checking owner identity")
+	}
+	if !ok {
+		logger.Error("Caller is not the owner of the meter")
+		return nil, nil, errors.New("The caller is not the owner of meter")
+	}
+	return metadata, owner, nil
+}
+
+// Updates the metadata of a meter. Only the meter owner can do it.
+func (t *EnergyTradingChainCode) updateMeterMetadata(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	logger.Info("In updateMeterMetadata function")
+	if len(args) != 5 {
+		logger.Error("Incorrect number of arguments")
+		return nil, errors.New("Incorrect number of arguments. Specify account number, location, capacity in kw, generation type and installation date")
+	}
+
+	accountId := args[0]
+	location := args[1]
+	capacity, err := strconv.ParseFloat(args[2], 64)
+	if err != nil || capacity < 0 {
+		logger.Errorf("Invalid value %s for capacity", args[2])
+		return nil, fmt.Errorf("Invalid value of capacity:%s", args[2])
+	}
+	generationType := args[3]
+	if !settlement.IsGenerationType(generationType) {
+		logger.Errorf("Invalid generation type %s", generationType)
+		return nil, fmt.Errorf("Invalid generation type %s", generationType)
+	}
+	installationDate := args[4]
+	if _, err = time.Parse(installationDateLayout, installationDate); err != nil {
+		logger.Errorf("Invalid installation date %s", installationDate)
+		return nil, fmt.Errorf("Invalid installation date %s. Expected format is YYYY-MM-DD", installationDate)
+	}
+
+	metadata, owner, err := t.checkMeterOwner(stub, accountId)
+	if err != nil {
+		return nil, err
+	}
+
+	metadata.Location = location
+	metadata.CapacityKw = capacity
+	metadata.GenerationType = generationType
+	metadata.InstallationDate = installationDate
+
+	ok, err := stub.ReplaceRow(metadataTableName, t.metadataRow(accountId, owner, *metadata))
+	if !ok || err != nil {
+		logger.Errorf("Error in updating metadata of account %s:%s", accountId, err)
+		return nil, errors.New("Error in updating meter metadata")
+	}
+	logger.Infof("Updated metadata of account %s", accountId)
+
+	return nil, nil
+}
+
+// Sets the source preference of a buyer. The preference can be "any", "renewable" or
+// one specific generation type. Only the meter owner can do it.
+func (t *EnergyTradingChainCode) setSourcePreference(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	logger.Info("In setSourcePreference function")
+	if len(args) != 2 {
+		logger.Error("Incorrect number of arguments")
+		return nil, errors.New("Incorrect number of arguments. Specify account number and source preference")
+	}
+
+	accountId := args[0]
+	preference := args[1]
+	if !settlement.IsSourcePreference(preference) {
+		logger.Errorf("Invalid source preference %s", preference)
+		return nil, fmt.Errorf("Invalid source preference %s", preference)
+	}
+
+	metadata, owner, err := t.checkMeterOwner(stub, accountId)
+	if err != nil {
+		return nil, err
+	}
+
+	metadata.SourcePreference = preference
+	ok, err := stub.ReplaceRow(metadataTableName, t.metadataRow(accountId, owner, *metadata))
+	if !ok || err != nil {
+		logger.Errorf("Error in updating source preference of account %s:%s", accountId, err)
+		return nil, errors.New("Error in updating source preference")
+	}
+	logger.Infof("Source preference of account %s set to %s", accountId, preference)
+
+	return nil, nil
+}
+
+// Return all meters with the given generation type
+func (t *EnergyTradingChainCode) metersByGenerationType(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	logger.Info("In metersByGenerationType function")
+	if len(args) != 1 {
+		logger.Error("Incorrect number of arguments")
+		return nil, errors.New("Incorrect number of arguments. Specify generation type")
+	}
+
+	generationType := args[0]
+	payload, err := t.meters(stub, nil)
+	if err != nil {
+		return nil, err
+	}
+	var meters []settlement.MeterInfo
+	err = json.Unmarshal(payload, &meters)
+	if err != nil {
+		logger.Errorf("Failed unmarshalling meters: [%s]", err)
+		return nil, fmt.Errorf("Failed unmarshalling meters [%s]", err)
+	}
+
+	filtered := make([]settlement.MeterInfo, 0)
+	for _, meter := range meters {
+		if meter.Metadata != nil && meter.Metadata.GenerationType == generationType {
+			filtered = append(filtered, meter)
+		}
+	}
+
+	payload, err = json.Marshal(filtered)
+	if err != nil {
+		logger.Errorf("Failed marshalling payload")
+		return nil, fmt.Errorf("Failed marshalling payload [%s]", err)
+	}
+
+	return payload, nil
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Direction values of the CSV export. Delivered is energy the grid delivered to the
+// premises, received is energy the grid received from it.
+const (
+	directionDelivered = "delivered"
+	directionReceived  = "received"
+)
+
+// ParseCSV reads an interval export with a header row. The columns are matched by name,
+// case insensitively, and may come in any order:
+//
+//	serial     meter serial number
+//	start      interval start, RFC3339
+//	end        interval end, RFC3339 (optional if interval minutes is given)
+//	minutes    interval length in minutes (optional if end is given)
+//	kwh        energy measured over the interval
+//	direction  delivered or received (optional, kwh is taken as signed without it)
+func ParseCSV(r io.Reader) ([]IntervalReading, error) {
+	reader := csv.NewReader(r)
+	reader.TrimLeadingSpace = true
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("Failed reading CSV header: %s", err)
+	}
+	columns := make(map[string]int)
+	for i, name := range header {
+		columns[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	for _, name := range []string{"serial", "start", "kwh"} {
+		if _, ok := columns[name]; !ok {
+			return nil, fmt.Errorf("CSV has no %s column", name)
+		}
+	}
+	_, hasEnd := columns["end"]
+	_, hasMinutes := columns["minutes"]
+	if !hasEnd && !hasMinutes {
+		return nil, fmt.Errorf("CSV has neither an end nor a minutes column")
+	}
+	_, hasDirection := columns["direction"]
+
+	readings := make([]IntervalReading, 0)
+	for line := 2; ; line++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		field := func(name string) string {
+			return strings.TrimSpace(record[columns[name]])
+		}
+
+		reading := IntervalReading{Serial: field("serial")}
+		if reading.Serial == "" {
+			return nil, fmt.Errorf("Line %d: empty serial", line)
+		}
+		reading.Start, err = time.Parse(time.RFC3339, field("start"))
+		if err != nil {
+			return nil, fmt.Errorf("Line %d: invalid start %s", line, field("start"))
+		}
+		if hasEnd {
+			end, err := time.Parse(time.RFC3339, field("end"))
+			if err != nil {
+				return nil, fmt.Errorf("Line %d: invalid end %s", line, field("end"))
+			}
+			reading.Duration = end.Sub(reading.Start)
+		} else {
+			minutes, err := strconv.Atoi(field("minutes"))
+			if err != nil {
+				return nil, fmt.Errorf("Line %d: invalid minutes %s", line, field("minutes"))
+			}
+			reading.Duration = time.Duration(minutes) * time.Minute
+		}
+		if reading.Duration <= 0 {
+			return nil, fmt.Errorf("Line %d: interval has no length", line)
+		}
+		reading.Kwh, err = strconv.ParseFloat(field("kwh"), 64)
+		if err != nil {
+			return nil, fmt.Errorf("Line %d: invalid kwh %s", line, field("kwh"))
+		}
+		if hasDirection {
+			switch strings.ToLower(field("direction")) {
+			case directionDelivered:
+				reading.Kwh = -reading.Kwh
+			case directionReceived:
+			default:
+				return nil, fmt.Errorf("Line %d: invalid direction %s", line, field("direction"))
+			}
+		}
+		readings = append(readings, reading)
+	}
+	return readings, nil
+}
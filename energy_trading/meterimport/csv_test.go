@@ -0,0 +1,105 @@
+package main
+
+import (
+	"math"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseCSVExample(t *testing.T) {
+	file, err := os.Open("examples/intervals.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	readings, err := ParseCSV(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Date(2026, 10, 1, 10, 0, 0, 0, time.UTC)
+	want := []IntervalReading{
+		{"SN-1001", start, 15 * time.Minute, 1.4},
+		{"SN-1001", start.Add(15 * time.Minute), 15 * time.Minute, 1.3},
+		{"SN-1001", start.Add(30 * time.Minute), 15 * time.Minute, 1.6},
+		{"SN-1001", start.Add(45 * time.Minute), 15 * time.Minute, 1.2},
+		{"SN-1002", start, 15 * time.Minute, -0.8},
+		{"SN-1002", start.Add(15 * time.Minute), 15 * time.Minute, -1.1},
+		{"SN-1002", start.Add(30 * time.Minute), 15 * time.Minute, -0.9},
+		{"SN-1002", start.Add(45 * time.Minute), 15 * time.Minute, -1.0},
+	}
+	expectReadings(t, readings, want)
+}
+
+func TestParseCSV(t *testing.T) {
+	start := time.Date(2026, 10, 1, 10, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name  string
+		input string
+		want  []IntervalReading
+		err   string
+	}{
+		{
+			name:  "columns in any order and case with an end",
+			input: "KWH, End, Serial, Start\n-2.5, 2026-10-01T11:00:00Z, SN-1, 2026-10-01T10:30:00Z\n",
+			want:  []IntervalReading{{"SN-1", start.Add(30 * time.Minute), 30 * time.Minute, -2.5}},
+		},
+		{
+			name:  "signed kwh without direction",
+			input: "serial,start,minutes,kwh\nSN-1,2026-10-01T10:00:00Z,60,3\nSN-1,2026-10-01T11:00:00Z,60,-1\n",
+			want: []IntervalReading{
+				{"SN-1", start, time.Hour, 3},
+				{"SN-1", start.Add(time.Hour), time.Hour, -1},
+			},
+		},
+		{
+			name:  "direction is case insensitive",
+			input: "serial,start,minutes,kwh,direction\nSN-1,2026-10-01T10:00:00Z,60,3,DELIVERED\n",
+			want:  []IntervalReading{{"SN-1", start, time.Hour, -3}},
+		},
+		{
+			name:  "only a header",
+			input: "serial,start,minutes,kwh\n",
+			want:  []IntervalReading{},
+		},
+		{name: "empty input", input: "", err: "Failed reading CSV header"},
+		{name: "missing kwh", input: "serial,start,minutes\n", err: "CSV has no kwh column"},
+		{name: "missing length", input: "serial,start,kwh\n", err: "CSV has neither an end nor a minutes column"},
+		{name: "empty serial", input: "serial,start,minutes,kwh\n,2026-10-01T10:00:00Z,60,3\n", err: "Line 2: empty serial"},
+		{name: "invalid start", input: "serial,start,minutes,kwh\nSN-1,yesterday,60,3\n", err: "Line 2: invalid start yesterday"},
+		{name: "invalid minutes", input: "serial,start,minutes,kwh\nSN-1,2026-10-01T10:00:00Z,hour,3\n", err: "Line 2: invalid minutes hour"},
+		{name: "end before start", input: "serial,start,end,kwh\nSN-1,2026-10-01T10:00:00Z,2026-10-01T09:00:00Z,3\n", err: "Line 2: interval has no length"},
+		{name: "invalid kwh", input: "serial,start,minutes,kwh\nSN-1,2026-10-01T10:00:00Z,60,three\n", err: "Line 2: invalid kwh three"},
+		{name: "invalid direction", input: "serial,start,minutes,kwh,direction\nSN-1,2026-10-01T10:00:00Z,60,3,up\n", err: "Line 2: invalid direction up"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			readings, err := ParseCSV(strings.NewReader(test.input))
+			if test.err != "" {
+				if err == nil || !strings.HasPrefix(err.Error(), test.err) {
+					t.Fatalf("Error %v, want %s", err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			expectReadings(t, readings, test.want)
+		})
+	}
+}
+
+func expectReadings(t *testing.T, readings, want []IntervalReading) {
+	t.Helper()
+	if len(readings) != len(want) {
+		t.Fatalf("%d readings, want %d: %+v", len(readings), len(want), readings)
+	}
+	for i := range want {
+		got := readings[i]
+		if got.Serial != want[i].Serial || !got.Start.Equal(want[i].Start) || got.Duration != want[i].Duration || math.Abs(got.Kwh-want[i].Kwh) > 1e-9 {
+			t.Errorf("Reading %d is %+v, want %+v", i, got, want[i])
+		}
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"math"
+	"strings"
+	"time"
+)
+
+// ESPI codes used by ReadingType
+const (
+	uomWh                = 72
+	flowDirectionForward = 1
+	flowDirectionReverse = 19
+)
+
+type espiLink struct {
+	Rel  string `xml:"rel,attr"`
+	Href string `xml:"href,attr"`
+}
+
+type espiTimePeriod struct {
+	Duration int64 `xml:"duration"`
+	Start    int64 `xml:"start"`
+}
+
+type espiIntervalReading struct {
+	TimePeriod espiTimePeriod `xml:"timePeriod"`
+	Value      int64          `xml:"value"`
+}
+
+type espiIntervalBlock struct {
+	Readings []espiIntervalReading `xml:"IntervalReading"`
+}
+
+type espiReadingType struct {
+	FlowDirection        int `xml:"flowDirection"`
+	PowerOfTenMultiplier int `xml:"powerOfTenMultiplier"`
+	Uom                  int `xml:"uom"`
+}
+
+type espiContent struct {
+	UsagePoint     *struct{}           `xml:"UsagePoint"`
+	MeterReading   *struct{}           `xml:"MeterReading"`
+	ReadingType    *espiReadingType    `xml:"ReadingType"`
+	IntervalBlocks []espiIntervalBlock `xml:"IntervalBlock"`
+}
+
+type espiEntry struct {
+	Title   string      `xml:"title"`
+	Links   []espiLink  `xml:"link"`
+	Content espiContent `xml:"content"`
+}
+
+type espiFeed struct {
+	Entries []espiEntry `xml:"entry"`
+}
+
+func (e espiEntry) link(rel string) string {
+	for _, link := range e.Links {
+		if link.Rel == rel {
+			return link.Href
+		}
+	}
+	return ""
+}
+
+// Returns the part of href up to and including the resource following collection,
+// e.g. .../UsagePoint/01 for collection UsagePoint
+func resourcePrefix(href, collection string) string {
+	i := strings.Index(href, "/"+collection+"/")
+	if i < 0 {
+		return ""
+	}
+	rest := href[i+len(collection)+2:]
+	if j := strings.Index(rest, "/"); j >= 0 {
+		rest = rest[:j]
+	}
+	return href[:i+len(collection)+2] + rest
+}
+
+// ParseESPI reads a Green Button (ESPI) Atom feed. Entries are related through their
+// links the way Green Button data custodians publish them: interval blocks live under a
+// meter reading, which lives under a usage point and links to its reading type.
+// The title of the usage point is taken as the meter serial, falling back to the usage
+// point link when it has no title. Only readings in Wh are supported; forward flow is
+// energy delivered to the premises and is reported as consumption.
+func ParseESPI(r io.Reader) ([]IntervalReading, error) {
+	var feed espiFeed
+	err := xml.NewDecoder(r).Decode(&feed)
+	if err != nil {
+		return nil, fmt.Errorf("Failed parsing ESPI feed: %s", err)
+	}
+
+	serials := make(map[string]string)
+	readingTypes := make(map[string]espiReadingType)
+	meterReadingTypes := make(map[string]string)
+	for _, entry := range feed.Entries {
+		self := entry.link("self")
+		switch {
+		case entry.Content.UsagePoint != nil:
+			serial := strings.TrimSpace(entry.Title)
+			if serial == "" {
+				serial = self
+			}
+			serials[self] = serial
+		case entry.Content.ReadingType != nil:
+			readingTypes[self] = *entry.Content.ReadingType
+		case entry.Content.MeterReading != nil:
+			for _, link := range entry.Links {
+				if link.Rel == "related" && strings.Contains(link.Href, "/ReadingType/") {
+					meterReadingTypes[self] = link.Href
+				}
+			}
+		}
+	}
+
+	readings := make([]IntervalReading, 0)
+	for _, entry := range feed.Entries {
+		if len(entry.Content.IntervalBlocks) == 0 {
+			continue
+		}
+		href := entry.link("self")
+		if href == "" {
+			href = entry.link("up")
+		}
+		usagePoint := resourcePrefix(href, "UsagePoint")
+		serial, ok := serials[usagePoint]
+		if !ok {
+			return nil, fmt.Errorf("Interval block %s does not belong to a known usage point", href)
+		}
+		meterReading := resourcePrefix(href, "MeterReading")
+		readingType, ok := readingTypes[meterReadingTypes[meterReading]]
+		if !ok {
+			return nil, fmt.Errorf("No reading type for meter reading %s", meterReading)
+		}
+		if readingType.Uom != uomWh {
+			return nil, fmt.Errorf("Unsupported unit of measure %d for meter reading %s", readingType.Uom, meterReading)
+		}
+		var sign float64
+		switch readingType.FlowDirection {
+		case flowDirectionForward:
+			sign = -1
+		case flowDirectionReverse:
+			sign = 1
+		default:
+			return nil, fmt.Errorf("Unsupported flow direction %d for meter reading %s", readingType.FlowDirection, meterReading)
+		}
+		scale := sign * math.Pow10(readingType.PowerOfTenMultiplier) / 1000
+
+		for _, block := range entry.Content.IntervalBlocks {
+			for _, interval := range block.Readings {
+				if interval.TimePeriod.Duration <= 0 {
+					return nil, fmt.Errorf("Interval at %d of meter reading %s has no length", interval.TimePeriod.Start, meterReading)
+				}
+				readings = append(readings, IntervalReading{
+					Serial:   serial,
+					Start:    time.Unix(interval.TimePeriod.Start, 0).UTC(),
+					Duration: time.Duration(interval.TimePeriod.Duration) * time.Second,
+					Kwh:      float64(interval.Value) * scale,
+				})
+			}
+		}
+	}
+	return readings, nil
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseESPIExample(t *testing.T) {
+	file, err := os.Open("examples/greenbutton.xml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	readings, err := ParseESPI(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Date(2026, 10, 2, 10, 0, 0, 0, time.UTC)
+	// Forward flow in Wh is consumption in kwh
+	want := []IntervalReading{
+		{"SN-1002", start, time.Hour, -3.8},
+		{"SN-1002", start.Add(time.Hour), time.Hour, -4.2},
+	}
+	expectReadings(t, readings, want)
+}
+
+func TestParseESPI(t *testing.T) {
+	example, err := ioutil.ReadFile("examples/greenbutton.xml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Date(2026, 10, 2, 10, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name     string
+		old, new string
+		want     []IntervalReading
+		err      string
+	}{
+		{
+			name: "reverse flow is production",
+			old:  "<espi:flowDirection>1</espi:flowDirection>",
+			new:  "<espi:flowDirection>19</espi:flowDirection>",
+			want: []IntervalReading{
+				{"SN-1002", start, time.Hour, 3.8},
+				{"SN-1002", start.Add(time.Hour), time.Hour, 4.2},
+			},
+		},
+		{
+			name: "power of ten multiplier",
+			old:  "<espi:powerOfTenMultiplier>0</espi:powerOfTenMultiplier>",
+			new:  "<espi:powerOfTenMultiplier>3</espi:powerOfTenMultiplier>",
+			want: []IntervalReading{
+				{"SN-1002", start, time.Hour, -3800},
+				{"SN-1002", start.Add(time.Hour), time.Hour, -4200},
+			},
+		},
+		{
+			name: "usage point without title",
+			old:  "<title>SN-1002</title>",
+			new:  "<title></title>",
+			want: []IntervalReading{
+				{"https://utility.example.com/espi/1_1/resource/RetailCustomer/9/UsagePoint/01", start, time.Hour, -3.8},
+				{"https://utility.example.com/espi/1_1/resource/RetailCustomer/9/UsagePoint/01", start.Add(time.Hour), time.Hour, -4.2},
+			},
+		},
+		{
+			name: "unsupported unit",
+			old:  "<espi:uom>72</espi:uom>",
+			new:  "<espi:uom>38</espi:uom>",
+			err:  "Unsupported unit of measure 38",
+		},
+		{
+			name: "unsupported flow direction",
+			old:  "<espi:flowDirection>1</espi:flowDirection>",
+			new:  "<espi:flowDirection>4</espi:flowDirection>",
+			err:  "Unsupported flow direction 4",
+		},
+		{
+			name: "unknown usage point",
+			old:  "UsagePoint/01\" rel=\"self\"/>\n    <title>",
+			new:  "UsagePoint/02\" rel=\"self\"/>\n    <title>",
+			err:  "Interval block",
+		},
+		{
+			name: "no reading type",
+			old:  "ReadingType/07\" rel=\"related\"",
+			new:  "ReadingType/08\" rel=\"related\"",
+			err:  "No reading type for meter reading",
+		},
+		{
+			name: "interval without length",
+			old:  "<espi:duration>3600</espi:duration><espi:start>1790935200</espi:start>",
+			new:  "<espi:duration>0</espi:duration><espi:start>1790935200</espi:start>",
+			err:  "Interval at 1790935200",
+		},
+		{
+			name: "truncated feed",
+			old:  "</feed>",
+			new:  "",
+			err:  "Failed parsing ESPI feed",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if !strings.Contains(string(example), test.old) {
+				t.Fatalf("Example has no %q", test.old)
+			}
+			input := strings.Replace(string(example), test.old, test.new, 1)
+			readings, err := ParseESPI(strings.NewReader(input))
+			if test.err != "" {
+				if err == nil || !strings.HasPrefix(err.Error(), test.err) {
+					t.Fatalf("Error %v, want %s", err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			expectReadings(t, readings, test.want)
+		})
+	}
+}
@@ -0,0 +1,180 @@
+// Command meterimport reads smart meter interval data, either CSV exports or Green Button
+// (ESPI) XML, and reports it to the energy trading chaincode. Intervals are mapped from
+// meter serials to account ids, summed into settlement periods and submitted as one
+// reportDelta invoke per account and period.
+package main
+
+import (
+	"encoding/csv"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/predix/chaincode_example/energy_trading/rpc"
+)
+
+// Smallest rounding remainder reported as left over, below it is noise of the floating
+// point sums
+const unreportedKwh = 0.0005
+
+var (
+	configPath  string
+	mappingPath string
+	format      string
+	period      time.Duration
+	source      string
+	dryRun      bool
+	out         io.Writer = os.Stdout
+)
+
+// Reads the mapping of meter serials to account ids. Each line holds a serial and an
+// account id, lines starting with # are ignored.
+func loadMapping(path string) (map[string]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("Failed reading mapping [%s]: [%s]", path, err)
+	}
+	defer file.Close()
+
+	reader := csv.NewReader(file)
+	reader.Comment = '#'
+	reader.FieldsPerRecord = 2
+	reader.TrimLeadingSpace = true
+	records, err := reader.ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("Failed parsing mapping [%s]: [%s]", path, err)
+	}
+	accounts := make(map[string]string)
+	for _, record := range records {
+		serial, accountId := strings.TrimSpace(record[0]), strings.TrimSpace(record[1])
+		if other, ok := accounts[serial]; ok && other != accountId {
+			return nil, fmt.Errorf("Meter %s mapped to both %s and %s", serial, other, accountId)
+		}
+		accounts[serial] = accountId
+	}
+	return accounts, nil
+}
+
+func parseFile(path string) ([]IntervalReading, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	fileFormat := format
+	if fileFormat == "" {
+		switch strings.ToLower(filepath.Ext(path)) {
+		case ".csv":
+			fileFormat = "csv"
+		case ".xml":
+			fileFormat = "espi"
+		default:
+			return nil, fmt.Errorf("Cannot tell the format of %s, use -format", path)
+		}
+	}
+
+	var readings []IntervalReading
+	switch fileFormat {
+	case "csv":
+		readings, err = ParseCSV(file)
+	case "espi":
+		readings, err = ParseESPI(file)
+	default:
+		return nil, fmt.Errorf("Unknown format %s", fileFormat)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	return readings, nil
+}
+
+func run(files []string) error {
+	if len(files) == 0 {
+		return errors.New("No input files specified")
+	}
+	if mappingPath == "" {
+		return errors.New("No mapping file specified")
+	}
+	if period <= 0 || (24*time.Hour)%period != 0 {
+		return fmt.Errorf("Period %s does not divide a day", period)
+	}
+	accounts, err := loadMapping(mappingPath)
+	if err != nil {
+		return err
+	}
+
+	readings := make([]IntervalReading, 0)
+	for _, path := range files {
+		fileReadings, err := parseFile(path)
+		if err != nil {
+			return err
+		}
+		readings = append(readings, fileReadings...)
+	}
+	for _, reading := range readings {
+		if reading.Duration > period {
+			return fmt.Errorf("Interval of %s at %s of meter %s is longer than the period", reading.Duration, reading.Start.Format(time.RFC3339), reading.Serial)
+		}
+	}
+
+	deltas, err := Aggregate(readings, accounts, period)
+	if err != nil {
+		return err
+	}
+
+	var client *rpc.Client
+	if !dryRun {
+		config, err := rpc.LoadConfig(configPath)
+		if err != nil {
+			return err
+		}
+		client = rpc.NewClient(config)
+	}
+	for _, delta := range deltas {
+		args := delta.args(source)
+		if dryRun {
+			fmt.Fprintf(out, "invoke reportDelta %s\n", strings.Join(args, " "))
+			continue
+		}
+		txId, err := client.Invoke("reportDelta", args...)
+		if err != nil {
+			return fmt.Errorf("Failed reporting %d kwh of account %s for %s: %s", delta.Kwh, delta.AccountId, delta.Period.Format(time.RFC3339), err)
+		}
+		fmt.Fprintf(out, "Reported %d kwh of account %s for %s in transaction %s\n", delta.Kwh, delta.AccountId, delta.Period.Format(time.RFC3339), txId)
+	}
+	for i, delta := range deltas {
+		last := i == len(deltas)-1 || deltas[i+1].AccountId != delta.AccountId
+		if last && math.Abs(delta.Remainder) >= unreportedKwh {
+			fmt.Fprintf(out, "%.3f kwh of account %s after %s left unreported\n", delta.Remainder, delta.AccountId, delta.Period.Format(time.RFC3339))
+		}
+	}
+	fmt.Fprintf(out, "%d intervals, %d periods\n", len(readings), len(deltas))
+	return nil
+}
+
+func main() {
+	flag.StringVar(&configPath, "config", "energyctl.json", "Path of the energyctl config file")
+	flag.StringVar(&mappingPath, "mapping", "", "CSV file mapping meter serials to account ids")
+	flag.StringVar(&format, "format", "", "Input format, csv or espi (default: from the file extension)")
+	flag.DurationVar(&period, "period", time.Hour, "Length of a settlement period")
+	flag.StringVar(&source, "source", "headend", "Reading source to report, meter or headend. Empty reports plain deltas")
+	flag.BoolVar(&dryRun, "dry-run", false, "Print the transactions instead of submitting them")
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: meterimport -mapping file [flags] <file>...\n\nFlags:")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	err := run(flag.Args())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+		os.Exit(1)
+	}
+}
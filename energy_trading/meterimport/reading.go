@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"time"
+)
+
+// IntervalReading is the energy measured by a meter over one interval. Kwh is positive
+// for energy fed into the grid and negative for energy taken from it, the same sign
+// convention reportDelta uses.
+type IntervalReading struct {
+	Serial   string
+	Start    time.Time
+	Duration time.Duration
+	Kwh      float64
+}
+
+// Delta is the energy of one account over one settlement period, ready to be reported.
+// Remainder is the rounding error carried over to the next period of the account.
+type Delta struct {
+	AccountId string
+	Period    time.Time
+	Kwh       int64
+	Remainder float64
+}
+
+func (d Delta) args(source string) []string {
+	kwh := fmt.Sprintf("%d", d.Kwh)
+	if source == "" {
+		return []string{d.AccountId, kwh}
+	}
+	return []string{d.AccountId, kwh, source, d.Period.UTC().Format(time.RFC3339)}
+}
+
+type byPeriod []Delta
+
+func (a byPeriod) Len() int      { return len(a) }
+func (a byPeriod) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a byPeriod) Less(i, j int) bool {
+	if a[i].AccountId != a[j].AccountId {
+		return a[i].AccountId < a[j].AccountId
+	}
+	return a[i].Period.Before(a[j].Period)
+}
+
+// Aggregate sums the readings of each account over settlement periods of the given
+// length, aligned to UTC midnight. An interval that straddles a period boundary counts
+// towards the period it starts in. The chaincode only accepts whole kwh, so each period
+// is rounded and the rounding error carried over to the next period of the account so
+// that the reported total matches the measured one. The error left after the last period
+// of an account, at most half a kwh, is not reported; it is kept in the Remainder of
+// that delta and is not carried over to later imports.
+func Aggregate(readings []IntervalReading, accounts map[string]string, period time.Duration) ([]Delta, error) {
+	type key struct {
+		accountId string
+		period    int64
+	}
+	sums := make(map[key]float64)
+	for _, reading := range readings {
+		accountId, ok := accounts[reading.Serial]
+		if !ok {
+			return nil, fmt.Errorf("No account mapped to meter %s", reading.Serial)
+		}
+		start := reading.Start.Truncate(period)
+		sums[key{accountId, start.Unix()}] += reading.Kwh
+	}
+
+	deltas := make([]Delta, 0, len(sums))
+	for k := range sums {
+		deltas = append(deltas, Delta{AccountId: k.accountId, Period: time.Unix(k.period, 0).UTC()})
+	}
+	sort.Sort(byPeriod(deltas))
+
+	var remainder float64
+	for i := range deltas {
+		if i == 0 || deltas[i-1].AccountId != deltas[i].AccountId {
+			remainder = 0
+		}
+		exact := sums[key{deltas[i].AccountId, deltas[i].Period.Unix()}] + remainder
+		deltas[i].Kwh = int64(math.Floor(exact + 0.5))
+		remainder = exact - float64(deltas[i].Kwh)
+		deltas[i].Remainder = remainder
+	}
+	return deltas, nil
+}
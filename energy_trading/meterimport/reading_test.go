@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"math"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAggregate(t *testing.T) {
+	accounts := map[string]string{"SN-1": "1", "SN-2": "2", "SN-3": "1"}
+	start := time.Date(2026, 10, 1, 10, 0, 0, 0, time.UTC)
+	quarter := func(serial string, n int, kwh float64) IntervalReading {
+		return IntervalReading{serial, start.Add(time.Duration(n) * 15 * time.Minute), 15 * time.Minute, kwh}
+	}
+	tests := []struct {
+		name     string
+		readings []IntervalReading
+		period   time.Duration
+		want     []Delta
+		err      string
+	}{
+		{
+			name:     "no readings",
+			readings: nil,
+			period:   time.Hour,
+			want:     []Delta{},
+		},
+		{
+			name:     "sums intervals of a period",
+			readings: []IntervalReading{quarter("SN-1", 0, 1), quarter("SN-1", 1, 2), quarter("SN-1", 3, 3)},
+			period:   time.Hour,
+			want:     []Delta{{"1", start, 6, 0}},
+		},
+		{
+			name:     "meters of one account are summed",
+			readings: []IntervalReading{quarter("SN-1", 0, 4), quarter("SN-3", 0, -1)},
+			period:   time.Hour,
+			want:     []Delta{{"1", start, 3, 0}},
+		},
+		{
+			name:     "rounding error is carried to the next period",
+			readings: []IntervalReading{quarter("SN-1", 0, 1.4), quarter("SN-1", 4, 1.4), quarter("SN-1", 8, 1.4)},
+			period:   time.Hour,
+			want: []Delta{
+				{"1", start, 1, 0.4},
+				{"1", start.Add(time.Hour), 2, -0.2},
+				{"1", start.Add(2 * time.Hour), 1, 0.2},
+			},
+		},
+		{
+			name:     "rounding error is not carried between accounts",
+			readings: []IntervalReading{quarter("SN-2", 0, -0.4), quarter("SN-1", 0, 0.4), quarter("SN-1", 4, 0.4)},
+			period:   time.Hour,
+			want: []Delta{
+				{"1", start, 0, 0.4},
+				{"1", start.Add(time.Hour), 1, -0.2},
+				{"2", start, 0, -0.4},
+			},
+		},
+		{
+			name:     "interval straddling a boundary counts to its start",
+			readings: []IntervalReading{{"SN-1", start.Add(50 * time.Minute), 20 * time.Minute, 2}},
+			period:   time.Hour,
+			want:     []Delta{{"1", start, 2, 0}},
+		},
+		{
+			name:     "periods are aligned to midnight",
+			readings: []IntervalReading{quarter("SN-1", 0, 1), quarter("SN-1", 20, 1)},
+			period:   4 * time.Hour,
+			want: []Delta{
+				{"1", start.Add(-2 * time.Hour), 1, 0},
+				{"1", start.Add(2 * time.Hour), 1, 0},
+			},
+		},
+		{
+			name:     "unmapped meter",
+			readings: []IntervalReading{quarter("SN-9", 0, 1)},
+			period:   time.Hour,
+			err:      "No account mapped to meter SN-9",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			deltas, err := Aggregate(test.readings, accounts, test.period)
+			if test.err != "" {
+				if err == nil || err.Error() != test.err {
+					t.Fatalf("Error %v, want %s", err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(deltas) != len(test.want) {
+				t.Fatalf("Deltas %+v, want %+v", deltas, test.want)
+			}
+			for i, want := range test.want {
+				got := deltas[i]
+				if got.AccountId != want.AccountId || !got.Period.Equal(want.Period) || got.Kwh != want.Kwh || math.Abs(got.Remainder-want.Remainder) > 1e-9 {
+					t.Errorf("Delta %d is %+v, want %+v", i, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestDeltaArgs(t *testing.T) {
+	delta := Delta{AccountId: "7", Period: time.Date(2026, 10, 1, 10, 0, 0, 0, time.FixedZone("CEST", 2*3600)), Kwh: -3}
+	if args := delta.args(""); !reflect.DeepEqual(args, []string{"7", "-3"}) {
+		t.Errorf("Plain delta args %q", args)
+	}
+	if args := delta.args("headend"); !reflect.DeepEqual(args, []string{"7", "-3", "headend", "2026-10-01T08:00:00Z"}) {
+		t.Errorf("Interval delta args %q", args)
+	}
+}
+
+// Imports the shipped examples without submitting them
+func TestDryRunExamples(t *testing.T) {
+	output := new(bytes.Buffer)
+	out = output
+	defer func() { out = os.Stdout }()
+	mappingPath = "examples/mapping.csv"
+	format = ""
+	period = time.Hour
+	source = "meter"
+	dryRun = true
+
+	err := run([]string{"examples/intervals.csv", "examples/greenbutton.xml"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"invoke reportDelta 1 6 meter 2026-10-01T10:00:00Z",
+		"invoke reportDelta 2 -4 meter 2026-10-01T10:00:00Z",
+		"invoke reportDelta 2 -4 meter 2026-10-02T10:00:00Z",
+		"invoke reportDelta 2 -4 meter 2026-10-02T11:00:00Z",
+		"-0.500 kwh of account 1 after 2026-10-01T10:00:00Z left unreported",
+		"0.200 kwh of account 2 after 2026-10-02T11:00:00Z left unreported",
+		"10 intervals, 4 periods",
+	}
+	lines := strings.Split(strings.TrimRight(output.String(), "\n"), "\n")
+	if !reflect.DeepEqual(lines, want) {
+		t.Errorf("Output\n%s\nwant\n%s", strings.Join(lines, "\n"), strings.Join(want, "\n"))
+	}
+
+	period = 7 * time.Hour
+	err = run([]string{"examples/intervals.csv"})
+	if err == nil || err.Error() != "Period 7h0m0s does not divide a day" {
+		t.Errorf("Error %v for a period not dividing a day", err)
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// RateChange is the rate per kwh of a meter in force from a settlement round on
+type RateChange struct {
+	AccountId  string `json:"account_id"`
+	Round      int64  `json:"round"`
+	RatePerKwh int64  `json:"rate_per_kwh"`
+}
+
+// Records the rate of a meter from a round on, replacing a change already scheduled
+// for the same round
+func (t *EnergyTradingChainCode) recordRate(stub shim.ChaincodeStubInterface, accountId string, round int64, rateKwh int64) error {
+	row := shim.Row{
+		Columns: []*shim.Column{
+			&shim.Column{Value: &shim.Column_String_{String_: accountId}},
+			&shim.Column{Value: &shim.Column_Int64{Int64: round}},
+			&shim.Column{Value: &shim.Column_Int64{Int64: rateKwh}},
+		},
+	}
+	ok, err := stub.InsertRow(rateHistoryTableName, row)
+	if err == nil && !ok {
+		ok, err = stub.ReplaceRow(rateHistoryTableName, row)
+	}
+	if !ok || err != nil {
+		return fmt.Errorf("Error in recording rate of account %s for round %d: %s", accountId, round, err)
+	}
+	return nil
+}
+
+// Returns the rate change of a meter taking effect in the round, nil if there is none
+func (t *EnergyTradingChainCode) getRateChange(stub shim.ChaincodeStubInterface, accountId string, round int64) (*RateChange, error) {
+	var columns []shim.Column
+	col1 := shim.Column{Value: &shim.Column_String_{String_: accountId}}
+	col2 := shim.Column{Value: &shim.Column_Int64{Int64: round}}
+	columns = append(columns, col1, col2)
+
+	row, err := stub.GetRow(rateHistoryTableName, columns)
+	if err != nil {
+		return nil, err
+	}
+	if len(row.Columns) == 0 {
+		return nil, nil
+	}
+	return &RateChange{
+		AccountId:  row.Columns[0].GetString_(),
+		Round:      row.Columns[1].GetInt64(),
+		RatePerKwh: row.Columns[2].GetInt64(),
+	}, nil
+}
+
+// Returns the rate history of a meter ordered by round
+func (t *EnergyTradingChainCode) getRateHistory(stub shim.ChaincodeStubInterface, accountId string) ([]RateChange, error) {
+	var columns []shim.Column
+	col1 := shim.Column{Value: &shim.Column_String_{String_: accountId}}
+	columns = append(columns, col1)
+
+	rowChannel, err := stub.GetRows(rateHistoryTableName, columns)
+	if err != nil {
+		return nil, err
+	}
+	changes := make([]RateChange, 0)
+	for row := range rowChannel {
+		change := RateChange{
+			AccountId:  row.Columns[0].GetString_(),
+			Round:      row.Columns[1].GetInt64(),
+			RatePerKwh: row.Columns[2].GetInt64(),
+		}
+		// Round keys compare as strings, so rows do not come back in round order
+		i := len(changes)
+		changes = append(changes, change)
+		for ; i > 0 && changes[i-1].Round > change.Round; i-- {
+			changes[i] = changes[i-1]
+		}
+		changes[i] = change
+	}
+	return changes, nil
+}
+
+// Schedules a new rate per kwh for a meter, effective from the round after the open one
+// so the open round still settles at the rate the meter traded with. Only the owner of
+// the meter can do it.
+func (t *EnergyTradingChainCode) updateRate(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	logger.Info("In updateRate function")
+	if len(args) != 2 {
+		logger.Error("Incorrect number of arguments")
+		return nil, errors.New("Incorrect number of arguments. Specify account number and rate per kwh")
+	}
+
+	accountId := args[0]
+	rateKwh, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil {
+		logger.Errorf("Error in converting to int:%s", err.Error())
+		return nil, fmt.Errorf("Invalid value of rate per kwh:%s", args[1])
+	}
+
+	_, _, err = t.checkMeterOwner(stub, accountId)
+	if err != nil {
+		return nil, err
+	}
+
+	round, err := t.getCurrentRound(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	err = t.recordRate(stub, accountId, round+1, rateKwh)
+	if err != nil {
+		logger.Errorf("Error in scheduling rate change:%s", err)
+		return nil, errors.New("Error in scheduling rate change")
+	}
+	logger.Infof("Rate of account %s set to %d from round %d", accountId, rateKwh, round+1)
+
+	return nil, nil
+}
+
+// Return the rate per kwh of a meter in force in a round
+func (t *EnergyTradingChainCode) rateAt(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	logger.Info("In rateAt function")
+	if len(args) != 2 {
+		logger.Error("Incorrect number of arguments")
+		return nil, errors.New("Incorrect number of arguments. Specify account number and settlement round")
+	}
+
+	accountId := args[0]
+	round, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil {
+		logger.Errorf("Error in converting to int:%s", err.Error())
+		return nil, fmt.Errorf("Invalid value of settlement round:%s", args[1])
+	}
+
+	changes, err := t.getRateHistory(stub, accountId)
+	if err != nil {
+		logger.Errorf("Failed retrieving rate history of account [%s]: [%s]", accountId, err)
+		return nil, fmt.Errorf("Failed retrieving rate history of account [%s]: [%s]", accountId, err)
+	}
+	var inForce *RateChange
+	for i := range changes {
+		if changes[i].Round > round {
+			break
+		}
+		inForce = &changes[i]
+	}
+	if inForce == nil {
+		logger.Errorf("No rate of account %s in round %d", accountId, round)
+		return nil, fmt.Errorf("No rate of account %s in round %d", accountId, round)
+	}
+
+	return []byte(strconv.FormatInt(inForce.RatePerKwh, 10)), nil
+}
+
+// Return the rate history of a meter, including a change scheduled for the next round
+func (t *EnergyTradingChainCode) rateHistory(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	logger.Info("In rateHistory function")
+	if len(args) != 1 {
+		logger.Error("Incorrect number of arguments")
+		return nil, errors.New("Incorrect number of arguments. Specify account number")
+	}
+
+	changes, err := t.getRateHistory(stub, args[0])
+	if err != nil {
+		logger.Errorf("Failed retrieving rate history of account [%s]: [%s]", args[0], err)
+		return nil, fmt.Errorf("Failed retrieving rate history of account [%s]: [%s]", args[0], err)
+	}
+
+	payload, err := json.Marshal(changes)
+	if err != nil {
+		logger.Errorf("Failed marshalling payload")
+		return nil, fmt.Errorf("Failed marshalling payload [%s]", err)
+	}
+
+	return payload, nil
+}
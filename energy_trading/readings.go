@@ -0,0 +1,458 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// Sources a reading can be reported from
+const (
+	sourceMeter   = "meter"
+	sourceHeadEnd = "headend"
+)
+
+// Reconciliation status of a reading
+const (
+	readingPending     = "pending"
+	readingReconciled  = "reconciled"
+	readingDiscrepancy = "discrepancy"
+	readingResolved    = "resolved"
+)
+
+// Reading holds the energy reported for one interval of a meter by the meter itself and
+// by the head-end of the distribution operator
+type Reading struct {
+	AccountId       string `json:"account_id"`
+	Interval        string `json:"interval"`
+	MeterKwh        int64  `json:"meter_kwh"`
+	MeterReported   bool   `json:"meter_reported"`
+	HeadEndKwh      int64  `json:"headend_kwh"`
+	HeadEndReported bool   `json:"headend_reported"`
+	Status          string `json:"status"`
+	AcceptedKwh     int64  `json:"accepted_kwh"`
+}
+
+func (t *EnergyTradingChainCode) readingRow(reading Reading) shim.Row {
+	return shim.Row{
+		Columns: []*shim.Column{
+			&shim.Column{Value: &shim.Column_String_{String_: reading.AccountId}},
+			&shim.Column{Value: &shim.Column_String_{String_: reading.Interval}},
+			&shim.Column{Value: &shim.Column_Int64{Int64: reading.MeterKwh}},
+			&shim.Column{Value: &shim.Column_Bool{Bool: reading.MeterReported}},
+			&shim.Column{Value: &shim.Column_Int64{Int64: reading.HeadEndKwh}},
+			&shim.Column{Value: &shim.Column_Bool{Bool: reading.HeadEndReported}},
+			&shim.Column{Value: &shim.Column_String_{String_: reading.Status}},
+			&shim.Column{Value: &shim.Column_Int64{Int64: reading.AcceptedKwh}},
+		},
+	}
+}
+
+func (t *EnergyTradingChainCode) extractReading(row shim.Row) Reading {
+	return Reading{
+		AccountId:       row.Columns[0].GetString_(),
+		Interval:        row.Columns[1].GetString_(),
+		MeterKwh:        row.Columns[2].GetInt64(),
+		MeterReported:   row.Columns[3].GetBool(),
+		HeadEndKwh:      row.Columns[4].GetInt64(),
+		HeadEndReported: row.Columns[5].GetBool(),
+		Status:          row.Columns[6].GetString_(),
+		AcceptedKwh:     row.Columns[7].GetInt64(),
+	}
+}
+
+// Returns the reading of a meter for an interval. Returns nil if nothing was reported yet.
+func (t *EnergyTradingChainCode) getReading(stub shim.ChaincodeStubInterface, accountId, interval string) (*Reading, error) {
+	var columns []shim.Column
+	col1 := shim.Column{Value: &shim.Column_String_{String_: accountId}}
+	col2 := shim.Column{Value: &shim.Column_String_{String_: interval}}
+	columns = append(columns, col1, col2)
+
+	row, err := stub.GetRow(readingsTableName, columns)
+	if err != nil {
+		return nil, err
+	}
+	if len(row.Columns) == 0 {
+		return nil, nil
+	}
+	reading := t.extractReading(row)
+	return &reading, nil
+}
+
+func (t *EnergyTradingChainCode) getReadingTolerance(stub shim.ChaincodeStubInterface) (int64, error) {
+	toleranceStr, err := stub.GetState("reading_tolerance")
+	if err != nil {
+		logger.Error("Failed to retrieve reading tolerance")
+		return 0, errors.New("Failed to retrieve reading tolerance")
+	}
+	if len(toleranceStr) == 0 {
+		return 0, nil
+	}
+	tolerance, err := strconv.ParseInt(string(toleranceStr), 10, 64)
+	if err != nil {
+		logger.Errorf("Invalid value %s for reading tolerance", toleranceStr)
+		return 0, errors.New("Invalid value for reading tolerance")
+	}
+	return tolerance, nil
+}
+
+func (t *EnergyTradingChainCode) hasOpenDiscrepancy(stub shim.ChaincodeStubInterface, accountId string) (bool, error) {
+	var columns []shim.Column
+	col1 := shim.Column{Value: &shim.Column_String_{String_: accountId}}
+	columns = append(columns, col1)
+
+	rowChannel, err := stub.GetRows(discrepanciesTableName, columns)
+	if err != nil {
+		return false, err
+	}
+	found := false
+	for range rowChannel {
+		found = true
+	}
+	return found, nil
+}
+
+// Returns whether any interval reading was reported for the meter
+func (t *EnergyTradingChainCode) hasReadings(stub shim.ChaincodeStubInterface, accountId string) (bool, error) {
+	var columns []shim.Column
+	col1 := shim.Column{Value: &shim.Column_String_{String_: accountId}}
+	columns = append(columns, col1)
+
+	rowChannel, err := stub.GetRows(readingsTableName, columns)
+	if err != nil {
+		return false, err
+	}
+	found := false
+	for range rowChannel {
+		found = true
+	}
+	return found, nil
+}
+
+// Records a reading from one source. Once both sources have reported the interval the
+// readings are reconciled: if they agree within the configured tolerance the head-end
+// reading counts towards settlement, otherwise the interval is flagged as a discrepancy.
+func (t *EnergyTradingChainCode) recordReading(stub shim.ChaincodeStubInterface, accountId, source, interval string, kwh int64) error {
+	logger.Debugf("Recording %d kwh reported by %s for interval %s of meter %s", kwh, source, interval, accountId)
+	if source != sourceMeter && source != sourceHeadEnd {
+		logger.Errorf("Invalid reading source %s", source)
+		return fmt.Errorf("Invalid reading source %s. Specify %s or %s", source, sourceMeter, sourceHeadEnd)
+	}
+	if interval == "" {
+		logger.Error("Empty reading interval")
+		return errors.New("Reading interval cannot be empty")
+	}
+	err := t.checkReadingSource(stub, accountId, source)
+	if err != nil {
+		return err
+	}
+
+	row, err := t.getRow(stub, accountId)
+	if err != nil {
+		logger.Errorf("Failed retrieving account [%s]: [%s]", accountId, err)
+		return fmt.Errorf("Failed retrieving account [%s]: [%s]", accountId, err)
+	}
+	if len(row.Columns) == 0 {
+		logger.Errorf("Account %s not found", accountId)
+		return fmt.Errorf("Account %s not found", accountId)
+	}
+
+	reading, err := t.getReading(stub, accountId, interval)
+	if err != nil {
+		logger.Errorf("Failed retrieving reading [%s]: [%s]", accountId, err)
+		return fmt.Errorf("Failed retrieving reading [%s]: [%s]", accountId, err)
+	}
+	exists := reading != nil
+	if !exists {
+		reading = &Reading{AccountId: accountId, Interval: interval, Status: readingPending}
+	}
+	if reading.Status != readingPending {
+		logger.Errorf("Reading for interval %s of meter %s is already %s", interval, accountId, reading.Status)
+		return fmt.Errorf("Reading for interval %s of meter %s is already %s", interval, accountId, reading.Status)
+	}
+
+	if source == sourceMeter {
+		reading.MeterKwh = kwh
+		reading.MeterReported = true
+	} else {
+		reading.HeadEndKwh = kwh
+		reading.HeadEndReported = true
+	}
+
+	if reading.MeterReported && reading.HeadEndReported {
+		tolerance, err := t.getReadingTolerance(stub)
+		if err != nil {
+			return err
+		}
+		if abs(reading.MeterKwh-reading.HeadEndKwh) <= tolerance {
+			reading.Status = readingReconciled
+			reading.AcceptedKwh = reading.HeadEndKwh
+		} else {
+			logger.Infof("Readings for interval %s of meter %s differ by more than %d kwh", interval, accountId, tolerance)
+			reading.Status = readingDiscrepancy
+		}
+	}
+
+	var ok bool
+	if exists {
+		ok, err = stub.ReplaceRow(readingsTableName, t.readingRow(*reading))
+	} else {
+		ok, err = stub.InsertRow(readingsTableName, t.readingRow(*reading))
+	}
+	if !ok || err != nil {
+		logger.Errorf("Error in saving reading of account %s:%s", accountId, err)
+		return errors.New("Error in saving reading")
+	}
+
+	switch reading.Status {
+	case readingReconciled:
+		return t.acceptReading(stub, accountId, interval, reading.AcceptedKwh)
+	case readingDiscrepancy:
+		ok, err = stub.InsertRow(discrepanciesTableName, shim.Row{
+			Columns: []*shim.Column{
+				&shim.Column{Value: &shim.Column_String_{String_: accountId}},
+				&shim.Column{Value: &shim.Column_String_{String_: interval}},
+			},
+		})
+		if !ok || err != nil {
+			logger.Errorf("Error in flagging discrepancy of account %s:%s", accountId, err)
+			return errors.New("Error in flagging discrepancy")
+		}
+	}
+	return nil
+}
+
+// Counts the accepted energy of an interval towards settlement and peak demand
+func (t *EnergyTradingChainCode) acceptReading(stub shim.ChaincodeStubInterface, accountId, interval string, kwh int64) error {
+	err := t.recordConsumption(stub, accountId, interval, kwh)
+	if err != nil {
+		logger.Errorf("Failed recording consumption [%s]: [%s]", accountId, err)
+		return err
+	}
+	return t.addReportedKwh(stub, accountId, kwh)
+}
+
+// Checks that the caller may report readings of the source: the meter owner those of
+// the meter, the head-end or the administrator those of the head-end. Otherwise one
+// caller could report both sides of a reconciliation.
+func (t *EnergyTradingChainCode) checkReadingSource(stub shim.ChaincodeStubInterface, accountId, source string) error {
+	if source == sourceMeter {
+		_, _, err := t.checkMeterOwner(stub, accountId)
+		return err
+	}
+
+	headEndCertificate, err := stub.GetState("headend_certificate")
+	if err != nil {
+		return fmt.Errorf("Failed getting head-end certificate:%s", err.Error())
+	}
+	if len(headEndCertificate) > 0 {
+		ok, err := t.isCaller(stub, headEndCertificate)
+		if err != nil {
+			logger.Error("Failed checking head-end identity")
+			return fmt.Errorf("Failed checking head-end identity:%s", err.Error())
+		}
+		if ok {
+			return nil
+		}
+	}
+	err = t.checkAdmin(stub)
+	if err != nil {
+		logger.Error("Caller is neither the head-end nor the administrator")
+		return errors.New("The caller is neither the head-end nor the administrator")
+	}
+	return nil
+}
+
+// Sets the certificate, given base64 encoded, the head-end reports its readings with.
+// Only the administrator can do it.
+func (t *EnergyTradingChainCode) setHeadEnd(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	logger.Info("In setHeadEnd function")
+	if len(args) != 1 {
+		logger.Error("Incorrect number of arguments")
+		return nil, errors.New("Incorrect number of arguments. Specify the head-end certificate")
+	}
+
+	certificate, err := base64.StdEncoding.DecodeString(args[0])
+	if err != nil || len(certificate) == 0 {
+		logger.Error("Failed decoding head-end certificate")
+		return nil, errors.New("Failed decoding head-end certificate")
+	}
+
+	err = t.checkAdmin(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	err = stub.PutState("headend_certificate", certificate)
+	if err != nil {
+		logger.Errorf("Error saving head-end certificate %s", err.Error())
+		return nil, errors.New("Head-end certificate cannot be saved")
+	}
+	logger.Info("Head-end certificate set")
+
+	return nil, nil
+}
+
+// Sets the largest difference in kwh between the meter and head-end readings that is
+// still accepted without review. Only the administrator can do it.
+func (t *EnergyTradingChainCode) setReadingTolerance(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	logger.Info("In setReadingTolerance function")
+	if len(args) != 1 {
+		logger.Error("Incorrect number of arguments")
+		return nil, errors.New("Incorrect number of arguments. Specify the tolerance in kwh")
+	}
+
+	tolerance, err := strconv.ParseInt(args[0], 10, 64)
+	if err != nil || tolerance < 0 {
+		logger.Errorf("Invalid value %s for reading tolerance", args[0])
+		return nil, errors.New("Invalid value for reading tolerance")
+	}
+
+	err = t.checkAdmin(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	err = stub.PutState("reading_tolerance", []byte(strconv.FormatInt(tolerance, 10)))
+	if err != nil {
+		logger.Errorf("Error saving reading tolerance %s", err.Error())
+		return nil, errors.New("Reading tolerance cannot be saved")
+	}
+	logger.Infof("Reading tolerance set to %d kwh", tolerance)
+
+	return nil, nil
+}
+
+// Resolves a discrepancy by setting the kwh that counts for the interval. Only the
+// administrator can do it.
+func (t *EnergyTradingChainCode) resolveDiscrepancy(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	logger.Info("In resolveDiscrepancy function")
+	if len(args) != 3 {
+		logger.Error("Incorrect number of arguments")
+		return nil, errors.New("Incorrect number of arguments. Specify account number, interval and the accepted kwh")
+	}
+
+	accountId := args[0]
+	interval := args[1]
+	acceptedKwh, err := strconv.ParseInt(args[2], 10, 64)
+	if err != nil {
+		logger.Errorf("Error in converting to int:%s", err.Error())
+		return nil, fmt.Errorf("Invalid value of accepted kwh:%s", args[2])
+	}
+
+	err = t.checkAdmin(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	reading, err := t.getReading(stub, accountId, interval)
+	if err != nil {
+		logger.Errorf("Failed retrieving reading [%s]: [%s]", accountId, err)
+		return nil, fmt.Errorf("Failed retrieving reading [%s]: [%s]", accountId, err)
+	}
+	if reading == nil || reading.Status != readingDiscrepancy {
+		logger.Errorf("No discrepancy for interval %s of meter %s", interval, accountId)
+		return nil, fmt.Errorf("No discrepancy for interval %s of meter %s", interval, accountId)
+	}
+
+	reading.Status = readingResolved
+	reading.AcceptedKwh = acceptedKwh
+	ok, err := stub.ReplaceRow(readingsTableName, t.readingRow(*reading))
+	if !ok || err != nil {
+		logger.Errorf("Error in resolving discrepancy of account %s:%s", accountId, err)
+		return nil, errors.New("Error in resolving discrepancy")
+	}
+
+	var columns []shim.Column
+	col1 := shim.Column{Value: &shim.Column_String_{String_: accountId}}
+	col2 := shim.Column{Value: &shim.Column_String_{String_: interval}}
+	columns = append(columns, col1, col2)
+	err = stub.DeleteRow(discrepanciesTableName, columns)
+	if err != nil {
+		logger.Errorf("Error in clearing discrepancy of account %s:%s", accountId, err)
+		return nil, errors.New("Error in resolving discrepancy")
+	}
+
+	err = t.acceptReading(stub, accountId, interval, acceptedKwh)
+	if err != nil {
+		return nil, err
+	}
+	logger.Infof("Resolved discrepancy for interval %s of meter %s with %d kwh", interval, accountId, acceptedKwh)
+
+	return nil, nil
+}
+
+// Return the reading of a meter for an interval
+func (t *EnergyTradingChainCode) reading(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	logger.Info("In reading function")
+	if len(args) != 2 {
+		logger.Error("Incorrect number of arguments")
+		return nil, errors.New("Incorrect number of arguments. Specify account number and interval")
+	}
+
+	reading, err := t.getReading(stub, args[0], args[1])
+	if err != nil {
+		logger.Errorf("Failed retrieving reading [%s]: [%s]", args[0], err)
+		return nil, fmt.Errorf("Failed retrieving reading [%s]: [%s]", args[0], err)
+	}
+	if reading == nil {
+		return nil, fmt.Errorf("No reading for interval %s found for account %s", args[1], args[0])
+	}
+
+	payload, err := json.Marshal(reading)
+	if err != nil {
+		logger.Errorf("Failed marshalling payload: [%s]", err)
+		return nil, fmt.Errorf("Failed marshalling payload [%s]", err)
+	}
+
+	return payload, nil
+}
+
+// Return the readings in discrepancy, optionally only those of one meter
+func (t *EnergyTradingChainCode) discrepancies(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	logger.Info("In discrepancies function")
+	if len(args) > 1 {
+		logger.Error("Incorrect number of arguments")
+		return nil, errors.New("Incorrect number of arguments. Optionally specify account number")
+	}
+
+	var columns []shim.Column
+	if len(args) == 1 {
+		col1 := shim.Column{Value: &shim.Column_String_{String_: args[0]}}
+		columns = append(columns, col1)
+	}
+
+	rowChannel, err := stub.GetRows(discrepanciesTableName, columns)
+	if err != nil {
+		logger.Errorf("Error in getting rows:%s", err.Error())
+		return nil, errors.New("Error in fetching rows")
+	}
+	keys := make([]shim.Row, 0)
+	for row := range rowChannel {
+		keys = append(keys, row)
+	}
+
+	readings := make([]Reading, 0)
+	for _, key := range keys {
+		reading, err := t.getReading(stub, key.Columns[0].GetString_(), key.Columns[1].GetString_())
+		if err != nil {
+			logger.Errorf("Failed retrieving reading [%s]: [%s]", key.Columns[0].GetString_(), err)
+			return nil, fmt.Errorf("Failed retrieving reading [%s]: [%s]", key.Columns[0].GetString_(), err)
+		}
+		if reading != nil {
+			readings = append(readings, *reading)
+		}
+	}
+
+	payload, err := json.Marshal(readings)
+	if err != nil {
+		logger.Errorf("Failed marshalling payload")
+		return nil, fmt.Errorf("Failed marshalling payload [%s]", err)
+	}
+
+	return payload, nil
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/base64"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+func TestPlainDeltaRejectedAfterIntervalReading(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	cc, stub := newTestChaincode(t)
+	enrollMeters(t, cc, stub, r, 2)
+
+	invokeAs(t, cc, stub, testAdmin, "reportDelta", "2", "-5")
+	invokeAs(t, cc, stub, []byte("owner-2"), "reportDelta", "2", "-4", sourceMeter, "2026-10-01T10:00:00Z")
+
+	// The meter reading is pending until the head-end reports the interval, a plain
+	// delta must not count in the meantime
+	_, err := invokeChaincode(cc, stub, testAdmin, "reportDelta", "2", "-4")
+	if err == nil || !strings.Contains(err.Error(), "Specify the reading source and interval") {
+		t.Fatalf("Plain delta after an interval reading returned %v", err)
+	}
+	if kwh := string(queryAs(t, cc, stub, "reportedKwh", "2")); kwh != "-5" {
+		t.Errorf("Reported kwh %s with a pending reading, want -5", kwh)
+	}
+
+	invokeAs(t, cc, stub, testAdmin, "reportDelta", "2", "-4", sourceHeadEnd, "2026-10-01T10:00:00Z")
+	if kwh := string(queryAs(t, cc, stub, "reportedKwh", "2")); kwh != "-9" {
+		t.Errorf("Reported kwh %s after reconciliation, want -9", kwh)
+	}
+
+	// Meters without interval readings keep reporting plain deltas
+	invokeAs(t, cc, stub, testAdmin, "reportDelta", "1", "3")
+}
+
+// Each side of a reconciliation is reported by its own certificate
+func TestReadingSourcesAreAuthenticated(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	cc, stub := newTestChaincode(t)
+	enrollMeters(t, cc, stub, r, 2)
+	owner := []byte("owner-2")
+	headEnd := []byte("headend")
+	interval := "2026-10-01T10:00:00Z"
+
+	tests := []struct {
+		caller []byte
+		source string
+		err    string
+	}{
+		{caller: testAdmin, source: sourceMeter, err: "The caller is not the owner of meter"},
+		{caller: []byte("owner-1"), source: sourceMeter, err: "The caller is not the owner of meter"},
+		{caller: owner, source: sourceHeadEnd, err: "The caller is neither the head-end nor the administrator"},
+		{caller: headEnd, source: sourceHeadEnd, err: "The caller is neither the head-end nor the administrator"},
+	}
+	for _, test := range tests {
+		_, err := invokeChaincode(cc, stub, test.caller, "reportDelta", "2", "-4", test.source, interval)
+		if err == nil || err.Error() != test.err {
+			t.Errorf("Reading of %s reported by %s returned %v, want %s", test.source, test.caller, err, test.err)
+		}
+	}
+
+	_, err := invokeChaincode(cc, stub, owner, "setHeadEnd", base64.StdEncoding.EncodeToString(headEnd))
+	if err == nil {
+		t.Error("Head-end certificate set by a meter owner")
+	}
+	invokeAs(t, cc, stub, testAdmin, "setHeadEnd", base64.StdEncoding.EncodeToString(headEnd))
+
+	invokeAs(t, cc, stub, owner, "reportDelta", "2", "-4", sourceMeter, interval)
+	invokeAs(t, cc, stub, headEnd, "reportDelta", "2", "-4", sourceHeadEnd, interval)
+	if kwh := string(queryAs(t, cc, stub, "reportedKwh", "2")); kwh != "-4" {
+		t.Errorf("Reported kwh %s after reconciliation, want -4", kwh)
+	}
+}
+
+func TestInitKeepsReadingTolerance(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	cc, stub := newTestChaincode(t)
+	enrollMeters(t, cc, stub, r, 2)
+	invokeAs(t, cc, stub, testAdmin, "setReadingTolerance", "2")
+
+	stub.Caller = testAdmin
+	_, err := cc.Init(stub, "init", []string{"0.01"})
+	if err != nil {
+		t.Fatalf("Init failed: %s", err)
+	}
+
+	// Readings 1 kwh apart are still within the tolerance
+	invokeAs(t, cc, stub, []byte("owner-2"), "reportDelta", "2", "-5", sourceMeter, "2026-10-01T10:00:00Z")
+	invokeAs(t, cc, stub, testAdmin, "reportDelta", "2", "-4", sourceHeadEnd, "2026-10-01T10:00:00Z")
+	if kwh := string(queryAs(t, cc, stub, "reportedKwh", "2")); kwh != "-4" {
+		t.Errorf("Reported kwh %s, want the head-end reading -4", kwh)
+	}
+}
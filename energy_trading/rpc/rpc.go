@@ -0,0 +1,215 @@
+// Package rpc talks to the JSON-RPC endpoint of a peer to deploy, invoke and query the
+// energy trading chaincode. It builds the same requests as the files in the scripts
+// directory.
+package rpc
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Chaincode types as defined by the fabric protos
+const chaincodeTypeGolang = 1
+
+// Config of the peer and the deployed chaincode
+type Config struct {
+	// Base URL of the peer REST API, e.g. https://127.0.0.1:7050
+	Endpoint string `json:"endpoint"`
+	// Name of the deployed chaincode as returned by deploy
+	ChaincodeId string `json:"chaincode_id"`
+	// Path used to deploy the chaincode
+	ChaincodePath string `json:"chaincode_path"`
+	// Enrolled user on whose behalf transactions are submitted, if security is enabled
+	SecureContext string `json:"secure_context,omitempty"`
+	// Skip verification of the peer TLS certificate, same as curl -k
+	Insecure bool `json:"insecure"`
+	// Request timeout in seconds
+	Timeout int `json:"timeout"`
+}
+
+// LoadConfig reads the configuration from a JSON file
+func LoadConfig(path string) (Config, error) {
+	var config Config
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return config, fmt.Errorf("Failed reading config [%s]: [%s]", path, err)
+	}
+	err = json.Unmarshal(data, &config)
+	if err != nil {
+		return config, fmt.Errorf("Failed parsing config [%s]: [%s]", path, err)
+	}
+	if config.Endpoint == "" {
+		return config, fmt.Errorf("No endpoint specified in config [%s]", path)
+	}
+	return config, nil
+}
+
+// SaveConfig writes the configuration to a JSON file
+func SaveConfig(path string, config Config) error {
+	data, err := json.MarshalIndent(config, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, append(data, '\n'), 0644)
+}
+
+type ChaincodeID struct {
+	Path string `json:"path,omitempty"`
+	Name string `json:"name,omitempty"`
+}
+
+type CtorMsg struct {
+	Function string   `json:"function"`
+	Args     []string `json:"args"`
+}
+
+type Params struct {
+	Type          int         `json:"type"`
+	ChaincodeID   ChaincodeID `json:"chaincodeID"`
+	CtorMsg       CtorMsg     `json:"ctorMsg"`
+	SecureContext string      `json:"secureContext,omitempty"`
+}
+
+// Request is a JSON-RPC request to the chaincode endpoint
+type Request struct {
+	JSONRPC string `json:"jsonrpc"`
+	Method  string `json:"method"`
+	Params  Params `json:"params"`
+	ID      int64  `json:"id"`
+}
+
+type Result struct {
+	Status  string `json:"status"`
+	Message string `json:"message"`
+}
+
+type Error struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+	Data    string `json:"data"`
+}
+
+// Response is a JSON-RPC response from the chaincode endpoint
+type Response struct {
+	JSONRPC string  `json:"jsonrpc"`
+	Result  *Result `json:"result,omitempty"`
+	Error   *Error  `json:"error,omitempty"`
+	ID      int64   `json:"id"`
+}
+
+// Client submits requests to the chaincode endpoint
+type Client struct {
+	Config     Config
+	HTTPClient *http.Client
+	nextId     int64
+}
+
+// NewClient returns a client for the given configuration
+func NewClient(config Config) *Client {
+	timeout := time.Duration(config.Timeout) * time.Second
+	if timeout == 0 {
+		timeout = 30 * time.Second
+	}
+	return &Client{
+		Config: config,
+		HTTPClient: &http.Client{
+			Timeout: timeout,
+			Transport: &http.Transport{
+				TLSClientConfig: &tls.Config{InsecureSkipVerify: config.Insecure},
+			},
+		},
+	}
+}
+
+// NewRequest builds a request for the given method (deploy, invoke or query)
+func (c *Client) NewRequest(method, function string, args []string) Request {
+	if args == nil {
+		args = []string{}
+	}
+	chaincodeID := ChaincodeID{Name: c.Config.ChaincodeId}
+	if method == "deploy" {
+		chaincodeID = ChaincodeID{Path: c.Config.ChaincodePath}
+	}
+	c.nextId++
+	return Request{
+		JSONRPC: "2.0",
+		Method:  method,
+		Params: Params{
+			Type:          chaincodeTypeGolang,
+			ChaincodeID:   chaincodeID,
+			CtorMsg:       CtorMsg{Function: function, Args: args},
+			SecureContext: c.Config.SecureContext,
+		},
+		ID: c.nextId,
+	}
+}
+
+// Do posts a request and returns the message of the result
+func (c *Client) Do(request Request) (string, error) {
+	body, err := json.Marshal(request)
+	if err != nil {
+		return "", err
+	}
+
+	url := strings.TrimRight(c.Config.Endpoint, "/") + "/chaincode"
+	httpResponse, err := c.HTTPClient.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return "", fmt.Errorf("Failed posting to [%s]: [%s]", url, err)
+	}
+	defer httpResponse.Body.Close()
+
+	data, err := ioutil.ReadAll(httpResponse.Body)
+	if err != nil {
+		return "", fmt.Errorf("Failed reading response: [%s]", err)
+	}
+	var response Response
+	err = json.Unmarshal(data, &response)
+	if err != nil {
+		return "", fmt.Errorf("Invalid response (HTTP %d): %s", httpResponse.StatusCode, string(data))
+	}
+	if response.Error != nil {
+		return "", fmt.Errorf("%s (%d): %s", response.Error.Message, response.Error.Code, response.Error.Data)
+	}
+	if response.Result == nil {
+		return "", errors.New("Response has neither result nor error")
+	}
+	if response.Result.Status != "OK" {
+		return "", fmt.Errorf("Request failed with status %s: %s", response.Result.Status, response.Result.Message)
+	}
+	return response.Result.Message, nil
+}
+
+// Deploy deploys the chaincode from the configured path and returns its name
+func (c *Client) Deploy(args ...string) (string, error) {
+	if c.Config.ChaincodePath == "" {
+		return "", errors.New("No chaincode path configured")
+	}
+	return c.Do(c.NewRequest("deploy", "init", args))
+}
+
+// Invoke submits a transaction and returns its id
+func (c *Client) Invoke(function string, args ...string) (string, error) {
+	if c.Config.ChaincodeId == "" {
+		return "", errors.New("No chaincode id configured, deploy the chaincode first")
+	}
+	return c.Do(c.NewRequest("invoke", function, args))
+}
+
+// Query runs a query and returns its payload
+func (c *Client) Query(function string, args ...string) ([]byte, error) {
+	if c.Config.ChaincodeId == "" {
+		return nil, errors.New("No chaincode id configured, deploy the chaincode first")
+	}
+	message, err := c.Do(c.NewRequest("query", function, args))
+	if err != nil {
+		return nil, err
+	}
+	return []byte(message), nil
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/predix/chaincode_example/energy_trading/settlement"
+)
+
+// Version of the table layout written by this chaincode. Deployments without a
+// schema_version in state predate versioning and are at version 1.
+const currentSchemaVersion = 4
+
+// A migration upgrades the tables from one schema version to the next. Migrations only
+// fill in what is missing, so running one again on already migrated tables is harmless.
+type migration func(t *EnergyTradingChainCode, stub shim.ChaincodeStubInterface) error
+
+// migrations[i] upgrades from version i+1 to version i+2
+var migrations = []migration{
+	(*EnergyTradingChainCode).migrateMeterTables,
+	(*EnergyTradingChainCode).migrateCarbonTables,
+	(*EnergyTradingChainCode).migrateRateHistory,
+}
+
+// Tells whether Init deploys on an empty ledger rather than over the tables of an
+// earlier deploy. Only then the tables are created in the current schema version;
+// otherwise the version is left for migrate.
+func (t *EnergyTradingChainCode) isFreshDeploy(stub shim.ChaincodeStubInterface) (bool, error) {
+	versionStr, err := stub.GetState("schema_version")
+	if err != nil {
+		logger.Error("Failed to retrieve schema version")
+		return false, errors.New("Failed to retrieve schema version")
+	}
+	if len(versionStr) > 0 {
+		return false, nil
+	}
+	_, err = stub.GetTable(tableName)
+	if err == shim.ErrTableNotFound {
+		return true, nil
+	}
+	if err != nil {
+		logger.Errorf("Error in fetching table %s: %s", tableName, err)
+		return false, fmt.Errorf("Error in fetching table %s: %s", tableName, err)
+	}
+	return false, nil
+}
+
+func (t *EnergyTradingChainCode) getSchemaVersion(stub shim.ChaincodeStubInterface) (int64, error) {
+	versionStr, err := stub.GetState("schema_version")
+	if err != nil {
+		logger.Error("Failed to retrieve schema version")
+		return 0, errors.New("Failed to retrieve schema version")
+	}
+	if len(versionStr) == 0 {
+		return 1, nil
+	}
+	version, err := strconv.ParseInt(string(versionStr), 10, 64)
+	if err != nil {
+		logger.Errorf("Invalid value %s for schema version", versionStr)
+		return 0, errors.New("Invalid value for schema version")
+	}
+	return version, nil
+}
+
+// Version 1 only had the Meters table. Version 2 adds the tables of the features built
+// since, and every meter gets a metadata row, without owner, and account totals matching
+// its current balance, as if all of it had been deposited.
+func (t *EnergyTradingChainCode) migrateMeterTables(stub shim.ChaincodeStubInterface) error {
+	err := t.createTables(stub)
+	if err != nil {
+		return err
+	}
+
+	var columns []shim.Column
+	rowChannel, err := stub.GetRows(tableName, columns)
+	if err != nil {
+		return fmt.Errorf("Error in fetching rows: %s", err)
+	}
+	balances := make(map[string]float64)
+	accountIds := make([]string, 0)
+	for row := range rowChannel {
+		balance, err := strconv.ParseFloat(row.Columns[3].GetString_(), 64)
+		if err != nil {
+			return fmt.Errorf("Invalid value of accountBalance:%s", row.Columns[3].GetString_())
+		}
+		accountIds = append(accountIds, row.Columns[0].GetString_())
+		balances[row.Columns[0].GetString_()] = balance
+	}
+
+	xchngBalanceStr, err := stub.GetState("exchange_account_balance")
+	if err != nil {
+		return errors.New("Failed to retrieve exchange account balance")
+	}
+	if len(xchngBalanceStr) > 0 {
+		xchngBalance, err := strconv.ParseFloat(string(xchngBalanceStr), 64)
+		if err != nil {
+			return fmt.Errorf("Invalid value %s for exchange account balance", xchngBalanceStr)
+		}
+		accountIds = append(accountIds, exchangeAccountId)
+		balances[exchangeAccountId] = xchngBalance
+	}
+
+	for _, accountId := range accountIds {
+		if accountId != exchangeAccountId {
+			metadata, _, err := t.getMeterMetadata(stub, accountId)
+			if err != nil {
+				return err
+			}
+			if metadata == nil {
+				logger.Debugf("Adding metadata of account %s", accountId)
+				ok, err := stub.InsertRow(metadataTableName, t.metadataRow(accountId, nil, settlement.MeterMetadata{SourcePreference: settlement.SourceAny}))
+				if !ok || err != nil {
+					return fmt.Errorf("Error in adding metadata of account %s: %s", accountId, err)
+				}
+			}
+		}
+
+		var key []shim.Column
+		key = append(key, shim.Column{Value: &shim.Column_String_{String_: accountId}})
+		row, err := stub.GetRow(totalsTableName, key)
+		if err != nil {
+			return err
+		}
+		if len(row.Columns) > 0 {
+			continue
+		}
+		logger.Debugf("Adding totals of account %s", accountId)
+		totals := AccountTotals{AccountId: accountId}
+		if balances[accountId] >= 0 {
+			totals.Deposits = balances[accountId]
+		} else {
+			totals.Withdrawals = -balances[accountId]
+		}
+		ok, err := stub.InsertRow(totalsTableName, t.totalsRow(totals))
+		if !ok || err != nil {
+			return fmt.Errorf("Error in adding totals of account %s: %s", accountId, err)
+		}
+	}
+	return nil
+}
+
+// Version 3 adds the emission factor and carbon tables. Emissions are not attributed to
+// trades settled before the upgrade.
+func (t *EnergyTradingChainCode) migrateCarbonTables(stub shim.ChaincodeStubInterface) error {
+	return t.createTables(stub)
+}
+
+// Version 4 keeps the rate history of every meter. Meters without history get their
+// current rate in force from the first round, earlier changes are not known.
+func (t *EnergyTradingChainCode) migrateRateHistory(stub shim.ChaincodeStubInterface) error {
+	err := t.createTables(stub)
+	if err != nil {
+		return err
+	}
+
+	var columns []shim.Column
+	rowChannel, err := stub.GetRows(tableName, columns)
+	if err != nil {
+		return fmt.Errorf("Error in fetching rows: %s", err)
+	}
+	rows := make([]shim.Row, 0)
+	for row := range rowChannel {
+		rows = append(rows, row)
+	}
+
+	for _, row := range rows {
+		accountId := row.Columns[0].GetString_()
+		changes, err := t.getRateHistory(stub, accountId)
+		if err != nil {
+			return err
+		}
+		if len(changes) > 0 {
+			continue
+		}
+		logger.Debugf("Adding rate history of account %s", accountId)
+		err = t.recordRate(stub, accountId, 1, row.Columns[4].GetInt64())
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Upgrades the tables to the schema version of this chaincode, running the migrations
+// of every version in between. Only the administrator can do it.
+func (t *EnergyTradingChainCode) migrate(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	logger.Info("In migrate function")
+	if len(args) > 0 {
+		logger.Error("Incorrect number of arguments")
+		return nil, errors.New("Incorrect number of arguments. No arguments necessary")
+	}
+
+	err := t.checkAdmin(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	version, err := t.getSchemaVersion(stub)
+	if err != nil {
+		return nil, err
+	}
+	if version > currentSchemaVersion {
+		logger.Errorf("Schema version %d is newer than %d", version, currentSchemaVersion)
+		return nil, fmt.Errorf("Schema version %d is newer than this chaincode supports (%d)", version, currentSchemaVersion)
+	}
+
+	for ; version < currentSchemaVersion; version++ {
+		logger.Infof("Migrating schema from version %d to %d", version, version+1)
+		err = migrations[version-1](t, stub)
+		if err != nil {
+			logger.Errorf("Failed migrating schema to version %d: %s", version+1, err)
+			return nil, fmt.Errorf("Failed migrating schema to version %d: %s", version+1, err)
+		}
+		err = stub.PutState("schema_version", []byte(strconv.FormatInt(version+1, 10)))
+		if err != nil {
+			logger.Errorf("Error saving schema version %s", err.Error())
+			return nil, errors.New("Schema version cannot be saved")
+		}
+	}
+	logger.Infof("Schema is at version %d", version)
+
+	return nil, nil
+}
+
+// Return the schema version of the tables
+func (t *EnergyTradingChainCode) schemaVersion(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	logger.Info("In schemaVersion function")
+	if len(args) > 0 {
+		logger.Error("Incorrect number of arguments")
+		return nil, errors.New("Incorrect number of arguments. No arguments necessary")
+	}
+
+	version, err := t.getSchemaVersion(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	return []byte(strconv.FormatInt(version, 10)), nil
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/predix/chaincode_example/energy_trading/memstub"
+	"github.com/predix/chaincode_example/energy_trading/settlement"
+)
+
+// Loads the ledger of a version 1 deploy: the Meters table, the exchange account
+// balance and the admin, without a schema version
+func loadVersion1(tb testing.TB, stub *memstub.Stub) {
+	err := stub.CreateTable(tableName, []*shim.ColumnDefinition{
+		&shim.ColumnDefinition{Name: "AccountId", Type: shim.ColumnDefinition_STRING, Key: true},
+		&shim.ColumnDefinition{Name: "AccountName", Type: shim.ColumnDefinition_STRING, Key: false},
+		&shim.ColumnDefinition{Name: "ReportedKWH", Type: shim.ColumnDefinition_INT64, Key: false},
+		&shim.ColumnDefinition{Name: "AccountBalance", Type: shim.ColumnDefinition_STRING, Key: false},
+		&shim.ColumnDefinition{Name: "RatePerKWH", Type: shim.ColumnDefinition_INT64, Key: false},
+	})
+	if err != nil {
+		tb.Fatal(err)
+	}
+	meters := []struct {
+		accountId string
+		kwh       int64
+		balance   string
+		rate      int64
+	}{
+		{"1", 12, "150.000000", 3},
+		{"2", -4, "-20.500000", 5},
+	}
+	for _, m := range meters {
+		ok, err := stub.InsertRow(tableName, shim.Row{
+			Columns: []*shim.Column{
+				&shim.Column{Value: &shim.Column_String_{String_: m.accountId}},
+				&shim.Column{Value: &shim.Column_String_{String_: "meter " + m.accountId}},
+				&shim.Column{Value: &shim.Column_Int64{Int64: m.kwh}},
+				&shim.Column{Value: &shim.Column_String_{String_: m.balance}},
+				&shim.Column{Value: &shim.Column_Int64{Int64: m.rate}},
+			},
+		})
+		if !ok || err != nil {
+			tb.Fatalf("Failed loading meter %s: %s", m.accountId, err)
+		}
+	}
+	stub.PutState("exchange_rate", []byte("0.010000"))
+	stub.PutState("exchange_account_balance", []byte("7.250000"))
+	stub.PutState("admin", testAdmin)
+}
+
+func TestInitWritesSchemaVersionOnFreshDeploy(t *testing.T) {
+	cc, stub := newTestChaincode(t)
+	version, err := cc.getSchemaVersion(stub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != currentSchemaVersion {
+		t.Errorf("Schema version %d after deploy, want %d", version, currentSchemaVersion)
+	}
+}
+
+func TestMigrateFromVersion1(t *testing.T) {
+	logger.SetLevel(shim.LogError)
+	stub := memstub.New()
+	cc := new(EnergyTradingChainCode)
+	loadVersion1(t, stub)
+
+	// Deploying the new chaincode over the old tables leaves the version to migrate
+	stub.Caller = testAdmin
+	_, err := cc.Init(stub, "init", []string{"0.01"})
+	if err != nil {
+		t.Fatalf("Init failed: %s", err)
+	}
+	version, err := cc.getSchemaVersion(stub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != 1 {
+		t.Fatalf("Schema version %d after deploying over version 1, want 1", version)
+	}
+
+	invokeAs(t, cc, stub, testAdmin, "migrate")
+
+	version, err = cc.getSchemaVersion(stub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != currentSchemaVersion {
+		t.Fatalf("Schema version %d after migrate, want %d", version, currentSchemaVersion)
+	}
+
+	for _, accountId := range []string{"1", "2"} {
+		metadata, owner, err := cc.getMeterMetadata(stub, accountId)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if metadata == nil || metadata.SourcePreference != settlement.SourceAny || len(owner) != 0 {
+			t.Errorf("Metadata of account %s: %+v owner %q", accountId, metadata, owner)
+		}
+	}
+
+	totals := []AccountTotals{
+		{AccountId: "1", Deposits: 150},
+		{AccountId: "2", Withdrawals: 20.5},
+		{AccountId: exchangeAccountId, Deposits: 7.25},
+	}
+	for _, want := range totals {
+		row, err := stub.GetRow(totalsTableName, []shim.Column{{Value: &shim.Column_String_{String_: want.AccountId}}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(row.Columns) == 0 {
+			t.Errorf("No totals for account %s", want.AccountId)
+			continue
+		}
+		got, err := cc.extractTotals(row)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != want {
+			t.Errorf("Totals of account %s: got %+v, want %+v", want.AccountId, got, want)
+		}
+	}
+
+	rates := map[string]int64{"1": 3, "2": 5}
+	for accountId, rate := range rates {
+		changes, err := cc.getRateHistory(stub, accountId)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(changes) != 1 || changes[0].Round != 1 || changes[0].RatePerKwh != rate {
+			t.Errorf("Rate history of account %s: %+v, want rate %d from round 1", accountId, changes, rate)
+		}
+	}
+
+	// A second run finds nothing left to do
+	invokeAs(t, cc, stub, testAdmin, "migrate")
+	changes, err := cc.getRateHistory(stub, "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 1 {
+		t.Errorf("Rate history of account 1 after migrating twice: %+v", changes)
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/base64"
+	"math/rand"
+	"strconv"
+	"testing"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/predix/chaincode_example/energy_trading/memstub"
+)
+
+var testAdmin = []byte("admin")
+
+// Deploys the chaincode on an empty in-memory stub, the admin as deployer
+func newTestChaincode(tb testing.TB) (*EnergyTradingChainCode, *memstub.Stub) {
+	logger.SetLevel(shim.LogError)
+	stub := memstub.New()
+	t := new(EnergyTradingChainCode)
+	stub.Caller = testAdmin
+	_, err := t.Init(stub, "init", []string{"0.01"})
+	if err != nil {
+		tb.Fatalf("Init failed: %s", err)
+	}
+	return t, stub
+}
+
+func invokeChaincode(t *EnergyTradingChainCode, stub *memstub.Stub, caller []byte, function string, args ...string) ([]byte, error) {
+	stub.Caller = caller
+	stub.TxID = function + strconv.Itoa(rand.Int())
+	return t.Invoke(stub, function, args)
+}
+
+func invokeAs(tb testing.TB, t *EnergyTradingChainCode, stub *memstub.Stub, caller []byte, function string, args ...string) []byte {
+	payload, err := invokeChaincode(t, stub, caller, function, args...)
+	if err != nil {
+		tb.Fatalf("%s %v failed: %s", function, args, err)
+	}
+	return payload
+}
+
+// Enrolls meters with random rates and funds, two in five of them selling
+func enrollMeters(tb testing.TB, t *EnergyTradingChainCode, stub *memstub.Stub, r *rand.Rand, meters int) {
+	for i := 1; i <= meters; i++ {
+		accountId := strconv.Itoa(i)
+		owner := base64.StdEncoding.EncodeToString([]byte("owner-" + accountId))
+		invokeAs(tb, t, stub, testAdmin, "enroll", accountId, "meter "+accountId, strconv.Itoa(1+r.Intn(10)), owner)
+		invokeAs(tb, t, stub, testAdmin, "changeAccountBalance", accountId, "1000")
+	}
+}
+
+// Reports a round of energy, produced by the sellers and consumed by the others
+func reportRound(tb testing.TB, t *EnergyTradingChainCode, stub *memstub.Stub, r *rand.Rand, meters int) {
+	for i := 1; i <= meters; i++ {
+		kwh := 1 + r.Intn(40)
+		if i%5 >= 2 {
+			kwh = -kwh
+		}
+		invokeAs(tb, t, stub, testAdmin, "reportDelta", strconv.Itoa(i), strconv.Itoa(kwh))
+	}
+}
+
+func benchmarkSettle(b *testing.B, meters int) {
+	r := rand.New(rand.NewSource(1))
+	t, stub := newTestChaincode(b)
+	enrollMeters(b, t, stub, r, meters)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	var reads, writes int64
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		reportRound(b, t, stub, r, meters)
+		stub.ResetCounts()
+		b.StartTimer()
+
+		invokeAs(b, t, stub, testAdmin, "settle")
+
+		reads += stub.Counts.Reads()
+		writes += stub.Counts.Writes()
+	}
+	b.ReportMetric(float64(reads)/float64(b.N), "reads/op")
+	b.ReportMetric(float64(writes)/float64(b.N), "writes/op")
+}
+
+func BenchmarkSettle(b *testing.B) {
+	for _, meters := range []int{100, 1000} {
+		b.Run(strconv.Itoa(meters)+"meters", func(b *testing.B) {
+			benchmarkSettle(b, meters)
+		})
+	}
+}
+
+// Deploying again keeps the open round, so the trades of the next settlement do not
+// collide with those already recorded
+func TestInitKeepsSettlementRound(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	cc, stub := newTestChaincode(t)
+	enrollMeters(t, cc, stub, r, 10)
+	reportRound(t, cc, stub, r, 10)
+	invokeAs(t, cc, stub, testAdmin, "settle")
+
+	stub.Caller = testAdmin
+	_, err := cc.Init(stub, "init", []string{"0.01"})
+	if err != nil {
+		t.Fatalf("Init failed: %s", err)
+	}
+	round, err := cc.getCurrentRound(stub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if round != 2 {
+		t.Fatalf("Open round %d after deploying again, want 2", round)
+	}
+
+	reportRound(t, cc, stub, r, 10)
+	invokeAs(t, cc, stub, testAdmin, "settle")
+	for _, round := range []int64{1, 2} {
+		trades, err := cc.getTrades(stub, round, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(trades) == 0 {
+			t.Errorf("No trades recorded for round %d", round)
+		}
+	}
+}
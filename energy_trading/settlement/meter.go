@@ -0,0 +1,100 @@
+package settlement
+
+// Generation types a meter can be registered with
+const (
+	GenerationSolar   = "solar"
+	GenerationWind    = "wind"
+	GenerationHydro   = "hydro"
+	GenerationBiomass = "biomass"
+	GenerationGas     = "gas"
+	GenerationDiesel  = "diesel"
+	GenerationGrid    = "grid"
+)
+
+// Source preferences a buyer can declare. Besides these a buyer can also ask
+// for one specific generation type, e.g. "solar".
+const (
+	SourceAny       = "any"
+	SourceRenewable = "renewable"
+)
+
+var renewableGenerationTypes = map[string]bool{
+	GenerationSolar:   true,
+	GenerationWind:    true,
+	GenerationHydro:   true,
+	GenerationBiomass: true,
+}
+
+var generationTypes = map[string]bool{
+	GenerationSolar:   true,
+	GenerationWind:    true,
+	GenerationHydro:   true,
+	GenerationBiomass: true,
+	GenerationGas:     true,
+	GenerationDiesel:  true,
+	GenerationGrid:    true,
+}
+
+// IsGenerationType returns true if the given value is a known generation type
+func IsGenerationType(generationType string) bool {
+	return generationTypes[generationType]
+}
+
+// IsSourcePreference returns true if a buyer can declare the given source preference
+func IsSourcePreference(preference string) bool {
+	return preference == SourceAny || preference == SourceRenewable || generationTypes[preference]
+}
+
+// MeterInfo is the state of a meter as seen by the settlement
+type MeterInfo struct {
+	Id             string         `json:"id"`
+	Name           string         `json:"name"`
+	Kwh            int64          `json:"kwh"`
+	AccountBalance float64        `json:"account_balance"`
+	RatePerKwh     int64          `json:"rate_per_kwh"`
+	Metadata       *MeterMetadata `json:"metadata,omitempty"`
+}
+
+// MeterMetadata describes the installation behind a meter. It is maintained by the
+// meter owner.
+type MeterMetadata struct {
+	Location         string  `json:"location"`
+	CapacityKw       float64 `json:"capacity_kw"`
+	GenerationType   string  `json:"generation_type"`
+	InstallationDate string  `json:"installation_date"`
+	SourcePreference string  `json:"source_preference"`
+}
+
+// Accepts returns true if energy produced by a meter with the given metadata satisfies
+// the source preference of this (buying) meter
+func (m *MeterMetadata) Accepts(seller *MeterMetadata) bool {
+	if m == nil || m.SourcePreference == "" || m.SourcePreference == SourceAny {
+		return true
+	}
+	if seller == nil {
+		return false
+	}
+	if m.SourcePreference == SourceRenewable {
+		return renewableGenerationTypes[seller.GenerationType]
+	}
+	return m.SourcePreference == seller.GenerationType
+}
+
+// ByRate orders meters by their rate. Meters with the same rate are ordered by id so
+// the outcome of a settlement does not depend on the order meters are passed in.
+type ByRate []*MeterInfo
+
+func (a ByRate) Len() int {
+	return len(a)
+}
+
+func (a ByRate) Swap(i, j int) {
+	a[i], a[j] = a[j], a[i]
+}
+
+func (a ByRate) Less(i, j int) bool {
+	if a[i].RatePerKwh != a[j].RatePerKwh {
+		return a[i].RatePerKwh < a[j].RatePerKwh
+	}
+	return a[i].Id < a[j].Id
+}
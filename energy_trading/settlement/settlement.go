@@ -0,0 +1,94 @@
+// Package settlement matches buyers with sellers of energy and computes the resulting
+// account balances. It works on plain MeterInfo values and has no dependency on the
+// chaincode shim, so it can be used and verified outside of a peer.
+package settlement
+
+import (
+	"sort"
+)
+
+// Trade is energy sold by one meter to another during a settlement. The buyer pays
+// Amount, of which Fee goes to the exchange and the rest to the seller.
+type Trade struct {
+	Seller     string  `json:"seller"`
+	Buyer      string  `json:"buyer"`
+	Kwh        int64   `json:"kwh"`
+	RatePerKwh int64   `json:"rate_per_kwh"`
+	Amount     float64 `json:"amount"`
+	Fee        float64 `json:"fee"`
+}
+
+// Result of a settlement
+type Result struct {
+	// Settled meters, in the order they were passed in
+	Meters []MeterInfo `json:"meters"`
+	Trades []Trade     `json:"trades"`
+	// Total fees collected for the exchange
+	Fees float64 `json:"fees"`
+}
+
+func copyMeters(meters []MeterInfo) []MeterInfo {
+	copied := make([]MeterInfo, len(meters))
+	copy(copied, meters)
+	return copied
+}
+
+// Settle matches meters that consumed energy (-ve kwh) with meters that produced energy
+// (+ve kwh). Buyers asking for the lowest rate are served first and buy from the cheapest
+// sellers whose rate does not exceed their own and whose generation type satisfies their
+// source preference. Buyers pay the seller's rate, feeRate of which is kept by the exchange.
+// Energy that cannot be matched stays on the meter. The passed meters are not modified.
+func Settle(meters []MeterInfo, feeRate float64) Result {
+	result := Result{Meters: copyMeters(meters), Trades: make([]Trade, 0)}
+
+	buyers := make([]*MeterInfo, 0)
+	sellers := make([]*MeterInfo, 0)
+	for i := range result.Meters {
+		meter := &result.Meters[i]
+		if meter.Kwh < 0 {
+			buyers = append(buyers, meter)
+		} else if meter.Kwh > 0 {
+			sellers = append(sellers, meter)
+		}
+	}
+	// Sort the buyers so we can match buyers with lower asking rate with sellers offering
+	// lower rates
+	sort.Sort(ByRate(buyers))
+	// Sort the sellers so buyers can purchase from sellers offering lower rates first
+	sort.Sort(ByRate(sellers))
+
+	for _, buyer := range buyers {
+		for _, seller := range sellers {
+			if buyer.Kwh == 0 {
+				break
+			}
+			if seller.Kwh == 0 || seller.RatePerKwh > buyer.RatePerKwh || !buyer.Metadata.Accepts(seller.Metadata) {
+				continue
+			}
+
+			kwh := -buyer.Kwh
+			if kwh > seller.Kwh {
+				kwh = seller.Kwh
+			}
+			buyer.Kwh = buyer.Kwh + kwh
+			seller.Kwh = seller.Kwh - kwh
+
+			amount := float64(kwh * seller.RatePerKwh)
+			fee := amount * feeRate
+			buyer.AccountBalance = buyer.AccountBalance - amount
+			seller.AccountBalance = seller.AccountBalance + amount - fee
+			result.Fees = result.Fees + fee
+
+			result.Trades = append(result.Trades, Trade{
+				Seller:     seller.Id,
+				Buyer:      buyer.Id,
+				Kwh:        kwh,
+				RatePerKwh: seller.RatePerKwh,
+				Amount:     amount,
+				Fee:        fee,
+			})
+		}
+	}
+
+	return result
+}
@@ -0,0 +1,371 @@
+package settlement
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"reflect"
+	"testing"
+	"testing/quick"
+)
+
+// Tolerance used when comparing amounts of money
+const tolerance = 1e-6
+
+// market is a random settlement input for testing/quick
+type market struct {
+	Meters  []MeterInfo
+	FeeRate float64
+}
+
+var testGenerationTypes = []string{
+	GenerationSolar, GenerationWind, GenerationHydro, GenerationBiomass, GenerationGas, GenerationDiesel, GenerationGrid,
+}
+
+func (market) Generate(r *rand.Rand, size int) reflect.Value {
+	m := market{FeeRate: float64(r.Intn(11)) / 100}
+	n := r.Intn(size + 1)
+	for i := 0; i < n; i++ {
+		meter := MeterInfo{
+			Id:             fmt.Sprintf("m%d", i),
+			Name:           fmt.Sprintf("meter %d", i),
+			Kwh:            int64(r.Intn(101) - 50),
+			AccountBalance: float64(r.Intn(200000)-10000) / 100,
+			RatePerKwh:     int64(1 + r.Intn(10)),
+		}
+		switch {
+		case r.Intn(4) == 0:
+			// Meters enrolled before metadata existed
+		case meter.Kwh > 0:
+			meter.Metadata = &MeterMetadata{GenerationType: testGenerationTypes[r.Intn(len(testGenerationTypes))]}
+		default:
+			preferences := append([]string{"", SourceAny, SourceRenewable}, testGenerationTypes...)
+			meter.Metadata = &MeterMetadata{SourcePreference: preferences[r.Intn(len(preferences))]}
+		}
+		m.Meters = append(m.Meters, meter)
+	}
+	return reflect.ValueOf(m)
+}
+
+var quickConfig = &quick.Config{MaxCount: 500, Rand: rand.New(rand.NewSource(1))}
+
+// verify checks that result is a valid settlement of meters at the given fee rate:
+//
+//   - no money is created or destroyed, every amount paid by a buyer ends up with a
+//     seller or in the fees
+//   - no buyer pays above its rate and no seller sells below its rate
+//   - buyers only buy from sellers matching their source preference
+//   - energy moves only through trades and no meter switches between buying and selling
+//
+// It returns an error describing the first violation found.
+func verify(meters []MeterInfo, feeRate float64, result Result) error {
+	if len(result.Meters) != len(meters) {
+		return fmt.Errorf("Settled %d meters, expected %d", len(result.Meters), len(meters))
+	}
+
+	before := make(map[string]MeterInfo)
+	after := make(map[string]MeterInfo)
+	for i, meter := range meters {
+		if result.Meters[i].Id != meter.Id {
+			return fmt.Errorf("Meter %s settled in place of %s", result.Meters[i].Id, meter.Id)
+		}
+		before[meter.Id] = meter
+		after[meter.Id] = result.Meters[i]
+	}
+
+	kwhSold := make(map[string]int64)
+	kwhBought := make(map[string]int64)
+	paid := make(map[string]float64)
+	received := make(map[string]float64)
+	var fees float64
+	for _, trade := range result.Trades {
+		seller, ok := before[trade.Seller]
+		if !ok {
+			return fmt.Errorf("Trade with unknown seller %s", trade.Seller)
+		}
+		buyer, ok := before[trade.Buyer]
+		if !ok {
+			return fmt.Errorf("Trade with unknown buyer %s", trade.Buyer)
+		}
+		if trade.Kwh <= 0 {
+			return fmt.Errorf("Trade of %d kwh from %s to %s", trade.Kwh, trade.Seller, trade.Buyer)
+		}
+		if trade.RatePerKwh > buyer.RatePerKwh {
+			return fmt.Errorf("Buyer %s paid %d per kwh above its rate %d", trade.Buyer, trade.RatePerKwh, buyer.RatePerKwh)
+		}
+		if trade.RatePerKwh < seller.RatePerKwh {
+			return fmt.Errorf("Seller %s sold at %d per kwh below its rate %d", trade.Seller, trade.RatePerKwh, seller.RatePerKwh)
+		}
+		if !buyer.Metadata.Accepts(seller.Metadata) {
+			return fmt.Errorf("Buyer %s bought from %s against its source preference", trade.Buyer, trade.Seller)
+		}
+		if math.Abs(trade.Amount-float64(trade.Kwh*trade.RatePerKwh)) > tolerance {
+			return fmt.Errorf("Trade from %s to %s charged %f for %d kwh at %d", trade.Seller, trade.Buyer, trade.Amount, trade.Kwh, trade.RatePerKwh)
+		}
+		if math.Abs(trade.Fee-trade.Amount*feeRate) > tolerance {
+			return fmt.Errorf("Trade from %s to %s charged fee %f on %f", trade.Seller, trade.Buyer, trade.Fee, trade.Amount)
+		}
+
+		kwhSold[trade.Seller] += trade.Kwh
+		kwhBought[trade.Buyer] += trade.Kwh
+		paid[trade.Buyer] += trade.Amount
+		received[trade.Seller] += trade.Amount - trade.Fee
+		fees += trade.Fee
+	}
+
+	for id, meter := range before {
+		settled := after[id]
+		if kwhSold[id] > 0 && kwhBought[id] > 0 {
+			return fmt.Errorf("Meter %s both sold and bought energy", id)
+		}
+		if settled.Kwh != meter.Kwh-kwhSold[id]+kwhBought[id] {
+			return fmt.Errorf("Meter %s has %d kwh left, expected %d", id, settled.Kwh, meter.Kwh-kwhSold[id]+kwhBought[id])
+		}
+		if (meter.Kwh >= 0 && settled.Kwh < 0) || (meter.Kwh <= 0 && settled.Kwh > 0) {
+			return fmt.Errorf("Meter %s went from %d to %d kwh", id, meter.Kwh, settled.Kwh)
+		}
+		expected := meter.AccountBalance - paid[id] + received[id]
+		if math.Abs(settled.AccountBalance-expected) > tolerance {
+			return fmt.Errorf("Meter %s has balance %f, expected %f", id, settled.AccountBalance, expected)
+		}
+		if settled.RatePerKwh != meter.RatePerKwh {
+			return fmt.Errorf("Rate of meter %s changed from %d to %d", id, meter.RatePerKwh, settled.RatePerKwh)
+		}
+	}
+
+	if math.Abs(result.Fees-fees) > tolerance {
+		return fmt.Errorf("Reported fees %f differ from the fees of the trades %f", result.Fees, fees)
+	}
+	return nil
+}
+
+// equivalent checks that two settlements of the same meters, possibly passed in a
+// different order, produced the same outcome for every meter and the same fees
+func equivalent(a, b Result) error {
+	if len(a.Meters) != len(b.Meters) {
+		return fmt.Errorf("Settled %d and %d meters", len(a.Meters), len(b.Meters))
+	}
+	settled := make(map[string]MeterInfo)
+	for _, meter := range a.Meters {
+		settled[meter.Id] = meter
+	}
+	for _, meter := range b.Meters {
+		other, ok := settled[meter.Id]
+		if !ok {
+			return fmt.Errorf("Meter %s settled only once", meter.Id)
+		}
+		if other.Kwh != meter.Kwh || math.Abs(other.AccountBalance-meter.AccountBalance) > tolerance {
+			return fmt.Errorf("Meter %s settled to %d kwh and %f, and to %d kwh and %f", meter.Id, other.Kwh, other.AccountBalance, meter.Kwh, meter.AccountBalance)
+		}
+	}
+	if math.Abs(a.Fees-b.Fees) > tolerance {
+		return fmt.Errorf("Fees of %f and %f", a.Fees, b.Fees)
+	}
+	return nil
+}
+
+func TestSettleIsValid(t *testing.T) {
+	property := func(m market) bool {
+		err := verify(m.Meters, m.FeeRate, Settle(m.Meters, m.FeeRate))
+		if err != nil {
+			t.Log(err)
+		}
+		return err == nil
+	}
+	if err := quick.Check(property, quickConfig); err != nil {
+		t.Error(err)
+	}
+}
+
+// conservesEnergy checks that energy only moves between meters: what the sellers lose
+// the buyers gain
+func conservesEnergy(meters []MeterInfo, result Result) error {
+	var before, after, traded, sold int64
+	for i := range meters {
+		before += meters[i].Kwh
+		after += result.Meters[i].Kwh
+		if meters[i].Kwh > 0 {
+			sold += meters[i].Kwh - result.Meters[i].Kwh
+		}
+	}
+	for _, trade := range result.Trades {
+		traded += trade.Kwh
+	}
+	if before != after || sold != traded {
+		return fmt.Errorf("%d kwh before and %d after, %d sold and %d traded", before, after, sold, traded)
+	}
+	return nil
+}
+
+// balancesMoney checks that the balances of all meters drop by exactly the fees taken
+// by the exchange
+func balancesMoney(meters []MeterInfo, result Result) error {
+	var before, after float64
+	for i := range meters {
+		before += meters[i].AccountBalance
+		after += result.Meters[i].AccountBalance
+	}
+	if math.Abs(before-after-result.Fees) > tolerance*float64(len(result.Trades)+1) {
+		return fmt.Errorf("Balances went from %f to %f with %f in fees", before, after, result.Fees)
+	}
+	if result.Fees < 0 {
+		return fmt.Errorf("Negative fees %f", result.Fees)
+	}
+	return nil
+}
+
+func TestSettleConservesEnergy(t *testing.T) {
+	property := func(m market) bool {
+		err := conservesEnergy(m.Meters, Settle(m.Meters, m.FeeRate))
+		if err != nil {
+			t.Log(err)
+		}
+		return err == nil
+	}
+	if err := quick.Check(property, quickConfig); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestSettleBalancesMoney(t *testing.T) {
+	property := func(m market) bool {
+		err := balancesMoney(m.Meters, Settle(m.Meters, m.FeeRate))
+		if err != nil {
+			t.Log(err)
+		}
+		return err == nil
+	}
+	if err := quick.Check(property, quickConfig); err != nil {
+		t.Error(err)
+	}
+}
+
+// Energy is left on a buyer only when no seller it accepts has energy left at its rate
+func TestSettleLeavesNoMatchableEnergy(t *testing.T) {
+	property := func(m market) bool {
+		result := Settle(m.Meters, m.FeeRate)
+		for _, buyer := range result.Meters {
+			if buyer.Kwh >= 0 {
+				continue
+			}
+			for _, seller := range result.Meters {
+				if seller.Kwh > 0 && seller.RatePerKwh <= buyer.RatePerKwh && buyer.Metadata.Accepts(seller.Metadata) {
+					t.Logf("Buyer %s left with %d kwh while %s has %d kwh", buyer.Id, buyer.Kwh, seller.Id, seller.Kwh)
+					return false
+				}
+			}
+		}
+		return true
+	}
+	if err := quick.Check(property, quickConfig); err != nil {
+		t.Error(err)
+	}
+}
+
+// The outcome does not depend on the order the meters are passed in
+func TestSettleIsDeterministicUnderPermutation(t *testing.T) {
+	property := func(m market, seed int64) bool {
+		permuted := make([]MeterInfo, len(m.Meters))
+		for i, j := range rand.New(rand.NewSource(seed)).Perm(len(m.Meters)) {
+			permuted[j] = m.Meters[i]
+		}
+		err := equivalent(Settle(m.Meters, m.FeeRate), Settle(permuted, m.FeeRate))
+		if err != nil {
+			t.Log(err)
+		}
+		return err == nil
+	}
+	if err := quick.Check(property, quickConfig); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestSettleDoesNotModifyInput(t *testing.T) {
+	property := func(m market) bool {
+		before := copyMeters(m.Meters)
+		Settle(m.Meters, m.FeeRate)
+		for i := range before {
+			if !reflect.DeepEqual(before[i], m.Meters[i]) {
+				t.Logf("Meter %s changed from %+v to %+v", before[i].Id, before[i], m.Meters[i])
+				return false
+			}
+		}
+		return true
+	}
+	if err := quick.Check(property, quickConfig); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestSettleServesCheapestBuyersFirst(t *testing.T) {
+	meters := []MeterInfo{
+		{Id: "seller", Kwh: 10, RatePerKwh: 2, Metadata: &MeterMetadata{GenerationType: GenerationSolar}},
+		{Id: "gas", Kwh: 5, RatePerKwh: 1, Metadata: &MeterMetadata{GenerationType: GenerationGas}},
+		{Id: "green", Kwh: -8, RatePerKwh: 3, AccountBalance: 100, Metadata: &MeterMetadata{SourcePreference: SourceRenewable}},
+		{Id: "any", Kwh: -8, RatePerKwh: 2, AccountBalance: 100},
+	}
+	result := Settle(meters, 0.1)
+	if err := verify(meters, 0.1, result); err != nil {
+		t.Fatal(err)
+	}
+	want := []Trade{
+		{Seller: "gas", Buyer: "any", Kwh: 5, RatePerKwh: 1, Amount: 5, Fee: 0.5},
+		{Seller: "seller", Buyer: "any", Kwh: 3, RatePerKwh: 2, Amount: 6, Fee: 0.6},
+		{Seller: "seller", Buyer: "green", Kwh: 7, RatePerKwh: 2, Amount: 14, Fee: 1.4},
+	}
+	if len(result.Trades) != len(want) {
+		t.Fatalf("Trades %+v, want %+v", result.Trades, want)
+	}
+	for i := range want {
+		got := result.Trades[i]
+		if got.Seller != want[i].Seller || got.Buyer != want[i].Buyer || got.Kwh != want[i].Kwh || got.RatePerKwh != want[i].RatePerKwh ||
+			math.Abs(got.Amount-want[i].Amount) > tolerance || math.Abs(got.Fee-want[i].Fee) > tolerance {
+			t.Errorf("Trade %d is %+v, want %+v", i, got, want[i])
+		}
+	}
+	if result.Meters[2].Kwh != -1 {
+		t.Errorf("Renewable buyer left with %d kwh, want -1", result.Meters[2].Kwh)
+	}
+}
+
+// decodeMeters turns arbitrary bytes into meters, five bytes per meter: the signed kwh,
+// the rate, the balance in two bytes and the metadata. Trailing bytes are ignored.
+func decodeMeters(data []byte) []MeterInfo {
+	preferences := append([]string{SourceAny, SourceRenewable}, testGenerationTypes...)
+	meters := make([]MeterInfo, 0, len(data)/5)
+	for i := 0; i+5 <= len(data); i += 5 {
+		meter := MeterInfo{
+			Id:             fmt.Sprintf("m%d", len(meters)),
+			Kwh:            int64(int8(data[i])),
+			RatePerKwh:     int64(data[i+1]),
+			AccountBalance: float64(int16(uint16(data[i+2])<<8|uint16(data[i+3]))) / 10,
+		}
+		// Every other meter has no metadata, as those enrolled before metadata existed
+		if kind := int(data[i+4]); kind%2 == 1 {
+			if meter.Kwh > 0 {
+				meter.Metadata = &MeterMetadata{GenerationType: testGenerationTypes[kind/2%len(testGenerationTypes)]}
+			} else {
+				meter.Metadata = &MeterMetadata{SourcePreference: preferences[kind/2%len(preferences)]}
+			}
+		}
+		meters = append(meters, meter)
+	}
+	return meters
+}
+
+func FuzzSettle(f *testing.F) {
+	f.Add([]byte{}, uint8(0))
+	f.Add([]byte{10, 2, 0, 0, 1, 0xf6, 3, 1, 0, 3}, uint8(10))
+	f.Add([]byte{5, 1, 0, 0, 11, 10, 2, 0, 0, 1, 0xf8, 3, 3, 0xe8, 5, 0xf8, 2, 3, 0xe8, 0}, uint8(10))
+	f.Add([]byte{0x7f, 0, 0x80, 0, 2, 0x80, 0xff, 0x7f, 0xff, 0xff}, uint8(100))
+	f.Fuzz(func(t *testing.T, data []byte, feePercent uint8) {
+		meters := decodeMeters(data)
+		feeRate := float64(feePercent%101) / 100
+		result := Settle(meters, feeRate)
+		for _, check := range []error{verify(meters, feeRate, result), conservesEnergy(meters, result), balancesMoney(meters, result)} {
+			if check != nil {
+				t.Fatalf("Settling %+v at fee rate %f: %s", meters, feeRate, check)
+			}
+		}
+	})
+}
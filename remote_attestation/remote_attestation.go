@@ -22,6 +22,7 @@ type DeviceAttestationInfo struct {
 	Status              uint64 `json:"status"`
 	ValidationHash      string `json:"validation_hash"`
 	Time                int64  `json:"time"`
+	Submitter           []byte `json:"submitter"`
 }
 
 // RemoteDeviceAttestation implementation. This smart contract enables multiple attestors
@@ -38,6 +39,61 @@ func (t *RemoteDeviceAttestation) Init(stub shim.ChaincodeStubInterface, functio
 		return nil, errors.New("Incorrect number of arguments. No arguments required for deploying this contract.")
 	}
 
+	fresh, err := t.isFreshDeploy(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	err = t.createTables(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	// Keep the administrator of an earlier deploy, so that a redeploy cannot take over
+	// the migrate invoke
+	storedAdmin, err := stub.GetState("admin")
+	if err != nil {
+		logger.Errorf("Failed getting admin certificate:%s", err.Error())
+		return nil, fmt.Errorf("Failed getting admin certificate:%s", err.Error())
+	}
+
+	// Set the admin, if the deployer signed the transaction
+	// The metadata will contain the certificate of the administrator
+	adminCert, err := stub.GetCallerMetadata()
+	if err != nil {
+		logger.Debug("Failed getting metadata")
+		return nil, errors.New("Failed getting metadata.")
+	}
+	if len(storedAdmin) > 0 {
+		logger.Info("Administrator already configured, keeping it")
+	} else if len(adminCert) > 0 {
+		logger.Debugf("The administrator is [%x]", adminCert)
+		err = stub.PutState("admin", adminCert)
+		if err != nil {
+			logger.Errorf("Error saving administrator %s", err.Error())
+			return nil, errors.New("Administrator cannot be saved")
+		}
+	} else {
+		logger.Info("No administrator certificate supplied, administrative functions are disabled")
+	}
+
+	if fresh {
+		err = stub.PutState("schema_version", []byte(strconv.FormatInt(currentSchemaVersion, 10)))
+		if err != nil {
+			logger.Errorf("Error saving schema version %s", err.Error())
+			return nil, errors.New("Schema version cannot be saved")
+		}
+	}
+
+	logger.Info("Successfully deployed chain code")
+
+	return nil, nil
+}
+
+// Create the tables that do not exist yet
+func (t *RemoteDeviceAttestation) createTables(stub shim.ChaincodeStubInterface) error {
+	var err error
+
 	_, err = stub.GetTable(tableName)
 	if err == shim.ErrTableNotFound {
 		err = stub.CreateTable(tableName, []*shim.ColumnDefinition{
@@ -46,18 +102,88 @@ func (t *RemoteDeviceAttestation) Init(stub shim.ChaincodeStubInterface, functio
 			&shim.ColumnDefinition{Name: "Status", Type: shim.ColumnDefinition_UINT64, Key: false},
 			&shim.ColumnDefinition{Name: "ValidationHash", Type: shim.ColumnDefinition_STRING, Key: false},
 			&shim.ColumnDefinition{Name: "Time", Type: shim.ColumnDefinition_INT64, Key: false},
+			&shim.ColumnDefinition{Name: "Submitter", Type: shim.ColumnDefinition_BYTES, Key: false},
 		})
 		if err != nil {
 			logger.Errorf("Error creating table:%s", err.Error())
-			return nil, errors.New("Failed creating DeviceAttestation table.")
+			return errors.New("Failed creating DeviceAttestation table.")
 		}
 	} else {
 		logger.Info("Table already exists")
 	}
 
-	logger.Info("Successfully deployed chain code")
+	return nil
+}
 
-	return nil, nil
+// Check that the caller is the administrator
+func (t *RemoteDeviceAttestation) checkAdmin(stub shim.ChaincodeStubInterface) error {
+	adminCertificate, err := stub.GetState("admin")
+	if err != nil {
+		return fmt.Errorf("Failed getting admin certificate:%s", err.Error())
+	}
+	if len(adminCertificate) == 0 {
+		logger.Error("No administrator configured")
+		return errors.New("No administrator configured for this chaincode")
+	}
+
+	ok, err := t.isCaller(stub, adminCertificate)
+	if err != nil {
+		logger.Error("Failed checking admin identity")
+		return fmt.Errorf("Failed checking admin identity:%s", err.Error())
+	}
+	if !ok {
+		logger.Error("Caller is not administrator")
+		return errors.New("The caller is not an administrator")
+	}
+	return nil
+}
+
+func (t *RemoteDeviceAttestation) isCaller(stub shim.ChaincodeStubInterface, certificate []byte) (bool, error) {
+	logger.Debug("Checking caller...")
+
+	// In order to enforce access control, we require that the
+	// metadata contains the signature under the signing key corresponding
+	// to the verification key inside certificate of
+	// the payload of the transaction (namely, function name and args) and
+	// the transaction binding (to avoid copying attacks)
+
+	// Verify \sigma=Sign(certificate.sk, tx.Payload||tx.Binding) against certificate.vk
+	// \sigma is in the metadata
+
+	sigma, err := stub.GetCallerMetadata()
+	if err != nil {
+		return false, errors.New("Failed getting metadata")
+	}
+	payload, err := stub.GetPayload()
+	if err != nil {
+		return false, errors.New("Failed getting payload")
+	}
+	binding, err := stub.GetBinding()
+	if err != nil {
+		return false, errors.New("Failed getting binding")
+	}
+
+	logger.Debugf("passed certificate [% x]", certificate)
+	logger.Debugf("passed sigma [% x]", sigma)
+	logger.Debugf("passed payload [% x]", payload)
+	logger.Debugf("passed binding [% x]", binding)
+
+	ok, err := stub.VerifySignature(
+		certificate,
+		sigma,
+		append(payload, binding...),
+	)
+	if err != nil {
+		logger.Errorf("Failed checking signature [%s]", err)
+		return ok, fmt.Errorf("Failed checking signature [%s]", err)
+	}
+	if !ok {
+		logger.Error("Invalid signature")
+	}
+
+	logger.Debug("Check caller...Verified!")
+
+	return ok, err
 }
 
 func (t *RemoteDeviceAttestation) Invoke(stub shim.ChaincodeStubInterface, function string, args []string) ([]byte, error) {
@@ -66,6 +192,10 @@ func (t *RemoteDeviceAttestation) Invoke(stub shim.ChaincodeStubInterface, funct
 		return t.deviceAttestationStatus(stub, args)
 	}
 
+	if function == "migrate" {
+		return t.migrate(stub, args)
+	}
+
 	logger.Errorf("Unimplemented method :%s called", function)
 
 	return nil, errors.New("Unimplemented '" + function + "' invoked")
@@ -89,6 +219,13 @@ func (t *RemoteDeviceAttestation) deviceAttestationStatus(stub shim.ChaincodeStu
 		return nil, fmt.Errorf("Invalid value of status:%s", statusStr)
 	}
 
+	// The certificate of the attestor, if the transaction was signed
+	submitter, err := stub.GetCallerMetadata()
+	if err != nil {
+		logger.Error("Failed getting metadata")
+		return nil, errors.New("Failed getting metadata")
+	}
+
 	logger.Infof("Registering attestation status of device:%s, status:%d, server:%s and validation hash:%s", deviceId, status, serverId, validationHash)
 	now := time.Now().UnixNano()
 	ok, err := stub.InsertRow(tableName, shim.Row{
@@ -98,6 +235,7 @@ func (t *RemoteDeviceAttestation) deviceAttestationStatus(stub shim.ChaincodeStu
 			&shim.Column{Value: &shim.Column_Uint64{Uint64: status}},
 			&shim.Column{Value: &shim.Column_String_{String_: validationHash}},
 			&shim.Column{Value: &shim.Column_Int64{Int64: now}},
+			&shim.Column{Value: &shim.Column_Bytes{Bytes: submitter}},
 		},
 	})
 
@@ -116,6 +254,7 @@ func (t *RemoteDeviceAttestation) deviceAttestationStatus(stub shim.ChaincodeStu
 		row.Columns[2] = &shim.Column{Value: &shim.Column_Uint64{Uint64: status}}
 		row.Columns[3] = &shim.Column{Value: &shim.Column_String_{String_: validationHash}}
 		row.Columns[4] = &shim.Column{Value: &shim.Column_Int64{Int64: now}}
+		row.Columns[5] = &shim.Column{Value: &shim.Column_Bytes{Bytes: submitter}}
 		_, err = t.updateRow(stub, row)
 		if err != nil {
 			logger.Errorf("Error in updating attestation record for device:%s with status:%d and validation hash:%s by server %s", deviceId, status, validationHash, serverId)
@@ -148,6 +287,10 @@ func (t *RemoteDeviceAttestation) Query(stub shim.ChaincodeStubInterface, functi
 		return t.attestationRecords(stub, args)
 	}
 
+	if function == "schemaVersion" {
+		return t.schemaVersion(stub, args)
+	}
+
 	return nil, errors.New("Invalid query function name")
 }
 
@@ -175,6 +318,10 @@ func (t *RemoteDeviceAttestation) attestationRecords(stub shim.ChaincodeStubInte
 			ValidationHash:      row.Columns[3].GetString_(),
 			Time:                row.Columns[4].GetInt64(),
 		}
+		// Rows of version 1 have no submitter until migrated
+		if len(row.Columns) > 5 {
+			attestnRecord.Submitter = row.Columns[5].GetBytes()
+		}
 		attestnRecords = append(attestnRecords, attestnRecord)
 	}
 
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"math/rand"
+	"strconv"
+	"testing"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/predix/chaincode_example/energy_trading/memstub"
+)
+
+var testAdmin = []byte("admin")
+
+func invokeAs(tb testing.TB, t *RemoteDeviceAttestation, stub *memstub.Stub, caller []byte, function string, args ...string) []byte {
+	stub.Caller = caller
+	stub.TxID = function + strconv.Itoa(rand.Int())
+	payload, err := t.Invoke(stub, function, args)
+	if err != nil {
+		tb.Fatalf("%s %v failed: %s", function, args, err)
+	}
+	return payload
+}
+
+func attestationRecords(tb testing.TB, t *RemoteDeviceAttestation, stub *memstub.Stub) []DeviceAttestationInfo {
+	payload, err := t.Query(stub, "attestationRecords", nil)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	var records []DeviceAttestationInfo
+	err = json.Unmarshal(payload, &records)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return records
+}
+
+// Loads the ledger of a version 1 deploy: the DeviceAttestation table without the
+// submitter column and the admin, without a schema version
+func loadVersion1(tb testing.TB, stub *memstub.Stub) {
+	err := stub.CreateTable(tableName, []*shim.ColumnDefinition{
+		&shim.ColumnDefinition{Name: "DeviceId", Type: shim.ColumnDefinition_STRING, Key: true},
+		&shim.ColumnDefinition{Name: "AttestationServerId", Type: shim.ColumnDefinition_STRING, Key: true},
+		&shim.ColumnDefinition{Name: "Status", Type: shim.ColumnDefinition_UINT64, Key: false},
+		&shim.ColumnDefinition{Name: "ValidationHash", Type: shim.ColumnDefinition_STRING, Key: false},
+		&shim.ColumnDefinition{Name: "Time", Type: shim.ColumnDefinition_INT64, Key: false},
+	})
+	if err != nil {
+		tb.Fatal(err)
+	}
+	for i, serverId := range []string{"server1", "server2"} {
+		ok, err := stub.InsertRow(tableName, shim.Row{
+			Columns: []*shim.Column{
+				&shim.Column{Value: &shim.Column_String_{String_: "device1"}},
+				&shim.Column{Value: &shim.Column_String_{String_: serverId}},
+				&shim.Column{Value: &shim.Column_Uint64{Uint64: uint64(i)}},
+				&shim.Column{Value: &shim.Column_String_{String_: "hash-" + serverId}},
+				&shim.Column{Value: &shim.Column_Int64{Int64: int64(100 + i)}},
+			},
+		})
+		if !ok || err != nil {
+			tb.Fatalf("Failed loading attestation of %s: %s", serverId, err)
+		}
+	}
+	stub.PutState("admin", testAdmin)
+}
+
+func TestInitWritesSchemaVersionOnFreshDeploy(t *testing.T) {
+	logger.SetLevel(shim.LogError)
+	stub := memstub.New()
+	cc := new(RemoteDeviceAttestation)
+	stub.Caller = testAdmin
+	_, err := cc.Init(stub, "init", nil)
+	if err != nil {
+		t.Fatalf("Init failed: %s", err)
+	}
+	version, err := cc.getSchemaVersion(stub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != currentSchemaVersion {
+		t.Errorf("Schema version %d after deploy, want %d", version, currentSchemaVersion)
+	}
+
+	invokeAs(t, cc, stub, []byte("attestor"), "deviceAttestationStatus", "device1", "server1", "1", "hash")
+	records := attestationRecords(t, cc, stub)
+	if len(records) != 1 || !bytes.Equal(records[0].Submitter, []byte("attestor")) {
+		t.Errorf("Attestation records %+v", records)
+	}
+}
+
+func TestMigrateFromVersion1(t *testing.T) {
+	logger.SetLevel(shim.LogError)
+	stub := memstub.New()
+	cc := new(RemoteDeviceAttestation)
+	loadVersion1(t, stub)
+
+	// Deploying again, even by someone else, keeps the administrator and the version
+	stub.Caller = []byte("stranger")
+	_, err := cc.Init(stub, "init", nil)
+	if err != nil {
+		t.Fatalf("Init failed: %s", err)
+	}
+	admin, _ := stub.GetState("admin")
+	if !bytes.Equal(admin, testAdmin) {
+		t.Fatalf("Administrator %q after deploying again, want %q", admin, testAdmin)
+	}
+	version, err := cc.getSchemaVersion(stub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != 1 {
+		t.Fatalf("Schema version %d after deploying over version 1, want 1", version)
+	}
+
+	stub.Caller = []byte("stranger")
+	_, err = cc.Invoke(stub, "migrate", nil)
+	if err == nil {
+		t.Fatal("Migrate by a stranger succeeded")
+	}
+
+	invokeAs(t, cc, stub, testAdmin, "migrate")
+	version, err = cc.getSchemaVersion(stub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != currentSchemaVersion {
+		t.Fatalf("Schema version %d after migrate, want %d", version, currentSchemaVersion)
+	}
+
+	records := attestationRecords(t, cc, stub)
+	if len(records) != 2 {
+		t.Fatalf("%d attestation records after migrate, want 2", len(records))
+	}
+	for i, record := range records {
+		serverId := "server" + strconv.Itoa(i+1)
+		if record.DeviceId != "device1" || record.AttestationServerId != serverId || record.Status != uint64(i) ||
+			record.ValidationHash != "hash-"+serverId || record.Time != int64(100+i) || len(record.Submitter) != 0 {
+			t.Errorf("Attestation record %d after migrate: %+v", i, record)
+		}
+	}
+
+	// Migrating again does nothing, and new statuses record their submitter
+	invokeAs(t, cc, stub, testAdmin, "migrate")
+	invokeAs(t, cc, stub, []byte("attestor"), "deviceAttestationStatus", "device1", "server2", "3", "hash")
+	records = attestationRecords(t, cc, stub)
+	if len(records) != 2 || records[1].Status != 3 || !bytes.Equal(records[1].Submitter, []byte("attestor")) {
+		t.Errorf("Attestation records after a new status: %+v", records)
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// Layout of the DeviceAttestation table written by this chaincode. Version 1 is the
+// layout from before the schema_version state existed.
+const currentSchemaVersion = 2
+
+// Step from one version of the table layout to the next
+type migration func(t *RemoteDeviceAttestation, stub shim.ChaincodeStubInterface) error
+
+// Indexed by the version a step starts from, less one
+var migrations = []migration{
+	(*RemoteDeviceAttestation).migrateSubmitter,
+}
+
+// A deploy is fresh when neither the schema version nor the attestation table is on the
+// ledger yet. A deploy over an existing table keeps its version until migrate runs.
+func (t *RemoteDeviceAttestation) isFreshDeploy(stub shim.ChaincodeStubInterface) (bool, error) {
+	versionStr, err := stub.GetState("schema_version")
+	if err != nil {
+		logger.Error("Failed to retrieve schema version")
+		return false, errors.New("Failed to retrieve schema version")
+	}
+	if len(versionStr) > 0 {
+		return false, nil
+	}
+	_, err = stub.GetTable(tableName)
+	if err == shim.ErrTableNotFound {
+		return true, nil
+	}
+	if err != nil {
+		logger.Errorf("Error in fetching table %s: %s", tableName, err)
+		return false, fmt.Errorf("Error in fetching table %s: %s", tableName, err)
+	}
+	return false, nil
+}
+
+func (t *RemoteDeviceAttestation) getSchemaVersion(stub shim.ChaincodeStubInterface) (int64, error) {
+	versionStr, err := stub.GetState("schema_version")
+	if err != nil {
+		logger.Error("Failed to retrieve schema version")
+		return 0, errors.New("Failed to retrieve schema version")
+	}
+	if len(versionStr) == 0 {
+		return 1, nil
+	}
+	version, err := strconv.ParseInt(string(versionStr), 10, 64)
+	if err != nil {
+		logger.Errorf("Invalid value %s for schema version", versionStr)
+		return 0, errors.New("Invalid value for schema version")
+	}
+	return version, nil
+}
+
+// Version 2 records the certificate of the attestor that submitted each status. The
+// column cannot be added in place, so the rows are read, the table is created again and
+// the rows are written back without a submitter, which is unknown for them.
+func (t *RemoteDeviceAttestation) migrateSubmitter(stub shim.ChaincodeStubInterface) error {
+	var columns []shim.Column
+	rowChannel, err := stub.GetRows(tableName, columns)
+	if err != nil {
+		return fmt.Errorf("Error in fetching rows: %s", err)
+	}
+	var rows []shim.Row
+	for row := range rowChannel {
+		rows = append(rows, row)
+	}
+
+	err = stub.DeleteTable(tableName)
+	if err != nil {
+		return fmt.Errorf("Error in deleting table %s: %s", tableName, err)
+	}
+	err = t.createTables(stub)
+	if err != nil {
+		return err
+	}
+
+	for _, row := range rows {
+		row.Columns = append(row.Columns, &shim.Column{Value: &shim.Column_Bytes{Bytes: nil}})
+		ok, err := stub.InsertRow(tableName, row)
+		if err != nil || !ok {
+			return fmt.Errorf("Error in migrating attestation of device %s by server %s: %v", row.Columns[0].GetString_(), row.Columns[1].GetString_(), err)
+		}
+	}
+	return nil
+}
+
+// Brings the table up to currentSchemaVersion one step at a time, recording the version
+// after each step. Restricted to the administrator.
+func (t *RemoteDeviceAttestation) migrate(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	logger.Info("In migrate function")
+	if len(args) > 0 {
+		logger.Error("Incorrect number of arguments")
+		return nil, errors.New("Incorrect number of arguments. No arguments necessary")
+	}
+
+	err := t.checkAdmin(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	version, err := t.getSchemaVersion(stub)
+	if err != nil {
+		return nil, err
+	}
+	if version > currentSchemaVersion {
+		logger.Errorf("Schema version %d is newer than %d", version, currentSchemaVersion)
+		return nil, fmt.Errorf("Schema version %d is newer than this chaincode supports (%d)", version, currentSchemaVersion)
+	}
+
+	for ; version < currentSchemaVersion; version++ {
+		logger.Infof("Migrating schema from version %d to %d", version, version+1)
+		err = migrations[version-1](t, stub)
+		if err != nil {
+			logger.Errorf("Failed migrating schema to version %d: %s", version+1, err)
+			return nil, fmt.Errorf("Failed migrating schema to version %d: %s", version+1, err)
+		}
+		err = stub.PutState("schema_version", []byte(strconv.FormatInt(version+1, 10)))
+		if err != nil {
+			logger.Errorf("Error saving schema version %s", err.Error())
+			return nil, errors.New("Schema version cannot be saved")
+		}
+	}
+	logger.Infof("Schema is at version %d", version)
+
+	return nil, nil
+}
+
+// Return the schema version of the tables
+func (t *RemoteDeviceAttestation) schemaVersion(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	logger.Info("In schemaVersion function")
+	if len(args) > 0 {
+		logger.Error("Incorrect number of arguments")
+		return nil, errors.New("Incorrect number of arguments. No arguments necessary")
+	}
+
+	version, err := t.getSchemaVersion(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	return []byte(strconv.FormatInt(version, 10)), nil
+}